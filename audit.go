@@ -0,0 +1,281 @@
+package gonymizer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditGenesisHash is the previous hash of the first entry of an audit log.
+var auditGenesisHash = strings.Repeat("0", sha256.Size*2)
+
+// auditLogMutex serializes appends to audit logs within the process.
+var auditLogMutex sync.Mutex
+
+const (
+	// auditLockTimeout is how long AppendAuditEntry waits for another process appending to the same audit log.
+	auditLockTimeout = 30 * time.Second
+	// auditLockInterval is how often AppendAuditEntry tries to acquire the lock of the audit log.
+	auditLockInterval = 10 * time.Millisecond
+)
+
+// errAuditKeyRequired is returned when an audit log is written or verified without a key.
+var errAuditKeyRequired = errors.New("a key is required to write or verify the audit log")
+
+// AuditEntry is a single entry of the audit log. Every entry contains the hash of the previous entry so changing,
+// removing, or reordering entries breaks the chain (see: VerifyAuditLog). The hashes are HMAC-SHA256 hashes so the
+// chain can not be recalculated without the key of the audit log.
+type AuditEntry struct {
+	Sequence     int64                  `json:"sequence"`
+	Time         time.Time              `json:"time"`
+	Operator     string                 `json:"operator"`
+	Host         string                 `json:"host"`
+	Command      string                 `json:"command"`
+	Arguments    []string               `json:"arguments,omitempty"`
+	Version      string                 `json:"version"`
+	Databases    []AuditDatabase        `json:"databases,omitempty"`
+	MapFile      string                 `json:"map_file,omitempty"`
+	MapFileHash  string                 `json:"map_file_sha256,omitempty"`
+	Policy       map[string]interface{} `json:"policy,omitempty"`
+	Status       string                 `json:"status"`
+	Error        string                 `json:"error,omitempty"`
+	PreviousHash string                 `json:"previous_hash"`
+	Hash         string                 `json:"hash,omitempty"`
+}
+
+// AuditDatabase is a database a command connected to. The URI never contains the password.
+type AuditDatabase struct {
+	Role string `json:"role"`
+	URI  string `json:"uri"`
+}
+
+// NewAuditEntry will return an AuditEntry for the command that started now. The operator defaults to the user running
+// the process. Secrets in the arguments are redacted (see: RedactSecrets).
+func NewAuditEntry(command string, arguments []string, operator string) *AuditEntry {
+	if len(operator) == 0 {
+		if current, err := user.Current(); err == nil {
+			operator = current.Username
+		} else {
+			operator = os.Getenv("USER")
+		}
+	}
+	host, _ := os.Hostname()
+
+	entry := &AuditEntry{
+		Time:     time.Now().UTC(),
+		Operator: operator,
+		Host:     host,
+		Command:  command,
+		Version:  Version(),
+		Policy:   map[string]interface{}{},
+	}
+	for _, argument := range arguments {
+		entry.Arguments = append(entry.Arguments, RedactSecrets(argument))
+	}
+	return entry
+}
+
+// AddDatabase will add a database the command connected to using the role (I.E. dump, load) to the entry.
+func (entry *AuditEntry) AddDatabase(role string, conf PGConfig) {
+	entry.Databases = append(entry.Databases, AuditDatabase{Role: role, URI: RedactSecrets(conf.CommandURI())})
+}
+
+// SetMapFile will add the map file and the SHA-256 hash of its contents to the entry. The map file may be a local path
+// or a URL for any registered Storage backend.
+func (entry *AuditEntry) SetMapFile(mapFile string) error {
+	reader, err := OpenURL(mapFile)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, reader); err != nil {
+		return err
+	}
+	entry.MapFile = RedactSecrets(mapFile)
+	entry.MapFileHash = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+// Finish will set the outcome of the command. The status is RunStatusFailure if err is not nil and RunStatusSuccess
+// otherwise.
+func (entry *AuditEntry) Finish(err error) {
+	entry.Status = RunStatusSuccess
+	if err != nil {
+		entry.Status = RunStatusFailure
+		entry.Error = RedactSecrets(err.Error())
+	}
+}
+
+// AppendAuditEntry will append the entry as a JSON line to the audit log at the supplied local path. The sequence
+// number and previous hash of the entry are set from the last entry of the log, which is created if it does not exist.
+// The entry is hashed using the supplied key, which must be kept secret from anyone who can write to the log. An error
+// is returned if the last entry of the log can not be read, so entries are never appended to a log that was truncated
+// or corrupted. Appends from other processes are serialized using the lock file <path>.lock (see: AcquireLock).
+func AppendAuditEntry(path string, entry *AuditEntry, key []byte) error {
+	if len(key) == 0 {
+		return errAuditKeyRequired
+	}
+
+	auditLogMutex.Lock()
+	defer auditLogMutex.Unlock()
+
+	// Other processes may append to the same log so the last entry is read and the new one appended under a lock file
+	release, err := acquireAuditLock(path)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entry.Sequence = 1
+	entry.PreviousHash = auditGenesisHash
+	last, err := lastAuditLine(file)
+	if err != nil {
+		return err
+	}
+	if last != nil {
+		var previous AuditEntry
+		if err = json.Unmarshal(last, &previous); err != nil {
+			return fmt.Errorf("unable to read the last entry of audit log %s: %v", path, err)
+		}
+		entry.Sequence = previous.Sequence + 1
+		entry.PreviousHash = previous.Hash
+	}
+
+	line, err := entry.seal(key)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// acquireAuditLock will acquire the lock file of the audit log at the supplied path, waiting up to auditLockTimeout
+// for other processes to release it.
+func acquireAuditLock(path string) (func() error, error) {
+	deadline := time.Now().Add(auditLockTimeout)
+	for {
+		release, err := AcquireLock(path + ".lock")
+		if err == nil || !errors.Is(err, ErrLocked) || time.Now().After(deadline) {
+			return release, err
+		}
+		time.Sleep(auditLockInterval)
+	}
+}
+
+// VerifyAuditLog will check the hash chain of the audit log at the supplied local path using the key the entries were
+// hashed with, and return the number of entries that were verified. An error describing the first broken entry is
+// returned if any entry was changed, removed, inserted, or reordered.
+func VerifyAuditLog(path string, key []byte) (int, error) {
+	if len(key) == 0 {
+		return 0, errAuditKeyRequired
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var (
+		count        int
+		previousHash = auditGenesisHash
+		scanner      = bufio.NewScanner(file)
+	)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var entry AuditEntry
+		if err = json.Unmarshal(line, &entry); err != nil {
+			return count, fmt.Errorf("entry %d: %v", count+1, err)
+		}
+		if entry.Sequence != int64(count+1) {
+			return count, fmt.Errorf("entry %d: expected sequence %d, found %d", count+1, count+1, entry.Sequence)
+		}
+		if entry.PreviousHash != previousHash {
+			return count, fmt.Errorf("entry %d: previous hash does not match the hash of entry %d", count+1, count)
+		}
+
+		suffix := []byte(`,"hash":"` + entry.Hash + `"}`)
+		if !bytes.HasSuffix(line, suffix) {
+			return count, fmt.Errorf("entry %d: hash is missing", count+1)
+		}
+		body := append(append([]byte{}, line[:len(line)-len(suffix)]...), '}')
+		if !hmac.Equal([]byte(auditHash(key, entry.PreviousHash, body)), []byte(entry.Hash)) {
+			return count, fmt.Errorf("entry %d: hash does not match the contents of the entry", count+1)
+		}
+
+		previousHash = entry.Hash
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// seal will set the hash of the entry and return the entry as a JSON line. The hash covers the previous hash and the
+// JSON of the entry without the hash, which is always the last field.
+func (entry *AuditEntry) seal(key []byte) ([]byte, error) {
+	entry.Hash = ""
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	entry.Hash = auditHash(key, entry.PreviousHash, body)
+
+	line := append([]byte{}, body[:len(body)-1]...)
+	return append(line, `,"hash":"`+entry.Hash+`"}`...), nil
+}
+
+// auditHash will return the hex encoded HMAC-SHA256 of the previous hash and the entry using the key.
+func auditHash(key []byte, previousHash string, body []byte) string {
+	hash := hmac.New(sha256.New, key)
+	hash.Write([]byte(previousHash))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// lastAuditLine will return the last non-empty line of the file, or nil if the file is empty.
+func lastAuditLine(file *os.File) ([]byte, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var last []byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			last = append(last[:0], line...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if last != nil && !bytes.HasSuffix(last, []byte("}")) {
+		return nil, errors.New("the last entry of the audit log is incomplete")
+	}
+	return last, nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/logrusorgru/aurora"
+	"github.com/rkuska/gonymizer"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	apiListenAddress     string
+	apiMaxConcurrentJobs int
+	apiMaxJobs           int
+	apiTLSCertFile       string
+	apiTLSKeyFile        string
+	apiWorkDir           string
+
+	// APICmd is the cobra.Command struct we use for the "api" command.
+	APICmd = &cobra.Command{
+		Use:   "api",
+		Short: "Serve an HTTP API for submitting, monitoring, and cancelling anonymization jobs",
+	}
+)
+
+// init initializes the API command for the application and adds application flags and options.
+func init() {
+	// Run is set here since jobs refer to APICmd, which would be an initialization cycle
+	APICmd.Run = cliCommandAPI
+
+	APICmd.Flags().StringVar(
+		&apiListenAddress,
+		"listen-address",
+		"localhost:8081",
+		"Address the API is served on",
+	)
+	_ = viper.BindPFlag("api.listen-address", APICmd.Flags().Lookup("listen-address"))
+
+	APICmd.Flags().StringVar(
+		&apiTLSCertFile,
+		"tls-cert-file",
+		"",
+		"Certificate file used to serve the API over HTTPS (requires --tls-key-file)",
+	)
+	_ = viper.BindPFlag("api.tls-cert-file", APICmd.Flags().Lookup("tls-cert-file"))
+
+	APICmd.Flags().StringVar(
+		&apiTLSKeyFile,
+		"tls-key-file",
+		"",
+		"Private key file used to serve the API over HTTPS (requires --tls-cert-file)",
+	)
+	_ = viper.BindPFlag("api.tls-key-file", APICmd.Flags().Lookup("tls-key-file"))
+
+	APICmd.Flags().StringVar(
+		&apiWorkDir,
+		"work-dir",
+		filepath.Join(os.TempDir(), "gonymizer-jobs"),
+		"Directory all files of jobs are stored in. Files of requests are relative to its files directory",
+	)
+	_ = viper.BindPFlag("api.work-dir", APICmd.Flags().Lookup("work-dir"))
+
+	APICmd.Flags().IntVar(
+		&apiMaxConcurrentJobs,
+		"max-concurrent-jobs",
+		1,
+		"Number of jobs that may run at the same time. Jobs using the same database always run one after another",
+	)
+	_ = viper.BindPFlag("api.max-concurrent-jobs", APICmd.Flags().Lookup("max-concurrent-jobs"))
+
+	APICmd.Flags().IntVar(
+		&apiMaxJobs,
+		"max-jobs",
+		100,
+		"Number of completed jobs kept in memory",
+	)
+	_ = viper.BindPFlag("api.max-jobs", APICmd.Flags().Lookup("max-jobs"))
+}
+
+// cliCommandAPI is the initialization point for serving the job API from the CLI. It runs until it receives SIGINT or
+// SIGTERM.
+func cliCommandAPI(cmd *cobra.Command, args []string) {
+	log.Info(aurora.Bold(aurora.Yellow(fmt.Sprint("Enabling log level: ",
+		strings.ToUpper(viper.GetString("log-level"))))))
+
+	err := serveAPI(
+		viper.GetString("api.listen-address"),
+		viper.GetString("api.tls-cert-file"),
+		viper.GetString("api.tls-key-file"),
+		gonymizer.JobServerOptions{
+			WorkDir:           viper.GetString("api.work-dir"),
+			MaxConcurrentJobs: viper.GetInt("api.max-concurrent-jobs"),
+			MaxJobs:           viper.GetInt("api.max-jobs"),
+			OnComplete: func(job gonymizer.Job) {
+				auditJob(job)
+				notifyJob(job)
+			},
+		},
+	)
+	if err != nil {
+		log.Error(err)
+		log.Error("❌ Gonymizer did not exit properly. See above for errors ❌")
+		finishCommand(err)
+		os.Exit(1)
+	} else {
+		finishCommand(nil)
+		log.Info("🦄 ", aurora.Bold(aurora.Green("-- SUCCESS --")), " 🌈")
+	}
+}
+
+// serveAPI serves the job API using the databases (api.source-databases and api.target-databases) and tokens
+// (api.tokens) of the configuration until the process is stopped.
+func serveAPI(listenAddress, tlsCertFile, tlsKeyFile string, options gonymizer.JobServerOptions) error {
+	if (len(tlsCertFile) == 0) != (len(tlsKeyFile) == 0) {
+		return errors.New("--tls-cert-file and --tls-key-file must be used together")
+	}
+
+	fileOptions, err := loadOptions()
+	if err != nil {
+		return err
+	}
+	options.Manifest = fileOptions.Manifest
+	if options.SigningKey, err = manifestSigningKey(); err != nil {
+		return err
+	}
+	options.Tokens = viper.GetStringMapString("api.tokens")
+	if options.SourceDatabases, err = apiDatabases("api.source-databases"); err != nil {
+		return err
+	}
+	if options.TargetDatabases, err = apiDatabases("api.target-databases"); err != nil {
+		return err
+	}
+	if len(options.SourceDatabases) == 0 && len(options.TargetDatabases) == 0 {
+		return errors.New("at least one database is required in the api.source-databases or api.target-databases " +
+			"section of the configuration")
+	}
+
+	jobServer, err := gonymizer.NewJobServer(options)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Source databases available to jobs: ", strings.Join(databaseNames(options.SourceDatabases), ", "))
+	log.Info("Target databases available to jobs: ", strings.Join(databaseNames(options.TargetDatabases), ", "))
+
+	server := &http.Server{Addr: listenAddress, Handler: jobServer.Handler()}
+	serveErr := make(chan error, 1)
+	go func() {
+		if len(tlsCertFile) > 0 {
+			serveErr <- server.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+	scheme := "http"
+	if len(tlsCertFile) > 0 {
+		scheme = "https"
+	}
+	log.Info("🚀 ", aurora.Bold(aurora.Green(fmt.Sprintf("Serving the job API on: %s://%s/jobs", scheme,
+		listenAddress))), " 🚀")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err = <-serveErr:
+		return err
+	case sig := <-signals:
+		signal.Stop(signals)
+		log.Infof("Received %s. Stopping the job API and cancelling the queued and running jobs", sig)
+	}
+
+	// Jobs are stopped first so the streams of their logs complete
+	jobServer.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
+
+// apiDatabases returns the databases configured in the section of the configuration by name.
+func apiDatabases(section string) (map[string]gonymizer.PGConfig, error) {
+	databases := map[string]gonymizer.PGConfig{}
+	for name := range viper.GetStringMap(section) {
+		conf, err := dbConfig(section + "." + name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid database '%s': %v", name, err)
+		}
+		databases[name] = conf
+	}
+	return databases, nil
+}
+
+// databaseNames returns the sorted names of the databases.
+func databaseNames(databases map[string]gonymizer.PGConfig) []string {
+	names := make([]string, 0, len(databases))
+	for name := range databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// auditJob appends an audit log entry for the job when audit.log-file is configured. The operator of the entry is the
+// name of the API token the job was submitted with.
+func auditJob(job gonymizer.Job) {
+	logFile := viper.GetString("audit.log-file")
+	if len(logFile) == 0 {
+		return
+	}
+
+	request := job.Request
+	entry := gonymizer.NewAuditEntry(APICmd.Name(), []string{"--job=" + job.ID,
+		"--steps=" + strings.Join(request.Steps, ",")}, job.Operator)
+	if len(request.SourceDatabase) > 0 && viper.GetStringMap("api.source-databases")[request.SourceDatabase] != nil {
+		if conf, err := dbConfig("api.source-databases." + request.SourceDatabase); err == nil {
+			entry.AddDatabase("source", conf)
+		}
+	}
+	if len(request.TargetDatabase) > 0 && viper.GetStringMap("api.target-databases")[request.TargetDatabase] != nil {
+		if conf, err := dbConfig("api.target-databases." + request.TargetDatabase); err == nil {
+			entry.AddDatabase("target", conf)
+		}
+	}
+	entry.Policy["schema"] = request.Schemas
+	entry.Policy["schema-prefix"] = request.SchemaPrefix
+	entry.Policy["exclude-schema"] = request.ExcludeSchemas
+	entry.Policy["exclude-table"] = request.ExcludeTables
+	entry.Policy["exclude-table-data"] = request.ExcludeTableData
+	entry.Policy["generate-seed"] = request.GenerateSeed
+	entry.Policy["pre-process-file"] = request.PreProcessFile
+	entry.Policy["post-process-file"] = request.PostProcessFile
+	entry.Policy["encryption"] = gonymizer.GetEncryption().Enabled()
+	if len(request.MapFile) > 0 {
+		if err := entry.SetMapFile(request.MapFile); err != nil {
+			log.Warn("Unable to hash map file for the audit log: ", err)
+		}
+	}
+
+	entry.Finish(jobError(job))
+
+	key, err := auditKey()
+	if err == nil {
+		err = gonymizer.AppendAuditEntry(logFile, entry, key)
+	}
+	if err != nil {
+		log.Error("Unable to write audit log: ", err)
+	}
+}
+
+// jobError returns the error of a job that did not succeed, or nil.
+func jobError(job gonymizer.Job) error {
+	switch {
+	case job.Status == gonymizer.RunStatusSuccess:
+		return nil
+	case len(job.Error) > 0:
+		return errors.New(job.Error)
+	default:
+		return errors.New("job " + job.Status)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/logrusorgru/aurora"
+	"github.com/rkuska/gonymizer"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+var (
+	auditLogFile  string
+	auditOperator string
+
+	// auditEntry is the audit log entry of the running command, or nil if no audit log is configured.
+	auditEntry *gonymizer.AuditEntry
+	// auditFatalError is the message of the log.Fatal call the command exits with, if any.
+	auditFatalError error
+	// auditExitHandler registers finishAudit as a logrus exit handler once.
+	auditExitHandler sync.Once
+
+	// auditPolicyKeys are the settings of each command that are recorded in the policy of its audit log entry.
+	auditPolicyKeys = map[string][]string{
+		"dump": {"dump.schema", "dump.schema-prefix", "dump.exclude-schema", "dump.exclude-table",
+			"dump.exclude-table-data"},
+		"load": {"load.require-manifest", "load.strict-row-count", "load.row-count-tolerances",
+			"load.exclude-table-data"},
+		"map":     {"map.schema", "map.schema-prefix", "map.exclude-table", "map.exclude-table-data"},
+		"process": {"process.inclusive", "process.generate-seed", "process.pre-process-file", "process.post-process-file"},
+		"run": {"run.stages", "dump.schema", "dump.schema-prefix", "dump.exclude-schema", "dump.exclude-table",
+			"dump.exclude-table-data", "process.inclusive", "process.generate-seed", "process.pre-process-file",
+			"process.post-process-file", "load.require-manifest", "load.strict-row-count", "load.row-count-tolerances"},
+		"verify": {"verify.min-length"},
+	}
+
+	// auditMapFileKeys are the settings holding the map file of each command. The map file is hashed when the command
+	// completes.
+	auditMapFileKeys = map[string]string{
+		"map":     "map.map-file",
+		"process": "process.map-file",
+		"run":     "process.map-file",
+		"verify":  "verify.map-file",
+	}
+
+	// AuditCmd is the cobra.Command struct we use for the "audit" command.
+	AuditCmd = &cobra.Command{
+		Use:   "audit",
+		Short: "Work with the audit log of Gonymizer commands",
+	}
+
+	// AuditVerifyCmd is the cobra.Command struct we use for the "audit verify" command.
+	AuditVerifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Verify that the audit log was not tampered with",
+		Run:   cliCommandAuditVerify,
+	}
+)
+
+// init initializes the Audit command for the application and adds application flags and options.
+func init() {
+	AuditCmd.AddCommand(AuditVerifyCmd)
+}
+
+// cliCommandAuditVerify is the initialization point for verifying the audit log from the CLI. It exits with a non-zero
+// exit code when the hash chain of the audit log is broken.
+func cliCommandAuditVerify(cmd *cobra.Command, args []string) {
+	err := auditVerify(viper.GetString("audit.log-file"))
+	if err != nil {
+		log.Error(err)
+		log.Error("❌ Gonymizer did not exit properly. See above for errors ❌")
+		finishCommand(err)
+		os.Exit(1)
+	} else {
+		finishCommand(nil)
+		log.Info("🦄 ", aurora.Bold(aurora.Green("-- SUCCESS --")), " 🌈")
+	}
+}
+
+// auditVerify checks the hash chain of the audit log.
+func auditVerify(logFile string) error {
+	if len(logFile) == 0 {
+		return errors.New("--audit-log is required")
+	}
+
+	key, err := auditKey()
+	if err != nil {
+		return err
+	}
+
+	log.Info("Verifying audit log: ", logFile)
+	count, err := gonymizer.VerifyAuditLog(logFile, key)
+	if err != nil {
+		return fmt.Errorf("audit log %s has been tampered with after %d valid entries: %v", logFile, count, err)
+	}
+	log.Infof("Verified %d audit log entries", count)
+	return nil
+}
+
+// auditKey returns the key (audit.key) the entries of the audit log are hashed with.
+func auditKey() ([]byte, error) {
+	key := viper.GetString("audit.key")
+	if len(key) == 0 {
+		return nil, errors.New("audit.key is required when an audit log is used")
+	}
+	return []byte(key), nil
+}
+
+// startAudit starts the audit log entry of the command when audit.log-file is configured. The command does not run if
+// the audit log can not be written to. Scheduled runs and API jobs have their own audit log entries. Commands that exit
+// using log.Fatal are audited by a logrus exit handler.
+func startAudit(cmd *cobra.Command) {
+	if err := beginAudit(cmd); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// beginAudit starts the audit log entry of the command when audit.log-file is configured and returns an error if the
+// audit log can not be written to.
+func beginAudit(cmd *cobra.Command) error {
+	logFile := viper.GetString("audit.log-file")
+	if len(logFile) == 0 || cmd == VersionCmd {
+		return nil
+	}
+	if _, err := auditKey(); err != nil {
+		return err
+	}
+	if cmd == AuditVerifyCmd || cmd == ServeCmd || cmd == APICmd {
+		return nil
+	}
+
+	file, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open audit log: %v", err)
+	}
+	_ = file.Close()
+
+	var arguments []string
+	cmd.Flags().Visit(func(flag *pflag.Flag) {
+		value := flag.Value.String()
+		if isSecretFlag(flag.Name) {
+			value = "xxxxx"
+		}
+		arguments = append(arguments, fmt.Sprintf("--%s=%s", flag.Name, value))
+	})
+	auditEntry = gonymizer.NewAuditEntry(cmd.Name(), arguments, viper.GetString("audit.operator"))
+
+	auditExitHandler.Do(func() {
+		log.AddHook(auditFatalHook{})
+		log.RegisterExitHandler(func() {
+			finishAudit(auditFatalError)
+		})
+	})
+	return nil
+}
+
+// auditDatabase adds a database the command connects to to the audit log entry (if any).
+func auditDatabase(role string, conf gonymizer.PGConfig) {
+	if auditEntry != nil {
+		auditEntry.AddDatabase(role, conf)
+	}
+}
+
+// finishAudit records the policy, map file, and outcome of the command and appends the entry to the audit log. The
+// command fails if the entry can not be appended.
+func finishAudit(err error) {
+	if err = endAudit(err); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// endAudit records the policy, map file, and outcome of the command and appends the entry to the audit log. An error
+// is returned if the entry can not be appended.
+func endAudit(err error) error {
+	entry := auditEntry
+	if entry == nil {
+		return nil
+	}
+	// The entry is only written once, even when writing it fails and log.Fatal runs the exit handler
+	auditEntry = nil
+
+	for _, key := range auditPolicyKeys[entry.Command] {
+		entry.Policy[key] = viper.Get(key)
+	}
+	entry.Policy["encryption"] = gonymizer.GetEncryption().Enabled()
+
+	if mapFile := viper.GetString(auditMapFileKeys[entry.Command]); len(mapFile) > 0 {
+		if hashErr := entry.SetMapFile(mapFile); hashErr != nil {
+			log.Warn("Unable to hash map file for the audit log: ", hashErr)
+		}
+	}
+	entry.Finish(err)
+
+	key, err := auditKey()
+	if err == nil {
+		err = gonymizer.AppendAuditEntry(viper.GetString("audit.log-file"), entry, key)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write audit log: %v", err)
+	}
+	return nil
+}
+
+// auditFatalHook is a logrus hook that records the message of log.Fatal as the error of the audit log entry.
+type auditFatalHook struct{}
+
+// Levels will return the log levels the hook is fired for.
+func (auditFatalHook) Levels() []log.Level {
+	return []log.Level{log.FatalLevel}
+}
+
+// Fire will record the message of the log entry as the error of the command.
+func (auditFatalHook) Fire(entry *log.Entry) error {
+	auditFatalError = errors.New(entry.Message)
+	return nil
+}
+
+// isSecretFlag returns true if the value of the flag must not be written to the audit log.
+func isSecretFlag(name string) bool {
+	name = strings.ToLower(name)
+	return strings.Contains(name, "password") || strings.Contains(name, "passphrase") ||
+		strings.Contains(name, "secret")
+}
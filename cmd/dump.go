@@ -1,16 +1,10 @@
 package main
 
 import (
-	"encoding/csv"
-	"errors"
 	"fmt"
 	"os"
-	"strconv"
 	"strings"
-	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/logrusorgru/aurora"
 	"github.com/rkuska/gonymizer"
 	log "github.com/sirupsen/logrus"
@@ -88,7 +82,7 @@ func init() {
 		&dumpFile,
 		"dump-file",
 		"",
-		"Location to dump file containing PHI/PII",
+		"Location (local path or storage URL) to dump file containing PHI/PII",
 	)
 	_ = viper.BindPFlag("dump.dump-file", DumpCmd.Flags().Lookup("dump-file"))
 
@@ -131,7 +125,7 @@ func init() {
 		&rowCountFile,
 		"row-count-file",
 		"",
-		"CSV file to store table row counts to (see documentation)",
+		"CSV file (local path or storage URL) to store table row counts to (see documentation)",
 	)
 	_ = viper.BindPFlag("dump.row-count-file", DumpCmd.Flags().Lookup("row-count-file"))
 
@@ -144,10 +138,12 @@ func init() {
 	)
 	_ = viper.BindPFlag("dump.username", DumpCmd.Flags().Lookup("username"))
 
+	addConnectionFlags(DumpCmd, "dump")
+
 }
 
-// cliCommandDump verifies that the supplied configuration is correct and starts the Dump process. If there is an error
-// this function will notify others using the slack URI supplied in the configuration.
+// cliCommandDump verifies that the supplied configuration is correct and starts the Dump process. The notifiers in the
+// notifications section of the configuration are notified of the outcome.
 func cliCommandDump(cmd *cobra.Command, args []string) {
 	var err error
 
@@ -174,44 +170,15 @@ func cliCommandDump(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	// If no password was supplied grab from user input
-	if len(viper.GetString("dump.password")) < 1 {
-		log.Debug("Password is empty. Asking user for password")
-		viper.SetDefault("dump.password", GetPassword())
-	}
-
-	dbConf, _ := GetDb(
-		viper.GetString("dump.host"),
-		viper.GetString("dump.username"),
-		viper.GetString("dump.password"),
-		viper.GetString("dump.database"),
-		viper.GetInt32("dump.port"),
-		viper.GetBool("dump.disable-ssl"),
-	)
-
-	// Check to see if we need to complete row counts at the end of the dump process
-	if len(viper.GetString("dump.row-count-file")) > 1 {
-		excludeAllTables := append(
-			viper.GetStringSlice("dump.exclude-table"),
-			viper.GetStringSlice("dump.exclude-table-data")...,
-		)
-		log.Info("Storing table row counts CSV to: ", viper.GetString("dump.row-count-file"))
-		err = storeRowCountFile(
-			dbConf,
-			viper.GetString("dump.schema-prefix"),
-			viper.GetString("dump.row-count-file"),
-			excludeAllTables)
-		if err != nil {
-			log.Error(err)
-			log.Error("❌ Gonymizer did not exit properly. See above for errors ❌")
-			os.Exit(1)
-		}
-	}
+	dbConf, _ := GetDb("dump")
+	manifest := gonymizer.NewManifest("dump")
 
 	log.Info("🚜 ", aurora.Bold(aurora.Green("Creating dump file")), " 🚜")
 	err = dump(
 		dbConf,
+		manifest,
 		viper.GetString("dump.dump-file"),
+		viper.GetString("dump.row-count-file"),
 		viper.GetString("dump.schema-prefix"),
 		viper.GetStringSlice("dump.exclude-table"),
 		viper.GetStringSlice("dump.exclude-table-data"),
@@ -222,23 +189,30 @@ func cliCommandDump(cmd *cobra.Command, args []string) {
 	if err != nil {
 		log.Error(err)
 		log.Error("❌ Gonymizer did not exit properly. See above for errors ❌")
+		finishCommand(err)
 		os.Exit(1)
 	} else {
+		finishCommand(nil)
 		log.Info("🦄 ", aurora.Bold(aurora.Green("-- SUCCESS --")), " 🌈")
 	}
 }
 
-// dump initiates the dump process.
+// dump initiates the dump process and writes the manifest of the dump file. The dump is checksummed and its rows are
+// counted while it is written, so the dump file is never read again.
 func dump(
 	conf gonymizer.PGConfig,
+	manifest *gonymizer.Manifest,
 	dumpFile,
+	rowCountFile,
 	schemaPrefix string,
 	excludeTable,
 	excludeTableData,
 	excludeSchemas,
 	schema []string,
 ) (err error) {
-	return gonymizer.CreateDumpFile(
+	// pg_dump is streamed into the dump file so the dump is encrypted before it reaches the disk or remote storage
+	dumpManifest, err := gonymizer.CreateDumpFileWithManifestContext(
+		commandContext,
 		conf,
 		dumpFile,
 		schemaPrefix,
@@ -247,79 +221,22 @@ func dump(
 		excludeSchemas,
 		schema,
 	)
-}
-
-// storeRowCountFile stores the row counts for every table that was saved into the dump file. This can be used during
-// the load process to verify that all the included tables were anonymized and transferred properly.
-func storeRowCountFile(dbConf gonymizer.PGConfig, schemaPrefix, path string, excludeTable []string) (err error) {
-	rowCounts, err := gonymizer.GetTableRowCountsInDB(dbConf, schemaPrefix, excludeTable)
 	if err != nil {
 		return err
 	}
 
-	if len(*rowCounts) < 1 {
-		return errors.New("We received 0 row counts for database: " + dbConf.DefaultDBName)
-	}
-
-	// S3 Storage
-	if strings.HasPrefix(strings.ToLower(path), "s3://") {
-		var s3file gonymizer.S3File
-		log.Debug("S3 path detected for row-count-file")
-		if err := s3file.ParseS3Url(path); err != nil {
-			return err
-		}
-
-		// NOTE: Temp file creation. We will remove below after we load to S3
-		// Use /tmp/filePath_EPOCH_TIME to store the file before copying to S3
-		tempFile := "/tmp/" + strconv.FormatInt(time.Now().Unix(), 10) + "_" + s3file.FilePath
-		log.Debug("Creating temp file: ", tempFile)
-		f, err := os.OpenFile(tempFile, os.O_RDWR|os.O_CREATE, 0644)
-
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		if err = saveToCsv(f, rowCounts); err != nil {
-			return err
-		}
-
-		log.Infof("🚛 Uploading '%s' => S3: %s\n", tempFile, s3file.URL)
-		sess, err := session.NewSession(&aws.Config{Region: aws.String(s3file.Region)})
-		if err != nil {
-			return err
-		}
-
-		if err = gonymizer.AddFileToS3(sess, tempFile, &s3file); err != nil {
-			log.Errorf("Unable to upload '%s' => '%s'", tempFile, s3file.URL)
-			return err
-		}
-
-		// Local Storage
-	} else {
-		log.Debug("Saving row-count-file to local disk: ", path)
-		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
-
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		if err = saveToCsv(f, rowCounts); err != nil {
+	// Row counts are taken from the dump file so they are exact and do not query the database again
+	if len(rowCountFile) > 0 {
+		log.Info("Storing table row counts CSV to: ", gonymizer.RedactSecrets(rowCountFile))
+		if err = gonymizer.WriteRowCountFile(rowCountFile, dumpManifest.RowCounts); err != nil {
 			return err
 		}
 	}
-	return nil
-}
 
-// saveToCsv saves the rowCounts file to the specified location that the file pointer is pointing to.
-func saveToCsv(writer *os.File, rowCounts *[]gonymizer.RowCounts) (err error) {
-	// Write table row counts to file
-	csvWriter := csv.NewWriter(writer)
-	for _, row := range *rowCounts {
-		if err = csvWriter.Write([]string{*row.SchemaName, *row.TableName, strconv.Itoa(*row.Count)}); err != nil {
-			return err
-		}
-	}
-	csvWriter.Flush()
-	return err
+	manifest.Output = dumpManifest.Output
+	manifest.RowCounts = dumpManifest.RowCounts
+	manifest.Tables = dumpManifest.Tables
+	manifest.Source = dumpManifest.Source
+	manifest.CompletedAt = dumpManifest.CompletedAt
+	return writeManifest(dumpFile, manifest)
 }
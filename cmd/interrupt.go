@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// commandContext is the context of the running command. It is cancelled when the command is interrupted, which kills
+// pg_dump and psql, removes partially written files, and drops the temporary database of the load command.
+var commandContext = context.Background()
+
+// newCommandContext replaces commandContext with a context that is cancelled by calling the returned function.
+func newCommandContext() context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	commandContext = ctx
+	return cancel
+}
+
+// startInterrupts cancels commandContext when the command receives SIGINT or SIGTERM so it stops gracefully. The
+// serve and api commands handle signals themselves. A second signal exits immediately.
+func startInterrupts(cmd *cobra.Command) {
+	if cmd == ServeCmd || cmd == APICmd {
+		return
+	}
+
+	cancel := newCommandContext()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		// Restore the default behavior so a second signal terminates the process
+		signal.Stop(signals)
+		log.Warnf("Received %s. Stopping the %s command, send it again to exit immediately", sig, cmd.Name())
+		cancel()
+	}()
+}
@@ -3,9 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
-	"strconv"
 	"strings"
-	"time"
 
 	"github.com/logrusorgru/aurora"
 	"github.com/rkuska/gonymizer"
@@ -57,7 +55,7 @@ func init() {
 		&loadFile,
 		"load-file",
 		"",
-		"Location to load file containing anonymized data",
+		"Location to load file containing anonymized data (local path or storage URL, see documentation)",
 	)
 	_ = viper.BindPFlag("load.load-file", LoadCmd.Flags().Lookup("load-file"))
 
@@ -93,7 +91,47 @@ func init() {
 		"",
 		"CSV file to load and compare row counts to (see documentation)",
 	)
-	_ = viper.BindPFlag("dump.row-count-file", LoadCmd.Flags().Lookup("row-count-file"))
+	_ = viper.BindPFlag("load.row-count-file", LoadCmd.Flags().Lookup("row-count-file"))
+
+	LoadCmd.Flags().BoolVar(
+		&strictRowCount,
+		"strict-row-count",
+		false,
+		"Fail when row counts do not match the row-count-file (within the row-count-tolerance)",
+	)
+	_ = viper.BindPFlag("load.strict-row-count", LoadCmd.Flags().Lookup("strict-row-count"))
+
+	LoadCmd.Flags().StringSliceVar(
+		&rowCountTolerances,
+		"row-count-tolerance",
+		[]string{},
+		"Allowed row count difference in the form schema.table=rows or schema.table=percent% (* for all tables)",
+	)
+	_ = viper.BindPFlag("load.row-count-tolerances", LoadCmd.Flags().Lookup("row-count-tolerance"))
+
+	LoadCmd.Flags().StringSliceVar(
+		&excludeTableData,
+		"exclude-table-data",
+		[]string{},
+		"Tables whose data was excluded from the dump and must be empty after loading (default: dump.exclude-table-data)",
+	)
+	_ = viper.BindPFlag("load.exclude-table-data", LoadCmd.Flags().Lookup("exclude-table-data"))
+
+	LoadCmd.Flags().BoolVar(
+		&requireManifest,
+		"require-manifest",
+		false,
+		"Refuse to load files that do not have a manifest (see documentation)",
+	)
+	_ = viper.BindPFlag("load.require-manifest", LoadCmd.Flags().Lookup("require-manifest"))
+
+	LoadCmd.Flags().StringVar(
+		&sqliteFile,
+		"sqlite-file",
+		"",
+		"Load the anonymized dump file into this SQLite database file instead of a PostgreSQL database",
+	)
+	_ = viper.BindPFlag("load.sqlite-file", LoadCmd.Flags().Lookup("sqlite-file"))
 
 	LoadCmd.Flags().StringVarP(
 		&dbUser,
@@ -104,10 +142,12 @@ func init() {
 	)
 	_ = viper.BindPFlag("load.username", LoadCmd.Flags().Lookup("username"))
 
+	addConnectionFlags(LoadCmd, "load")
+
 }
 
-// cliCommandLoad verifies that the supplied configuration is correct and starts the Load process. If there is an error
-// this function will notify others using the slack URI supplied in the configuration.
+// cliCommandLoad verifies that the supplied configuration is correct and starts the Load process. The notifiers in the
+// notifications section of the configuration are notified of the outcome.
 func cliCommandLoad(cmd *cobra.Command, args []string) {
 	var err error
 
@@ -115,83 +155,107 @@ func cliCommandLoad(cmd *cobra.Command, args []string) {
 		strings.ToUpper(viper.GetString("log-level"))))),
 	)
 
-	// If no password was supplied grab from user input
-	if len(viper.GetString("load.password")) < 1 {
-		log.Debug("Password is empty. Asking user for password")
-		viper.SetDefault("load.password", GetPassword())
+	// SQLite does not need a database server so skip everything PostgreSQL related
+	if len(viper.GetString("load.sqlite-file")) > 0 {
+		log.Info("🚜 ", aurora.Bold(aurora.Green("Loading the anonymized database into SQLite")), " 🚜")
+		err = loadSQLite(
+			viper.GetString("load.sqlite-file"),
+			viper.GetString("load.load-file"),
+			viper.GetString("load.s3-file-path"),
+		)
+		if err != nil {
+			log.Error(err)
+			log.Error("❌ Gonymizer did not exit properly. See above for errors ❌")
+			finishCommand(err)
+			os.Exit(1)
+		}
+
+		if len(viper.GetString("load.row-count-file")) > 1 {
+			log.Warn("Row count verification is not supported for SQLite databases. Skipping row-count-file")
+		}
+		finishCommand(nil)
+		log.Info("🦄 ", aurora.Bold(aurora.Green("-- SUCCESS --")), " 🌈")
+		return
 	}
 
-	dbConf, _ := GetDb(
-		viper.GetString("load.host"),
-		viper.GetString("load.username"),
-		viper.GetString("load.password"),
-		viper.GetString("load.database"),
-		viper.GetInt32("load.port"),
-		viper.GetBool("load.disable-ssl"),
-	)
+	dbConf, _ := GetDb("load")
 
-	// Start the loading process
+	// Start the loading process. Row counts are compared before the existing database is replaced.
 	log.Info("🚜 ", aurora.Bold(aurora.Green("Loading the anonymized database")), " 🚜")
-	if err = load(dbConf, viper.GetString("load.load-file"), viper.GetString("load.s3-file-path")); err != nil {
+	err = load(
+		dbConf,
+		viper.GetString("load.load-file"),
+		viper.GetString("load.s3-file-path"),
+		viper.GetString("load.row-count-file"),
+	)
+	if err != nil {
 		log.Error(err)
 		log.Error("❌ Gonymizer did not exit properly. See above for errors ❌")
+		finishCommand(err)
 		os.Exit(1)
 	}
 
-	// Store row counts
-	if len(viper.GetString("load.row-count-file")) > 1 {
-		log.Info("Loading row-counts CSV file from: ", viper.GetString("load.row-count-file"))
-		err = downloadRowCountFile(dbConf, viper.GetString("load.row-count-file"))
-		if err != nil {
-			log.Error(err)
-			log.Error("❌ Gonymizer did not exit properly. See above for errors ❌")
-			os.Exit(1)
-		}
-	}
-
+	finishCommand(nil)
 	log.Info("🦄 ", aurora.Bold(aurora.Green("-- SUCCESS --")), " 🌈")
 }
 
-// load starts the loading process.
-func load(conf gonymizer.PGConfig, loadFile, s3FilePath string) (err error) {
-	// Check for S3 file here. If it is defined we should download it to loadFile's path and then load it.
-	if s3FilePath != "" {
-		log.Infof("🚛 Downloading from S3 '%s' -> %s\n", s3FilePath, loadFile)
-		anonFile := new(gonymizer.S3File)
-		if err = anonFile.ParseS3Url(s3FilePath); err != nil {
-			return err
-		}
-		if err = gonymizer.GetFileFromS3(nil, anonFile, loadFile); err != nil {
+// load starts the loading process. The loaded database is compared to the row count file, if any, before it replaces
+// the existing database.
+func load(conf gonymizer.PGConfig, loadFile, s3FilePath, rowCountFile string) (err error) {
+	loadFile = loadFileURL(loadFile, s3FilePath)
+	options, err := loadOptions()
+	if err != nil {
+		return err
+	}
+	if len(rowCountFile) > 0 {
+		log.Info("Loading row-counts CSV file from: ", gonymizer.RedactSecrets(rowCountFile))
+		options.RowCountFile = rowCountFile
+		if options.RowCounts, err = rowCountOptions(); err != nil {
 			return err
 		}
 	}
+	log.Info("Loading data from file: ", gonymizer.RedactSecrets(loadFile))
+	return gonymizer.LoadFileWithOptionsContext(commandContext, conf, loadFile, options)
+}
 
-	log.Info("Loading data from file: ", loadFile)
-	return gonymizer.LoadFile(conf, loadFile)
+// loadSQLite starts the loading process using a SQLite database file as the destination.
+func loadSQLite(sqliteFile, loadFile, s3FilePath string) (err error) {
+	loadFile = loadFileURL(loadFile, s3FilePath)
+	options, err := loadOptions()
+	if err != nil {
+		return err
+	}
+	log.Infof("Loading data from file: %s -> SQLite: %s", gonymizer.RedactSecrets(loadFile), sqliteFile)
+	return gonymizer.LoadFileToSQLiteWithOptionsContext(commandContext, sqliteFile, loadFile, options)
 }
 
-// downloadRowCountFile will download the row count file from S3 if needed and verify that the table row counts is
-// correct.
-func downloadRowCountFile(dbConf gonymizer.PGConfig, path string) (err error) {
-	// S3 Storage
-	if strings.HasPrefix(strings.ToLower(path), "s3://") {
-		var s3File gonymizer.S3File
-		if err = s3File.ParseS3Url(path); err != nil {
-			return err
-		}
+// loadFileURL returns the location of the file to load. Load files in remote storage are streamed directly from the
+// storage backend. The s3-file-path setting is still supported for backwards compatibility and takes precedence.
+func loadFileURL(loadFile, s3FilePath string) string {
+	if s3FilePath != "" {
+		log.Debug("s3-file-path is deprecated, please use --load-file instead")
+		return s3FilePath
+	}
+	return loadFile
+}
 
-		// NOTE: Temp file creation. We will remove below after we load to S3
-		// Use /tmp/filePath_EPOCH_TIME to store the file before copying to S3
-		tempFile := "/tmp/" + strconv.FormatInt(time.Now().Unix(), 10) + "_" + s3File.FilePath
-		log.Infof("🚛 Downloading from S3 '%s' -> %s\n", s3File.URL, tempFile)
-		if err = gonymizer.GetFileFromS3(nil, &s3File, tempFile); err != nil {
-			return err
-		}
-		err = gonymizer.VerifyRowCount(dbConf, tempFile)
+// rowCountOptions returns the options used to verify that the table row counts of the loaded database match the row
+// count file within the configured tolerances. Mismatches fail the load when load.strict-row-count is set.
+func rowCountOptions() (gonymizer.RowCountOptions, error) {
+	options := gonymizer.RowCountOptions{
+		Strict:      viper.GetBool("load.strict-row-count"),
+		EmptyTables: viper.GetStringSlice("load.exclude-table-data"),
+	}
+	if len(options.EmptyTables) == 0 {
+		options.EmptyTables = viper.GetStringSlice("dump.exclude-table-data")
+	}
 
-		// Local file storage
-	} else {
-		err = gonymizer.VerifyRowCount(dbConf, path)
+	for _, value := range viper.GetStringSlice("load.row-count-tolerances") {
+		tolerance, err := gonymizer.ParseRowCountTolerance(value)
+		if err != nil {
+			return options, err
+		}
+		options.Tolerances = append(options.Tolerances, tolerance)
 	}
-	return err
+	return options, nil
 }
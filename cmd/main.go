@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io"
 	"os"
 	"runtime"
+	"sort"
 	"strings"
 	"syscall"
 
@@ -50,32 +52,45 @@ License Information
 `
 
 var (
-	configPath       string
-	dbUser           string
-	dbHost           string
-	dbName           string
-	dbPassword       string
-	dbPort           int32
-	dbDisableSSL     bool
-	excludeSchemas   []string
-	excludeTable     []string
-	excludeTableData []string
-	generateSeed     bool
-	inclusive        bool
-	loadFile         string
-	localFile        string
-	logFile          string
-	logFormat        string
-	logLevel         string
-	mapFile          string
-	dumpFile         string
-	postProcessFile  string
-	preProcessFile   string
-	procedures       bool
-	rowCountFile     string
-	schemaPrefix     string
-	s3File           string
-	schema           []string
+	configPath            string
+	dbUser                string
+	dbHost                string
+	dbName                string
+	dbPassword            string
+	dbPort                int32
+	dbDisableSSL          bool
+	excludeSchemas        []string
+	excludeTable          []string
+	excludeTableData      []string
+	generateSeed          bool
+	inclusive             bool
+	loadFile              string
+	localFile             string
+	logFile               string
+	logFormat             string
+	logLevel              string
+	mapFile               string
+	metricsJob            string
+	metricsListenAddress  string
+	metricsPushgatewayURL string
+	dumpFile              string
+	postProcessFile       string
+	preProcessFile        string
+	procedures            bool
+	progress              string
+	requireManifest       bool
+	rowCountFile          string
+	rowCountTolerances    []string
+	runReportFile         string
+	schemaPrefix          string
+	s3File                string
+	schema                []string
+	sqliteFile            string
+	strictRowCount        bool
+	tracingEndpoint       string
+	tracingExporter       string
+	tracingFile           string
+	tracingInsecure       bool
 
 	rootCmd = &cobra.Command{
 		Use:              "gonymizer",
@@ -85,10 +100,22 @@ var (
 	}
 )
 
-// GetDb returns a PGConfig set to the supplied database settings.
-func GetDb(host, username, password, database string, port int32, disableSSL bool) (gonymizer.PGConfig, *sql.DB) {
-	conf := gonymizer.PGConfig{}
-	conf.LoadFromCLI(host, username, password, database, port, disableSSL)
+// GetDb returns a PGConfig set to the database settings stored under the supplied configuration prefix (dump, load,
+// map) along with an open connection to the database. If no password was supplied, and none could be found in the
+// service or password files, the user is asked for one.
+func GetDb(prefix string) (gonymizer.PGConfig, *sql.DB) {
+	conf, err := dbConfig(prefix)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// If no password was supplied grab from user input (client certificates do not need a password)
+	if len(conf.Pass) < 1 && len(conf.SSLCert) < 1 {
+		log.Debug("Password is empty. Asking user for password")
+		conf.Pass = GetPassword()
+	}
+
+	auditDatabase(prefix, conf)
 
 	db, err := gonymizer.OpenDB(conf)
 	if err != nil {
@@ -103,9 +130,165 @@ func GetDb(host, username, password, database string, port int32, disableSSL boo
 	return conf, db
 }
 
+// checkDb returns a PGConfig set to the database settings stored under the supplied configuration prefix after checking
+// that the database can be connected to. Unlike GetDb it never asks for a password or exits, and the connection is
+// closed before it returns.
+func checkDb(ctx context.Context, prefix string) (gonymizer.PGConfig, error) {
+	conf, err := dbConfig(prefix)
+	if err != nil {
+		return conf, err
+	}
+	auditDatabase(prefix, conf)
+
+	db, err := gonymizer.OpenDB(conf)
+	if err != nil {
+		return conf, err
+	}
+	defer db.Close()
+
+	if err = db.PingContext(ctx); err != nil {
+		return conf, fmt.Errorf("unable to connect to the %s database: %v", prefix, err)
+	}
+	return conf, nil
+}
+
+// dbConfig returns a PGConfig set to the database settings stored under the supplied configuration prefix without
+// connecting to the database.
+func dbConfig(prefix string) (gonymizer.PGConfig, error) {
+	conf := gonymizer.PGConfig{}
+
+	// A connection string is used as the base which can be overridden by the more specific options below
+	if connString := viper.GetString(prefix + ".conn-string"); len(connString) > 0 {
+		if err := conf.LoadFromConnString(connString); err != nil {
+			return conf, err
+		}
+	}
+
+	if service := viper.GetString(prefix + ".service"); len(service) > 0 {
+		conf.Service = service
+	}
+
+	host := viper.GetString(prefix + ".host")
+	if len(host) > 0 || (len(conf.Host) == 0 && len(conf.Service) == 0) {
+		port := viper.GetInt32(prefix + ".port")
+		if port == 0 {
+			port = 5432
+		}
+		conf.Host = fmt.Sprintf("%s:%d", host, port)
+	}
+	if username := viper.GetString(prefix + ".username"); len(username) > 0 {
+		conf.Username = username
+	}
+	if password := viper.GetString(prefix + ".password"); len(password) > 0 {
+		conf.Pass = password
+	}
+	if database := viper.GetString(prefix + ".database"); len(database) > 0 {
+		conf.DefaultDBName = database
+	}
+
+	// Set SSL Mode. --ssl-mode always wins over --disable-ssl
+	if sslMode := viper.GetString(prefix + ".ssl-mode"); len(sslMode) > 0 {
+		conf.SSLMode = sslMode
+	} else if viper.GetBool(prefix + ".disable-ssl") {
+		conf.SSLMode = "disable"
+	}
+	if sslRootCert := viper.GetString(prefix + ".ssl-root-cert"); len(sslRootCert) > 0 {
+		conf.SSLRootCert = sslRootCert
+	}
+	if sslCert := viper.GetString(prefix + ".ssl-cert"); len(sslCert) > 0 {
+		conf.SSLCert = sslCert
+	}
+	if sslKey := viper.GetString(prefix + ".ssl-key"); len(sslKey) > 0 {
+		conf.SSLKey = sslKey
+	}
+	if applicationName := viper.GetString(prefix + ".application-name"); len(applicationName) > 0 {
+		conf.ApplicationName = applicationName
+	}
+	if connectTimeout := viper.GetInt(prefix + ".connect-timeout"); connectTimeout > 0 {
+		conf.ConnectTimeout = connectTimeout
+	}
+	if passFile := viper.GetString(prefix + ".passfile"); len(passFile) > 0 {
+		conf.PassFile = passFile
+	}
+
+	if err := conf.Resolve(); err != nil {
+		return conf, err
+	}
+
+	// Gonymizer has always required SSL unless told otherwise. Unix domain sockets do not support SSL
+	if len(conf.SSLMode) == 0 && conf.IsUnixSocket() {
+		conf.SSLMode = "disable"
+	} else if len(conf.SSLMode) == 0 {
+		conf.SSLMode = "require"
+	}
+	return conf, nil
+}
+
+// addConnectionFlags adds the PostgreSQL connection option flags to the supplied command and binds them to the
+// supplied configuration prefix.
+func addConnectionFlags(cmd *cobra.Command, prefix string) {
+	cmd.Flags().String(
+		"conn-string",
+		"",
+		"libpq connection string or URI (I.E. 'host=localhost dbname=store' or postgresql://user@localhost/store). "+
+			"Other connection flags override values in the connection string",
+	)
+	cmd.Flags().String(
+		"service",
+		"",
+		"Service name from the pg_service.conf file (see PGSERVICEFILE and PGSYSCONFDIR)",
+	)
+	cmd.Flags().String(
+		"passfile",
+		"",
+		"Password file to use instead of PGPASSFILE or ~/.pgpass",
+	)
+	cmd.Flags().String(
+		"ssl-mode",
+		"",
+		"SSL mode: disable, allow, prefer, require, verify-ca, verify-full (overrides --disable-ssl)",
+	)
+	cmd.Flags().String(
+		"ssl-root-cert",
+		"",
+		"Certificate authority file used to verify the server certificate (verify-ca, verify-full)",
+	)
+	cmd.Flags().String(
+		"ssl-cert",
+		"",
+		"Client SSL certificate file",
+	)
+	cmd.Flags().String(
+		"ssl-key",
+		"",
+		"Client SSL private key file",
+	)
+	cmd.Flags().String(
+		"application-name",
+		"",
+		"Application name reported to the database server",
+	)
+	cmd.Flags().Int(
+		"connect-timeout",
+		0,
+		"Maximum number of seconds to wait while connecting (0 waits indefinitely)",
+	)
+
+	for _, name := range []string{"conn-string", "service", "passfile", "ssl-mode", "ssl-root-cert", "ssl-cert",
+		"ssl-key", "application-name", "connect-timeout"} {
+		_ = viper.BindPFlag(prefix+"."+name, cmd.Flags().Lookup(name))
+	}
+}
+
 // GetPassword will ask the user to input a database password from the CLI if the password was left blank in the
-// configuration. Returns the password as a string.
+// configuration. Returns the password as a string. Exits if there is no terminal to ask the user with (I.E. cronjobs).
 func GetPassword() string {
+	if !terminal.IsTerminal(int(syscall.Stdin)) {
+		log.Error("No database password was supplied and stdin is not a terminal. Set the password in the " +
+			"configuration, a GON_* environment variable, or a secret reference (file://, env://, vault://, awssm://)")
+		os.Exit(1)
+	}
+
 	fmt.Print("Database Password: ")
 	bytePassword, err := terminal.ReadPassword(syscall.Stdin)
 	fmt.Println() // terminal.ReadPassword does not add a new line after receiving the password
@@ -163,14 +346,108 @@ func init() {
 	)
 	_ = viper.BindPFlag("log-format", rootCmd.PersistentFlags().Lookup("log-format"))
 
+	rootCmd.PersistentFlags().StringVar(
+		&runReportFile,
+		"run-report-file",
+		"",
+		"Filename and location (local path or storage URL) of the JSON report of the command's results",
+	)
+	_ = viper.BindPFlag("run-report-file", rootCmd.PersistentFlags().Lookup("run-report-file"))
+
+	rootCmd.PersistentFlags().StringVar(
+		&progress,
+		"progress",
+		"auto",
+		"How to report progress, one of: auto (bar on a terminal, log otherwise), bar, log, none",
+	)
+	_ = viper.BindPFlag("progress", rootCmd.PersistentFlags().Lookup("progress"))
+
+	rootCmd.PersistentFlags().StringVar(
+		&metricsListenAddress,
+		"metrics-listen-address",
+		"",
+		"Expose Prometheus metrics on this address (I.E. localhost:9187) while the command runs",
+	)
+	_ = viper.BindPFlag("metrics.listen-address", rootCmd.PersistentFlags().Lookup("metrics-listen-address"))
+
+	rootCmd.PersistentFlags().StringVar(
+		&metricsPushgatewayURL,
+		"metrics-pushgateway-url",
+		"",
+		"Push Prometheus metrics to this Pushgateway when the command completes",
+	)
+	_ = viper.BindPFlag("metrics.pushgateway-url", rootCmd.PersistentFlags().Lookup("metrics-pushgateway-url"))
+
+	rootCmd.PersistentFlags().StringVar(
+		&metricsJob,
+		"metrics-job",
+		"gonymizer",
+		"Job name used when pushing metrics to the Pushgateway",
+	)
+	_ = viper.BindPFlag("metrics.job", rootCmd.PersistentFlags().Lookup("metrics-job"))
+
+	rootCmd.PersistentFlags().StringVar(
+		&tracingExporter,
+		"tracing-exporter",
+		"",
+		"Export OpenTelemetry spans using this exporter, one of: otlp, file",
+	)
+	_ = viper.BindPFlag("tracing.exporter", rootCmd.PersistentFlags().Lookup("tracing-exporter"))
+
+	rootCmd.PersistentFlags().StringVar(
+		&tracingEndpoint,
+		"tracing-endpoint",
+		"",
+		"Host and port of the OTLP collector (I.E. localhost:4318) when using the otlp exporter",
+	)
+	_ = viper.BindPFlag("tracing.endpoint", rootCmd.PersistentFlags().Lookup("tracing-endpoint"))
+
+	rootCmd.PersistentFlags().BoolVar(
+		&tracingInsecure,
+		"tracing-insecure",
+		false,
+		"Connect to the OTLP collector without TLS",
+	)
+	_ = viper.BindPFlag("tracing.insecure", rootCmd.PersistentFlags().Lookup("tracing-insecure"))
+
+	rootCmd.PersistentFlags().StringVar(
+		&tracingFile,
+		"tracing-file",
+		"",
+		"Write spans as JSON to this file when using the file exporter",
+	)
+	_ = viper.BindPFlag("tracing.file", rootCmd.PersistentFlags().Lookup("tracing-file"))
+
+	rootCmd.PersistentFlags().StringVar(
+		&auditLogFile,
+		"audit-log",
+		"",
+		"Append a tamper-evident entry for the command to this audit log (see: gonymizer audit verify)",
+	)
+	_ = viper.BindPFlag("audit.log-file", rootCmd.PersistentFlags().Lookup("audit-log"))
+
+	rootCmd.PersistentFlags().StringVar(
+		&auditOperator,
+		"audit-operator",
+		"",
+		"Operator recorded in the audit log. Defaults to the user running Gonymizer",
+	)
+	_ = viper.BindPFlag("audit.operator", rootCmd.PersistentFlags().Lookup("audit-operator"))
+
 	// Bind commands to root
 	rootCmd.AddCommand(
 		DumpCmd,
 		LoadCmd,
 		MapCmd,
 		ProcessCmd,
+		ReportCmd,
+		RunCmd,
+		ServeCmd,
 		UploadCmd,
+		VerifyCmd,
 		VersionCmd,
+		AuditCmd,
+		APICmd,
 	)
 }
 
@@ -211,6 +488,126 @@ func initConfig() {
 	if err := viper.BindPFlags(rootCmd.PersistentFlags()); err != nil {
 		log.Error("Unable to bind flags")
 	}
+
+	// 4. Resolve secret references (file://, env://, vault://, awssm://) in the configuration
+	if err := resolveConfigSecrets(); err != nil {
+		fmt.Println("Failed to resolve secrets:", err.Error())
+		os.Exit(1)
+	}
+
+	// 5. Configure the storage backends
+	configureStorage()
+
+	// 6. Configure client-side encryption of dump, processed, and row count files
+	if err := configureEncryption(); err != nil {
+		fmt.Println("Failed to configure encryption:", err.Error())
+		os.Exit(1)
+	}
+}
+
+// configureStorage will register the storage backends that need configuration using the s3.*, azure.*, and sftp.*
+// configuration settings. Unset values fall back to the defaults of each backend.
+func configureStorage() {
+	gonymizer.RegisterStorage("s3", gonymizer.NewS3StorageWithConfig(gonymizer.S3Config{
+		Endpoint:             viper.GetString("s3.endpoint"),
+		Region:               viper.GetString("s3.region"),
+		Profile:              viper.GetString("s3.profile"),
+		RoleARN:              viper.GetString("s3.role-arn"),
+		PathStyle:            viper.GetBool("s3.path-style"),
+		ServerSideEncryption: viper.GetString("s3.server-side-encryption"),
+		KMSKeyID:             viper.GetString("s3.kms-key-id"),
+		UploadPartSize:       viper.GetInt64("s3.upload-part-size-mb") * 1024 * 1024,
+		UploadConcurrency:    viper.GetInt("s3.upload-concurrency"),
+	}))
+	gonymizer.RegisterStorage("azblob", gonymizer.NewAzureStorage(
+		viper.GetString("azure.account"),
+		viper.GetString("azure.key"),
+	))
+	gonymizer.RegisterStorage("sftp", gonymizer.NewSFTPStorage(
+		viper.GetString("sftp.key-file"),
+		viper.GetString("sftp.known-hosts-file"),
+	))
+}
+
+// configureEncryption will enable client-side encryption using the keys in the encryption.* configuration settings.
+// Keys may be supplied inline, as paths to key files, or as secret references.
+func configureEncryption() error {
+	var keys [4][]string
+	for i, key := range []string{
+		"encryption.age-recipients",
+		"encryption.age-identities",
+		"encryption.pgp-recipients",
+		"encryption.pgp-keys",
+	} {
+		for _, value := range viper.GetStringSlice(key) {
+			value, err := gonymizer.ResolveSecret(value)
+			if err != nil {
+				return fmt.Errorf("%s: %s", key, err)
+			}
+			keys[i] = append(keys[i], value)
+		}
+	}
+
+	enc, err := gonymizer.NewEncryption(gonymizer.EncryptionConfig{
+		AgeRecipients: keys[0],
+		AgeIdentities: keys[1],
+		PGPRecipients: keys[2],
+		PGPKeys:       keys[3],
+		PGPPassphrase: viper.GetString("encryption.pgp-passphrase"),
+	})
+	if err != nil {
+		return err
+	}
+	gonymizer.SetEncryption(enc)
+	return nil
+}
+
+// resolveConfigSecrets will replace the value of every credential and key setting (see: isSecretSetting) that
+// references a secret provider with the secret. The Vault provider is configured using the vault.address, vault.token,
+// and vault.namespace settings which may themselves reference file:// or env:// secrets.
+func resolveConfigSecrets() error {
+	var vaultSettings []string
+	for _, key := range []string{"vault.address", "vault.token", "vault.namespace"} {
+		value, err := gonymizer.ResolveSecret(viper.GetString(key))
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		vaultSettings = append(vaultSettings, value)
+	}
+	gonymizer.RegisterSecretProvider(
+		"vault",
+		gonymizer.NewVaultSecretProvider(vaultSettings[0], vaultSettings[1], vaultSettings[2]),
+	)
+
+	for _, key := range viper.AllKeys() {
+		value, ok := viper.Get(key).(string)
+		if !ok || !isSecretSetting(key) {
+			continue
+		}
+		if _, isSecret, _ := gonymizer.ParseSecretRef(value); !isSecret {
+			continue
+		}
+
+		secret, err := gonymizer.ResolveSecret(value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		viper.Set(key, secret)
+	}
+	return nil
+}
+
+// isSecretSetting returns true if the setting holds a credential or key, and may therefore be a secret reference. Other
+// settings are never resolved since file:// is also the scheme of local files (I.E. dump.dump-file).
+func isSecretSetting(key string) bool {
+	if strings.HasPrefix(key, "api.tokens.") || strings.Contains(key, ".headers.") {
+		return true
+	}
+	switch key[strings.LastIndex(key, ".")+1:] {
+	case "password", "smtp-password", "pgp-passphrase", "token", "key", "signing-key", "conn-string", "url":
+		return true
+	}
+	return false
 }
 
 // preRun sets up default logging as well as printing the build number and date to the screen for debug purposes.
@@ -229,6 +626,15 @@ func preRun(cmd *cobra.Command, args []string) {
 		runtime.GOMAXPROCS(-1),
 		runtime.NumCPU(),
 	)
+
+	startInterrupts(cmd)
+	configureProgress()
+	startMetrics()
+	startTracing(cmd)
+	startNotifications()
+	startExternalProcessors()
+	startRunReport(cmd)
+	startAudit(cmd)
 }
 
 // setLoggingLevel sets the logging level depending on the application configuration.
@@ -283,7 +689,23 @@ func setupLogging() {
 	if log.GetLevel() == log.DebugLevel {
 		log.Debugf("os.Args: %v", os.Args)
 		log.Debugf("🐍 %s 👇", aurora.Bold(aurora.Green(fmt.Sprintf(" configuration "))))
-		viper.Debug()
+		logConfiguration()
 		log.Debugf("🐍 %s ☝️", aurora.Bold(aurora.Green(fmt.Sprintf(" configuration "))))
 	}
 }
+
+// logConfiguration logs all configuration settings at the debug level. Passwords, tokens, keys, and connection strings
+// are redacted since they may contain credentials.
+func logConfiguration() {
+	keys := viper.AllKeys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := fmt.Sprint(viper.Get(key))
+		if strings.HasSuffix(key, "password") || strings.HasSuffix(key, "token") || strings.HasSuffix(key, ".key") ||
+			strings.HasSuffix(key, "passphrase") || strings.HasSuffix(key, "identities") ||
+			strings.HasSuffix(key, "pgp-keys") || strings.HasSuffix(key, "signing-key") {
+			value = "xxxxx"
+		}
+		log.Debugf("%s: %s", key, gonymizer.RedactSecrets(value))
+	}
+}
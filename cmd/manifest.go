@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+
+	"github.com/rkuska/gonymizer"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// manifestSigningKey returns the key from manifest.signing-key used to sign manifests, or nil if it is not configured.
+func manifestSigningKey() (ed25519.PrivateKey, error) {
+	if len(viper.GetString("manifest.signing-key")) == 0 {
+		return nil, nil
+	}
+	key, err := gonymizer.ParseManifestSigningKey(viper.GetString("manifest.signing-key"))
+	if err != nil {
+		return nil, fmt.Errorf("manifest.signing-key: %s", err)
+	}
+	return key, nil
+}
+
+// manifestVerifyKeys returns the keys from manifest.verify-keys, and the public key of manifest.signing-key, that are
+// trusted to sign manifests.
+func manifestVerifyKeys() ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+
+	for _, value := range viper.GetStringSlice("manifest.verify-keys") {
+		value, err := gonymizer.ResolveSecret(value)
+		if err != nil {
+			return nil, fmt.Errorf("manifest.verify-keys: %s", err)
+		}
+		key, err := gonymizer.ParseManifestVerifyKey(value)
+		if err != nil {
+			return nil, fmt.Errorf("manifest.verify-keys: %s", err)
+		}
+		keys = append(keys, key)
+	}
+
+	signingKey, err := manifestSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	if signingKey != nil {
+		keys = append(keys, signingKey.Public().(ed25519.PublicKey))
+	}
+	return keys, nil
+}
+
+// writeManifest signs the manifest (if manifest.signing-key is configured) and writes it next to the supplied file.
+func writeManifest(urlStr string, manifest *gonymizer.Manifest) error {
+	key, err := manifestSigningKey()
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		if err = manifest.Sign(key); err != nil {
+			return err
+		}
+	} else {
+		log.Warn("No manifest.signing-key is configured. Writing an unsigned manifest")
+	}
+
+	log.Info("Writing manifest to: ", gonymizer.RedactSecrets(gonymizer.ManifestURL(urlStr)))
+	return gonymizer.WriteManifest(urlStr, manifest)
+}
+
+// loadOptions returns the options used to load files. Files are verified against their manifest while they are
+// loaded, and files without a manifest are refused when load.require-manifest is set.
+func loadOptions() (gonymizer.LoadOptions, error) {
+	keys, err := manifestVerifyKeys()
+	if err != nil {
+		return gonymizer.LoadOptions{}, err
+	}
+	return gonymizer.LoadOptions{
+		Manifest: gonymizer.ManifestOptions{
+			Require: viper.GetBool("load.require-manifest"),
+			Keys:    keys,
+		},
+	}, nil
+}
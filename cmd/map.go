@@ -122,6 +122,8 @@ func init() {
 	)
 	_ = viper.BindPFlag("map.username", MapCmd.Flags().Lookup("username"))
 
+	addConnectionFlags(MapCmd, "map")
+
 }
 
 // ClICommandMap is the initialization point for executing the Map process from the CLI and returns to the CLI on exit.
@@ -150,19 +152,7 @@ func cliCommandMap(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	if len(viper.GetString("map.password")) < 1 {
-		log.Debug("Password is empty. Asking user for password")
-		viper.SetDefault("map.password", GetPassword())
-	}
-
-	dbConf, _ := GetDb(
-		viper.GetString("map.host"),
-		viper.GetString("map.username"),
-		viper.GetString("map.password"),
-		viper.GetString("map.database"),
-		viper.GetInt32("map.port"),
-		viper.GetBool("map.disable-ssl"),
-	)
+	dbConf, _ := GetDb("map")
 	err = runMap(
 		dbConf,
 		viper.GetString("map.map-file"),
@@ -174,8 +164,10 @@ func cliCommandMap(cmd *cobra.Command, args []string) {
 	if err != nil {
 		log.Error(err)
 		log.Error("❌ Gonymizer did not exit properly. See above for errors ❌")
+		finishCommand(err)
 		os.Exit(1)
 	} else {
+		finishCommand(nil)
 		log.Info("🦄 ", aurora.Bold(aurora.Green("-- SUCCESS --")), " 🌈")
 	}
 }
@@ -204,7 +196,8 @@ func runMap(
 	}
 
 	log.Info("🚜 ", aurora.Bold(aurora.Green("Creating map file")), " 🚜")
-	skeleton, err = gonymizer.GenerateConfigSkeleton(
+	skeleton, err = gonymizer.GenerateConfigSkeletonContext(
+		commandContext,
 		conf,
 		schemaPrefix,
 		schema,
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/rkuska/gonymizer"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// configureProgress sets how the progress of processing dump files is reported. In auto mode a progress bar is drawn
+// when stderr is a terminal and the progress is logged otherwise.
+func configureProgress() {
+	name := viper.GetString("progress")
+	if name == "" || strings.ToLower(name) == "auto" {
+		name = "log"
+		if terminal.IsTerminal(int(os.Stderr.Fd())) && viper.GetString("log-format") != "json" {
+			name = "bar"
+		}
+	}
+
+	mode, err := gonymizer.ParseProgressMode(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gonymizer.SetProgress(mode, os.Stderr)
+}
+
+// startMetrics exposes the Prometheus metrics on metrics.listen-address (if configured) while the command runs.
+func startMetrics() {
+	addr := viper.GetString("metrics.listen-address")
+	if len(addr) == 0 {
+		return
+	}
+	if _, err := gonymizer.ServeMetrics(addr); err != nil {
+		log.Fatal("Unable to expose metrics: ", err)
+	}
+	log.Infof("Exposing metrics on: http://%s/metrics", addr)
+}
+
+// pushMetrics records the result of the command and pushes the metrics to metrics.pushgateway-url (if configured).
+// Errors pushing the metrics are logged since the command has already completed.
+func pushMetrics(err error) {
+	gonymizer.SetRunResult(err)
+
+	gatewayURL := viper.GetString("metrics.pushgateway-url")
+	if len(gatewayURL) == 0 {
+		return
+	}
+	log.Info("Pushing metrics to: ", gonymizer.RedactSecrets(gatewayURL))
+	if err := gonymizer.PushMetrics(gatewayURL, viper.GetString("metrics.job")); err != nil {
+		log.Error("Unable to push metrics: ", err)
+	}
+}
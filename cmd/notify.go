@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/rkuska/gonymizer"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// notifiers are the notifiers configured in the notifications section of the configuration.
+var notifiers []gonymizer.Notifier
+
+// startNotifications creates the notifiers configured in the notifications section of the configuration. The command
+// does not run if a notifier is configured incorrectly.
+func startNotifications() {
+	names := make([]string, 0)
+	for name := range viper.GetStringMap("notifications") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	notifiers = nil
+	for _, name := range names {
+		prefix := "notifications." + name + "."
+		notifier, err := gonymizer.NewNotifier(gonymizer.NotifierConfig{
+			Name:         name,
+			Type:         viper.GetString(prefix + "type"),
+			Triggers:     viper.GetStringSlice(prefix + "triggers"),
+			URL:          viper.GetString(prefix + "url"),
+			Headers:      viper.GetStringMapString(prefix + "headers"),
+			Channel:      viper.GetString(prefix + "channel"),
+			Username:     viper.GetString(prefix + "username"),
+			SMTPAddress:  viper.GetString(prefix + "smtp-address"),
+			SMTPUsername: viper.GetString(prefix + "smtp-username"),
+			SMTPPassword: viper.GetString(prefix + "smtp-password"),
+			From:         viper.GetString(prefix + "from"),
+			To:           viper.GetStringSlice(prefix + "to"),
+			Subject:      viper.GetString(prefix + "subject"),
+			Template:     viper.GetString(prefix + "template"),
+		})
+		if err != nil {
+			log.Fatalf("Invalid notifier %s: %v", name, err)
+		}
+		notifiers = append(notifiers, notifier)
+	}
+}
+
+// sendNotifications sends the outcome of the command, summarized from its run report (if any), to the notifiers whose
+// triggers match. Errors sending notifications are logged since the command has already completed.
+func sendNotifications(command string, report *gonymizer.RunReport, err error) {
+	if len(notifiers) == 0 {
+		return
+	}
+	sendNotification(gonymizer.NewNotification(command, report, err))
+}
+
+// notifyJob sends the outcome of a job of the api command to the notifiers whose triggers match.
+func notifyJob(job gonymizer.Job) {
+	if len(notifiers) == 0 {
+		return
+	}
+
+	notification := gonymizer.NewNotification(APICmd.Name()+" job "+job.ID, nil, jobError(job))
+	if !job.StartedAt.IsZero() {
+		notification.StartedAt = job.StartedAt
+		notification.CompletedAt = job.CompletedAt
+		notification.DurationSeconds = job.CompletedAt.Sub(job.StartedAt).Seconds()
+	}
+	sendNotification(notification)
+}
+
+// sendNotification sends the notification to the notifiers whose triggers match.
+func sendNotification(notification gonymizer.Notification) {
+	if err := gonymizer.SendNotifications(notifiers, notification); err != nil {
+		log.Error("Unable to send notifications: ", err)
+	}
+}
@@ -46,7 +46,7 @@ func init() {
 		&dumpFile,
 		"dump-file",
 		"",
-		"Filename and location of the PII-PostgreSQL dump file",
+		"Filename and location (local path or storage URL) of the PII-PostgreSQL dump file",
 	)
 	_ = viper.BindPFlag("process.dump-file", ProcessCmd.Flags().Lookup("dump-file"))
 
@@ -63,7 +63,7 @@ func init() {
 		&processedFile,
 		"processed-file",
 		"",
-		"Filename and location to store the non-PII processed PostgreSQL dump file",
+		"Filename and location (local path or storage URL) to store the non-PII processed PostgreSQL dump file",
 	)
 	_ = viper.BindPFlag("process.processed-file", ProcessCmd.Flags().Lookup("processed-file"))
 
@@ -83,10 +83,18 @@ func init() {
 	)
 	_ = viper.BindPFlag("process.post-process-file", ProcessCmd.Flags().Lookup("post-process-file"))
 
+	ProcessCmd.Flags().StringVar(
+		&rowCountFile,
+		"row-count-file",
+		"",
+		"CSV file (local path or storage URL) to store the exact row counts of the tables in the dump file to",
+	)
+	_ = viper.BindPFlag("process.row-count-file", ProcessCmd.Flags().Lookup("row-count-file"))
+
 }
 
 // ClICommandProcess is the initialization point for executing the Process command from the CLI and returns to the CLI
-// on exit. If there is an error this function will notify others using the slack URI supplied in the configuration.
+// on exit. The notifiers in the notifications section of the configuration are notified of the outcome.
 func cliCommandProcess(cmd *cobra.Command, args []string) {
 	var err error
 
@@ -98,6 +106,7 @@ func cliCommandProcess(cmd *cobra.Command, args []string) {
 		viper.GetString("process.dump-file"),
 		viper.GetString("process.map-file"),
 		viper.GetString("process.processed-file"),
+		viper.GetString("process.row-count-file"),
 		viper.GetString("process.pre-process-file"),
 		viper.GetString("process.post-process-file"),
 		viper.GetBool("process.generate-seed"),
@@ -105,26 +114,76 @@ func cliCommandProcess(cmd *cobra.Command, args []string) {
 	if err != nil {
 		log.Error(err)
 		log.Error("❌ Gonymizer did not exit properly. See above for errors ❌")
+		finishCommand(err)
 		os.Exit(1)
 	} else {
+		finishCommand(nil)
 		log.Info("🦄 ", aurora.Bold(aurora.Green("-- SUCCESS --")), " 🌈")
 	}
 }
 
-// process is the entry point for processing a dump file according to the map file.
-func process(dumpFile, mapFile, processedDumpFile, preProcess, postProcess string, generateSeed bool) (err error) {
+// process is the entry point for processing a dump file according to the map file. The row counts of the dump file
+// are written to the row count file (if any).
+func process(
+	dumpFile,
+	mapFile,
+	processedDumpFile,
+	rowCountFile,
+	preProcess,
+	postProcess string,
+	generateSeed bool,
+) (err error) {
 	log.Info("Loading map file from: ", mapFile)
-	columnMap, err := gonymizer.LoadConfigSkeleton(mapFile)
+	columnMap, mapManifest, err := gonymizer.LoadConfigSkeletonWithManifest(mapFile)
 	if err != nil {
 		return err
 	}
 
-	log.Info("Processing dump file: ", dumpFile)
-	err = gonymizer.ProcessDumpFile(columnMap, dumpFile, processedDumpFile, preProcess,
-		postProcess, generateSeed)
+	// The manifest of the dump file (if any) is checked after processing so the dump file is only read once
+	dumpManifest, dumpManifestSum, err := gonymizer.ReadManifest(dumpFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Dump files in remote storage are streamed directly from and to the storage backend
+	log.Info("Processing dump file: ", gonymizer.RedactSecrets(dumpFile))
+	manifest, err := gonymizer.ProcessDumpFileWithManifestContext(commandContext, columnMap, dumpFile,
+		processedDumpFile, preProcess, postProcess, generateSeed)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if dumpManifest != nil {
+		keys, err := manifestVerifyKeys()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err = dumpManifest.VerifySignature(keys); err != nil {
+				_ = gonymizer.DeleteURL(processedDumpFile)
+				return err
+			}
+		}
+		if dumpManifest.Output.SHA256 != manifest.Input.SHA256 {
+			_ = gonymizer.DeleteURL(processedDumpFile)
+			return fmt.Errorf("checksum of the dump file (%s) does not match its manifest (%s)",
+				manifest.Input.SHA256, dumpManifest.Output.SHA256)
+		}
+		manifest.InputManifest = dumpManifestSum
+		manifest.Source = dumpManifest.Source
+	} else {
+		log.Warn("No manifest was found for dump file: ", gonymizer.RedactSecrets(dumpFile))
+	}
+
+	// Rows are counted while the dump file is processed so the counts are exact
+	if len(rowCountFile) > 0 {
+		log.Info("Storing table row counts CSV to: ", gonymizer.RedactSecrets(rowCountFile))
+		if err = gonymizer.WriteRowCountFile(rowCountFile, manifest.RowCounts); err != nil {
+			return err
+		}
+	}
+
+	manifest.MapFile = &mapManifest
+
+	return writeManifest(processedDumpFile, manifest)
 }
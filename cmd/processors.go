@@ -0,0 +1,69 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rkuska/gonymizer"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// externalProcessorConfig is an external processor in the processors section of the configuration. Processors are
+// configured in a list since viper lowercases the keys of maps, and processor names are case sensitive.
+type externalProcessorConfig struct {
+	Name          string        `mapstructure:"name"`
+	Description   string        `mapstructure:"description"`
+	Command       string        `mapstructure:"command"`
+	Args          []string      `mapstructure:"args"`
+	Env           []string      `mapstructure:"env"`
+	BatchSize     int           `mapstructure:"batch-size"`
+	Timeout       time.Duration `mapstructure:"timeout"`
+	MaxRestarts   int           `mapstructure:"max-restarts"`
+	DataTypes     []string      `mapstructure:"data-types"`
+	ColumnNames   []string      `mapstructure:"column-names"`
+	Deterministic bool          `mapstructure:"deterministic"`
+	Consistent    bool          `mapstructure:"consistent"`
+}
+
+// externalProcessors are the processors configured in the processors section of the configuration.
+var externalProcessors []*gonymizer.ExternalProcessor
+
+// startExternalProcessors registers the external processors configured in the processors section of the
+// configuration so they can be used in map files. The command does not run if a processor is configured incorrectly.
+func startExternalProcessors() {
+	var configs []externalProcessorConfig
+	if err := viper.UnmarshalKey("processors", &configs); err != nil {
+		log.Fatal("Invalid processors: ", err)
+	}
+
+	for _, config := range configs {
+		processor, err := gonymizer.RegisterExternalProcessor(gonymizer.ExternalProcessorConfig{
+			Name:          config.Name,
+			Description:   config.Description,
+			Command:       config.Command,
+			Args:          config.Args,
+			Env:           config.Env,
+			BatchSize:     config.BatchSize,
+			Timeout:       config.Timeout,
+			MaxRestarts:   config.MaxRestarts,
+			DataTypes:     config.DataTypes,
+			ColumnNames:   config.ColumnNames,
+			Deterministic: config.Deterministic,
+			Consistent:    config.Consistent,
+		})
+		if err != nil {
+			log.Fatalf("Invalid processor %s: %v", config.Name, err)
+		}
+		externalProcessors = append(externalProcessors, processor)
+	}
+}
+
+// stopExternalProcessors stops the commands of the external processors. Errors are logged since the command has
+// already completed.
+func stopExternalProcessors() {
+	for _, processor := range externalProcessors {
+		if err := processor.Close(); err != nil {
+			log.Warnf("Processor %s did not exit cleanly: %v", processor.Info().Name, err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/logrusorgru/aurora"
+	"github.com/rkuska/gonymizer"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	quasiIdentifiers []string
+	sensitiveColumns []string
+	reportFile       string
+	reportFormat     string
+	reportK          int
+
+	// ReportCmd is the cobra.Command struct we use for the "report" command.
+	ReportCmd = &cobra.Command{
+		Use:   "report",
+		Short: "Report the k-anonymity of the processed file and compare its distributions with the dump file",
+		Run:   cliCommandReport,
+	}
+)
+
+// init initializes the Report command for the application and adds application flags and options.
+func init() {
+	ReportCmd.Flags().StringVar(
+		&dumpFile,
+		"dump-file",
+		"",
+		"Filename and location (local path or storage URL) of the PII-PostgreSQL dump file",
+	)
+	_ = viper.BindPFlag("report.dump-file", ReportCmd.Flags().Lookup("dump-file"))
+
+	ReportCmd.Flags().StringVar(
+		&processedFile,
+		"processed-file",
+		"",
+		"Filename and location (local path or storage URL) of the processed dump file",
+	)
+	_ = viper.BindPFlag("report.processed-file", ReportCmd.Flags().Lookup("processed-file"))
+
+	ReportCmd.Flags().StringSliceVar(
+		&quasiIdentifiers,
+		"quasi-identifier",
+		[]string{},
+		"Quasi-identifier column (schema.table.column) used to calculate k-anonymity. May be repeated",
+	)
+	_ = viper.BindPFlag("report.quasi-identifiers", ReportCmd.Flags().Lookup("quasi-identifier"))
+
+	ReportCmd.Flags().StringSliceVar(
+		&sensitiveColumns,
+		"sensitive-column",
+		[]string{},
+		"Sensitive column (schema.table.column) used to calculate l-diversity. May be repeated",
+	)
+	_ = viper.BindPFlag("report.sensitive-columns", ReportCmd.Flags().Lookup("sensitive-column"))
+
+	ReportCmd.Flags().IntVar(
+		&reportK,
+		"k",
+		5,
+		"Target k. Rows in equivalence classes smaller than k are reported",
+	)
+	_ = viper.BindPFlag("report.k", ReportCmd.Flags().Lookup("k"))
+
+	ReportCmd.Flags().StringVar(
+		&reportFile,
+		"report-file",
+		"",
+		"Filename and location (local path or storage URL) of the report. Defaults to stdout",
+	)
+	_ = viper.BindPFlag("report.report-file", ReportCmd.Flags().Lookup("report-file"))
+
+	ReportCmd.Flags().StringVar(
+		&reportFormat,
+		"format",
+		"",
+		"Report format, one of: json, html. Defaults to the extension of the report file, or json",
+	)
+	_ = viper.BindPFlag("report.format", ReportCmd.Flags().Lookup("format"))
+}
+
+// cliCommandReport is the initialization point for executing the Report process from the CLI.
+func cliCommandReport(cmd *cobra.Command, args []string) {
+	log.Info(aurora.Bold(aurora.Yellow(fmt.Sprint("Enabling log level: ",
+		strings.ToUpper(viper.GetString("log-level"))))))
+
+	log.Info("📊 ", aurora.Bold(aurora.Green("Creating anonymization quality report")), " 📊")
+	err := report(
+		viper.GetString("report.dump-file"),
+		viper.GetString("report.processed-file"),
+		viper.GetString("report.report-file"),
+		viper.GetString("report.format"),
+		gonymizer.QualityOptions{
+			QuasiIdentifiers: viper.GetStringSlice("report.quasi-identifiers"),
+			SensitiveColumns: viper.GetStringSlice("report.sensitive-columns"),
+			K:                viper.GetInt("report.k"),
+		},
+	)
+	if err != nil {
+		log.Error(err)
+		log.Error("❌ Gonymizer did not exit properly. See above for errors ❌")
+		finishCommand(err)
+		os.Exit(1)
+	} else {
+		finishCommand(nil)
+		log.Info("🦄 ", aurora.Bold(aurora.Green("-- SUCCESS --")), " 🌈")
+	}
+}
+
+// report creates the quality report of the processed file and writes it to the report file, or stdout.
+func report(dumpFile, processedFile, reportFile, format string, options gonymizer.QualityOptions) (err error) {
+	if len(dumpFile) == 0 || len(processedFile) == 0 {
+		return errors.New("--dump-file and --processed-file are required")
+	}
+
+	if format == "" {
+		format = "json"
+		if ext := strings.ToLower(filepath.Ext(reportFile)); ext == ".html" || ext == ".htm" {
+			format = "html"
+		}
+	}
+	if format != "json" && format != "html" {
+		return fmt.Errorf("unknown report format: %s", format)
+	}
+
+	quality, err := gonymizer.GenerateQualityReportContext(commandContext, dumpFile, processedFile, options)
+	if err != nil {
+		return err
+	}
+	for _, anonymity := range quality.Anonymity {
+		log.Infof("%s.%s is %d-anonymous (%d of %d rows are below k=%d)", anonymity.Schema, anonymity.Table,
+			anonymity.K, anonymity.RowsBelowTargetK, anonymity.Rows, anonymity.TargetK)
+	}
+
+	var writer io.Writer = os.Stdout
+	if reportFile != "" {
+		log.Info("Writing report to: ", gonymizer.RedactSecrets(reportFile))
+		out, err := gonymizer.CreateURL(reportFile)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		writer = out
+	}
+
+	if format == "html" {
+		return quality.WriteHTML(writer)
+	}
+	return quality.WriteJSON(writer)
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/logrusorgru/aurora"
+	"github.com/rkuska/gonymizer"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Stages of the run pipeline in the order they are executed
+const (
+	stageDump    = "dump"
+	stageProcess = "process"
+	stageUpload  = "upload"
+	stageLoad    = "load"
+)
+
+// runStages are all stages of the run pipeline in the order they are executed.
+var runStages = []string{stageDump, stageProcess, stageUpload, stageLoad}
+
+var (
+	runKeepDump   bool
+	runResume     bool
+	runRetries    int
+	runRetryDelay time.Duration
+	runStageList  []string
+	runStageRetry []string
+	runStateFile  string
+	runWorkDir    string
+
+	// RunCmd is the cobra.Command struct we use for the "run" command.
+	RunCmd = &cobra.Command{
+		Use:   "run",
+		Short: "Run the dump, process, upload, and load stages (or any subset) as a single pipeline",
+		Run:   cliCommandRun,
+	}
+)
+
+// runOptions configures a run of the pipeline. The settings of each stage are read from the dump, process, upload, and
+// load sections of the configuration.
+type runOptions struct {
+	Stages       []string
+	WorkDir      string
+	StateFile    string
+	Resume       bool
+	KeepDump     bool
+	Retries      map[string]int
+	RetryDelay   time.Duration
+	DumpConf     gonymizer.PGConfig
+	LoadConf     gonymizer.PGConfig
+	loadToSQLite bool
+}
+
+// runState is the progress of a run that is stored in the state file so a failed run can be resumed from the last
+// successful stage.
+type runState struct {
+	Stages map[string]runStageState `json:"stages"`
+}
+
+// runStageState is the result of a completed stage.
+type runStageState struct {
+	Output      string    `json:"output,omitempty"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// init initializes the Run command for the application and adds application flags and options.
+func init() {
+	RunCmd.Flags().StringSliceVar(
+		&runStageList,
+		"stages",
+		runStages,
+		"Stages to run in order, any subset of: dump, process, upload, load",
+	)
+	_ = viper.BindPFlag("run.stages", RunCmd.Flags().Lookup("stages"))
+
+	RunCmd.Flags().StringVar(
+		&runWorkDir,
+		"work-dir",
+		filepath.Join(os.TempDir(), "gonymizer-run"),
+		"Directory the intermediate dump files are stored in. Intermediate files are removed when the run completes",
+	)
+	_ = viper.BindPFlag("run.work-dir", RunCmd.Flags().Lookup("work-dir"))
+
+	RunCmd.Flags().StringVar(
+		&runStateFile,
+		"state-file",
+		"",
+		"File the progress of the run is stored in for --resume. Defaults to state.json in the work directory",
+	)
+	_ = viper.BindPFlag("run.state-file", RunCmd.Flags().Lookup("state-file"))
+
+	RunCmd.Flags().BoolVar(
+		&runResume,
+		"resume",
+		false,
+		"Resume a failed run from the last successful stage",
+	)
+	_ = viper.BindPFlag("run.resume", RunCmd.Flags().Lookup("resume"))
+
+	RunCmd.Flags().IntVar(
+		&runRetries,
+		"retries",
+		0,
+		"Number of times a failed stage is retried",
+	)
+	_ = viper.BindPFlag("run.retries", RunCmd.Flags().Lookup("retries"))
+
+	RunCmd.Flags().StringSliceVar(
+		&runStageRetry,
+		"stage-retries",
+		[]string{},
+		"Number of times a failed stage is retried per stage, overriding --retries (I.E. upload=5)",
+	)
+	_ = viper.BindPFlag("run.stage-retries", RunCmd.Flags().Lookup("stage-retries"))
+
+	RunCmd.Flags().DurationVar(
+		&runRetryDelay,
+		"retry-delay",
+		30*time.Second,
+		"Time to wait before retrying a failed stage",
+	)
+	_ = viper.BindPFlag("run.retry-delay", RunCmd.Flags().Lookup("retry-delay"))
+
+	RunCmd.Flags().BoolVar(
+		&runKeepDump,
+		"keep-dump-on-failure",
+		false,
+		"Keep the intermediate (PII) dump file when a later stage fails so --resume does not dump the database again",
+	)
+	_ = viper.BindPFlag("run.keep-dump-on-failure", RunCmd.Flags().Lookup("keep-dump-on-failure"))
+}
+
+// cliCommandRun is the initialization point for executing the run pipeline from the CLI.
+func cliCommandRun(cmd *cobra.Command, args []string) {
+	log.Info(aurora.Bold(aurora.Yellow(fmt.Sprint("Enabling log level: ",
+		strings.ToUpper(viper.GetString("log-level"))))))
+
+	options, err := newRunOptions()
+	if err == nil {
+		err = runPipeline(options)
+	}
+	if err != nil {
+		log.Error(err)
+		log.Error("❌ Gonymizer did not exit properly. See above for errors ❌")
+		finishCommand(err)
+		os.Exit(1)
+	} else {
+		finishCommand(nil)
+		log.Info("🦄 ", aurora.Bold(aurora.Green("-- SUCCESS --")), " 🌈")
+	}
+}
+
+// newRunOptions returns the runOptions from the configuration. The databases are connected to before any stage runs
+// so connection problems are found before the database is dumped.
+func newRunOptions() (options runOptions, err error) {
+	options = runOptions{
+		Stages:     viper.GetStringSlice("run.stages"),
+		WorkDir:    viper.GetString("run.work-dir"),
+		StateFile:  viper.GetString("run.state-file"),
+		Resume:     viper.GetBool("run.resume"),
+		KeepDump:   viper.GetBool("run.keep-dump-on-failure"),
+		Retries:    map[string]int{},
+		RetryDelay: viper.GetDuration("run.retry-delay"),
+	}
+	if err = validateRunStages(options.Stages); err != nil {
+		return options, err
+	}
+
+	for _, stage := range options.Stages {
+		options.Retries[stage] = viper.GetInt("run.retries")
+	}
+	for _, value := range viper.GetStringSlice("run.stage-retries") {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || !isRunStage(parts[0]) {
+			return options, fmt.Errorf("invalid stage retries '%s', must be stage=retries (I.E. upload=5)", value)
+		}
+		if options.Retries[parts[0]], err = strconv.Atoi(parts[1]); err != nil {
+			return options, fmt.Errorf("invalid stage retries '%s': %v", value, err)
+		}
+	}
+
+	if hasRunStage(options.Stages, stageDump) {
+		if len(viper.GetString("dump.schema-prefix")) > 0 && len(viper.GetStringSlice("dump.schema")) < 1 {
+			return options, errors.New("if a using --schema-prefix=schema_name_ you must add " +
+				"--schema=schema_name as well")
+		}
+		if options.DumpConf, err = checkDb(commandContext, "dump"); err != nil {
+			return options, err
+		}
+	}
+	if hasRunStage(options.Stages, stageLoad) {
+		if options.loadToSQLite = len(viper.GetString("load.sqlite-file")) > 0; !options.loadToSQLite {
+			if options.LoadConf, err = checkDb(commandContext, "load"); err != nil {
+				return options, err
+			}
+		}
+	}
+	return options, nil
+}
+
+// runPipeline runs the configured stages in order passing the output of each stage to the next. Intermediate files are
+// removed when the run completes. When the run fails the intermediate dump file (which contains PII) is removed unless
+// KeepDump is set, and the state of the run is kept so it can be resumed.
+func runPipeline(options runOptions) (err error) {
+	if err = validateRunStages(options.Stages); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(options.WorkDir, 0700); err != nil {
+		return err
+	}
+
+	// Runs using the same work directory would overwrite each others intermediate files
+	unlock, err := gonymizer.AcquireLock(filepath.Join(options.WorkDir, "gonymizer.lock"))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := unlock(); unlockErr != nil {
+			log.Warn("Unable to release the lock: ", unlockErr)
+		}
+	}()
+	if len(options.StateFile) == 0 {
+		options.StateFile = filepath.Join(options.WorkDir, "state.json")
+	}
+
+	state := &runState{Stages: map[string]runStageState{}}
+	if options.Resume {
+		if state, err = readRunState(options.StateFile); err != nil {
+			return err
+		}
+	}
+
+	dumpFile := filepath.Join(options.WorkDir, "dump.sql")
+	processedFile := filepath.Join(options.WorkDir, "processed.sql")
+	defer func() {
+		if err == nil {
+			log.Info("Removing intermediate files from: ", options.WorkDir)
+			err = removeRunFiles(dumpFile, processedFile, options.StateFile)
+			return
+		}
+
+		// The dump (which contains PII) is removed wherever it was written to, including remote storage
+		var remove []string
+		if !options.KeepDump {
+			remove = append(remove, dumpFile)
+			if completed, ok := state.Stages[stageDump]; ok && completed.Output != dumpFile {
+				remove = append(remove, completed.Output)
+			}
+		}
+		if _, ok := state.Stages[stageProcess]; !ok {
+			remove = append(remove, processedFile)
+		}
+		if removeErr := removeRunFiles(remove...); removeErr != nil {
+			log.Error(removeErr)
+		}
+		if writeErr := writeRunState(options.StateFile, state); writeErr != nil {
+			log.Error("Unable to write the state of the run: ", writeErr)
+		} else {
+			log.Info("Resume the run from the last successful stage using --resume")
+		}
+	}()
+
+	// Resume after the last completed stage whose output still exists
+	var artifact string
+	start := 0
+	for i, stage := range options.Stages {
+		if completed, ok := state.Stages[stage]; ok && runOutputExists(completed.Output) {
+			start = i + 1
+			artifact = completed.Output
+		}
+	}
+	for _, stage := range options.Stages[:start] {
+		log.Infof("Skipping stage '%s' completed at %s", stage, state.Stages[stage].CompletedAt)
+	}
+
+	for i := start; i < len(options.Stages); i++ {
+		if err = commandContext.Err(); err != nil {
+			return err
+		}
+		stage := options.Stages[i]
+		final := i == len(options.Stages)-1
+
+		var output string
+		switch stage {
+		case stageDump:
+			output = dumpFile
+			if final {
+				output = viper.GetString("dump.dump-file")
+			}
+		case stageProcess:
+			if i == 0 {
+				artifact = viper.GetString("process.dump-file")
+			}
+			output = processedFile
+			if final {
+				output = viper.GetString("process.processed-file")
+			}
+		case stageUpload:
+			if i == 0 {
+				artifact = viper.GetString("upload.local-file")
+			}
+			output = viper.GetString("upload.s3-file")
+		case stageLoad:
+			if i == 0 {
+				artifact = loadFileURL(viper.GetString("load.load-file"), viper.GetString("load.s3-file-path"))
+			}
+		}
+
+		input := artifact
+		err = retryStage(stage, options.Retries[stage], options.RetryDelay, func() error {
+			return runStage(options, stage, input, output)
+		})
+		if err != nil {
+			return fmt.Errorf("stage '%s' failed: %v", stage, err)
+		}
+
+		state.Stages[stage] = runStageState{Output: output, CompletedAt: time.Now().UTC()}
+		if err = writeRunState(options.StateFile, state); err != nil {
+			return err
+		}
+		artifact = output
+	}
+	return nil
+}
+
+// runStage runs a single stage of the pipeline reading the input and writing the output.
+func runStage(options runOptions, stage, input, output string) error {
+	switch stage {
+	case stageDump:
+		log.Info("🚜 ", aurora.Bold(aurora.Green("Creating dump file")), " 🚜")
+		return dump(
+			options.DumpConf,
+			gonymizer.NewManifest("dump"),
+			output,
+			viper.GetString("dump.row-count-file"),
+			viper.GetString("dump.schema-prefix"),
+			viper.GetStringSlice("dump.exclude-table"),
+			viper.GetStringSlice("dump.exclude-table-data"),
+			viper.GetStringSlice("dump.exclude-schema"),
+			viper.GetStringSlice("dump.schema"),
+		)
+	case stageProcess:
+		log.Info("🚜 ", aurora.Bold(aurora.Green("Processing dump file")), " 🚜")
+		return process(
+			input,
+			viper.GetString("process.map-file"),
+			output,
+			viper.GetString("process.row-count-file"),
+			viper.GetString("process.pre-process-file"),
+			viper.GetString("process.post-process-file"),
+			viper.GetBool("process.generate-seed"),
+		)
+	case stageUpload:
+		if err := upload(input, output); err != nil {
+			return err
+		}
+		// The manifest is uploaded as well so the load stage can verify the uploaded file
+		if _, err := gonymizer.StatURL(gonymizer.ManifestURL(input)); err == nil {
+			return gonymizer.CopyURLContext(commandContext, gonymizer.ManifestURL(output),
+				gonymizer.ManifestURL(input))
+		}
+		return nil
+	case stageLoad:
+		if options.loadToSQLite {
+			log.Info("🚜 ", aurora.Bold(aurora.Green("Loading the anonymized database into SQLite")), " 🚜")
+			return loadSQLite(viper.GetString("load.sqlite-file"), input, "")
+		}
+		log.Info("🚜 ", aurora.Bold(aurora.Green("Loading the anonymized database")), " 🚜")
+		rowCountFile := viper.GetString("load.row-count-file")
+		if len(rowCountFile) == 0 && hasRunStage(options.Stages, stageProcess) {
+			rowCountFile = viper.GetString("process.row-count-file")
+		}
+		return load(options.LoadConf, input, "", rowCountFile)
+	}
+	return fmt.Errorf("unknown stage '%s'", stage)
+}
+
+// retryStage calls fn until it succeeds or the stage was retried the supplied number of times. Interrupted stages are
+// not retried.
+func retryStage(stage string, retries int, delay time.Duration, fn func() error) (err error) {
+	for attempt := 0; ; attempt++ {
+		if err = fn(); err == nil || attempt >= retries || commandContext.Err() != nil {
+			return err
+		}
+		log.Warnf("Stage '%s' failed (attempt %d of %d): %v. Retrying in %s", stage, attempt+1, retries+1, err,
+			delay)
+		select {
+		case <-time.After(delay):
+		case <-commandContext.Done():
+			return commandContext.Err()
+		}
+	}
+}
+
+// validateRunStages returns an error if the stages are unknown, repeated, or not in pipeline order.
+func validateRunStages(stages []string) error {
+	if len(stages) == 0 {
+		return errors.New("no stages to run")
+	}
+	last := -1
+	for _, stage := range stages {
+		index := runStageIndex(stage)
+		if index < 0 {
+			return fmt.Errorf("unknown stage '%s', must be one of: %s", stage, strings.Join(runStages, ", "))
+		}
+		if index <= last {
+			return fmt.Errorf("stages must be in order (%s) and may not be repeated", strings.Join(runStages, ", "))
+		}
+		last = index
+	}
+	return nil
+}
+
+// runStageIndex returns the position of the stage in the pipeline, or -1 for unknown stages.
+func runStageIndex(stage string) int {
+	for i, name := range runStages {
+		if name == stage {
+			return i
+		}
+	}
+	return -1
+}
+
+// isRunStage returns true if the stage is a stage of the pipeline.
+func isRunStage(stage string) bool {
+	return runStageIndex(stage) >= 0
+}
+
+// hasRunStage returns true if the stage is one of the stages.
+func hasRunStage(stages []string, stage string) bool {
+	for _, name := range stages {
+		if name == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// runOutputExists returns true if the output of a completed stage can still be used. Stages without an output (load)
+// always exist.
+func runOutputExists(output string) bool {
+	if len(output) == 0 {
+		return true
+	}
+	_, err := gonymizer.StatURL(output)
+	return err == nil
+}
+
+// readRunState reads the state of a previous run. An empty state is returned if there was no previous run.
+func readRunState(path string) (*runState, error) {
+	state := &runState{Stages: map[string]runStageState{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Warn("No previous run was found to resume in: ", path)
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("unable to read the state of the previous run from %s: %v", path, err)
+	}
+	if state.Stages == nil {
+		state.Stages = map[string]runStageState{}
+	}
+	return state, nil
+}
+
+// writeRunState writes the state of the run.
+func writeRunState(path string, state *runState) error {
+	data, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// removeRunFiles removes files of the run and their manifests using the matching storage backend, so files in remote
+// storage are removed as well. Files that do not exist are ignored. All files are removed even if removing one of them
+// fails, and an error listing the files that could not be removed is returned.
+func removeRunFiles(urls ...string) error {
+	var failed []string
+	for _, urlStr := range urls {
+		for _, name := range []string{urlStr, gonymizer.ManifestURL(urlStr)} {
+			if err := gonymizer.DeleteURL(name); err != nil && !os.IsNotExist(err) {
+				log.Warn("Unable to remove file of the run: ", gonymizer.RedactSecrets(err.Error()))
+				failed = append(failed, gonymizer.RedactSecrets(name))
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to remove files of the run: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/rkuska/gonymizer"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// startRunReport starts the run report of the command when run-report-file or notifications are configured. Results
+// are added to the report by the gonymizer package while the command runs.
+func startRunReport(cmd *cobra.Command) {
+	if len(viper.GetString("run-report-file")) == 0 && len(notifiers) == 0 {
+		return
+	}
+	// Scheduled runs have their own run reports. API jobs are recorded in the audit log instead
+	if cmd == VersionCmd || cmd == ServeCmd || cmd == APICmd {
+		return
+	}
+	gonymizer.SetRunReport(gonymizer.NewRunReport(cmd.Name()))
+}
+
+// finishRunReport sets the final status of the run report, writes it to run-report-file (if configured), and returns
+// it. Errors writing the report are logged since the command has already completed.
+func finishRunReport(err error) *gonymizer.RunReport {
+	report := gonymizer.GetRunReport()
+	if report == nil {
+		return nil
+	}
+	report.Finish(err)
+	gonymizer.SetRunReport(nil)
+	if len(viper.GetString("run-report-file")) == 0 {
+		return report
+	}
+
+	log.Info("Writing run report to: ", gonymizer.RedactSecrets(viper.GetString("run-report-file")))
+	if err := gonymizer.WriteRunReport(viper.GetString("run-report-file"), report); err != nil {
+		log.Error("Unable to write run report: ", err)
+	}
+	return report
+}
+
+// finishCommand stops the external processors, writes the run report, sends the notifications, pushes the metrics,
+// flushes the spans, and appends the audit log entry of the command. It must be called before the command exits.
+func finishCommand(err error) {
+	stopExternalProcessors()
+	report := finishRunReport(err)
+	if report != nil {
+		sendNotifications(report.Command, report, err)
+	}
+	pushMetrics(err)
+	finishTracing(err)
+	finishAudit(err)
+}
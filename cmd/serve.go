@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/logrusorgru/aurora"
+	"github.com/rkuska/gonymizer"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	serveHistoryFile   string
+	serveHistorySize   int
+	serveListenAddress string
+	serveSchedule      string
+
+	// ServeCmd is the cobra.Command struct we use for the "serve" command.
+	ServeCmd = &cobra.Command{
+		Use:   "serve",
+		Short: "Run the pipeline on a schedule and expose the status of recent runs over HTTP",
+	}
+)
+
+// init initializes the Serve command for the application and adds application flags and options.
+func init() {
+	// Run is set here since scheduled runs refer to ServeCmd, which would be an initialization cycle
+	ServeCmd.Run = cliCommandServe
+
+	ServeCmd.Flags().StringVar(
+		&serveSchedule,
+		"schedule",
+		"",
+		"Cron expression the pipeline is run on (I.E. \"0 2 * * *\" or @daily)",
+	)
+	_ = viper.BindPFlag("serve.schedule", ServeCmd.Flags().Lookup("schedule"))
+
+	ServeCmd.Flags().StringVar(
+		&serveListenAddress,
+		"listen-address",
+		"localhost:8080",
+		"Address the status of recent runs is served on (/status and /healthz)",
+	)
+	_ = viper.BindPFlag("serve.listen-address", ServeCmd.Flags().Lookup("listen-address"))
+
+	ServeCmd.Flags().IntVar(
+		&serveHistorySize,
+		"history-size",
+		20,
+		"Number of recent runs kept in the history",
+	)
+	_ = viper.BindPFlag("serve.history-size", ServeCmd.Flags().Lookup("history-size"))
+
+	ServeCmd.Flags().StringVar(
+		&serveHistoryFile,
+		"history-file",
+		"",
+		"File the history of recent runs is stored in so it is kept across restarts",
+	)
+	_ = viper.BindPFlag("serve.history-file", ServeCmd.Flags().Lookup("history-file"))
+}
+
+// cliCommandServe is the initialization point for running the pipeline on a schedule from the CLI. It runs until it
+// receives SIGINT or SIGTERM, and waits for the run in progress (if any) to complete before exiting.
+func cliCommandServe(cmd *cobra.Command, args []string) {
+	log.Info(aurora.Bold(aurora.Yellow(fmt.Sprint("Enabling log level: ",
+		strings.ToUpper(viper.GetString("log-level"))))))
+
+	err := serve(
+		viper.GetString("serve.schedule"),
+		viper.GetString("serve.listen-address"),
+		viper.GetInt("serve.history-size"),
+		viper.GetString("serve.history-file"),
+	)
+	if err != nil {
+		log.Error(err)
+		log.Error("❌ Gonymizer did not exit properly. See above for errors ❌")
+		finishCommand(err)
+		os.Exit(1)
+	} else {
+		finishCommand(nil)
+		log.Info("🦄 ", aurora.Bold(aurora.Green("-- SUCCESS --")), " 🌈")
+	}
+}
+
+// serve runs the pipeline on the schedule and serves the status of recent runs until the process is stopped.
+func serve(schedule, listenAddress string, historySize int, historyFile string) error {
+	if len(schedule) == 0 {
+		return errors.New("--schedule is required")
+	}
+
+	scheduler, err := gonymizer.NewScheduler(schedule, scheduledRun, gonymizer.SchedulerOptions{
+		HistorySize: historySize,
+		HistoryFile: historyFile,
+	})
+	if err != nil {
+		return fmt.Errorf("invalid schedule '%s': %v", schedule, err)
+	}
+
+	server := &http.Server{Addr: listenAddress, Handler: scheduler.Handler()}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("Unable to serve the status of runs: ", err)
+		}
+	}()
+	log.Infof("Serving the status of runs on: http://%s/status", listenAddress)
+
+	// The first signal stops scheduling runs, the second one cancels the run in progress
+	stop := make(chan struct{})
+	cancel := newCommandContext()
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Infof("Received %s. Stopping after the run in progress (if any) completes, send it again to cancel the run",
+			sig)
+		close(stop)
+		sig = <-signals
+		signal.Stop(signals)
+		log.Warnf("Received %s. Cancelling the run in progress", sig)
+		cancel()
+	}()
+
+	log.Info("⏰ ", aurora.Bold(aurora.Green("Running the pipeline on schedule: "+schedule)), " ⏰")
+	scheduler.Run(stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
+
+// scheduledRun runs the pipeline using the run section of the configuration. Every run has its own run report,
+// notifications, audit log entry, trace, and pushed metrics. Errors are returned, and recorded in the history of runs,
+// instead of exiting so one failed run never stops the schedule.
+func scheduledRun() error {
+	startRunReport(RunCmd)
+	// Runs never overlap, so the span of the run is carried by the command context while it runs
+	runContext := commandContext
+	var endSpan func(error)
+	commandContext, endSpan = gonymizer.StartSpan(runContext, "gonymizer "+RunCmd.Name())
+	defer func() { commandContext = runContext }()
+
+	err := beginAudit(RunCmd)
+	if err == nil {
+		var options runOptions
+		if options, err = newRunOptions(); err == nil {
+			err = runPipeline(options)
+		}
+	}
+	if err != nil {
+		log.Error(err)
+	}
+
+	endSpan(err)
+	sendNotifications(RunCmd.Name(), finishRunReport(err), err)
+	pushMetrics(err)
+	if auditErr := endAudit(err); auditErr != nil {
+		log.Error(auditErr)
+		if err == nil {
+			err = auditErr
+		}
+	}
+	return err
+}
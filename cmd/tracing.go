@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/rkuska/gonymizer"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	// endRootSpan ends the span of the running command.
+	endRootSpan = func(error) {}
+	// stopTracing flushes the spans of the running command.
+	stopTracing = func() error { return nil }
+)
+
+// commandLogHook is a logrus hook that adds the command context to log lines that do not have a context, so the log
+// lines include the trace and span ID of the command.
+type commandLogHook struct{}
+
+// startTracing exports the spans of the command using tracing.exporter (if configured). All spans of the command are
+// children of a span named after the command, which is carried by commandContext. Scheduled runs have their own
+// traces, and every API job has its own trace since the api command runs until it is stopped.
+func startTracing(cmd *cobra.Command) {
+	// The hook must run before the hook of gonymizer.StartTracing that reads the context
+	log.AddHook(commandLogHook{})
+	stop, err := gonymizer.StartTracing(gonymizer.TracingConfig{
+		Exporter:    viper.GetString("tracing.exporter"),
+		Endpoint:    viper.GetString("tracing.endpoint"),
+		Insecure:    viper.GetBool("tracing.insecure"),
+		File:        viper.GetString("tracing.file"),
+		ServiceName: "gonymizer",
+	})
+	if err != nil {
+		log.Fatal("Unable to start tracing: ", err)
+	}
+	stopTracing = stop
+	if cmd != ServeCmd && cmd != APICmd {
+		commandContext, endRootSpan = gonymizer.StartSpan(commandContext, "gonymizer "+cmd.Name())
+	}
+}
+
+// finishTracing ends the span of the command and flushes all spans to the exporter. Errors exporting the spans are
+// logged since the command has already completed.
+func finishTracing(err error) {
+	endRootSpan(err)
+	if err := stopTracing(); err != nil {
+		log.Error("Unable to export spans: ", err)
+	}
+}
+
+// Levels will return the log levels the hook is fired for.
+func (commandLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire will set the context of the log entry to commandContext if it does not have one.
+func (commandLogHook) Fire(entry *log.Entry) error {
+	if entry.Context == nil {
+		entry.Context = commandContext
+	}
+	return nil
+}
@@ -1,12 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/logrusorgru/aurora"
@@ -19,7 +18,7 @@ import (
 var (
 	UploadCmd = &cobra.Command{
 		Use:   "upload",
-		Short: "Upload will transfer a file to the given s3 path",
+		Short: "Upload will transfer a file to the given storage URL (S3, GCS, Azure Blob, or SFTP)",
 		Run:   cliCommandUpload,
 	}
 )
@@ -30,7 +29,8 @@ func init() {
 		&s3File,
 		"s3-file",
 		"",
-		"S3 URL to upload processed file to: s3://bucket-name.us-west-2.s3.amazonaws.com/path/to/file.sql",
+		"Storage URL to upload processed file to: s3://bucket-name/path/to/file.sql, "+
+			"gs://bucket/path/to/file.sql, azblob://container/path/to/file.sql, or sftp://user@host/path/to/file.sql",
 	)
 	_ = viper.BindPFlag("upload.s3-file", UploadCmd.Flags().Lookup("s3-file"))
 
@@ -49,46 +49,28 @@ func cliCommandUpload(cmd *cobra.Command, args []string) {
 	log.Info(aurora.Bold(aurora.Yellow(fmt.Sprint("Enabling log level: ",
 		strings.ToUpper(viper.GetString("log-level"))))))
 	if err := upload(viper.GetString("upload.local-file"), viper.GetString("upload.s3-file")); err != nil {
+		log.Error(err)
 		log.Error("❌ Gonymizer did not exit properly. See above for errors ❌")
+		finishCommand(err)
 		os.Exit(1)
 	} else {
+		finishCommand(nil)
 		log.Info("🦄 ", aurora.Bold(aurora.Green("-- SUCCESS --")), " 🌈")
 	}
 }
 
+// upload will copy the local file to the supplied storage URL (s3://, gs://, azblob://, sftp://).
 func upload(localFile, urlStr string) (err error) {
-	var s3file gonymizer.S3File
-
-	log.Debug("s3 path: ", urlStr)
-	if err = s3file.ParseS3Url(urlStr); err != nil {
-		log.Error(err)
+	if len(urlStr) == 0 {
+		return errors.New("No destination URL was supplied (see --s3-file)")
 	}
-	log.Debugf("S3 URL: %s\tScheme: %s\tBucket: %s\tRegion: %s\tFile Path: %s",
-		s3file.URL,
-		s3file.Scheme,
-		s3file.Bucket,
-		s3file.Region,
-		s3file.FilePath,
-	)
-
-	// Upload the processed file to S3 (iff the user selected this option and it is valid)
-	log.Info("S3 scheme: ", s3file.Scheme)
-	switch s3file.Scheme {
-	case "s3":
-		log.Infof("🚛 Uploading %s => %s", localFile, s3file.URL)
-		sess, err := session.NewSession(&aws.Config{Region: aws.String(s3file.Region)})
-		if err != nil {
-			return err
-		}
 
-		if err = gonymizer.AddFileToS3(sess, localFile, &s3file); err != nil {
-			log.Errorf("Unable to upload %s => %s", localFile, s3file.URL)
-			return err
-		}
+	ctx, stopStep := gonymizer.StartStep(commandContext, "upload")
+	defer stopStep()
 
-		//TODO: Add other cloud service providers here
-	default:
-		log.Error("Unrecognized transfer protocol: ", s3file.Scheme)
+	log.Infof("🚛 Uploading %s => %s", localFile, gonymizer.RedactSecrets(urlStr))
+	if err = gonymizer.CopyURLContext(ctx, urlStr, localFile); err != nil {
+		log.Errorf("Unable to upload %s => %s", localFile, gonymizer.RedactSecrets(urlStr))
 	}
 	return err
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/logrusorgru/aurora"
+	"github.com/rkuska/gonymizer"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	leakMinLength   int
+	leakMaxMemoryMB int
+
+	// VerifyCmd is the cobra.Command struct we use for the "verify" command.
+	VerifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Verify that no PHI/PII from the dump file survived in the processed file",
+		Run:   cliCommandVerify,
+	}
+)
+
+// init initializes the Verify command for the application and adds application flags and options.
+func init() {
+	VerifyCmd.Flags().StringVar(
+		&dumpFile,
+		"dump-file",
+		"",
+		"Filename and location (local path or storage URL) of the PII-PostgreSQL dump file",
+	)
+	_ = viper.BindPFlag("verify.dump-file", VerifyCmd.Flags().Lookup("dump-file"))
+
+	VerifyCmd.Flags().StringVar(
+		&processedFile,
+		"processed-file",
+		"",
+		"Filename and location (local path or storage URL) of the processed dump file",
+	)
+	_ = viper.BindPFlag("verify.processed-file", VerifyCmd.Flags().Lookup("processed-file"))
+
+	VerifyCmd.Flags().StringVar(
+		&mapFile,
+		"map-file",
+		"",
+		"Map file location",
+	)
+	_ = viper.BindPFlag("verify.map-file", VerifyCmd.Flags().Lookup("map-file"))
+
+	VerifyCmd.Flags().IntVar(
+		&leakMinLength,
+		"min-length",
+		4,
+		"Minimum length of values to check. Shorter values are likely to be generated by the processors as well",
+	)
+	_ = viper.BindPFlag("verify.min-length", VerifyCmd.Flags().Lookup("min-length"))
+
+	VerifyCmd.Flags().IntVar(
+		&leakMaxMemoryMB,
+		"max-memory-mb",
+		256,
+		"Memory used to store the original values. More memory lowers the chance of false positives",
+	)
+	_ = viper.BindPFlag("verify.max-memory-mb", VerifyCmd.Flags().Lookup("max-memory-mb"))
+}
+
+// cliCommandVerify is the initialization point for executing the Verify process from the CLI. It exits with a
+// non-zero exit code when leaks are found.
+func cliCommandVerify(cmd *cobra.Command, args []string) {
+	log.Info(aurora.Bold(aurora.Yellow(fmt.Sprint("Enabling log level: ",
+		strings.ToUpper(viper.GetString("log-level"))))))
+
+	log.Info("🔎 ", aurora.Bold(aurora.Green("Scanning processed file for PHI/PII")), " 🔎")
+	err := verify(
+		viper.GetString("verify.dump-file"),
+		viper.GetString("verify.processed-file"),
+		viper.GetString("verify.map-file"),
+		viper.GetInt("verify.min-length"),
+		viper.GetInt("verify.max-memory-mb"),
+	)
+	if err != nil {
+		log.Error(err)
+		log.Error("❌ Gonymizer did not exit properly. See above for errors ❌")
+		finishCommand(err)
+		os.Exit(1)
+	} else {
+		finishCommand(nil)
+		log.Info("🦄 ", aurora.Bold(aurora.Green("-- SUCCESS --")), " 🌈")
+	}
+}
+
+// verify scans the processed file for values from the dump file and PII in columns that were not anonymized.
+func verify(dumpFile, processedFile, mapFile string, minLength, maxMemoryMB int) error {
+	if len(dumpFile) == 0 || len(processedFile) == 0 || len(mapFile) == 0 {
+		return errors.New("--dump-file, --processed-file, and --map-file are required")
+	}
+
+	log.Info("Loading map file from: ", mapFile)
+	columnMap, err := gonymizer.LoadConfigSkeleton(mapFile)
+	if err != nil {
+		return err
+	}
+
+	options := gonymizer.LeakScanOptions{
+		MinLength:   minLength,
+		MaxMemoryMB: maxMemoryMB,
+	}
+	report, err := gonymizer.ScanForLeaksContext(commandContext, columnMap, dumpFile, processedFile, options)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Checked %d original values (false positive rate: %.2g)", report.IndexedValues,
+		report.FalsePositiveRate)
+	if !report.HasLeaks() {
+		log.Info("No PHI/PII was found in: ", gonymizer.RedactSecrets(processedFile))
+		return nil
+	}
+
+	for _, leak := range report.Leaks {
+		log.Error(leak)
+	}
+	return fmt.Errorf("found %d leaks in: %s", len(report.Leaks), gonymizer.RedactSecrets(processedFile))
+}
@@ -0,0 +1,61 @@
+package gonymizer
+
+import (
+	"context"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// contextReader is an io.Reader that fails with the error of the context once it is cancelled so streaming functions
+// (processing, loading, copying, scanning) stop at the next read.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+// newContextReader will return a reader that reads from reader until ctx is cancelled.
+func newContextReader(ctx context.Context, reader io.Reader) io.Reader {
+	if ctx == nil || ctx.Done() == nil {
+		return reader
+	}
+	return &contextReader{ctx: ctx, reader: reader}
+}
+
+// Read will read from the underlying reader, or return the error of the context if it was cancelled.
+func (reader *contextReader) Read(p []byte) (int, error) {
+	if err := reader.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return reader.reader.Read(p)
+}
+
+// loggerKey is the key of the logger in the context (see: WithLogger).
+type loggerKey struct{}
+
+// WithLogger will return a context carrying the logger. Functions taking a context (I.E. CreateDumpFileContext,
+// ProcessDumpFileWithManifestContext, LoadFileWithOptionsContext) log using the logger of the context, so the output of
+// a job can be kept apart from the output of other jobs running at the same time.
+func WithLogger(ctx context.Context, logger log.FieldLogger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFromContext will return the logger of the context, or the standard logger if it does not carry one.
+func loggerFromContext(ctx context.Context) log.FieldLogger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(loggerKey{}).(log.FieldLogger); ok {
+			return logger
+		}
+	}
+	return log.StandardLogger()
+}
+
+// removePartialFile will remove a local file that was left behind by a command that did not complete.
+func removePartialFile(path string) {
+	if err := os.Remove(path); err == nil {
+		log.Info("Removed incomplete file: ", path)
+	} else if !os.IsNotExist(err) {
+		log.Warnf("Unable to remove incomplete file %s: %v", path, err)
+	}
+}
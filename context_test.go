@@ -0,0 +1,71 @@
+package gonymizer
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContextReader(t *testing.T) {
+	src := strings.NewReader("SELECT 1;\n")
+	require.Equal(t, src, newContextReader(context.Background(), src))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := newContextReader(ctx, src)
+	data, err := ioutil.ReadAll(reader)
+	require.Nil(t, err)
+	require.Equal(t, "SELECT 1;\n", string(data))
+
+	cancel()
+	_, err = reader.Read(make([]byte, 1))
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestProcessDumpFileContext(t *testing.T) {
+	defer os.Remove(TestContextProcessedFile)
+	columnMap, err := LoadConfigSkeleton(TestMapFile)
+	require.Nil(t, err)
+
+	// A cancelled process does not leave an incomplete processed file behind
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = ProcessDumpFileContext(ctx, columnMap, TestDbFile, TestContextProcessedFile, "", "", true)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), context.Canceled.Error())
+	_, err = os.Stat(TestContextProcessedFile)
+	require.True(t, os.IsNotExist(err))
+
+	require.Nil(t, ProcessDumpFileContext(context.Background(), columnMap, TestDbFile, TestContextProcessedFile, "",
+		"", true))
+	_, err = os.Stat(TestContextProcessedFile)
+	require.Nil(t, err)
+
+	// Columns missing from the map file in inclusive mode are returned as an error instead of exiting the process
+	viper.Set("process.inclusive", true)
+	defer viper.Set("process.inclusive", false)
+	var dst bytes.Buffer
+	src, err := os.Open(TestDbFile)
+	require.Nil(t, err)
+	defer src.Close()
+	err = ProcessDumpContext(context.Background(), &DBMapper{}, src, &dst, "", "", true)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Please add it to the map file")
+}
+
+func TestExecPostgresCmdContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var stdOut, stdErr bytes.Buffer
+	start := time.Now()
+	err := ExecPostgresCommand(ctx, PostgresCmdOptions{Stdout: &stdOut, Stderr: &stdErr}, "sleep", "10")
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.True(t, time.Since(start) < 5*time.Second)
+}
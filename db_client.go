@@ -1,13 +1,13 @@
 package gonymizer
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/lib/pq"
-	log "github.com/sirupsen/logrus"
 )
 
 // RowCounts is used to keep track of the number of rows for a given schema and table.
@@ -19,34 +19,50 @@ type RowCounts struct {
 
 // CheckIfDbExists checks to see if the database exists using the provided db connection.
 func CheckIfDbExists(db *sql.DB, dbName string) (exists bool, err error) {
+	return CheckIfDbExistsContext(context.Background(), db, dbName)
+}
+
+// CheckIfDbExistsContext is the same as CheckIfDbExists, but the query is cancelled when the context is cancelled.
+func CheckIfDbExistsContext(ctx context.Context, db *sql.DB, dbName string) (exists bool, err error) {
 	s := "SELECT exists(SELECT datname FROM pg_catalog.pg_database WHERE lower(datname) = lower($1));"
-	row := db.QueryRow(s, dbName)
-	_ = row.Scan(&exists)
-	log.Debugf("Exists: %t", exists)
-	return exists, err
+	if err = db.QueryRowContext(ctx, s, dbName).Scan(&exists); err != nil {
+		// The driver reports a cancelled query as a server error, so report the cancellation instead
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		return false, err
+	}
+	loggerFromContext(ctx).Debugf("Exists: %t", exists)
+	return exists, nil
 }
 
 // GetAllProceduresInSchema will return all procedures for the given schemas in SQL form.
 func GetAllProceduresInSchema(conf PGConfig, schema string) ([]string, error) {
+	return GetAllProceduresInSchemaContext(context.Background(), conf, schema)
+}
+
+// GetAllProceduresInSchemaContext is the same as GetAllProceduresInSchema, but the query is cancelled when the context
+// is cancelled.
+func GetAllProceduresInSchemaContext(ctx context.Context, conf PGConfig, schema string) ([]string, error) {
 	var (
 		rows       *sql.Rows
 		procedures []string
 	)
 	db, err := OpenDB(conf)
 	if err != nil {
-		log.Error(err)
+		loggerFromContext(ctx).Error(err)
 		return nil, err
 	}
 	defer db.Close()
 
-	rows, err = db.Query(`
+	rows, err = db.QueryContext(ctx, `
 		SELECT pg_get_functiondef(f.oid)
 		FROM pg_catalog.pg_proc f
 		INNER JOIN pg_catalog.pg_namespace n ON (f.pronamespace = n.oid)
 		WHERE n.nspname = $1`, schema)
 
 	if err != nil {
-		log.Error(err)
+		loggerFromContext(ctx).Error(err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -68,6 +84,12 @@ func GetAllProceduresInSchema(conf PGConfig, schema string) ([]string, error) {
 
 // GetAllSchemaColumns will return a row pointer to a list of table and column names for the given database connection.
 func GetAllSchemaColumns(db *sql.DB) (*sql.Rows, error) {
+	return GetAllSchemaColumnsContext(context.Background(), db)
+}
+
+// GetAllSchemaColumnsContext is the same as GetAllSchemaColumns, but the query is cancelled when the context is
+// cancelled.
+func GetAllSchemaColumnsContext(ctx context.Context, db *sql.DB) (*sql.Rows, error) {
 	query := `
 			SELECT table_catalog, table_schema, table_name, column_name, data_type, ordinal_position,
 			CASE
@@ -80,10 +102,10 @@ func GetAllSchemaColumns(db *sql.DB) (*sql.Rows, error) {
 			WHERE table_schema NOT IN ('information_schema', 'pg_catalog')
 			ORDER BY table_schema, table_name, ordinal_position
 	`
-	rows, err := db.Query(query)
+	rows, err := db.QueryContext(ctx, query)
 
 	if err != nil {
-		log.Error(err)
+		loggerFromContext(ctx).Error(err)
 		return nil, err
 	}
 	return rows, nil
@@ -91,6 +113,12 @@ func GetAllSchemaColumns(db *sql.DB) (*sql.Rows, error) {
 
 // GetAllTablesInSchema will return a list of database tables for a given database configuration.
 func GetAllTablesInSchema(conf PGConfig, schema string) ([]string, error) {
+	return GetAllTablesInSchemaContext(context.Background(), conf, schema)
+}
+
+// GetAllTablesInSchemaContext is the same as GetAllTablesInSchema, but the query is cancelled when the context is
+// cancelled.
+func GetAllTablesInSchemaContext(ctx context.Context, conf PGConfig, schema string) ([]string, error) {
 	var (
 		rows       *sql.Rows
 		tableNames []string
@@ -98,7 +126,7 @@ func GetAllTablesInSchema(conf PGConfig, schema string) ([]string, error) {
 
 	db, err := OpenDB(conf)
 	if err != nil {
-		log.Error(err)
+		loggerFromContext(ctx).Error(err)
 		return nil, err
 	}
 	defer db.Close()
@@ -108,14 +136,14 @@ func GetAllTablesInSchema(conf PGConfig, schema string) ([]string, error) {
 		schema = "public"
 	}
 
-	rows, err = db.Query(`
+	rows, err = db.QueryContext(ctx, `
 	SELECT table_name
 	FROM information_schema.tables
 	WHERE table_schema = $1`,
 		schema,
 	)
 	if err != nil {
-		log.Error(err)
+		loggerFromContext(ctx).Error(err)
 		return nil, err
 	}
 
@@ -140,6 +168,13 @@ func GetAllTablesInSchema(conf PGConfig, schema string) ([]string, error) {
 // GetSchemasInDatabase returns a list of schemas for a given database configuration. If an excludeSchemas list is
 // provided GetSchemasInDatabase will leave them out of the returned list of schemas.
 func GetSchemasInDatabase(conf PGConfig, excludeSchemas []string) ([]string, error) {
+	return GetSchemasInDatabaseContext(context.Background(), conf, excludeSchemas)
+}
+
+// GetSchemasInDatabaseContext is the same as GetSchemasInDatabase, but the query is cancelled when the context is
+// cancelled.
+func GetSchemasInDatabaseContext(ctx context.Context, conf PGConfig, excludeSchemas []string) ([]string, error) {
+	logger := loggerFromContext(ctx)
 	var (
 		rows            *sql.Rows
 		includedSchemas []string
@@ -147,18 +182,18 @@ func GetSchemasInDatabase(conf PGConfig, excludeSchemas []string) ([]string, err
 
 	db, err := OpenDB(conf)
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
 		return nil, err
 	}
 
-	rows, err = db.Query(`
+	rows, err = db.QueryContext(ctx, `
 		SELECT schema_name
 		FROM information_schema.schemata
 		WHERE schema_name NOT IN ($1)`, pq.Array(excludeSchemas))
 
 	if err != nil {
-		log.Error("Query IN clause: ")
-		log.Error(err)
+		logger.Error("Query IN clause: ")
+		logger.Error(err)
 		return nil, err
 	}
 
@@ -187,7 +222,13 @@ func GetSchemasInDatabase(conf PGConfig, excludeSchemas []string) ([]string, err
 // GetSchemaColumnEquals returns a pointer to a list of database rows containing the names of tables and columns for
 // the provided schema (using the SQL equals operator).
 func GetSchemaColumnEquals(db *sql.DB, schema string) (*sql.Rows, error) {
-	rows, err := db.Query(`
+	return GetSchemaColumnEqualsContext(context.Background(), db, schema)
+}
+
+// GetSchemaColumnEqualsContext is the same as GetSchemaColumnEquals, but the query is cancelled when the context is
+// cancelled.
+func GetSchemaColumnEqualsContext(ctx context.Context, db *sql.DB, schema string) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, `
 	SELECT table_catalog, table_schema, table_name, column_name, data_type, ordinal_position, 
 			CASE
 			    WHEN is_nullable = 'YES' THEN
@@ -200,7 +241,7 @@ func GetSchemaColumnEquals(db *sql.DB, schema string) (*sql.Rows, error) {
 	ORDER BY table_schema, table_name, ordinal_position`, schema)
 
 	if err != nil {
-		log.Error(err)
+		loggerFromContext(ctx).Error(err)
 		return nil, err
 	}
 	return rows, nil
@@ -209,12 +250,19 @@ func GetSchemaColumnEquals(db *sql.DB, schema string) (*sql.Rows, error) {
 // GetSchemaColumnsLike will return a pointer to a list of database rows containing the names of tables and columns for
 // the provided schema (using the SQL LIKE operator).
 func GetSchemaColumnsLike(db *sql.DB, schemaPrefix string) (*sql.Rows, error) {
+	return GetSchemaColumnsLikeContext(context.Background(), db, schemaPrefix)
+}
+
+// GetSchemaColumnsLikeContext is the same as GetSchemaColumnsLike, but the queries are cancelled when the context is
+// cancelled.
+func GetSchemaColumnsLikeContext(ctx context.Context, db *sql.DB, schemaPrefix string) (*sql.Rows, error) {
 	var selectedSchema string
 
 	// NOTE: Since we are grabbing a schema that matches the schemaPrefix we will assume UNIFORMITY in the DDL across all
 	// tables in each schema that match the prefix. Following this requirement, we can assume that we only need to grab a
 	// single schema that matches the prefix and use it as the map for all schemas that match the schemaPrefix.
-	err := db.QueryRow("SELECT table_schema FROM information_schema.columns WHERE table_schema LIKE $1 LIMIT 1",
+	err := db.QueryRowContext(ctx,
+		"SELECT table_schema FROM information_schema.columns WHERE table_schema LIKE $1 LIMIT 1",
 		schemaPrefix+"%").Scan(&selectedSchema)
 	switch err {
 	case sql.ErrNoRows:
@@ -222,11 +270,12 @@ func GetSchemaColumnsLike(db *sql.DB, schemaPrefix string) (*sql.Rows, error) {
 	case nil:
 		break
 	default:
-		panic(err)
+		loggerFromContext(ctx).Error(err)
+		return nil, err
 	}
 
 	// Now grab all the columns from this schema
-	rows, err := db.Query(`
+	rows, err := db.QueryContext(ctx, `
 			SELECT table_catalog, table_schema, table_name, column_name, data_type, ordinal_position, 
 			CASE
 			    WHEN is_nullable = 'YES' THEN
@@ -239,7 +288,7 @@ func GetSchemaColumnsLike(db *sql.DB, schemaPrefix string) (*sql.Rows, error) {
 			ORDER BY table_schema, table_name, ordinal_position`, selectedSchema)
 
 	if err != nil {
-		log.Error(err)
+		loggerFromContext(ctx).Error(err)
 		return nil, err
 	}
 	return rows, nil
@@ -249,6 +298,13 @@ func GetSchemaColumnsLike(db *sql.DB, schemaPrefix string) (*sql.Rows, error) {
 // GetTableRowCountsInDB collects the number of rows for each table in the given supplied schema prefix and will not
 // include any of the tables listed in the excludeTable list. Returns a list of tables the number of rows for each.
 func GetTableRowCountsInDB(conf PGConfig, schemaPrefix string, excludeTable []string) (*[]RowCounts, error) {
+	return GetTableRowCountsInDBContext(context.Background(), conf, schemaPrefix, excludeTable)
+}
+
+// GetTableRowCountsInDBContext is the same as GetTableRowCountsInDB, but the queries are cancelled when the context is
+// cancelled.
+func GetTableRowCountsInDBContext(ctx context.Context, conf PGConfig, schemaPrefix string,
+	excludeTable []string) (*[]RowCounts, error) {
 	var (
 		rows        *sql.Rows
 		dbRowCounts []RowCounts
@@ -256,7 +312,7 @@ func GetTableRowCountsInDB(conf PGConfig, schemaPrefix string, excludeTable []st
 
 	db, err := OpenDB(conf)
 	if err != nil {
-		log.Error(err)
+		loggerFromContext(ctx).Error(err)
 		return nil, err
 	}
 	defer db.Close()
@@ -271,10 +327,10 @@ func GetTableRowCountsInDB(conf PGConfig, schemaPrefix string, excludeTable []st
 	if len(excludeTable) > 0 {
 		query += "          AND tablename NOT IN ($1)"
 		query += "\n          ORDER BY schemaname, tablename;"
-		rows, err = db.Query(query, pq.Array(excludeTable))
+		rows, err = db.QueryContext(ctx, query, pq.Array(excludeTable))
 	} else {
 		query += "          ORDER BY schemaname, tablename;"
-		rows, err = db.Query(query)
+		rows, err = db.QueryContext(ctx, query)
 	}
 
 	if err != nil {
@@ -322,9 +378,12 @@ func GetTableRowCountsInDB(conf PGConfig, schemaPrefix string, excludeTable []st
 	// Luckily Postgres is smart and does not blow away cache for a
 	// simple Count(*). See -> https://stackoverflow.com/questions/37097736/understanding-postgres-caching
 	for _, row := range dbRowCounts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		query := fmt.Sprintf("SELECT COUNT(*) FROM %s.%s;", *row.SchemaName, *row.TableName)
-		if err := db.QueryRow(query).Scan(row.Count); err != nil {
-			log.Error(err)
+		if err := db.QueryRowContext(ctx, query).Scan(row.Count); err != nil {
+			loggerFromContext(ctx).Error(err)
 		}
 	}
 	return &dbRowCounts, err
@@ -332,6 +391,12 @@ func GetTableRowCountsInDB(conf PGConfig, schemaPrefix string, excludeTable []st
 
 // KillDatabaseConnections will kill all connections to the provided database name.
 func KillDatabaseConnections(db *sql.DB, dbName string) (err error) {
+	return KillDatabaseConnectionsContext(context.Background(), db, dbName)
+}
+
+// KillDatabaseConnectionsContext is the same as KillDatabaseConnections, but the query is cancelled when the context is
+// cancelled.
+func KillDatabaseConnectionsContext(ctx context.Context, db *sql.DB, dbName string) (err error) {
 	var success string
 
 	query := `
@@ -340,20 +405,25 @@ func KillDatabaseConnections(db *sql.DB, dbName string) (err error) {
 	WHERE pid != pg_backend_pid()
 		AND datname = $1;`
 
-	err = db.QueryRow(query, dbName).Scan(&success)
+	err = db.QueryRowContext(ctx, query, dbName).Scan(&success)
 	if err != nil {
-		log.Error(err)
+		loggerFromContext(ctx).Error(err)
 	}
-	log.Debug("Success: ", success)
+	loggerFromContext(ctx).Debug("Success: ", success)
 	return err
 }
 
 // RenameDatabase will rename a database using the fromName to the toName.
 func RenameDatabase(db *sql.DB, fromName, toName string) (err error) {
-	_, err = db.Exec(fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", fromName, toName))
+	return RenameDatabaseContext(context.Background(), db, fromName, toName)
+}
+
+// RenameDatabaseContext is the same as RenameDatabase, but the statement is cancelled when the context is cancelled.
+func RenameDatabaseContext(ctx context.Context, db *sql.DB, fromName, toName string) (err error) {
+	_, err = db.ExecContext(ctx, fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", fromName, toName))
 	if err != nil {
-		log.Errorf("Unable to rename database '%s' -> '%s'", fromName, toName)
-		log.Error(err)
+		loggerFromContext(ctx).Errorf("Unable to rename database '%s' -> '%s'", fromName, toName)
+		loggerFromContext(ctx).Error(err)
 		return err
 	}
 	return err
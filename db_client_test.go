@@ -1,6 +1,7 @@
 package gonymizer
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -15,10 +16,22 @@ func TestCheckIfDbExists(t *testing.T) {
 	require.Nil(t, err)
 	require.NotNil(t, dbConn)
 
+	// A cancelled query reports the cancellation instead of a database that does not exist
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	doesExist, err := CheckIfDbExistsContext(ctx, dbConn, conf.DefaultDBName)
+	require.Equal(t, context.Canceled, err)
+	require.False(t, doesExist)
+
 	// Next check to make sure the database exists
-	doesExist, err := CheckIfDbExists(dbConn, conf.DefaultDBName)
+	doesExist, err = CheckIfDbExists(dbConn, conf.DefaultDBName)
 	require.Nil(t, err)
 	require.True(t, doesExist)
+
+	// Errors running the query are returned
+	require.Nil(t, dbConn.Close())
+	_, err = CheckIfDbExists(dbConn, conf.DefaultDBName)
+	require.NotNil(t, err)
 }
 
 func TestGetAllProceduresInSchema(t *testing.T) {
@@ -1,9 +1,10 @@
 package gonymizer
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -11,13 +12,19 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // DropDatabase will drop the database that is supplied in the PGConfig.
 func DropDatabase(conf PGConfig) error {
+	return DropDatabaseContext(context.Background(), conf)
+}
+
+// DropDatabaseContext is the same as DropDatabase, but psql is killed when the context is cancelled.
+func DropDatabaseContext(ctx context.Context, conf PGConfig) error {
 	origName := conf.DefaultDBName
 	conf.DefaultDBName = "postgres"
-	dburl := conf.BaseURI()
+	dburl := conf.CommandBaseURI()
 	conf.DefaultDBName = origName
 
 	cmd := "psql"
@@ -28,10 +35,16 @@ func DropDatabase(conf PGConfig) error {
 		"DROP DATABASE IF EXISTS " + conf.DefaultDBName + ";",
 	}
 
-	err := ExecPostgresCmd(cmd, args...)
+	env, cleanup, err := conf.CommandEnv()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	err = ExecPostgresCommand(ctx, PostgresCmdOptions{Env: env}, cmd, args...)
 	if err != nil {
-		log.Error(err)
-		log.Debug("dburl: ", dburl)
+		loggerFromContext(ctx).Error(err)
+		loggerFromContext(ctx).Debug("dburl: ", RedactSecrets(dburl))
 		return err
 	}
 	return nil
@@ -39,9 +52,15 @@ func DropDatabase(conf PGConfig) error {
 
 // DropPublicTables drops all tables in the public schema.
 func DropPublicTables(conf PGConfig) error {
-	tablenames, err := GetAllTablesInSchema(conf, "public")
+	return DropPublicTablesContext(context.Background(), conf)
+}
+
+// DropPublicTablesContext is the same as DropPublicTables, but stops when the context is cancelled.
+func DropPublicTablesContext(ctx context.Context, conf PGConfig) error {
+	logger := loggerFromContext(ctx)
+	tablenames, err := GetAllTablesInSchemaContext(ctx, conf, "public")
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
 		return err
 	}
 
@@ -54,16 +73,22 @@ func DropPublicTables(conf PGConfig) error {
 
 	cmd := "psql"
 	args := []string{
-		conf.URI(),
+		conf.CommandURI(),
 		"-v", "ON_ERROR_STOP=1",
 		"-c", // run a command
 		dropAll,
 	}
 
-	err = ExecPostgresCmd(cmd, args...)
+	env, cleanup, err := conf.CommandEnv()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	err = ExecPostgresCommand(ctx, PostgresCmdOptions{Env: env}, cmd, args...)
 	if err != nil {
-		log.Error(err)
-		log.Error("conf: ", conf)
+		logger.Error(err)
+		logger.Error("conf: ", conf)
 		return err
 	}
 
@@ -72,10 +97,15 @@ func DropPublicTables(conf PGConfig) error {
 
 // CreateDatabase will create the database that is supplied in the PGConfig.
 func CreateDatabase(conf PGConfig) error {
+	return CreateDatabaseContext(context.Background(), conf)
+}
+
+// CreateDatabaseContext is the same as CreateDatabase, but psql is killed when the context is cancelled.
+func CreateDatabaseContext(ctx context.Context, conf PGConfig) error {
 	origName := conf.DefaultDBName
 	// Always use postgres database when moving, creating, or destroying databases
 	conf.DefaultDBName = "postgres"
-	dburl := conf.URI()
+	dburl := conf.CommandURI()
 	conf.DefaultDBName = origName
 
 	cmd := "psql"
@@ -86,10 +116,16 @@ func CreateDatabase(conf PGConfig) error {
 		"CREATE DATABASE " + conf.DefaultDBName + ";",
 	}
 
-	err := ExecPostgresCmd(cmd, args...)
+	env, cleanup, err := conf.CommandEnv()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	err = ExecPostgresCommand(ctx, PostgresCmdOptions{Env: env}, cmd, args...)
 	if err != nil {
-		log.Error(err)
-		log.Debug("dburl: ", dburl)
+		loggerFromContext(ctx).Error(err)
+		loggerFromContext(ctx).Debug("dburl: ", RedactSecrets(dburl))
 		return err
 	}
 	return nil
@@ -98,8 +134,13 @@ func CreateDatabase(conf PGConfig) error {
 // SQLCommandFile will run psql -f on a file and execute any queries contained in the sql file. If ignoreErrors is
 // supplied then psql will ignore errors in the file.
 func SQLCommandFile(conf PGConfig, filepath string, ignoreErrors bool) error {
+	return SQLCommandFileContext(context.Background(), conf, filepath, ignoreErrors)
+}
+
+// SQLCommandFileContext is the same as SQLCommandFile, but psql is killed when the context is cancelled.
+func SQLCommandFileContext(ctx context.Context, conf PGConfig, filepath string, ignoreErrors bool) error {
 
-	dburl := conf.URI()
+	dburl := conf.CommandURI()
 
 	cmd := "psql"
 	args := []string{
@@ -114,84 +155,258 @@ func SQLCommandFile(conf PGConfig, filepath string, ignoreErrors bool) error {
 	// Add the file to load last
 	args = append(args, "-f", filepath)
 
-	err := ExecPostgresCmd(cmd, args...)
+	env, cleanup, err := conf.CommandEnv()
 	if err != nil {
-		log.Error(err)
-		log.Debug("dburl: ", dburl)
+		return err
+	}
+	defer cleanup()
+
+	err = ExecPostgresCommand(ctx, PostgresCmdOptions{Env: env}, cmd, args...)
+	if err != nil {
+		loggerFromContext(ctx).Error(err)
+		loggerFromContext(ctx).Debug("dburl: ", RedactSecrets(dburl))
 		return err
 	}
 	return nil
 }
 
-// ExecPostgresCmd executes the psql command, but first opens the db_test_*.log log files for debugging runtime
-// issues using the psql command.
-func ExecPostgresCmd(name string, args ...string) error {
+// SQLCommandReader is the same as SQLCommandFile, but streams the SQL from the supplied reader to psql's standard input
+// instead of reading it from a local file.
+func SQLCommandReader(conf PGConfig, reader io.Reader, ignoreErrors bool) error {
+	return SQLCommandReaderContext(context.Background(), conf, reader, ignoreErrors)
+}
 
-	outLog := "db_test_out.log"
+// SQLCommandReaderContext is the same as SQLCommandReader, but psql is killed when the context is cancelled.
+func SQLCommandReaderContext(ctx context.Context, conf PGConfig, reader io.Reader, ignoreErrors bool) error {
+
+	dburl := conf.CommandURI()
+
+	cmd := "psql"
+	args := []string{
+		dburl,
+	}
+
+	// Should we quit on error?
+	if !ignoreErrors {
+		args = append(args, "-v", "ON_ERROR_STOP=1")
+	}
 
-	outputFile, err := os.OpenFile(outLog, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0660)
+	env, cleanup, err := conf.CommandEnv()
 	if err != nil {
-		log.Error(err)
-		log.Debug("outputFile: ", outLog)
-		log.Debug("name: ", name)
-		log.Debug("args: ", args)
 		return err
 	}
-	defer outputFile.Close()
+	defer cleanup()
 
-	errLog := "db_test_err.log"
-	errorFile, err := os.OpenFile(errLog, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0660)
+	err = ExecPostgresCommand(ctx, PostgresCmdOptions{Stdin: reader, Env: env}, cmd, args...)
 	if err != nil {
-		log.Error(err)
-		log.Debug("errorFile: ", errLog)
-		log.Debug("name: ", name)
-		log.Debug("args: ", args)
+		loggerFromContext(ctx).Error(err)
+		loggerFromContext(ctx).Debug("dburl: ", RedactSecrets(dburl))
 		return err
 	}
-	defer errorFile.Close()
-	return ExecPostgresCommandOutErr(outputFile, errorFile, name, args...)
+	return nil
+}
+
+// CommandEnv returns the environment variables needed to pass the PGConfig credentials to pg_dump and psql without
+// putting them in the process arguments. The password is written to a temporary password file (only readable by the
+// current user) which is referenced using PGPASSFILE. The returned cleanup function removes the temporary password
+// file and must always be called once the command has finished.
+func (conf *PGConfig) CommandEnv() (env []string, cleanup func(), err error) {
+	cleanup = func() {}
+	if len(conf.Pass) == 0 {
+		return nil, cleanup, nil
+	}
+
+	passFile, err := ioutil.TempFile("", "gonymizer_pgpass_")
+	if err != nil {
+		return nil, cleanup, err
+	}
+	cleanup = func() {
+		if err := os.Remove(passFile.Name()); err != nil && !os.IsNotExist(err) {
+			log.Error("Unable to remove temporary password file: ", passFile.Name())
+		}
+	}
+
+	// The entry matches any host, port, database, and user since the password file is only used for this command
+	escaper := strings.NewReplacer(`\`, `\\`, `:`, `\:`)
+	entry := fmt.Sprintf("*:*:*:*:%s\n", escaper.Replace(conf.Pass))
+	if err = passFile.Chmod(0600); err == nil {
+		_, err = passFile.WriteString(entry)
+	}
+	if closeErr := passFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return nil, func() {}, err
+	}
+
+	return []string{"PGPASSFILE=" + passFile.Name()}, cleanup, nil
+}
+
+// maxStderrTail is the number of bytes at the end of the standard error of a pg_dump or psql command that are kept to
+// report why it failed.
+const maxStderrTail = 64 << 10
+
+// tailBuffer is an io.Writer that keeps the last max bytes written to it.
+type tailBuffer struct {
+	max       int
+	data      []byte
+	truncated bool
+}
+
+// PostgresCmdOptions configures a pg_dump or psql command run using ExecPostgresCommand.
+type PostgresCmdOptions struct {
+	// Stdin is connected to the standard input of the command. The command reads from the null device when nil
+	Stdin io.Reader
+	// Stdout and Stderr receive the output of the command. The output is appended to the db_test_out.log and
+	// db_test_err.log files for debugging when they are nil
+	Stdout io.Writer
+	Stderr io.Writer
+	// Env are environment variables (see: CommandEnv) added to the environment of the command
+	Env []string
 }
 
-// ExecPostgresCommandOutErr is the executing function for the psql -f command. It also closed the loaded files/buffers
-// from the calling functions.
+// ExecPostgresCmd will run the pg_dump or psql command, appending its output to the db_test_out.log and db_test_err.log
+// files for debugging (see: ExecPostgresCommand).
+func ExecPostgresCmd(name string, args ...string) error {
+	return ExecPostgresCommand(context.Background(), PostgresCmdOptions{}, name, args...)
+}
+
+// ExecPostgresCommandOutErr will run the pg_dump or psql command, writing its standard output and error to the supplied
+// writers (see: ExecPostgresCommand). The writers are not closed.
 func ExecPostgresCommandOutErr(stdOut, stdErr io.Writer, name string, arg ...string) error {
+	return ExecPostgresCommand(context.Background(), PostgresCmdOptions{Stdout: stdOut, Stderr: stdErr}, name, arg...)
+}
+
+// ExecPostgresCommand will run the pg_dump or psql command (from PG_BIN_DIR when set) using the supplied options. The
+// command is killed when the context is cancelled, in which case the error of the context is returned. When the
+// options set PGPASSFILE, PGPASSWORD is removed from the environment of the command so it does not take precedence.
+func ExecPostgresCommand(ctx context.Context, options PostgresCmdOptions, name string, arg ...string) error {
+	logger := loggerFromContext(ctx)
 	var err error
 
+	span := startSpan(ctx, name, attribute.String("process.executable.name", name))
+	defer func() { endSpan(span, err) }()
+
+	if options.Stdout == nil {
+		outLog := "db_test_out.log"
+		var outputFile *os.File
+		outputFile, err = os.OpenFile(outLog, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0660)
+		if err != nil {
+			logger.Error(err)
+			logger.Debug("outputFile: ", outLog)
+			logger.Debug("name: ", name)
+			logger.Debug("args: ", redactArgs(arg))
+			return err
+		}
+		defer outputFile.Close()
+		options.Stdout = outputFile
+	}
+	if options.Stderr == nil {
+		errLog := "db_test_err.log"
+		var errorFile *os.File
+		errorFile, err = os.OpenFile(errLog, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0660)
+		if err != nil {
+			logger.Error(err)
+			logger.Debug("errorFile: ", errLog)
+			logger.Debug("name: ", name)
+			logger.Debug("args: ", redactArgs(arg))
+			return err
+		}
+		defer errorFile.Close()
+		options.Stderr = errorFile
+	}
+
 	pgBinDir := viper.GetString("PG_BIN_DIR")
 	if len(pgBinDir) > 0 {
 		name = filepath.Join(pgBinDir, name)
 	}
-	cmd := exec.Command(name, arg...)
-	cmd.Env = append(os.Environ())
+	cmd := exec.CommandContext(ctx, name, arg...)
+	cmd.Env = commandEnviron(options.Env)
 
-	// we use buffers cause we want the output to go to two places...
-	var outBuffer bytes.Buffer
-	var errBuffer bytes.Buffer
+	// The end of standard error is kept so it can be logged when the command fails. Standard output is not since it
+	// may be a complete dump
+	errTail := newTailBuffer(maxStderrTail)
 
-	cmd.Stdout = &outBuffer
-	cmd.Stderr = &errBuffer
+	cmd.Stdin = options.Stdin
+	cmd.Stdout = options.Stdout
+	cmd.Stderr = io.MultiWriter(options.Stderr, errTail)
 
-	log.Debugf("Running command: %s %s", name, strings.Join(arg, " "))
+	logger.Debugf("Running command: %s %s", name, strings.Join(redactArgs(arg), " "))
 
 	err = cmd.Run()
-	outBytes := outBuffer.Bytes()
-	errBytes := errBuffer.Bytes()
-
-	stdOut.Write(outBytes)
-	stdErr.Write(errBytes)
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		logger.Warnf("Killed %s: %v", filepath.Base(name), ctxErr)
+		err = ctxErr
+	}
 
 	if err != nil {
-		log.Error(err)
-		log.Debug("name: ", name)
-		log.Debug("arg: ", arg)
-		if len(errBytes) > 0 {
-			log.Debugf("errBytes: \n=====================\n%s\n=====================\n", string(errBytes))
-			log.Debugf("errBytes: \n=====================\n%s\n=====================\n", string(errBytes))
-		}
-		if len(outBytes) > 0 {
-			log.Debugf("outBytes: \n=====================\n%s\n=====================\n", string(outBytes))
-			log.Debugf("outBytes: \n=====================\n%s\n=====================\n", string(outBytes))
+		logger.Error(err)
+		logger.Debug("name: ", name)
+		logger.Debug("arg: ", redactArgs(arg))
+		if errTail.Len() > 0 {
+			logger.Debugf("errBytes: \n=====================\n%s\n=====================\n", errTail.String())
 		}
 	}
 	return err
 }
+
+// newTailBuffer will return a tailBuffer keeping the last max bytes written to it.
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+// Write will add p to the buffer, dropping the oldest bytes when it is full.
+func (buffer *tailBuffer) Write(p []byte) (int, error) {
+	if len(p) >= buffer.max {
+		buffer.truncated = buffer.truncated || len(buffer.data) > 0 || len(p) > buffer.max
+		buffer.data = append(buffer.data[:0], p[len(p)-buffer.max:]...)
+		return len(p), nil
+	}
+	if over := len(buffer.data) + len(p) - buffer.max; over > 0 {
+		buffer.truncated = true
+		buffer.data = append(buffer.data[:0], buffer.data[over:]...)
+	}
+	buffer.data = append(buffer.data, p...)
+	return len(p), nil
+}
+
+// Len will return the number of bytes in the buffer.
+func (buffer *tailBuffer) Len() int {
+	return len(buffer.data)
+}
+
+// String will return the contents of the buffer, prefixed by "..." when older bytes were dropped.
+func (buffer *tailBuffer) String() string {
+	if buffer.truncated {
+		return "...\n" + string(buffer.data)
+	}
+	return string(buffer.data)
+}
+
+// commandEnviron will return the environment of the current process with the supplied environment variables added.
+// PGPASSWORD is removed when env sets PGPASSFILE since libpq uses PGPASSWORD before the password file.
+func commandEnviron(env []string) []string {
+	setsPassFile := false
+	for _, kv := range env {
+		setsPassFile = setsPassFile || strings.HasPrefix(kv, "PGPASSFILE=")
+	}
+
+	environ := make([]string, 0, len(env))
+	for _, kv := range processEnviron() {
+		if setsPassFile && strings.HasPrefix(kv, "PGPASSWORD=") {
+			continue
+		}
+		environ = append(environ, kv)
+	}
+	return append(environ, env...)
+}
+
+// redactArgs returns a copy of the command arguments with all secrets redacted (see: RedactSecrets).
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		redacted[i] = RedactSecrets(arg)
+	}
+	return redacted
+}
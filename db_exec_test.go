@@ -2,6 +2,8 @@ package gonymizer
 
 import (
 	"bytes"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/spf13/viper"
@@ -74,3 +76,57 @@ func TestPsqlCommand(t *testing.T) {
 	require.NotNil(t, ExecPostgresCmd(cmd, args...))
 	viper.Set("PG_BIN_DIR", nil)
 }
+
+func TestCommandEnv(t *testing.T) {
+	// No password means no password file
+	conf := PGConfig{Host: "localhost"}
+	env, cleanup, err := conf.CommandEnv()
+	require.Nil(t, err)
+	require.Empty(t, env)
+	cleanup()
+
+	conf.Pass = `pa:ss\word`
+	env, cleanup, err = conf.CommandEnv()
+	require.Nil(t, err)
+	require.Len(t, env, 1)
+	require.True(t, strings.HasPrefix(env[0], "PGPASSFILE="))
+
+	passFile := strings.TrimPrefix(env[0], "PGPASSFILE=")
+	fileInfo, err := os.Stat(passFile)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), fileInfo.Mode().Perm())
+
+	// Reading the password file back should result in the same password
+	readConf := PGConfig{Host: "localhost", Username: "user", PassFile: passFile}
+	require.Nil(t, readConf.LoadFromPassFile())
+	require.Equal(t, conf.Pass, readConf.Pass)
+
+	// PGPASSWORD would take precedence over the password file
+	require.Nil(t, os.Setenv("PGPASSWORD", "inherited"))
+	defer os.Unsetenv("PGPASSWORD")
+	require.NotContains(t, commandEnviron(env), "PGPASSWORD=inherited")
+	require.Contains(t, commandEnviron(env), env[0])
+	require.Contains(t, commandEnviron(nil), "PGPASSWORD=inherited")
+
+	cleanup()
+	_, err = os.Stat(passFile)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestTailBuffer(t *testing.T) {
+	buffer := newTailBuffer(8)
+	_, err := buffer.Write([]byte("abc"))
+	require.Nil(t, err)
+	require.Equal(t, "abc", buffer.String())
+
+	// Only the last bytes are kept
+	_, err = buffer.Write([]byte("defghij"))
+	require.Nil(t, err)
+	require.Equal(t, 8, buffer.Len())
+	require.Equal(t, "...\ncdefghij", buffer.String())
+
+	n, err := buffer.Write([]byte("0123456789"))
+	require.Nil(t, err)
+	require.Equal(t, 10, n)
+	require.Equal(t, "...\n23456789", buffer.String())
+}
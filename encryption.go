@@ -0,0 +1,364 @@
+package gonymizer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	agearmor "filippo.io/age/armor"
+	"golang.org/x/crypto/openpgp"
+	pgparmor "golang.org/x/crypto/openpgp/armor"
+	// OpenPGP falls back to RIPEMD160 for keys that do not list their preferred hash functions
+	_ "golang.org/x/crypto/ripemd160"
+)
+
+const (
+	// ageHeader is the first line of a binary age encrypted file.
+	ageHeader = "age-encryption.org/v1"
+	// pgpArmorHeader is the first line of an ASCII armored OpenPGP message.
+	pgpArmorHeader = "-----BEGIN PGP MESSAGE-----"
+	// encryptionHeaderSize is the number of bytes read from the start of a file to detect its encryption format.
+	encryptionHeaderSize = 64
+)
+
+// EncryptionFormat is the client-side encryption format of a file.
+type EncryptionFormat int
+
+const (
+	// EncryptionNone is a file that is not encrypted.
+	EncryptionNone EncryptionFormat = iota
+	// EncryptionAge is a file encrypted using age (https://age-encryption.org).
+	EncryptionAge
+	// EncryptionAgeArmor is an ASCII armored file encrypted using age.
+	EncryptionAgeArmor
+	// EncryptionPGP is a file encrypted using OpenPGP.
+	EncryptionPGP
+	// EncryptionPGPArmor is an ASCII armored file encrypted using OpenPGP.
+	EncryptionPGPArmor
+)
+
+// artifactEncryption is the Encryption used by CreateURL and OpenURL (see: SetEncryption).
+var artifactEncryption *Encryption
+
+// artifactEncryptionMutex protects artifactEncryption from concurrent updates.
+var artifactEncryptionMutex sync.RWMutex
+
+// EncryptionConfig holds the keys used to encrypt and decrypt dump, processed, and row count files. Every key may be
+// supplied inline or as the path to a file containing the key(s).
+type EncryptionConfig struct {
+	// AgeRecipients are the age public keys (age1...) files are encrypted to.
+	AgeRecipients []string
+	// AgeIdentities are the age private keys (AGE-SECRET-KEY-1...) used to decrypt files.
+	AgeIdentities []string
+	// PGPRecipients are the OpenPGP public keys (binary or ASCII armored) files are encrypted to.
+	PGPRecipients []string
+	// PGPKeys are the OpenPGP private keys (binary or ASCII armored) used to decrypt files.
+	PGPKeys []string
+	// PGPPassphrase is used to unlock PGPKeys that are protected by a passphrase.
+	PGPPassphrase string
+}
+
+// Encryption will encrypt files to the configured age or OpenPGP recipients and decrypt files using the configured
+// identities. Both formats use envelope encryption: every file is encrypted with a random data key which is wrapped for
+// each recipient, so any one of the recipients' private keys can decrypt the file.
+type Encryption struct {
+	ageRecipients []age.Recipient
+	ageIdentities []age.Identity
+	pgpRecipients openpgp.EntityList
+	pgpKeys       openpgp.EntityList
+}
+
+// NewEncryption will parse the keys in the supplied configuration and return the Encryption. Age and OpenPGP
+// recipients cannot be used at the same time since a file can only be encrypted using one format.
+func NewEncryption(config EncryptionConfig) (*Encryption, error) {
+	enc := &Encryption{}
+
+	if len(config.AgeRecipients) > 0 && len(config.PGPRecipients) > 0 {
+		return nil, errors.New("age and OpenPGP recipients cannot be used at the same time")
+	}
+
+	for _, value := range config.AgeRecipients {
+		keys, err := readKeyMaterial(value)
+		if err != nil {
+			return nil, err
+		}
+		recipients, err := age.ParseRecipients(bytes.NewReader(keys))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse age recipient: %s", err)
+		}
+		enc.ageRecipients = append(enc.ageRecipients, recipients...)
+	}
+
+	for _, value := range config.AgeIdentities {
+		keys, err := readKeyMaterial(value)
+		if err != nil {
+			return nil, err
+		}
+		identities, err := age.ParseIdentities(bytes.NewReader(keys))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse age identity: %s", err)
+		}
+		enc.ageIdentities = append(enc.ageIdentities, identities...)
+	}
+
+	for _, value := range config.PGPRecipients {
+		entities, err := readPGPKeyRing(value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse OpenPGP recipient: %s", err)
+		}
+		enc.pgpRecipients = append(enc.pgpRecipients, entities...)
+	}
+
+	for _, value := range config.PGPKeys {
+		entities, err := readPGPKeyRing(value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse OpenPGP private key: %s", err)
+		}
+		for _, entity := range entities {
+			if err = unlockPGPEntity(entity, config.PGPPassphrase); err != nil {
+				return nil, err
+			}
+		}
+		enc.pgpKeys = append(enc.pgpKeys, entities...)
+	}
+
+	return enc, nil
+}
+
+// SetEncryption will set the Encryption used by CreateURL to encrypt new files and by OpenURL to decrypt encrypted
+// files. A nil Encryption disables encryption.
+func SetEncryption(enc *Encryption) {
+	artifactEncryptionMutex.Lock()
+	defer artifactEncryptionMutex.Unlock()
+	artifactEncryption = enc
+}
+
+// GetEncryption will return the Encryption set using SetEncryption, or nil if encryption is not configured.
+func GetEncryption() *Encryption {
+	artifactEncryptionMutex.RLock()
+	defer artifactEncryptionMutex.RUnlock()
+	return artifactEncryption
+}
+
+// Enabled will return true if files are encrypted when they are created (I.E. recipients are configured).
+func (enc *Encryption) Enabled() bool {
+	return enc != nil && (len(enc.ageRecipients) > 0 || len(enc.pgpRecipients) > 0)
+}
+
+// EncryptWriter will return a writer that encrypts everything written to it before writing it to dst. Closing the
+// returned writer finishes the encrypted file and closes dst. If encryption is not enabled dst is returned as-is.
+func (enc *Encryption) EncryptWriter(dst io.WriteCloser) (io.WriteCloser, error) {
+	var (
+		plaintext io.WriteCloser
+		err       error
+	)
+
+	switch {
+	case !enc.Enabled():
+		return dst, nil
+	case len(enc.ageRecipients) > 0:
+		plaintext, err = age.Encrypt(dst, enc.ageRecipients...)
+	default:
+		plaintext, err = openpgp.Encrypt(dst, enc.pgpRecipients, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	}
+
+	if err != nil {
+		abortWriter(dst, err)
+		return nil, err
+	}
+	return &encryptWriter{WriteCloser: plaintext, dst: dst}, nil
+}
+
+// DecryptReader will return a reader that decrypts src if it is encrypted using age or OpenPGP. Files that are not
+// encrypted are returned unchanged so plain and encrypted files can be read the same way. Closing the returned reader
+// closes src.
+func (enc *Encryption) DecryptReader(src io.ReadCloser) (io.ReadCloser, error) {
+	var (
+		plaintext io.Reader
+		err       error
+	)
+
+	buffered := bufio.NewReader(src)
+	header, _ := buffered.Peek(encryptionHeaderSize)
+	format := DetectEncryption(header)
+
+	switch format {
+	case EncryptionNone:
+		return &decryptReader{Reader: buffered, src: src}, nil
+	case EncryptionAge, EncryptionAgeArmor:
+		if enc == nil || len(enc.ageIdentities) == 0 {
+			err = errors.New("file is encrypted using age, but no age identities are configured")
+			break
+		}
+		if format == EncryptionAgeArmor {
+			plaintext, err = age.Decrypt(agearmor.NewReader(buffered), enc.ageIdentities...)
+		} else {
+			plaintext, err = age.Decrypt(buffered, enc.ageIdentities...)
+		}
+	case EncryptionPGP, EncryptionPGPArmor:
+		if enc == nil || len(enc.pgpKeys) == 0 {
+			err = errors.New("file is encrypted using OpenPGP, but no OpenPGP private keys are configured")
+			break
+		}
+		var ciphertext io.Reader = buffered
+		if format == EncryptionPGPArmor {
+			block, armorErr := pgparmor.Decode(buffered)
+			if armorErr != nil {
+				err = armorErr
+				break
+			}
+			ciphertext = block.Body
+		}
+		var md *openpgp.MessageDetails
+		if md, err = openpgp.ReadMessage(ciphertext, enc.pgpKeys, nil, nil); err == nil {
+			plaintext = md.UnverifiedBody
+		}
+	}
+
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return &decryptReader{Reader: plaintext, src: src}, nil
+}
+
+// DetectEncryption will return the encryption format of a file using the first bytes of the file.
+func DetectEncryption(header []byte) EncryptionFormat {
+	switch {
+	case bytes.HasPrefix(header, []byte(ageHeader)):
+		return EncryptionAge
+	case bytes.HasPrefix(header, []byte(agearmor.Header)):
+		return EncryptionAgeArmor
+	case bytes.HasPrefix(header, []byte(pgpArmorHeader)):
+		return EncryptionPGPArmor
+	case len(header) > 0 && header[0]&0x80 != 0:
+		// OpenPGP packet header: encrypted messages start with a public-key (1) or symmetric-key (3) encrypted
+		// session key packet. Plain SQL and CSV files never start with a byte >= 0x80.
+		tag := (header[0] & 0x3c) >> 2
+		if header[0]&0x40 != 0 {
+			tag = header[0] & 0x3f
+		}
+		if tag == 1 || tag == 3 {
+			return EncryptionPGP
+		}
+	}
+	return EncryptionNone
+}
+
+// IsEncryptedURL will return true if the file at the supplied URL is encrypted using age or OpenPGP.
+func IsEncryptedURL(urlStr string) (bool, error) {
+	storage, err := GetStorage(urlStr)
+	if err != nil {
+		return false, err
+	}
+	reader, err := storage.Open(urlStr)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+
+	header, err := bufio.NewReader(reader).Peek(encryptionHeaderSize)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return DetectEncryption(header) != EncryptionNone, nil
+}
+
+// encryptWriter finishes the encrypted file and closes the destination writer when it is closed.
+type encryptWriter struct {
+	io.WriteCloser
+	dst io.WriteCloser
+}
+
+// Close will write the end of the encrypted file and close the destination writer.
+func (writer *encryptWriter) Close() error {
+	if err := writer.WriteCloser.Close(); err != nil {
+		abortWriter(writer.dst, err)
+		return err
+	}
+	return writer.dst.Close()
+}
+
+// CloseWithError will abort the destination writer (see: abortWriter) so partial files are not stored.
+func (writer *encryptWriter) CloseWithError(err error) error {
+	abortWriter(writer.dst, err)
+	return nil
+}
+
+// decryptReader reads the decrypted file and closes the source reader when it is closed.
+type decryptReader struct {
+	io.Reader
+	src io.ReadCloser
+}
+
+// Close will close the source reader.
+func (reader *decryptReader) Close() error {
+	return reader.src.Close()
+}
+
+// readKeyMaterial will return the supplied key if it is an inline key, otherwise the contents of the key file at the
+// supplied path.
+func readKeyMaterial(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	for _, prefix := range []string{"age1", "AGE-SECRET-KEY-", "-----BEGIN", "#"} {
+		if strings.HasPrefix(value, prefix) {
+			return []byte(value), nil
+		}
+	}
+	if strings.Contains(value, "\n") {
+		return []byte(value), nil
+	}
+
+	keys, err := ioutil.ReadFile(value)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key file: %s", err)
+	}
+	return keys, nil
+}
+
+// readPGPKeyRing will parse the binary or ASCII armored OpenPGP key ring supplied inline or as a path.
+func readPGPKeyRing(value string) (openpgp.EntityList, error) {
+	keys, err := readKeyMaterial(value)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(keys, []byte("-----BEGIN")) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(keys))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(keys))
+}
+
+// unlockPGPEntity will decrypt the private key and subkeys of the entity using the supplied passphrase.
+func unlockPGPEntity(entity *openpgp.Entity, passphrase string) error {
+	if entity.PrivateKey == nil {
+		return errors.New("OpenPGP key is not a private key: " + pgpKeyName(entity))
+	}
+
+	if entity.PrivateKey.Encrypted {
+		if err := entity.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+			return fmt.Errorf("unable to unlock OpenPGP private key %s: %s", pgpKeyName(entity), err)
+		}
+	}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+			if err := subkey.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+				return fmt.Errorf("unable to unlock OpenPGP private key %s: %s", pgpKeyName(entity), err)
+			}
+		}
+	}
+	return nil
+}
+
+// pgpKeyName will return a name for the entity to use in error messages.
+func pgpKeyName(entity *openpgp.Entity) string {
+	for name := range entity.Identities {
+		return name
+	}
+	return entity.PrimaryKey.KeyIdString()
+}
@@ -0,0 +1,162 @@
+package gonymizer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+const testEncryptionPlaintext = "COPY public.users (id, email) FROM stdin;\n1\tjohn@example.com\n\\.\n"
+
+func TestDetectEncryption(t *testing.T) {
+	for header, expected := range map[string]EncryptionFormat{
+		"age-encryption.org/v1\n-> X25519":         EncryptionAge,
+		"-----BEGIN AGE ENCRYPTED FILE-----\nYWdl": EncryptionAgeArmor,
+		"-----BEGIN PGP MESSAGE-----\n\nhQEMA":     EncryptionPGPArmor,
+		"\x85\x01\x0c\x03":                         EncryptionPGP,
+		"\xc1\xc0\x4c\x03":                         EncryptionPGP,
+		"\xc3\x2e\x04\x09":                         EncryptionPGP,
+		"--\n-- PostgreSQL database dump\n--\n":    EncryptionNone,
+		"public,users,10\n":                        EncryptionNone,
+		"":                                         EncryptionNone,
+		"\xc6\x01":                                 EncryptionNone,
+	} {
+		require.Equal(t, expected, DetectEncryption([]byte(header)), "%q", header)
+	}
+}
+
+func TestAgeEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonymizer-encryption")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer SetEncryption(nil)
+
+	identity, err := age.GenerateX25519Identity()
+	require.Nil(t, err)
+	identityFile := filepath.Join(dir, "identity.txt")
+	require.Nil(t, ioutil.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600))
+
+	enc, err := NewEncryption(EncryptionConfig{
+		AgeRecipients: []string{identity.Recipient().String()},
+		AgeIdentities: []string{identityFile},
+	})
+	require.Nil(t, err)
+	require.True(t, enc.Enabled())
+	SetEncryption(enc)
+
+	encrypted := filepath.Join(dir, "dump.sql.age")
+	writeTestURL(t, encrypted, testEncryptionPlaintext)
+
+	raw, err := ioutil.ReadFile(encrypted)
+	require.Nil(t, err)
+	require.NotContains(t, string(raw), "john@example.com")
+	isEncrypted, err := IsEncryptedURL(encrypted)
+	require.Nil(t, err)
+	require.True(t, isEncrypted)
+	require.Equal(t, testEncryptionPlaintext, readTestURL(t, encrypted))
+
+	// Plain files are read as-is
+	plain := filepath.Join(dir, "plain.sql")
+	require.Nil(t, ioutil.WriteFile(plain, []byte(testEncryptionPlaintext), 0600))
+	require.Equal(t, testEncryptionPlaintext, readTestURL(t, plain))
+
+	// Decrypting without a matching identity must fail
+	other, err := age.GenerateX25519Identity()
+	require.Nil(t, err)
+	enc, err = NewEncryption(EncryptionConfig{AgeIdentities: []string{other.String()}})
+	require.Nil(t, err)
+	require.False(t, enc.Enabled())
+	SetEncryption(enc)
+	_, err = OpenURL(encrypted)
+	require.NotNil(t, err)
+
+	SetEncryption(nil)
+	_, err = OpenURL(encrypted)
+	require.NotNil(t, err)
+
+	// Encrypted files are copied without being decrypted
+	copied := filepath.Join(dir, "copy.sql.age")
+	require.Nil(t, CopyURL(copied, encrypted))
+	copiedRaw, err := ioutil.ReadFile(copied)
+	require.Nil(t, err)
+	require.Equal(t, raw, copiedRaw)
+
+	_, err = NewEncryption(EncryptionConfig{AgeRecipients: []string{"age1invalid"}})
+	require.NotNil(t, err)
+}
+
+func TestPGPEncryption(t *testing.T) {
+	var publicKey, privateKey bytes.Buffer
+
+	dir, err := ioutil.TempDir("", "gonymizer-encryption")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer SetEncryption(nil)
+
+	entity, err := openpgp.NewEntity("Gonymizer", "test", "gonymizer@example.com", nil)
+	require.Nil(t, err)
+	// The self-signatures are created when the private key is serialized so it must be serialized first
+	writer, err := armor.Encode(&privateKey, openpgp.PrivateKeyType, nil)
+	require.Nil(t, err)
+	require.Nil(t, entity.SerializePrivate(writer, nil))
+	require.Nil(t, writer.Close())
+	writer, err = armor.Encode(&publicKey, openpgp.PublicKeyType, nil)
+	require.Nil(t, err)
+	require.Nil(t, entity.Serialize(writer))
+	require.Nil(t, writer.Close())
+
+	keyFile := filepath.Join(dir, "private.asc")
+	require.Nil(t, ioutil.WriteFile(keyFile, privateKey.Bytes(), 0600))
+
+	enc, err := NewEncryption(EncryptionConfig{
+		PGPRecipients: []string{publicKey.String()},
+		PGPKeys:       []string{keyFile},
+	})
+	require.Nil(t, err)
+	SetEncryption(enc)
+
+	encrypted := filepath.Join(dir, "row_counts.csv.gpg")
+	writeTestURL(t, encrypted, testEncryptionPlaintext)
+
+	raw, err := ioutil.ReadFile(encrypted)
+	require.Nil(t, err)
+	require.NotContains(t, string(raw), "john@example.com")
+	require.Equal(t, EncryptionPGP, DetectEncryption(raw))
+	require.Equal(t, testEncryptionPlaintext, readTestURL(t, encrypted))
+
+	// Public keys can not be used to decrypt
+	_, err = NewEncryption(EncryptionConfig{PGPKeys: []string{publicKey.String()}})
+	require.NotNil(t, err)
+
+	_, err = NewEncryption(EncryptionConfig{
+		AgeRecipients: []string{"age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"},
+		PGPRecipients: []string{publicKey.String()},
+	})
+	require.NotNil(t, err)
+}
+
+// writeTestURL will write the contents to the URL using CreateURL.
+func writeTestURL(t *testing.T, urlStr, contents string) {
+	writer, err := CreateURL(urlStr)
+	require.Nil(t, err)
+	_, err = writer.Write([]byte(contents))
+	require.Nil(t, err)
+	require.Nil(t, writer.Close())
+}
+
+// readTestURL will return the contents of the URL using OpenURL.
+func readTestURL(t *testing.T, urlStr string) string {
+	reader, err := OpenURL(urlStr)
+	require.Nil(t, err)
+	defer reader.Close()
+	contents, err := ioutil.ReadAll(reader)
+	require.Nil(t, err)
+	return string(contents)
+}
@@ -0,0 +1,415 @@
+package gonymizer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults of the ExternalProcessorConfig.
+const (
+	DefaultExternalProcessorTimeout     = 30 * time.Second
+	DefaultExternalProcessorMaxRestarts = 3
+)
+
+// externalProcessorStopTimeout is how long Close waits for the command to exit once its stdin is closed before it is
+// killed.
+const externalProcessorStopTimeout = 5 * time.Second
+
+// errExternalProcessorExited is returned when the command of an ExternalProcessor exits or closes its stdin or stdout
+// while processing a batch.
+var errExternalProcessorExited = errors.New("the command exited unexpectedly")
+
+// ExternalProcessorConfig configures an ExternalProcessor.
+type ExternalProcessorConfig struct {
+	// Name is the name of the processor used in map files (required)
+	Name string
+	// Description is a short, one line description of what the processor does
+	Description string
+	// Command is the command to run (required)
+	Command string
+	// Args are the arguments of the command
+	Args []string
+	// Env are environment variables (KEY=value) added to the environment of the command
+	Env []string
+	// BatchSize is the maximum number of values sent in a request. Defaults to DefaultProcessorBatchSize
+	BatchSize int
+	// Timeout is how long to wait for the response to a request before the command is killed. Defaults to
+	// DefaultExternalProcessorTimeout
+	Timeout time.Duration
+	// MaxRestarts is how many times the command is restarted, and the request sent again, when it exits while
+	// processing a request. Defaults to DefaultExternalProcessorMaxRestarts, use a negative value to never restart it
+	MaxRestarts int
+	// DataTypes, ColumnNames, Deterministic, and Consistent describe the processor (see: ProcessorInfo)
+	DataTypes     []string
+	ColumnNames   []string
+	Deterministic bool
+	Consistent    bool
+}
+
+// ExternalProcessor is a processor that anonymizes values using a long-running external command, so processors can
+// be written in any language. The command is started when the processor is first used and reads requests from stdin
+// and writes responses to stdout, one JSON object per line:
+//
+//	{"id": 1, "processor": "MaskMRN", "column": {"schema": "public", "table": "patients", "column": "mrn",
+//	 "data_type": "text", "max": 0, "min": 0, "variance": 0}, "values": ["A-1234", "B-5678"]}
+//	{"id": 1, "values": ["X-9911", "X-4410"]}
+//
+// Every response has the id of its request and either one value for every value of the request, in the same order,
+// or an error ({"id": 1, "error": "invalid MRN"}). Values are sent without the escaping of the COPY format and NULL
+// values are never sent. Lines the command writes to stderr are logged.
+type ExternalProcessor struct {
+	config ExternalProcessorConfig
+
+	mutex   sync.Mutex
+	process *externalProcess
+	nextID  int64
+}
+
+// externalRequest is a request sent to the command of an ExternalProcessor.
+type externalRequest struct {
+	ID        int64          `json:"id"`
+	Processor string         `json:"processor"`
+	Column    externalColumn `json:"column"`
+	Values    []string       `json:"values"`
+}
+
+// externalColumn is the column of the values of an externalRequest, along with the options of the processor set in
+// the map file.
+type externalColumn struct {
+	Schema   string  `json:"schema"`
+	Table    string  `json:"table"`
+	Column   string  `json:"column"`
+	DataType string  `json:"data_type"`
+	Max      float64 `json:"max"`
+	Min      float64 `json:"min"`
+	Variance float64 `json:"variance"`
+}
+
+// externalResponse is a response written by the command of an ExternalProcessor.
+type externalResponse struct {
+	ID     int64    `json:"id"`
+	Values []string `json:"values"`
+	Error  string   `json:"error"`
+}
+
+// externalProcess is a running command of an ExternalProcessor.
+type externalProcess struct {
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	responses chan externalLine
+	// readers waits for the goroutines reading stdout and stderr, which must finish before cmd.Wait closes the pipes
+	readers sync.WaitGroup
+}
+
+// externalLine is a line read from the stdout of an externalProcess.
+type externalLine struct {
+	response externalResponse
+	err      error
+}
+
+// NewExternalProcessor will return an ExternalProcessor using the supplied configuration. The command is not started
+// until the processor is used.
+func NewExternalProcessor(config ExternalProcessorConfig) (*ExternalProcessor, error) {
+	if len(config.Name) == 0 {
+		return nil, errors.New("the name of the processor is required")
+	}
+	if len(config.Command) == 0 {
+		return nil, fmt.Errorf("processor %s: a command is required", config.Name)
+	}
+	if config.BatchSize < 0 || config.Timeout < 0 {
+		return nil, fmt.Errorf("processor %s: the batch size and timeout must not be negative", config.Name)
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = DefaultProcessorBatchSize
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultExternalProcessorTimeout
+	}
+	if config.MaxRestarts == 0 {
+		config.MaxRestarts = DefaultExternalProcessorMaxRestarts
+	}
+	if len(config.Description) == 0 {
+		config.Description = "Runs " + config.Command
+	}
+	return &ExternalProcessor{config: config}, nil
+}
+
+// RegisterExternalProcessor will create an ExternalProcessor and register it so it can be used in map files. The
+// processor should be closed once all dumps are processed.
+func RegisterExternalProcessor(config ExternalProcessorConfig) (*ExternalProcessor, error) {
+	processor, err := NewExternalProcessor(config)
+	if err != nil {
+		return nil, err
+	}
+	if err = RegisterProcessor(processor.Info()); err != nil {
+		return nil, err
+	}
+	return processor, nil
+}
+
+// Info will return the ProcessorInfo used to register the processor.
+func (processor *ExternalProcessor) Info() ProcessorInfo {
+	return ProcessorInfo{
+		Name:        processor.config.Name,
+		Description: processor.config.Description,
+		Func:        processor.Process,
+		BatchFunc:   processor.ProcessBatch,
+		BatchSize:   processor.config.BatchSize,
+		Options: []ProcessorOption{
+			{Name: ProcessorOptionMax, Description: "Sent to the command"},
+			{Name: ProcessorOptionMin, Description: "Sent to the command"},
+			{Name: ProcessorOptionVariance, Description: "Sent to the command"},
+		},
+		DataTypes:     processor.config.DataTypes,
+		Deterministic: processor.config.Deterministic,
+		Consistent:    processor.config.Consistent,
+		ColumnNames:   processor.config.ColumnNames,
+	}
+}
+
+// Process will anonymize a single value using the command.
+func (processor *ExternalProcessor) Process(cmap *ColumnMapper, input string) (string, error) {
+	outputs, err := processor.ProcessBatch(cmap, []string{input})
+	if err != nil {
+		return "", err
+	}
+	return outputs[0], nil
+}
+
+// ProcessBatch will anonymize the values using the command in a single request. The command is started if it is not
+// running, and restarted up to MaxRestarts times if it exits before responding.
+func (processor *ExternalProcessor) ProcessBatch(cmap *ColumnMapper, inputs []string) ([]string, error) {
+	if len(inputs) == 0 {
+		return []string{}, nil
+	}
+
+	request := externalRequest{
+		Processor: processor.config.Name,
+		Column: externalColumn{
+			Schema:   cmap.TableSchema,
+			Table:    cmap.TableName,
+			Column:   cmap.ColumnName,
+			DataType: cmap.DataType,
+		},
+		Values: make([]string, len(inputs)),
+	}
+	for _, procDef := range cmap.Processors {
+		if procDef.Name == processor.config.Name {
+			request.Column.Max = procDef.Max
+			request.Column.Min = procDef.Min
+			request.Column.Variance = procDef.Variance
+			break
+		}
+	}
+	for i, input := range inputs {
+		request.Values[i] = unescapeCopyValue(input)
+	}
+
+	processor.mutex.Lock()
+	defer processor.mutex.Unlock()
+
+	for restarts := 0; ; restarts++ {
+		outputs, err := processor.send(request)
+		if err == nil {
+			for i, output := range outputs {
+				outputs[i] = escapeCopyValue(output)
+			}
+			return outputs, nil
+		}
+		if !errors.Is(err, errExternalProcessorExited) || restarts >= processor.config.MaxRestarts {
+			return nil, fmt.Errorf("processor %s: %w", processor.config.Name, err)
+		}
+		log.Warnf("Processor %s: %v. Restarting the command (%d/%d)", processor.config.Name, err, restarts+1,
+			processor.config.MaxRestarts)
+	}
+}
+
+// Close will stop the command, killing it if it does not exit within a few seconds of closing its stdin. The command
+// is started again if the processor is used after it is closed.
+func (processor *ExternalProcessor) Close() error {
+	processor.mutex.Lock()
+	defer processor.mutex.Unlock()
+
+	if processor.process == nil {
+		return nil
+	}
+	err := processor.process.stop(externalProcessorStopTimeout)
+	processor.process = nil
+	return err
+}
+
+// send will send the request to the command, starting it if needed, and return the values of the response. The command
+// is killed if it does not respond within the timeout or does not follow the protocol.
+func (processor *ExternalProcessor) send(request externalRequest) ([]string, error) {
+	if processor.process == nil {
+		process, err := startExternalProcess(processor.config)
+		if err != nil {
+			return nil, err
+		}
+		processor.process = process
+	}
+
+	processor.nextID++
+	request.ID = processor.nextID
+	line, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = processor.process.stdin.Write(append(line, '\n')); err != nil {
+		return nil, fmt.Errorf("%w: %v", errExternalProcessorExited, processor.kill())
+	}
+
+	timer := time.NewTimer(processor.config.Timeout)
+	defer timer.Stop()
+	select {
+	case line, ok := <-processor.process.responses:
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("%w: %v", errExternalProcessorExited, processor.kill())
+		case line.err != nil:
+			processor.kill()
+			return nil, fmt.Errorf("invalid response: %v", line.err)
+		case line.response.ID != request.ID:
+			processor.kill()
+			return nil, fmt.Errorf("expected the response to request %d, got %d", request.ID, line.response.ID)
+		case len(line.response.Error) > 0:
+			return nil, errors.New(line.response.Error)
+		case len(line.response.Values) != len(request.Values):
+			return nil, fmt.Errorf("the command returned %d values for %d inputs", len(line.response.Values),
+				len(request.Values))
+		}
+		return line.response.Values, nil
+	case <-timer.C:
+		processor.kill()
+		return nil, fmt.Errorf("the command did not respond within %s", processor.config.Timeout)
+	}
+}
+
+// kill will kill the command and return the reason it exited.
+func (processor *ExternalProcessor) kill() error {
+	err := processor.process.stop(0)
+	processor.process = nil
+	return err
+}
+
+// startExternalProcess will start the command of the processor along with the goroutines reading its stdout and
+// stderr.
+func startExternalProcess(config ExternalProcessorConfig) (*externalProcess, error) {
+	cmd := exec.Command(config.Command, config.Args...)
+	cmd.Env = append(os.Environ(), config.Env...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to start %s: %w", config.Command, err)
+	}
+	log.Debugf("Started processor %s (pid %d)", config.Name, cmd.Process.Pid)
+
+	process := &externalProcess{
+		cmd:       cmd,
+		stdin:     stdin,
+		responses: make(chan externalLine),
+	}
+
+	process.readers.Add(2)
+	go func() {
+		defer process.readers.Done()
+		defer close(process.responses)
+		reader := bufio.NewReaderSize(stdout, streamBufferSize)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(strings.TrimSpace(string(line))) > 0 {
+				var response externalResponse
+				decodeErr := json.Unmarshal(line, &response)
+				process.responses <- externalLine{response: response, err: decodeErr}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer process.readers.Done()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.WithField("processor", config.Name).Warn(scanner.Text())
+		}
+	}()
+
+	return process, nil
+}
+
+// stop will close the stdin of the command and wait for it to exit, killing it once the timeout has passed.
+func (process *externalProcess) stop(timeout time.Duration) error {
+	_ = process.stdin.Close()
+
+	// Drain stdout so the command does not block writing responses nobody reads
+	go func() {
+		for range process.responses {
+		}
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		process.readers.Wait()
+		exited <- process.cmd.Wait()
+	}()
+
+	select {
+	case err := <-exited:
+		return err
+	case <-time.After(timeout):
+		_ = process.cmd.Process.Kill()
+		return <-exited
+	}
+}
+
+// escapeCopyValue will escape the value the way PostgreSQL does in the COPY text format (see: unescapeCopyValue).
+func escapeCopyValue(val string) string {
+	if !strings.ContainsAny(val, "\\\b\f\n\r\t\v") {
+		return val
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(val); i++ {
+		switch c := val[i]; c {
+		case '\\':
+			b.WriteString("\\\\")
+		case '\b':
+			b.WriteString("\\b")
+		case '\f':
+			b.WriteString("\\f")
+		case '\n':
+			b.WriteString("\\n")
+		case '\r':
+			b.WriteString("\\r")
+		case '\t':
+			b.WriteString("\\t")
+		case '\v':
+			b.WriteString("\\v")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
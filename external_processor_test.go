@@ -0,0 +1,139 @@
+package gonymizer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExternalProcessor(t *testing.T) {
+	for _, config := range []ExternalProcessorConfig{
+		{Command: os.Args[0]},
+		{Name: "TestExternalNoCommand"},
+		{Name: "TestExternalBatch", Command: os.Args[0], BatchSize: -1},
+	} {
+		_, err := NewExternalProcessor(config)
+		require.NotNil(t, err, config)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "gonymizer-external")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	processor, err := RegisterExternalProcessor(ExternalProcessorConfig{
+		Name:    "TestExternalUpper",
+		Command: os.Args[0],
+		Args:    []string{"-test.run=^TestExternalProcessorCommand$"},
+		Env: []string{
+			"GONYMIZER_TEST_EXTERNAL_PROCESSOR=1",
+			"GONYMIZER_TEST_CRASH_FILE=" + filepath.Join(tmpDir, "crashed"),
+		},
+		BatchSize: 2,
+		Timeout:   2 * time.Second,
+	})
+	require.Nil(t, err)
+	defer func() {
+		require.Nil(t, processor.Close())
+		processorRegistryMutex.Lock()
+		delete(processorRegistry, "TestExternalUpper")
+		delete(ProcessorCatalog, "TestExternalUpper")
+		processorRegistryMutex.Unlock()
+	}()
+
+	info, ok := LookupProcessor("TestExternalUpper")
+	require.True(t, ok)
+	require.Equal(t, 2, info.BatchSize)
+	require.Equal(t, "Runs "+os.Args[0], info.Description)
+
+	// Rows of tables using the processor are sent in batches, without NULL values and the escaping of the COPY format
+	mapper := &DBMapper{DBName: "test", Seed: 1, ColumnMaps: []ColumnMapper{{
+		TableSchema: "public",
+		TableName:   "members",
+		ColumnName:  "code",
+		DataType:    "text",
+		Processors:  []ProcessorDefinition{{Name: "TestExternalUpper"}},
+	}}}
+	require.Nil(t, mapper.Validate())
+	dumpProcessor, err := NewProcessor(ProcessorOptions{Mapper: mapper})
+	require.Nil(t, err)
+	var dst bytes.Buffer
+	src := "COPY public.members (id, code) FROM stdin;\n1\ta\n2\tb\n3\t\\N\n4\tc\\td\n\\.\n"
+	require.Nil(t, dumpProcessor.Process(strings.NewReader(src), &dst))
+	require.Contains(t, dst.String(), "\n1\tXA/2\n2\tXB/2\n3\t\\N\n4\tXC\\tD/1\n\\.\n")
+
+	cmap := &mapper.ColumnMaps[0]
+	outputs, err := processor.ProcessBatch(cmap, []string{})
+	require.Nil(t, err)
+	require.Empty(t, outputs)
+
+	// Errors returned by the command are returned without restarting it
+	_, err = processor.Process(cmap, "fail")
+	require.NotNil(t, err)
+	require.Equal(t, "processor TestExternalUpper: invalid value fail", err.Error())
+
+	// The command is restarted when it exits and the request is sent again
+	output, err := processor.Process(cmap, "crash")
+	require.Nil(t, err)
+	require.Equal(t, "XCRASH/1", output)
+
+	// The command is killed when it does not respond in time, and started again when the processor is used
+	processor.config.Timeout = 200 * time.Millisecond
+	_, err = processor.Process(cmap, "sleep")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "the command did not respond within 200ms")
+	output, err = processor.Process(cmap, "e")
+	require.Nil(t, err)
+	require.Equal(t, "XE/1", output)
+}
+
+// TestExternalProcessorCommand is the command run by the TestExternalUpper processor of TestExternalProcessor. It
+// returns the values in upper case prefixed by X and suffixed by the size of the batch.
+func TestExternalProcessorCommand(t *testing.T) {
+	if os.Getenv("GONYMIZER_TEST_EXTERNAL_PROCESSOR") != "1" {
+		return
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			os.Exit(0)
+		}
+		var request externalRequest
+		if err = json.Unmarshal(line, &request); err != nil {
+			os.Exit(2)
+		}
+
+		response := externalResponse{ID: request.ID, Values: make([]string, len(request.Values))}
+		for i, value := range request.Values {
+			switch value {
+			case "fail":
+				response = externalResponse{ID: request.ID, Error: "invalid value " + value}
+			case "crash":
+				crashFile := os.Getenv("GONYMIZER_TEST_CRASH_FILE")
+				if _, err := os.Stat(crashFile); os.IsNotExist(err) {
+					_ = ioutil.WriteFile(crashFile, []byte{}, 0600)
+					fmt.Fprintln(os.Stderr, "crashing")
+					os.Exit(1)
+				}
+			case "sleep":
+				time.Sleep(time.Minute)
+			}
+			if len(response.Values) > 0 {
+				response.Values[i] = fmt.Sprintf("X%s/%d", strings.ToUpper(value), len(request.Values))
+			}
+		}
+
+		output, _ := json.Marshal(response)
+		fmt.Println(string(output))
+	}
+}
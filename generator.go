@@ -2,23 +2,21 @@ package gonymizer
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
-	mathRand "math/rand"
 	"os"
 	"strings"
-	"unicode"
-
-	"github.com/spf13/viper"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-var lineCount = int64(0) // Used to notify user progress during processing
+// streamBufferSize is the size of the buffers used when reading and writing dump files. Larger buffers keep the
+// number of round trips low when streaming to and from remote storage.
+const streamBufferSize = 1024 * 1024
 
 // StateChangeTokenBeginCopy is the token used to notify the processor that we have hit SQL-COPY in the dump file
 // StateChangeTokenEndCopy is the token used to notify the processor that we are done with SQL-COPY
@@ -45,7 +43,8 @@ func (curLine *LineState) Clear() {
 }
 
 // CreateDumpFile will create a PostgreSQL dump file from the specified PGConfig to the location, and with
-// restrictions, that are provided by the inputs to the function.
+// restrictions, that are provided by the inputs to the function. The dump file may be a local path or a storage URL,
+// and is encrypted as it is written when encryption is enabled.
 func CreateDumpFile(
 	conf PGConfig,
 	dumpfilePath,
@@ -55,13 +54,146 @@ func CreateDumpFile(
 	excludeCreateSchemas,
 	schemas []string,
 ) error {
+	return CreateDumpFileContext(context.Background(), conf, dumpfilePath, schemaPrefix, excludeTables,
+		excludeDataTables, excludeCreateSchemas, schemas)
+}
 
-	var (
-		errBuffer bytes.Buffer
-		outBuffer bytes.Buffer
-	)
+// CreateDumpFileContext is the same as CreateDumpFile, but pg_dump is killed when the context is cancelled. The
+// output of pg_dump is streamed into the dump file so an unencrypted copy of the dump is never written to disk. The
+// incomplete dump file is removed, or its upload aborted, if pg_dump does not complete.
+func CreateDumpFileContext(
+	ctx context.Context,
+	conf PGConfig,
+	dumpfilePath,
+	schemaPrefix string,
+	excludeTables,
+	excludeDataTables,
+	excludeCreateSchemas,
+	schemas []string,
+) error {
+	_, err := CreateDumpFileWithManifestContext(ctx, conf, dumpfilePath, schemaPrefix, excludeTables,
+		excludeDataTables, excludeCreateSchemas, schemas)
+	return err
+}
+
+// CreateDumpFileWithManifest is the same as CreateDumpFile, but also returns a Manifest with the checksum of the dump
+// file, and the tables and their exact row counts in the dump file. The dump is checksummed and its rows are counted
+// while it is written. The manifest is not signed or written.
+func CreateDumpFileWithManifest(
+	conf PGConfig,
+	dumpfilePath,
+	schemaPrefix string,
+	excludeTables,
+	excludeDataTables,
+	excludeCreateSchemas,
+	schemas []string,
+) (*Manifest, error) {
+	return CreateDumpFileWithManifestContext(context.Background(), conf, dumpfilePath, schemaPrefix, excludeTables,
+		excludeDataTables, excludeCreateSchemas, schemas)
+}
+
+// CreateDumpFileWithManifestContext is the same as CreateDumpFileWithManifest, but pg_dump is killed when the context
+// is cancelled.
+func CreateDumpFileWithManifestContext(
+	ctx context.Context,
+	conf PGConfig,
+	dumpfilePath,
+	schemaPrefix string,
+	excludeTables,
+	excludeDataTables,
+	excludeCreateSchemas,
+	schemas []string,
+) (*Manifest, error) {
+	manifest := NewManifest("dump")
+
+	dstFile, err := CreateURL(dumpfilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := newManifestHasher()
+	err = CreateDumpContext(ctx, conf, io.MultiWriter(dstFile, hasher), schemaPrefix, excludeTables,
+		excludeDataTables, excludeCreateSchemas, schemas)
+	if err != nil {
+		abortWriter(dstFile, err)
+		if IsLocalURL(dumpfilePath) {
+			removePartialFile(localPath(dumpfilePath))
+		}
+		return nil, err
+	}
+	if err = dstFile.Close(); err != nil {
+		return nil, err
+	}
+
+	manifest.Output = hasher.File(dumpfilePath)
+	manifest.Tables = hasher.Tables()
+	manifest.RowCounts = hasher.RowCounts()
+	manifest.Source = fmt.Sprintf("%s/%s", conf.Host, conf.DefaultDBName)
+	manifest.CompletedAt = time.Now().UTC()
+	return manifest, nil
+}
+
+// CreateDump will run pg_dump using the specified PGConfig and restrictions, and write the dump to dst.
+func CreateDump(
+	conf PGConfig,
+	dst io.Writer,
+	schemaPrefix string,
+	excludeTables,
+	excludeDataTables,
+	excludeCreateSchemas,
+	schemas []string,
+) error {
+	return CreateDumpContext(context.Background(), conf, dst, schemaPrefix, excludeTables, excludeDataTables,
+		excludeCreateSchemas, schemas)
+}
+
+// CreateDumpContext is the same as CreateDump, but pg_dump is killed when the context is cancelled.
+func CreateDumpContext(
+	ctx context.Context,
+	conf PGConfig,
+	dst io.Writer,
+	schemaPrefix string,
+	excludeTables,
+	excludeDataTables,
+	excludeCreateSchemas,
+	schemas []string,
+) error {
+	ctx, stopStep := StartStep(ctx, "dump")
+	defer stopStep()
+
+	errTail := newTailBuffer(maxStderrTail)
 
 	cmd := "pg_dump"
+	args := pgDumpArgs(schemaPrefix, excludeTables, excludeDataTables, excludeCreateSchemas, schemas)
+
+	// Always put URI last
+	args = append(args, conf.CommandURI())
+
+	env, cleanup, err := conf.CommandEnv()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	// Execute pg_dump, streaming the dump from its standard output
+	writer := bufio.NewWriterSize(dst, streamBufferSize)
+	options := PostgresCmdOptions{Stdout: writer, Stderr: errTail, Env: env}
+	if err = ExecPostgresCommand(ctx, options, cmd, args...); err != nil {
+		loggerFromContext(ctx).Error("STDERR: ", errTail.String())
+		loggerFromContext(ctx).Error(err)
+		return err
+	}
+	return writer.Flush()
+}
+
+// pgDumpArgs returns the pg_dump arguments for the supplied restrictions.
+func pgDumpArgs(
+	schemaPrefix string,
+	excludeTables,
+	excludeDataTables,
+	excludeCreateSchemas,
+	schemas []string,
+) []string {
 	args := []string{
 		"--oids",
 		"--no-owner",
@@ -97,25 +229,13 @@ func CreateDumpFile(
 	for _, tbl := range excludeDataTables {
 		args = append(args, fmt.Sprintf("--exclude-table-data=%s", tbl))
 	}
-
-	args = append(args, "-f")
-	args = append(args, dumpfilePath)
-
-	// Always put URI last
-	args = append(args, conf.URI())
-
-	// Execute pg_dump
-	err := ExecPostgresCommandOutErr(&outBuffer, &errBuffer, cmd, args...)
-	if err != nil {
-		log.Error("STDOUT: ", outBuffer.String())
-		log.Error("STDERR: ", errBuffer.String())
-		log.Error(err)
-	}
-	return err
+	return args
 }
 
 // ProcessDumpFile will process the supplied dump file according to the supplied database map file. GenerateSeed can
-// also be set to true which will inform the function to use Go's built-in random number generator.
+// also be set to true which will inform the function to use Go's built-in random number generator. The src and dst
+// may be local paths or URLs for any registered Storage backend, in which case the files are streamed directly from
+// and to the storage backend.
 func ProcessDumpFile(mapper *DBMapper,
 	src,
 	dst,
@@ -123,138 +243,141 @@ func ProcessDumpFile(mapper *DBMapper,
 	postProcessFile string,
 	generateSeed bool,
 ) error {
+	return ProcessDumpFileContext(context.Background(), mapper, src, dst, preProcessFile, postProcessFile, generateSeed)
+}
 
-	var (
-		inputLine  string
-		outputLine string
-	)
-	if generateSeed {
-		for {
-			randVal, err := generateRandomInt64()
-			if err != nil {
-				log.Error(err)
-			} else {
-				log.Debugf("Using internal number generator for seed value: %d", randVal)
-				mathRand.Seed(randVal)
-				break
-			}
-		}
-	} else {
-		randVal := mapper.Seed
-		if randVal == 0 {
-			return errors.New("Expected non-zero Seed")
-		}
-		log.Debugf("Using map file for seed value: %d", randVal)
-		mathRand.Seed(mapper.Seed)
-	}
+// ProcessDumpFileContext is the same as ProcessDumpFile, but stops when the context is cancelled. The incomplete
+// processed file is never kept.
+func ProcessDumpFileContext(ctx context.Context,
+	mapper *DBMapper,
+	src,
+	dst,
+	preProcessFile,
+	postProcessFile string,
+	generateSeed bool,
+) error {
+	_, err := ProcessDumpFileWithManifestContext(ctx, mapper, src, dst, preProcessFile, postProcessFile, generateSeed)
+	return err
+}
 
-	srcFile, err := os.Open(src)
-	if err != nil {
-		log.Error(err)
-		log.Debug("src: ", src)
-		log.Debug("dst: ", dst)
-		return err
-	}
-	defer srcFile.Close()
+// ProcessDumpFileWithManifest is the same as ProcessDumpFile, but also returns a Manifest with the checksums of the dump
+// file and the processed file, and the tables and their exact row counts in the dump file. The manifest is not signed
+// or written.
+func ProcessDumpFileWithManifest(mapper *DBMapper,
+	src,
+	dst,
+	preProcessFile,
+	postProcessFile string,
+	generateSeed bool,
+) (*Manifest, error) {
+	return ProcessDumpFileWithManifestContext(context.Background(), mapper, src, dst, preProcessFile, postProcessFile,
+		generateSeed)
+}
 
-	fileReader := bufio.NewReader(srcFile)
+// ProcessDumpFileWithManifestContext is the same as ProcessDumpFileWithManifest, but stops when the context is
+// cancelled.
+func ProcessDumpFileWithManifestContext(ctx context.Context,
+	mapper *DBMapper,
+	src,
+	dst,
+	preProcessFile,
+	postProcessFile string,
+	generateSeed bool,
+) (*Manifest, error) {
+	logger := loggerFromContext(ctx)
+	ctx, stopStep := StartStep(ctx, "process")
+	defer stopStep()
 
-	dstFile, err := os.Create(dst)
+	manifest := NewManifest("process")
+	processor, err := newFileProcessor(mapper, preProcessFile, postProcessFile, generateSeed)
 	if err != nil {
-		log.Error(err)
-		log.Debug("src: ", src)
-		log.Debug("dst: ", dst)
-		return err
+		return nil, err
 	}
-	defer dstFile.Close()
+	processor.logger = logger
 
-	// Call fileInjector to write any required configuration settings to the top of the
-	// processed dump file
-	if len(preProcessFile) > 0 {
-		if err = fileInjector(preProcessFile, dstFile); err != nil {
-			log.Error("Unable to run preProcessor")
-			return err
-		}
+	srcFile, err := OpenURL(src)
+	if err != nil {
+		logger.Error(err)
+		logger.Debug("src: ", RedactSecrets(src))
+		logger.Debug("dst: ", RedactSecrets(dst))
+		return nil, err
 	}
+	defer srcFile.Close()
 
-	// Always make sure we are in replication mode so we can import tables without constraints
-	if _, err := dstFile.WriteString("SET session_replication_role = 'replica';\n"); err != nil {
-		return err
+	dstFile, err := CreateURL(dst)
+	if err != nil {
+		logger.Error(err)
+		logger.Debug("src: ", RedactSecrets(src))
+		logger.Debug("dst: ", RedactSecrets(dst))
+		return nil, err
 	}
 
-	allDone := false
-	state := new(LineState)
-
-	for {
-		lineCount++
-		state.LineNum = lineCount
-		inputLine, err = fileReader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				// readline will fail if it doesn't encounter our delimiter (\n)
-				// EOF isn't a real error tho...
-
-				// do nothing
-				allDone = true
-			} else {
-				log.Error(err)
-				log.Debug("src: ", src)
-				log.Debug("dst: ", dst)
-				log.Debug("lineCount: ", lineCount)
-				log.Debug("inputLine: ", inputLine)
-				return err
-			}
-		}
-
-		state, outputLine, err = processLine(mapper, state, inputLine)
-
-		if err != nil {
-			log.Error("processLine failure: ", err)
-			log.Debug("src: ", src)
-			log.Debug("dst: ", dst)
-			log.Debug("lineCount", lineCount)
-			log.Debug("inputLine", inputLine)
-			log.Debug("outputLine", outputLine)
-			return err
-		}
-
-		bytesWritten, err := dstFile.WriteString(outputLine)
-		if err != nil {
-			log.Error(err)
-			log.Debug("src: ", src)
-			log.Debug("dst: ", dst)
-			log.Debug("lineCount", lineCount)
-			log.Debug("inputLine", inputLine)
-			log.Debug("bytesWritten", bytesWritten)
-			return err
-		}
-
-		if allDone {
-			break
-		}
-
-		if lineCount%100000 == 0 {
-			log.Info("Processing line number: ", lineCount)
+	// The size is only used to report the progress so errors are ignored
+	var size int64
+	if storage, err := GetStorage(src); err == nil {
+		if object, err := storage.Stat(src); err == nil {
+			size = object.Size
 		}
 	}
-	if strings.ToLower(viper.GetString("log-level")) == "debug" {
-		err = writeDebugMap()
-		if err != nil {
-			return err
+
+	srcHasher := newManifestHasher()
+	dstHasher := newManifestHasher()
+	err = processor.process(
+		io.TeeReader(newContextReader(ctx, srcFile), srcHasher),
+		io.MultiWriter(dstFile, dstHasher),
+		newProgressTracker(ctx, size),
+	)
+	if err != nil {
+		logger.Debug("src: ", RedactSecrets(src))
+		logger.Debug("dst: ", RedactSecrets(dst))
+		// Make sure an incomplete processed file is never uploaded or left behind
+		abortWriter(dstFile, err)
+		if IsLocalURL(dst) {
+			removePartialFile(localPath(dst))
 		}
+		return nil, err
 	}
-	// Add in SQL at the end of the dump file
-	if len(postProcessFile) > 0 {
-		if err = fileInjector(postProcessFile, dstFile); err != nil {
-			return err
-		}
+	if err = dstFile.Close(); err != nil {
+		return nil, err
 	}
 
-	// Enable constraints (they were disabled earlier)
-	if _, err := dstFile.WriteString("SET session_replication_role = 'origin';\n"); err != nil {
+	input := srcHasher.File(src)
+	manifest.Input = &input
+	manifest.Output = dstHasher.File(dst)
+	manifest.Tables = srcHasher.Tables()
+	manifest.RowCounts = srcHasher.RowCounts()
+	manifest.SetSeed(mapper.Seed, generateSeed)
+	manifest.CompletedAt = time.Now().UTC()
+	return manifest, nil
+}
+
+// ProcessDump will read a dump from src, process it according to the supplied database map file, and write the
+// processed dump to dst. See ProcessDumpFile. The process.inclusive setting is read from the configuration, use a
+// Processor to process dumps without it.
+func ProcessDump(mapper *DBMapper,
+	src io.Reader,
+	dst io.Writer,
+	preProcessFile,
+	postProcessFile string,
+	generateSeed bool,
+) error {
+	return ProcessDumpContext(context.Background(), mapper, src, dst, preProcessFile, postProcessFile, generateSeed)
+}
+
+// ProcessDumpContext is the same as ProcessDump, but stops when the context is cancelled.
+func ProcessDumpContext(ctx context.Context,
+	mapper *DBMapper,
+	src io.Reader,
+	dst io.Writer,
+	preProcessFile,
+	postProcessFile string,
+	generateSeed bool,
+) error {
+	processor, err := newFileProcessor(mapper, preProcessFile, postProcessFile, generateSeed)
+	if err != nil {
 		return err
 	}
-	return nil
+	return processor.ProcessContext(ctx, src, dst)
 }
 
 // generateRandomInt64 will generate a pseudo random 64bit integer which is used for seeding the Go random
@@ -296,125 +419,6 @@ func generateSchemaSQL(conf PGConfig, outputFile *os.File, excludeCreateSchemas
 	return nil
 }
 
-// processLine will process the current line in the dump file by deciding which state the processor should be in
-// based on reading in the content of the current line in the dump file and analyzing it.
-func processLine(mapper *DBMapper, state *LineState, inputLine string) (*LineState, string, error) {
-
-	outputLine := inputLine
-	trimmedInput := strings.TrimLeftFunc(inputLine, unicode.IsSpace)
-	if len(trimmedInput) == 0 {
-		return state, outputLine, nil
-	}
-
-	if strings.HasPrefix(trimmedInput, "--") {
-		return state, outputLine, nil
-	}
-
-	if strings.HasPrefix(trimmedInput, StateChangeTokenBeginCopy) {
-		state.parseCopyLine(inputLine)
-		return state, outputLine, nil
-	}
-
-	if strings.HasPrefix(trimmedInput, StateChangeTokenEndCopy) {
-		state.Clear()
-		return state, outputLine, nil
-	}
-
-	if state.IsRow {
-		return processRow(mapper, state, inputLine)
-	}
-
-	return state, outputLine, nil
-}
-
-// processRow will process the line in the dump file IFF it is a SQL-line (eventual row in the database after import).
-func processRow(mapper *DBMapper, state *LineState, inputLine string) (*LineState, string, error) {
-
-	rowVals := strings.Split(inputLine, "\t")
-	outputVals := make([]string, 0, len(rowVals))
-
-	for i, columnName := range state.ColumnNames {
-		var (
-			err        error
-			escapeChar string
-			output     string
-		)
-
-		cmap := mapper.ColumnMapper(state.SchemaName, state.TableName, columnName)
-		if cmap == nil && viper.GetBool("process.inclusive") {
-			log.Fatalf("Column '%s.%s.%s' does not exist. Please add to Map file",
-				state.SchemaName, state.TableName, columnName)
-			os.Exit(1)
-		}
-		val := rowVals[i]
-
-		// Check to see if the column has an escape char at the end of it.
-		// If so cut it and keep it for later
-		if strings.HasSuffix(val, "\n") {
-			escapeChar = "\n"
-			val = strings.Replace(val, "\n", "", -1)
-		} else if strings.HasSuffix(val, "\t") {
-			escapeChar = "\t"
-			val = strings.Replace(val, "\t", "", -1)
-		}
-
-		// If column value is nil or if this column is not mapped, keep the value and continue on
-		if val == "\\N" || cmap == nil {
-			output = val
-		} else {
-			output, err = processValue(cmap, val)
-			if err != nil {
-				log.Error(err)
-				log.Debug("i: ", i)
-				log.Debug("columnName: ", columnName)
-				return state, "****************** PROCESS ROW ERROR ******************", err
-			}
-		}
-		// Add escape character back to column
-		output += escapeChar
-
-		// Append the column to our new line
-		outputVals = append(outputVals, output)
-	}
-
-	outputLine := strings.Join(outputVals, "\t")
-
-	return state, outputLine, nil
-}
-
-// processValue will anonymize or ignore the current value for a given column in the dump file
-func processValue(cmap *ColumnMapper, input string) (string, error) {
-	var err error
-
-	output := input
-
-	for i, procDef := range cmap.Processors {
-
-		pfunc := ProcessorCatalog[procDef.Name]
-
-		if pfunc == nil {
-			log.Error(err)
-			log.Error("Unknown Processor Name: ", procDef.Name)
-			log.Debug("i: ", i)
-			log.Debug("procDef: ", procDef)
-			log.Debug("cmap: ", cmap)
-			log.Debug("input: ", input)
-			return "", err
-
-		}
-
-		output, err = pfunc(cmap, input)
-		if err != nil {
-			log.Error(err)
-			log.Debug("i: ", i)
-			log.Debug("cmap: ", cmap)
-			log.Debug("input: ", input)
-			return "", err
-		}
-	}
-	return output, nil
-}
-
 // parseCopyLine will parse the /copy line in a PostgreSQL dump file
 func (curLine *LineState) parseCopyLine(inputLine string) {
 
@@ -447,56 +451,65 @@ func (curLine *LineState) parseCopyLine(inputLine string) {
 }
 
 // fileInjector writes data to the current position in the destination file from the source file
-func fileInjector(srcFileName string, dstFile *os.File) error {
-	srcFile, err := os.Open(srcFileName)
+func fileInjector(srcFileName string, dstFile io.Writer) error {
+	srcFile, err := OpenURL(srcFileName)
 	if err != nil {
 		return err
 	}
 	defer srcFile.Close()
-	srcBuf := bufio.NewReader(srcFile)
+	return sqlInjector("file: "+srcFileName, srcFile, dstFile)
+}
+
+// sqlInjector writes the SQL read from src to the current position in the destination file. The source describes where
+// the SQL came from in the tags surrounding it.
+func sqlInjector(source string, src io.Reader, dstFile io.Writer) error {
+	srcBuf := bufio.NewReader(src)
 
 	// Add the start tag to the destination file to indicate we are injecting another file into this one
 	startTag := fmt.Sprintf(`
 --
--- Begin Gonymizer Injection from file: %s
+-- Begin Gonymizer Injection from %s
 --
 
-`, srcFileName)
-	if _, err := dstFile.WriteString(startTag); err != nil {
+`, source)
+	if _, err := io.WriteString(dstFile, startTag); err != nil {
 		return err
 	}
 
 	for {
 		inputLine, err := srcBuf.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				return err
+		if err != nil && err != io.EOF {
+			return err
+		}
+		// Copy data from the source file into processed dump file. The last line may not end with a newline
+		if len(inputLine) > 0 {
+			if !strings.HasSuffix(inputLine, "\n") {
+				inputLine += "\n"
+			}
+			if _, writeErr := io.WriteString(dstFile, inputLine); writeErr != nil {
+				return writeErr
 			}
 		}
-		// Copy data from the source file into processed dump file
-		_, err = dstFile.WriteString(inputLine)
-		if err != nil {
-			return nil
+		if err == io.EOF {
+			break
 		}
 	}
 
 	// Add end tag to the destination file to indicate the injection is complete
 	endTag := fmt.Sprintf(`
 --
--- End Gonymizer File Injection from file: %s
+-- End Gonymizer File Injection from %s
 --
-`, srcFileName)
+`, source)
 
-	_, err = dstFile.WriteString(endTag)
+	_, err := io.WriteString(dstFile, endTag)
 	return err
 }
 
 // writeDebugMap is used to store the reverse of the original data to the anonymized data.
 // WARNING: this is disabled by default and the programmer must add this function back in to use it. Only use this
 // function when debugging improvements to the map and process commands.
-func writeDebugMap() (err error) {
+func writeDebugMap(random *ProcessorRandom) (err error) {
 	// Dump map to disk for debug
 	outputFile, err := os.OpenFile("/tmp/map.txt", os.O_RDWR|os.O_CREATE, 0660)
 	if err != nil {
@@ -505,13 +518,13 @@ func writeDebugMap() (err error) {
 	}
 	defer outputFile.Close()
 
-	for k, v := range UUIDMap {
+	for k, v := range random.uuids {
 		_, err = outputFile.WriteString(fmt.Sprintf("%s => %s\n", k, v))
 		if err != nil {
 			return err
 		}
 	}
-	for k1, v1 := range AlphaNumericMap {
+	for k1, v1 := range random.alphaNumeric {
 		_, err = outputFile.WriteString(fmt.Sprintf("\n=================\n%s\n=================\n", k1))
 		if err != nil {
 			return err
@@ -1,11 +1,17 @@
 package gonymizer
 
 import (
+	"bytes"
 	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
 
+	"filippo.io/age"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/require"
 )
 
@@ -38,6 +44,59 @@ func TestCreateDumpFile(t *testing.T) {
 	require.Nil(t, SQLCommandFile(conf, TestCreateFile, true))
 }
 
+func TestCreateDumpFileEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonymizer-dump")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer SetEncryption(nil)
+
+	// pg_dump is replaced by a script which writes the dump to its standard output
+	script := "#!/bin/sh\nprintf 'COPY public.users (id, email) FROM stdin;\\n1\\tjohn@example.com\\n\\\\.\\n'\n"
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "pg_dump"), []byte(script), 0700))
+	viper.Set("PG_BIN_DIR", dir)
+	defer viper.Set("PG_BIN_DIR", nil)
+
+	identity, err := age.GenerateX25519Identity()
+	require.Nil(t, err)
+	identityFile := filepath.Join(dir, "identity.txt")
+	require.Nil(t, ioutil.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600))
+	enc, err := NewEncryption(EncryptionConfig{
+		AgeRecipients: []string{identity.Recipient().String()},
+		AgeIdentities: []string{identityFile},
+	})
+	require.Nil(t, err)
+	SetEncryption(enc)
+
+	dumpFile := filepath.Join(dir, "dump.sql.age")
+	manifest, err := CreateDumpFileWithManifest(GetTestDbConf(TestDb), dumpFile, "", nil, nil, nil, nil)
+	require.Nil(t, err)
+
+	// The manifest is created while the dump is written and matches the decrypted dump
+	output, rowCounts, err := HashURL(dumpFile)
+	require.Nil(t, err)
+	require.Equal(t, output, manifest.Output)
+	require.Equal(t, rowCounts, manifest.RowCounts)
+	require.Equal(t, []string{"public.users"}, manifest.Tables)
+	require.Equal(t, "dump", manifest.Command)
+
+	// The dump is encrypted as it is written, and only the dump file is created
+	raw, err := ioutil.ReadFile(dumpFile)
+	require.Nil(t, err)
+	require.NotContains(t, string(raw), "john@example.com")
+	require.Equal(t, testEncryptionPlaintext, readTestURL(t, dumpFile))
+	files, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, files, 3)
+
+	// The incomplete dump file is removed when pg_dump fails
+	script = "#!/bin/sh\necho partial\nexit 1\n"
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "pg_dump"), []byte(script), 0700))
+	failedFile := filepath.Join(dir, "failed.sql.age")
+	require.NotNil(t, CreateDumpFile(GetTestDbConf(TestDb), failedFile, "", nil, nil, nil, nil))
+	_, err = os.Stat(failedFile)
+	require.True(t, os.IsNotExist(err))
+}
+
 func TestProcessDumpFile(t *testing.T) {
 	conf := GetTestDbConf(TestDb)
 
@@ -72,6 +131,25 @@ func TestProcessDumpFile(t *testing.T) {
 	require.Nil(t, SQLCommandFile(conf, TestProcessDumpfile, true)) //Must ignore errors
 }
 
+func TestProcessDump(t *testing.T) {
+	var dst bytes.Buffer
+
+	columnMap, err := LoadConfigSkeleton(TestMapFile)
+	require.Nil(t, err)
+
+	src, err := os.Open(TestDbFile)
+	require.Nil(t, err)
+	defer src.Close()
+
+	require.Nil(t, ProcessDump(columnMap, src, &dst, "", "", true))
+	require.True(t, strings.HasPrefix(dst.String(), "SET session_replication_role = 'replica';\n"))
+	require.True(t, strings.HasSuffix(dst.String(), "SET session_replication_role = 'origin';\n"))
+
+	// Read errors must be returned instead of writing a truncated file
+	require.NotNil(t, ProcessDump(columnMap, iotest.TimeoutReader(strings.NewReader("SELECT 1;\n")), &dst, "", "",
+		true))
+}
+
 func TestGenerateRandomInt64(t *testing.T) {
 	var test int64
 	num, err := generateRandomInt64()
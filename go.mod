@@ -3,9 +3,12 @@ module github.com/rkuska/gonymizer
 go 1.13
 
 require (
+	cloud.google.com/go/storage v1.10.0
+	filippo.io/age v1.0.0
+	github.com/Azure/azure-storage-blob-go v0.10.0
 	github.com/aws/aws-sdk-go v1.24.0
 	github.com/corpix/uarand v0.1.0 // indirect
-	github.com/google/uuid v1.1.1
+	github.com/google/uuid v1.1.2
 	github.com/icrowley/fake v0.0.0-20180203215853-4178557ae428
 	github.com/lib/pq v1.1.1
 	github.com/logrusorgru/aurora v0.0.0-20190428105938-cea283e61946
@@ -13,10 +16,21 @@ require (
 	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b // indirect
 	github.com/onsi/ginkgo v1.10.1 // indirect
 	github.com/onsi/gomega v1.7.0 // indirect
-	github.com/sirupsen/logrus v1.4.1
+	github.com/pkg/sftp v1.12.0
+	github.com/prometheus/client_golang v1.11.1
+	github.com/robfig/cron/v3 v3.0.1
+	github.com/sirupsen/logrus v1.6.0
 	github.com/spf13/cobra v0.0.5
+	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.4.0
-	github.com/stretchr/testify v1.3.0
+	github.com/stretchr/testify v1.7.0
 	github.com/x-cray/logrus-prefixed-formatter v0.5.2
-	golang.org/x/crypto v0.0.0-20190506204251-e1dfcc566284
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
+	google.golang.org/api v0.28.0
+	modernc.org/sqlite v1.10.8
 )
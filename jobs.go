@@ -0,0 +1,786 @@
+package gonymizer
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// JobStepMap generates a map file skeleton of the source database
+// JobStepDump dumps the source database
+// JobStepProcess anonymizes the dump file using the map file
+// JobStepLoad loads the processed file into the target database
+const (
+	JobStepMap     = "map"
+	JobStepDump    = "dump"
+	JobStepProcess = "process"
+	JobStepLoad    = "load"
+)
+
+// JobStatusQueued is the status of a job waiting for a previous job of the same database to complete
+// JobStatusCancelled is the status of a job that was cancelled before it completed
+const (
+	JobStatusQueued    = "queued"
+	JobStatusCancelled = "cancelled"
+)
+
+// jobSteps are all steps of a job in the order they are executed.
+var jobSteps = []string{JobStepMap, JobStepDump, JobStepProcess, JobStepLoad}
+
+const (
+	// defaultMaxJobs is the number of completed jobs kept when JobServerOptions.MaxJobs is not set.
+	defaultMaxJobs = 100
+	// maxJobLogLines is the number of log lines kept per job. Older lines are dropped.
+	maxJobLogLines = 10000
+	// jobFilesDir is the directory of JobServerOptions.WorkDir the files of requests are relative to.
+	jobFilesDir = "files"
+	// jobRunsDir is the directory of JobServerOptions.WorkDir the intermediate files of running jobs are stored in.
+	jobRunsDir = "jobs"
+)
+
+// JobServerOptions configures a JobServer.
+type JobServerOptions struct {
+	// SourceDatabases are the databases jobs may map and dump by name, and TargetDatabases are the databases jobs may
+	// load into. Requests only contain the name so credentials are never sent to the server. A database may not be
+	// both a source and a target, so source databases are never replaced.
+	SourceDatabases map[string]PGConfig
+	TargetDatabases map[string]PGConfig
+	// Tokens are the bearer tokens that may use the API by name. The name is recorded as the operator of the job.
+	Tokens map[string]string
+	// WorkDir is the directory owned by the server that all files of jobs are stored in. The files of requests are
+	// relative to its "files" directory, and intermediate files are stored in its "jobs" directory while a job runs.
+	WorkDir string
+	// Manifest configures how the manifests of the files loaded by jobs are verified. Jobs always require a manifest.
+	Manifest ManifestOptions
+	// SigningKey signs the manifests of the files processed by jobs. It is required when Manifest.Keys are set so jobs
+	// can load the files they process.
+	SigningKey ed25519.PrivateKey
+	// MaxConcurrentJobs is the number of jobs (for different databases) that may run at the same time. Defaults to 1.
+	MaxConcurrentJobs int
+	// MaxJobs is the number of completed jobs kept. Defaults to 100.
+	MaxJobs int
+	// OnComplete is called with every job that completes, fails, or is cancelled.
+	OnComplete func(job Job)
+}
+
+// JobServer runs anonymization jobs submitted over HTTP (see: Handler). Jobs using the same database run one after
+// another in the order they were submitted.
+type JobServer struct {
+	options JobServerOptions
+
+	mutex   sync.Mutex
+	jobs    map[string]*Job
+	order   []*Job
+	active  map[string]bool
+	running int
+	stopped bool
+	changed chan struct{}
+
+	// callbacks tracks the OnComplete calls that have not returned yet
+	callbacks sync.WaitGroup
+}
+
+// JobRequest is a job submitted to the JobServer. Steps run in the order: dump, process, load. The output of each step
+// is the input of the next, and intermediate files are removed when the job completes. Dumps contain PHI/PII, so they
+// are always processed by the job that created them and are never stored outside of the job. The map step writes the
+// skeleton of the map file to <map_file>.skeleton.json, which must be reviewed before it is used, so it can not be
+// combined with other steps. Files are relative to the files directory of JobServerOptions.WorkDir.
+type JobRequest struct {
+	Steps            []string `json:"steps"`
+	SourceDatabase   string   `json:"source_database,omitempty"`
+	TargetDatabase   string   `json:"target_database,omitempty"`
+	MapFile          string   `json:"map_file,omitempty"`
+	DumpFile         string   `json:"dump_file,omitempty"`
+	ProcessedFile    string   `json:"processed_file,omitempty"`
+	PreProcessFile   string   `json:"pre_process_file,omitempty"`
+	PostProcessFile  string   `json:"post_process_file,omitempty"`
+	GenerateSeed     bool     `json:"generate_seed,omitempty"`
+	SchemaPrefix     string   `json:"schema_prefix,omitempty"`
+	Schemas          []string `json:"schemas,omitempty"`
+	ExcludeSchemas   []string `json:"exclude_schemas,omitempty"`
+	ExcludeTables    []string `json:"exclude_tables,omitempty"`
+	ExcludeTableData []string `json:"exclude_table_data,omitempty"`
+}
+
+// Job is a job of the JobServer.
+type Job struct {
+	ID          string     `json:"id"`
+	Operator    string     `json:"operator"`
+	Request     JobRequest `json:"request"`
+	Status      string     `json:"status"`
+	Step        string     `json:"step,omitempty"`
+	SubmittedAt time.Time  `json:"submitted_at"`
+	StartedAt   time.Time  `json:"started_at,omitempty"`
+	CompletedAt time.Time  `json:"completed_at,omitempty"`
+	Error       string     `json:"error,omitempty"`
+
+	database string
+	logs     []string
+	log      *log.Entry
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// jobLogHook is a logrus hook that adds the log lines of the logger of a job to the logs of that job.
+type jobLogHook struct {
+	server *JobServer
+	job    *Job
+}
+
+// NewJobServer will return a JobServer using the supplied options. At least one token is required.
+func NewJobServer(options JobServerOptions) (*JobServer, error) {
+	if len(options.Tokens) == 0 {
+		return nil, errors.New("at least one API token is required")
+	}
+	if len(options.WorkDir) == 0 {
+		options.WorkDir = filepath.Join(os.TempDir(), "gonymizer-jobs")
+	}
+	if options.MaxConcurrentJobs <= 0 {
+		options.MaxConcurrentJobs = 1
+	}
+	if options.MaxJobs <= 0 {
+		options.MaxJobs = defaultMaxJobs
+	}
+	if len(options.Manifest.Keys) > 0 && options.SigningKey == nil {
+		return nil, errors.New("a signing key is required to load the files processed by jobs when manifest keys are set")
+	}
+	for name, target := range options.TargetDatabases {
+		for sourceName, source := range options.SourceDatabases {
+			if name == sourceName || sameDatabase(source, target) {
+				return nil, fmt.Errorf("target database '%s' is also the source database '%s'", name, sourceName)
+			}
+		}
+	}
+	for _, dir := range []string{jobFilesDir, jobRunsDir} {
+		if err := os.MkdirAll(filepath.Join(options.WorkDir, dir), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	server := &JobServer{
+		options: options,
+		jobs:    map[string]*Job{},
+		active:  map[string]bool{},
+		changed: make(chan struct{}),
+	}
+	return server, nil
+}
+
+// Submit will validate the request and queue the job. The operator is recorded with the job.
+func (server *JobServer) Submit(request JobRequest, operator string) (Job, error) {
+	database, err := server.validate(request)
+	if err != nil {
+		return Job{}, err
+	}
+	id, err := newJobID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:          id,
+		Operator:    operator,
+		Request:     request,
+		Status:      JobStatusQueued,
+		SubmittedAt: time.Now().UTC(),
+		database:    database,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	job.log = server.newJobLogger(job)
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.stopped {
+		cancel()
+		return Job{}, errors.New("the job server is shutting down")
+	}
+	server.jobs[id] = job
+	server.order = append(server.order, job)
+	server.appendLog(job, fmt.Sprintf("Job submitted by %s: %s", operator, strings.Join(request.Steps, ", ")))
+	server.dispatch()
+	return job.snapshot(), nil
+}
+
+// Get will return the job with the supplied ID.
+func (server *JobServer) Get(id string) (Job, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	job, ok := server.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.snapshot(), true
+}
+
+// Jobs will return all jobs, newest first.
+func (server *JobServer) Jobs() []Job {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	jobs := make([]Job, 0, len(server.order))
+	for i := len(server.order) - 1; i >= 0; i-- {
+		jobs = append(jobs, server.order[i].snapshot())
+	}
+	return jobs
+}
+
+// Cancel will cancel the job. Queued jobs are cancelled immediately, running jobs stop their current step (killing
+// pg_dump and psql and removing the partially written files) and are marked cancelled once it has stopped.
+func (server *JobServer) Cancel(id string) (Job, error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	job, ok := server.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("job %s does not exist", id)
+	}
+
+	job.cancel()
+	if job.Status == JobStatusQueued {
+		job.Status = JobStatusCancelled
+		job.CompletedAt = time.Now().UTC()
+		server.appendLog(job, "Job cancelled")
+		server.complete(job)
+	} else if job.Status == RunStatusRunning {
+		server.appendLog(job, "Job cancelled, stopping the current step")
+	}
+	return job.snapshot(), nil
+}
+
+// Shutdown will cancel all queued and running jobs, and wait for the running jobs to stop and for their OnComplete
+// calls to return. Jobs submitted after Shutdown is called are rejected.
+func (server *JobServer) Shutdown() {
+	server.mutex.Lock()
+	server.stopped = true
+	ids := make([]string, 0)
+	for _, job := range server.order {
+		if !job.finished() {
+			ids = append(ids, job.ID)
+		}
+	}
+	server.mutex.Unlock()
+
+	for _, id := range ids {
+		_, _ = server.Cancel(id)
+	}
+
+	server.mutex.Lock()
+	for server.running > 0 {
+		changed := server.changed
+		server.mutex.Unlock()
+		<-changed
+		server.mutex.Lock()
+	}
+	server.mutex.Unlock()
+	server.callbacks.Wait()
+}
+
+// Handler will return an http.Handler serving the API:
+//
+//	POST /jobs               submit a JobRequest
+//	GET  /jobs               list all jobs
+//	GET  /jobs/{id}          get a job
+//	GET  /jobs/{id}/logs     stream the logs of a job until it completes
+//	POST /jobs/{id}/cancel   cancel a job
+//	GET  /healthz            health check (no token required)
+//
+// All endpoints except /healthz require an "Authorization: Bearer <token>" header.
+func (server *JobServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/jobs", server.authenticate(server.handleJobs))
+	mux.HandleFunc("/jobs/", server.authenticate(server.handleJob))
+	return mux
+}
+
+// authenticate will only call the handler for requests with a valid token. The name of the token is added to the
+// request as the X-Gonymizer-Operator header.
+func (server *JobServer) authenticate(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		for name, valid := range server.options.Tokens {
+			if len(valid) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(valid)) == 1 {
+				r.Header.Set("X-Gonymizer-Operator", name)
+				handler(w, r)
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(w, http.StatusUnauthorized, errors.New("a valid API token is required"))
+	}
+}
+
+// handleJobs will submit or list jobs.
+func (server *JobServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, server.Jobs())
+	case http.MethodPost:
+		var request JobRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		job, err := server.Submit(request, r.Header.Get("X-Gonymizer-Operator"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, job)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// handleJob will get, cancel, or stream the logs of a job.
+func (server *JobServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+	if _, ok := server.Get(parts[0]); !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("job %s does not exist", parts[0]))
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		job, _ := server.Get(parts[0])
+		writeJSON(w, http.StatusOK, job)
+	case len(parts) == 2 && parts[1] == "cancel" && r.Method == http.MethodPost:
+		job, err := server.Cancel(parts[0])
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, job)
+	case len(parts) == 2 && parts[1] == "logs" && r.Method == http.MethodGet:
+		server.streamLogs(w, r, parts[0])
+	default:
+		writeJSONError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// streamLogs will write the logs of the job to the response as they are added until the job completes or the client
+// disconnects.
+func (server *JobServer) streamLogs(w http.ResponseWriter, r *http.Request, id string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+
+	sent := 0
+	for {
+		server.mutex.Lock()
+		job := server.jobs[id]
+		if job == nil {
+			server.mutex.Unlock()
+			return
+		}
+		if sent > len(job.logs) {
+			sent = len(job.logs)
+		}
+		lines := append([]string{}, job.logs[sent:]...)
+		sent += len(lines)
+		finished := job.finished()
+		changed := server.changed
+		server.mutex.Unlock()
+
+		for _, line := range lines {
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if finished {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// validate will return an error if the request can not be run, or the name of the database the job is serialized on.
+func (server *JobServer) validate(request JobRequest) (string, error) {
+	if len(request.Steps) == 0 {
+		return "", errors.New("at least one step is required")
+	}
+	last := -1
+	for _, step := range request.Steps {
+		index := -1
+		for i, name := range jobSteps {
+			if name == step {
+				index = i
+			}
+		}
+		if index < 0 {
+			return "", fmt.Errorf("unknown step '%s', must be one of: %s", step, strings.Join(jobSteps, ", "))
+		}
+		if index <= last {
+			return "", fmt.Errorf("steps must be in order (%s) and may not be repeated", strings.Join(jobSteps, ", "))
+		}
+		last = index
+	}
+
+	has := func(step string) bool { return hasJobStep(request, step) }
+	if has(JobStepMap) && len(request.Steps) > 1 {
+		return "", errors.New("the map step writes a skeleton that must be reviewed and can not be combined with other steps")
+	}
+	if has(JobStepMap) || has(JobStepDump) {
+		if _, ok := server.options.SourceDatabases[request.SourceDatabase]; !ok {
+			return "", fmt.Errorf("unknown source database '%s'", request.SourceDatabase)
+		}
+	}
+	if has(JobStepLoad) {
+		if _, ok := server.options.TargetDatabases[request.TargetDatabase]; !ok {
+			return "", fmt.Errorf("unknown target database '%s'", request.TargetDatabase)
+		}
+	}
+	if (has(JobStepMap) || has(JobStepProcess)) && len(request.MapFile) == 0 {
+		return "", errors.New("map_file is required")
+	}
+	if has(JobStepDump) && !has(JobStepProcess) {
+		return "", errors.New("dumps contain PHI/PII and must be processed by the job that creates them")
+	}
+	if has(JobStepDump) && len(request.DumpFile) > 0 {
+		return "", errors.New("dump_file may not be set when the database is dumped, the dump is removed once processed")
+	}
+	if has(JobStepProcess) && !has(JobStepDump) && len(request.DumpFile) == 0 {
+		return "", errors.New("dump_file is required when the database is not dumped")
+	}
+	if has(JobStepProcess) && !has(JobStepLoad) && len(request.ProcessedFile) == 0 {
+		return "", errors.New("processed_file is required when the processed file is not loaded")
+	}
+	if has(JobStepLoad) && !has(JobStepProcess) && len(request.ProcessedFile) == 0 {
+		return "", errors.New("processed_file is required when the dump is not processed")
+	}
+	for _, file := range [][2]string{
+		{"map_file", request.MapFile},
+		{"dump_file", request.DumpFile},
+		{"processed_file", request.ProcessedFile},
+		{"pre_process_file", request.PreProcessFile},
+		{"post_process_file", request.PostProcessFile},
+	} {
+		if _, err := server.jobFile(file[1]); err != nil {
+			return "", fmt.Errorf("%s: %v", file[0], err)
+		}
+	}
+
+	if has(JobStepLoad) {
+		return request.TargetDatabase, nil
+	}
+	return request.SourceDatabase, nil
+}
+
+// dispatch will start the queued jobs whose database is not in use by another job, oldest first. The caller must hold
+// the mutex.
+func (server *JobServer) dispatch() {
+	for _, job := range server.order {
+		if server.running >= server.options.MaxConcurrentJobs {
+			return
+		}
+		if job.Status != JobStatusQueued || server.active[job.database] {
+			continue
+		}
+
+		server.active[job.database] = true
+		server.running++
+		job.Status = RunStatusRunning
+		job.StartedAt = time.Now().UTC()
+		server.notify()
+		go server.run(job)
+	}
+}
+
+// run will run the steps of the job, and start the next queued jobs once it completes.
+func (server *JobServer) run(job *Job) {
+	err := server.runSteps(job)
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	job.Step = ""
+	job.CompletedAt = time.Now().UTC()
+	switch {
+	case err == nil:
+		job.Status = RunStatusSuccess
+		server.appendLog(job, "Job completed")
+	case job.ctx.Err() != nil:
+		job.Status = JobStatusCancelled
+		server.appendLog(job, "Job cancelled")
+	default:
+		job.Status = RunStatusFailure
+		job.Error = RedactSecrets(err.Error())
+		server.appendLog(job, "Job failed: "+job.Error)
+	}
+
+	server.active[job.database] = false
+	server.running--
+	server.complete(job)
+	server.dispatch()
+}
+
+// runSteps will run the steps of the job using the library functions, passing the output of each step to the next.
+func (server *JobServer) runSteps(job *Job) (err error) {
+	request := job.Request
+
+	// Every job has its own trace, and the library functions log to the logs of the job
+	ctx, endSpan := StartSpan(job.ctx, "gonymizer job", attribute.String("job.id", job.ID))
+	defer func() { endSpan(err) }()
+	ctx = WithLogger(ctx, job.log)
+
+	workDir := filepath.Join(server.options.WorkDir, jobRunsDir, job.ID)
+	if err = os.MkdirAll(workDir, 0700); err != nil {
+		return err
+	}
+	defer func() {
+		if removeErr := os.RemoveAll(workDir); removeErr != nil {
+			job.log.Warn("Unable to remove intermediate files: ", removeErr)
+		}
+	}()
+
+	// The request was validated, so all files are in the files directory
+	mapFile, _ := server.jobFile(request.MapFile)
+	preProcessFile, _ := server.jobFile(request.PreProcessFile)
+	postProcessFile, _ := server.jobFile(request.PostProcessFile)
+	dumpFile, _ := server.jobFile(request.DumpFile)
+	if len(dumpFile) == 0 {
+		dumpFile = filepath.Join(workDir, "dump.sql")
+	}
+	processedFile, _ := server.jobFile(request.ProcessedFile)
+	if len(processedFile) == 0 {
+		processedFile = filepath.Join(workDir, "processed.sql")
+	}
+	source := server.options.SourceDatabases[request.SourceDatabase]
+	target := server.options.TargetDatabases[request.TargetDatabase]
+	loadOptions := LoadOptions{Manifest: ManifestOptions{Require: true, Keys: server.options.Manifest.Keys}}
+
+	for _, step := range request.Steps {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		server.mutex.Lock()
+		job.Step = step
+		server.notify()
+		server.mutex.Unlock()
+		job.log.Infof("Starting step: %s", step)
+
+		switch step {
+		case JobStepMap:
+			var mapper *DBMapper
+			excludeTables := append(append([]string{}, request.ExcludeTables...), request.ExcludeTableData...)
+			mapper, err = GenerateConfigSkeletonContext(ctx, source, request.SchemaPrefix, request.Schemas,
+				excludeTables)
+			if err == nil {
+				err = WriteConfigSkeleton(mapper, mapFile+".skeleton.json")
+			}
+		case JobStepDump:
+			err = CreateDumpFileContext(ctx, source, dumpFile, request.SchemaPrefix, request.ExcludeTables,
+				request.ExcludeTableData, request.ExcludeSchemas, request.Schemas)
+		case JobStepProcess:
+			err = server.process(ctx, mapFile, dumpFile, processedFile, preProcessFile, postProcessFile,
+				request.GenerateSeed)
+		case JobStepLoad:
+			// The file is verified against its manifest while it is loaded, before it replaces the database
+			err = LoadFileWithOptionsContext(ctx, target, processedFile, loadOptions)
+		}
+		if err != nil {
+			return fmt.Errorf("step '%s' failed: %v", step, err)
+		}
+	}
+	return nil
+}
+
+// process will anonymize the dump file and write the (signed) manifest of the processed file, which is verified when
+// the file is loaded.
+func (server *JobServer) process(ctx context.Context, mapFile, dumpFile, processedFile, preProcessFile,
+	postProcessFile string, generateSeed bool) error {
+	mapper, mapManifest, err := LoadConfigSkeletonWithManifest(mapFile)
+	if err != nil {
+		return err
+	}
+	manifest, err := ProcessDumpFileWithManifestContext(ctx, mapper, dumpFile, processedFile, preProcessFile,
+		postProcessFile, generateSeed)
+	if err != nil {
+		return err
+	}
+	manifest.MapFile = &mapManifest
+	if server.options.SigningKey != nil {
+		if err = manifest.Sign(server.options.SigningKey); err != nil {
+			return err
+		}
+	}
+	return WriteManifest(processedFile, manifest)
+}
+
+// jobFile will return the path of a file of a request in the files directory of the work directory. Files outside of
+// the files directory, including storage URLs, are refused so jobs can not read or write files the server does not
+// own. An empty name is returned as is.
+func (server *JobServer) jobFile(name string) (string, error) {
+	if len(name) == 0 {
+		return "", nil
+	}
+	clean := filepath.Clean(name)
+	if strings.Contains(name, "://") || filepath.IsAbs(clean) || clean == ".." ||
+		strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%s' must be a relative path in the files directory of the API", name)
+	}
+	return filepath.Join(server.options.WorkDir, jobFilesDir, clean), nil
+}
+
+// newJobLogger will return the logger of the job. Its lines are only added to the logs of the job, and are written to
+// the output of the standard logger.
+func (server *JobServer) newJobLogger(job *Job) *log.Entry {
+	standard := log.StandardLogger()
+	logger := log.New()
+	logger.Out = standard.Out
+	logger.Formatter = standard.Formatter
+	logger.Level = standard.GetLevel()
+	logger.AddHook(&jobLogHook{server: server, job: job})
+	return logger.WithContext(job.ctx).WithField("job", job.ID)
+}
+
+// complete will call OnComplete with the job and remove the oldest completed jobs. The caller must hold the mutex.
+func (server *JobServer) complete(job *Job) {
+	server.notify()
+	if server.options.OnComplete != nil {
+		snapshot := job.snapshot()
+		server.callbacks.Add(1)
+		go func() {
+			defer server.callbacks.Done()
+			server.options.OnComplete(snapshot)
+		}()
+	}
+
+	completed := 0
+	for _, job := range server.order {
+		if job.finished() {
+			completed++
+		}
+	}
+	kept := server.order[:0]
+	for _, job := range server.order {
+		if job.finished() && completed > server.options.MaxJobs {
+			completed--
+			delete(server.jobs, job.ID)
+			continue
+		}
+		kept = append(kept, job)
+	}
+	server.order = kept
+}
+
+// appendLog will add a line to the logs of the job. The caller must hold the mutex.
+func (server *JobServer) appendLog(job *Job, line string) {
+	job.logs = append(job.logs, time.Now().UTC().Format(time.RFC3339)+" "+line)
+	if len(job.logs) > maxJobLogLines {
+		job.logs = job.logs[len(job.logs)-maxJobLogLines:]
+	}
+	server.notify()
+}
+
+// notify will wake up everyone waiting for a job to change. The caller must hold the mutex.
+func (server *JobServer) notify() {
+	close(server.changed)
+	server.changed = make(chan struct{})
+}
+
+// Levels will return the log levels the hook is fired for.
+func (hook *jobLogHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel, log.InfoLevel}
+}
+
+// Fire will add the log entry to the logs of the job.
+func (hook *jobLogHook) Fire(entry *log.Entry) error {
+	hook.server.mutex.Lock()
+	defer hook.server.mutex.Unlock()
+	hook.server.appendLog(hook.job, strings.ToUpper(entry.Level.String())+" "+RedactSecrets(entry.Message))
+	return nil
+}
+
+// snapshot will return a copy of the job without the logs. The caller must hold the mutex.
+func (job *Job) snapshot() Job {
+	return Job{
+		ID:          job.ID,
+		Operator:    job.Operator,
+		Request:     job.Request,
+		Status:      job.Status,
+		Step:        job.Step,
+		SubmittedAt: job.SubmittedAt,
+		StartedAt:   job.StartedAt,
+		CompletedAt: job.CompletedAt,
+		Error:       job.Error,
+	}
+}
+
+// finished will return true if the job will not run (anymore).
+func (job *Job) finished() bool {
+	return job.Status == RunStatusSuccess || job.Status == RunStatusFailure || job.Status == JobStatusCancelled
+}
+
+// hasJobStep will return true if the request contains the step.
+func hasJobStep(request JobRequest, step string) bool {
+	for _, name := range request.Steps {
+		if name == step {
+			return true
+		}
+	}
+	return false
+}
+
+// newJobID will return a random job ID.
+func newJobID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// writeJSON will write the value as the JSON response.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	_ = encoder.Encode(value)
+}
+
+// writeJSONError will write the error as the JSON response.
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// sameDatabase will return true if both configurations connect to the same database as the same user. A host without a
+// port is compared as if it used the default PostgreSQL port.
+func sameDatabase(a, b PGConfig) bool {
+	aHost, aPort := a.HostPort()
+	bHost, bPort := b.HostPort()
+	if aPort == "" {
+		aPort = "5432"
+	}
+	if bPort == "" {
+		bPort = "5432"
+	}
+	return a.Service == b.Service && aHost == bHost && aPort == bPort && a.Username == b.Username &&
+		a.DefaultDBName == b.DefaultDBName
+}
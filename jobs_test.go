@@ -0,0 +1,280 @@
+package gonymizer
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestJobServer will return a JobServer with the map and dump files of the tests in its files directory.
+func newTestJobServer(t *testing.T, workDir string, completed chan Job) *JobServer {
+	server, err := NewJobServer(JobServerOptions{
+		SourceDatabases: map[string]PGConfig{"production": {Host: "production:5432", DefaultDBName: "store"}},
+		TargetDatabases: map[string]PGConfig{"store": {Host: "qa:5432", DefaultDBName: "store"}},
+		Tokens:          map[string]string{"ci": "secret"},
+		WorkDir:         workDir,
+		OnComplete:      func(job Job) { completed <- job },
+	})
+	require.Nil(t, err)
+
+	for name, src := range map[string]string{"map.json": TestMapFile, "dump.sql": TestDbFile} {
+		data, err := ioutil.ReadFile(src)
+		require.Nil(t, err)
+		require.Nil(t, ioutil.WriteFile(filepath.Join(workDir, jobFilesDir, name), data, 0600))
+	}
+	return server
+}
+
+func TestJobServer(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "gonymizer-jobs")
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	_, err = NewJobServer(JobServerOptions{WorkDir: workDir})
+	require.NotNil(t, err)
+
+	// Source databases may never be loaded into
+	for _, options := range []JobServerOptions{
+		{TargetDatabases: map[string]PGConfig{"production": {}}, SourceDatabases: map[string]PGConfig{"production": {}}},
+		{TargetDatabases: map[string]PGConfig{"qa": {Host: "db:5432", DefaultDBName: "store"}},
+			SourceDatabases: map[string]PGConfig{"production": {Host: "db:5432", DefaultDBName: "store"}}},
+		{TargetDatabases: map[string]PGConfig{"qa": {Host: "db", Username: "app", DefaultDBName: "store"}},
+			SourceDatabases: map[string]PGConfig{"production": {Host: "db:5432", Username: "app", DefaultDBName: "store"}}},
+		{Manifest: ManifestOptions{Keys: []ed25519.PublicKey{make(ed25519.PublicKey, ed25519.PublicKeySize)}}},
+	} {
+		options.Tokens = map[string]string{"ci": "secret"}
+		options.WorkDir = workDir
+		_, err = NewJobServer(options)
+		require.NotNil(t, err)
+	}
+
+	// Another port or user of the same host is not the same database
+	source := PGConfig{Host: "db", Username: "app", DefaultDBName: "store"}
+	require.True(t, sameDatabase(source, PGConfig{Host: "db:5432", Username: "app", DefaultDBName: "store"}))
+	require.False(t, sameDatabase(source, PGConfig{Host: "db:5433", Username: "app", DefaultDBName: "store"}))
+	require.False(t, sameDatabase(source, PGConfig{Host: "db", Username: "qa", DefaultDBName: "store"}))
+
+	completed := make(chan Job, 10)
+	server := newTestJobServer(t, workDir, completed)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	request := func(method, path, token, body string) *http.Response {
+		req, err := http.NewRequest(method, httpServer.URL+path, strings.NewReader(body))
+		require.Nil(t, err)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		return resp
+	}
+
+	// Health checks do not require a token, everything else does
+	resp := request(http.MethodGet, "/healthz", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+	for _, token := range []string{"", "wrong"} {
+		resp = request(http.MethodGet, "/jobs", token, "")
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		resp.Body.Close()
+	}
+
+	// Invalid requests are rejected
+	for _, body := range []string{
+		`{"steps": []}`,
+		`{"steps": ["load", "process"], "map_file": "map.json", "dump_file": "dump.sql", "target_database": "store"}`,
+		`{"steps": ["anonymize"]}`,
+		`{"steps": ["dump", "process"], "source_database": "unknown", "map_file": "map.json"}`,
+		`{"steps": ["process"], "map_file": "map.json", "dump_file": "dump.sql"}`,
+		`{"steps": ["load"], "target_database": "store", "processed_file": "out.sql", "unknown": true}`,
+		// Map files are reviewed before they are used
+		`{"steps": ["map", "dump", "process"], "source_database": "production", "map_file": "map.json"}`,
+		// Dumps are never stored outside of the job
+		`{"steps": ["dump"], "source_database": "production", "dump_file": "dump.sql"}`,
+		`{"steps": ["dump", "process"], "source_database": "production", "map_file": "map.json",
+			"dump_file": "dump.sql", "processed_file": "processed.sql"}`,
+		// Source databases are never loaded into
+		`{"steps": ["load"], "target_database": "production", "processed_file": "processed.sql"}`,
+		// Files are in the files directory of the server
+		`{"steps": ["load"], "target_database": "store", "processed_file": "/tmp/processed.sql"}`,
+		`{"steps": ["load"], "target_database": "store", "processed_file": "../jobs/processed.sql"}`,
+		`{"steps": ["load"], "target_database": "store", "processed_file": "s3://bucket/processed.sql"}`,
+		`{"steps": ["process"], "map_file": "map.json", "dump_file": "dump.sql", "processed_file": "processed.sql",
+			"pre_process_file": "/etc/passwd"}`,
+	} {
+		resp = request(http.MethodPost, "/jobs", "secret", body)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+		resp.Body.Close()
+	}
+
+	// Jobs run using the library functions and their logs are streamed
+	body, err := json.Marshal(JobRequest{
+		Steps:         []string{JobStepProcess},
+		MapFile:       "map.json",
+		DumpFile:      "dump.sql",
+		ProcessedFile: "processed.sql",
+	})
+	require.Nil(t, err)
+	resp = request(http.MethodPost, "/jobs", "secret", string(body))
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	var job Job
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&job))
+	resp.Body.Close()
+	require.Equal(t, "ci", job.Operator)
+
+	resp = request(http.MethodGet, "/jobs/"+job.ID+"/logs", "secret", "")
+	logs, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Contains(t, string(logs), "Job submitted by ci: process")
+	require.Contains(t, string(logs), "INFO Starting step: process")
+	require.Contains(t, string(logs), "Job completed")
+
+	job = <-completed
+	require.Equal(t, RunStatusSuccess, job.Status)
+	require.FileExists(t, filepath.Join(workDir, jobFilesDir, "processed.sql"))
+	require.FileExists(t, ManifestURL(filepath.Join(workDir, jobFilesDir, "processed.sql")))
+	resp = request(http.MethodGet, "/jobs/"+job.ID, "secret", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	// The library functions run by the steps log to the logs of the job
+	job, err = server.Submit(JobRequest{
+		Steps:          []string{JobStepLoad},
+		TargetDatabase: "store",
+		ProcessedFile:  "processed.sql",
+	}, "ci")
+	require.Nil(t, err)
+	job = <-completed
+	require.Equal(t, RunStatusFailure, job.Status)
+	resp = request(http.MethodGet, "/jobs/"+job.ID+"/logs", "secret", "")
+	logs, err = ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Contains(t, string(logs), "INFO Checking to see if database 'store_gonymizer_loading' exists")
+
+	// Failed steps fail the job
+	job, err = server.Submit(JobRequest{
+		Steps:         []string{JobStepProcess},
+		MapFile:       "missing_map.json",
+		DumpFile:      "dump.sql",
+		ProcessedFile: "processed.sql",
+	}, "ci")
+	require.Nil(t, err)
+	job = <-completed
+	require.Equal(t, RunStatusFailure, job.Status)
+	require.Contains(t, job.Error, "step 'process' failed")
+
+	// The logs of a job only contain the lines of that job
+	resp = request(http.MethodGet, "/jobs/"+job.ID+"/logs", "secret", "")
+	logs, err = ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Contains(t, string(logs), "Job failed")
+	require.NotContains(t, string(logs), "Job completed")
+
+	// Files are never loaded without a manifest
+	require.Nil(t, ioutil.WriteFile(filepath.Join(workDir, jobFilesDir, "unverified.sql"), []byte("SELECT 1;\n"), 0600))
+	job, err = server.Submit(JobRequest{
+		Steps:          []string{JobStepLoad},
+		TargetDatabase: "store",
+		ProcessedFile:  "unverified.sql",
+	}, "ci")
+	require.Nil(t, err)
+	job = <-completed
+	require.Equal(t, RunStatusFailure, job.Status)
+	require.Contains(t, job.Error, "no manifest was found")
+
+	resp = request(http.MethodGet, "/jobs/unknown", "secret", "")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp.Body.Close()
+
+	resp = request(http.MethodGet, "/jobs", "secret", "")
+	var jobs []Job
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&jobs))
+	resp.Body.Close()
+	require.Equal(t, 4, len(jobs))
+	require.Equal(t, job.ID, jobs[0].ID)
+}
+
+func TestJobServerQueue(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "gonymizer-jobs")
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	completed := make(chan Job, 10)
+	server := newTestJobServer(t, workDir, completed)
+
+	// Pretend a job is loading the store database
+	server.mutex.Lock()
+	server.active["store"] = true
+	server.running++
+	server.mutex.Unlock()
+
+	load, err := server.Submit(JobRequest{
+		Steps:          []string{JobStepLoad},
+		TargetDatabase: "store",
+		ProcessedFile:  "processed.sql",
+	}, "ci")
+	require.Nil(t, err)
+	require.Equal(t, JobStatusQueued, load.Status)
+
+	process, err := server.Submit(JobRequest{
+		Steps:         []string{JobStepProcess},
+		MapFile:       "map.json",
+		DumpFile:      "dump.sql",
+		ProcessedFile: "processed.sql",
+	}, "ci")
+	require.Nil(t, err)
+	require.Equal(t, JobStatusQueued, process.Status)
+
+	// Queued jobs are cancelled immediately
+	load, err = server.Cancel(load.ID)
+	require.Nil(t, err)
+	require.Equal(t, JobStatusCancelled, load.Status)
+	require.Equal(t, load.ID, (<-completed).ID)
+	_, err = server.Cancel("unknown")
+	require.NotNil(t, err)
+
+	// Queued jobs start once a job completes
+	server.mutex.Lock()
+	server.active["store"] = false
+	server.running--
+	server.dispatch()
+	server.mutex.Unlock()
+
+	select {
+	case job := <-completed:
+		require.Equal(t, process.ID, job.ID)
+		require.Equal(t, RunStatusSuccess, job.Status)
+	case <-time.After(time.Minute):
+		t.Fatal("queued job did not run")
+	}
+	load, _ = server.Get(load.ID)
+	require.Equal(t, JobStatusCancelled, load.Status)
+
+	// Cancelling a completed job does not change it
+	process, err = server.Cancel(process.ID)
+	require.Nil(t, err)
+	require.Equal(t, RunStatusSuccess, process.Status)
+
+	// Jobs are rejected once the server is shut down
+	server.Shutdown()
+	_, err = server.Submit(JobRequest{
+		Steps:         []string{JobStepProcess},
+		MapFile:       "map.json",
+		DumpFile:      "dump.sql",
+		ProcessedFile: "processed.sql",
+	}, "ci")
+	require.NotNil(t, err)
+}
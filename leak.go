@@ -0,0 +1,476 @@
+package gonymizer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/bits"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// LeakVerbatim is the reason used when an original value appears unchanged in the processed file.
+	LeakVerbatim = "verbatim"
+	// LeakNormalized is the reason used when an original value appears in the processed file after normalization
+	// (I.E. different case, punctuation, or white space).
+	LeakNormalized = "normalized"
+	// LeakPIIColumnName is the reason used when a column left as Identity has a name that looks like PII.
+	LeakPIIColumnName = "pii-column-name"
+	// LeakPIIValue is the prefix of the reason used when values of a column left as Identity match a PII detector.
+	LeakPIIValue = "pii-value"
+
+	// defaultLeakMinLength is the default minimum length of values that are checked for leaks.
+	defaultLeakMinLength = 4
+	// defaultLeakMaxMemoryMB is the default size of the Bloom filter holding the original values.
+	defaultLeakMaxMemoryMB = 256
+	// leakBytesPerValue is the estimated number of bytes per value in a dump file used to size the Bloom filter.
+	leakBytesPerValue = 32
+)
+
+// piiColumnNames are the parts of column names that are considered PII when the column is left as Identity.
+var piiColumnNames = []string{
+	"email", "phone", "mobile", "ssn", "social_security", "first_name", "firstname", "last_name", "lastname",
+	"surname", "full_name", "fullname", "address", "street", "birth", "dob", "zip", "postal", "passport",
+	"credit_card", "card_number", "iban", "tax_id", "license_number",
+}
+
+// leakIgnoredProcessors are processors that only generate a handful of different values. Their output is expected to
+// match the original value by chance so they are not checked.
+var leakIgnoredProcessors = map[string]bool{
+	"Identity":          true,
+	"EmptyJson":         true,
+	"RandomBoolean":     true,
+	"RandomCountryCode": true,
+	"FakeState":         true,
+	"FakeStateAbbrev":   true,
+}
+
+// leakOutputSpaces are processors whose number of different output values depends on the input value. They return
+// the bucket of the value (values in the same bucket can only be replaced by each other) and the number of different
+// values the processor generates for the bucket. They are used to estimate how many matches are expected by chance.
+var leakOutputSpaces = map[string]func(value string) (string, float64){
+	// RandomDate keeps the year and only changes the month and day
+	"RandomDate": func(value string) (string, float64) {
+		return strings.SplitN(value, "-", 2)[0], 366
+	},
+	// RandomDigits keeps the length of the value
+	"RandomDigits": func(value string) (string, float64) {
+		return fmt.Sprint(len(value)), math.Pow(10, float64(len(value)))
+	},
+}
+
+// piiDetectors are the regular expressions used to find PII in values of columns left as Identity.
+var piiDetectors = map[string]*regexp.Regexp{
+	"email": regexp.MustCompile(`(?i)[a-z0-9._%+-]+@[a-z0-9.-]+\.[a-z]{2,}`),
+	"ssn":   regexp.MustCompile(`^\d{3}-\d{2}-\d{4}$`),
+	"phone": regexp.MustCompile(`^\+?1?[\s.-]?\(?\d{3}\)?[\s.-]?\d{3}[\s.-]?\d{4}$`),
+	"card":  regexp.MustCompile(`^(?:\d[ -]?){12,18}\d$`),
+}
+
+// LeakScanOptions are the options used by ScanForLeaks.
+type LeakScanOptions struct {
+	// MinLength is the minimum length of values that are checked. Short values (I.E. booleans, state codes) are likely
+	// to be generated by the processors as well.
+	MinLength int
+	// MaxMemoryMB is the size of the Bloom filter holding the original values.
+	MaxMemoryMB int
+}
+
+// LeakReport is the result of ScanForLeaks.
+type LeakReport struct {
+	// Leaks are the columns where original values appear in the processed file or where PII was left as Identity
+	Leaks []ColumnLeak
+	// IndexedValues is the number of original values that were checked
+	IndexedValues int64
+	// FalsePositiveRate is the probability that a single processed value is reported as verbatim or normalized leak
+	// even though it did not appear in the original file
+	FalsePositiveRate float64
+}
+
+// ColumnLeak is a single column that leaked PII.
+type ColumnLeak struct {
+	Schema  string
+	Table   string
+	Column  string
+	Reason  string
+	Matches int64
+	Values  int64
+}
+
+// leakColumn is the state of a single column while scanning the dump files.
+type leakColumn struct {
+	cmap     *ColumnMapper
+	indexed  bool
+	identity bool
+	verbatim int64
+	normal   int64
+	detected map[string]int64
+	values   int64
+
+	// space, originals, and expected are used to estimate the number of matches expected by chance for processors
+	// that generate few different values (see leakOutputSpaces)
+	space     func(value string) (string, float64)
+	originals map[string]int64
+	expected  float64
+}
+
+// leaked will return true if the number of matches is higher than the number expected by chance. Matches are counted
+// as a Poisson distribution so anything within three standard deviations of the expected number is ignored.
+func (col *leakColumn) leaked(matches int64) bool {
+	return float64(matches) > col.expected+3*math.Sqrt(col.expected)
+}
+
+// HasLeaks will return true if any leaks were found.
+func (report *LeakReport) HasLeaks() bool {
+	return len(report.Leaks) > 0
+}
+
+// ScanForLeaks will verify that the values of the anonymized columns in the raw dump file do not appear in the
+// processed dump file, either verbatim or normalized (lowercase without punctuation or white space), and that none of
+// the columns left as Identity in the map file contain PII. The original values are stored in a Bloom filter so memory
+// usage is bounded by options.MaxMemoryMB. Both files may be local paths or URLs for any registered Storage backend.
+func ScanForLeaks(mapper *DBMapper, rawURL, processedURL string, options LeakScanOptions) (*LeakReport, error) {
+	return ScanForLeaksContext(context.Background(), mapper, rawURL, processedURL, options)
+}
+
+// ScanForLeaksContext is the same as ScanForLeaks, but stops when the context is cancelled.
+func ScanForLeaksContext(ctx context.Context, mapper *DBMapper, rawURL, processedURL string,
+	options LeakScanOptions) (*LeakReport, error) {
+	ctx, stopStep := StartStep(ctx, "verify")
+	defer stopStep()
+
+	if options.MinLength <= 0 {
+		options.MinLength = defaultLeakMinLength
+	}
+	if options.MaxMemoryMB <= 0 {
+		options.MaxMemoryMB = defaultLeakMaxMemoryMB
+	}
+
+	// Size the filter using the size of the raw dump file. Every value is stored twice (verbatim and normalized).
+	estimatedValues := uint64(1024 * 1024)
+	if object, err := StatURL(rawURL); err == nil && object.Size > 0 {
+		estimatedValues = uint64(object.Size) / leakBytesPerValue * 2
+	}
+	filter := newBloomFilter(uint64(options.MaxMemoryMB)*8*1024*1024, estimatedValues)
+	columns := map[string]*leakColumn{}
+	report := &LeakReport{}
+
+	// 1. Add the original values of every anonymized column to the filter
+	log.Info("Indexing original values from: ", RedactSecrets(rawURL))
+	err := scanDumpURL(ctx, rawURL, func(state *LineState, column string, value string) {
+		col := leakColumnFor(columns, mapper, state, column)
+		if !col.indexed || value == "\\N" {
+			return
+		}
+		key := columnKey(state, column)
+		if len(value) >= options.MinLength {
+			filter.Add(key + "\x00v" + value)
+			report.IndexedValues++
+			if col.space != nil {
+				bucket, _ := col.space(value)
+				col.originals[bucket]++
+			}
+		}
+		if normalized := normalizeLeakValue(value); len(normalized) >= options.MinLength {
+			filter.Add(key + "\x00n" + normalized)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.FalsePositiveRate = filter.FalsePositiveRate()
+	log.Debugf("Indexed %d values (false positive rate: %g)", report.IndexedValues, report.FalsePositiveRate)
+
+	// 2. Check the processed values against the filter and the PII detectors
+	log.Info("Scanning processed file: ", RedactSecrets(processedURL))
+	err = scanDumpURL(ctx, processedURL, func(state *LineState, column string, value string) {
+		col := leakColumnFor(columns, mapper, state, column)
+		if value == "\\N" {
+			return
+		}
+		col.values++
+
+		key := columnKey(state, column)
+		if col.indexed {
+			if col.space != nil && len(value) >= options.MinLength {
+				bucket, space := col.space(value)
+				col.expected += math.Min(1, float64(col.originals[bucket])/space)
+			}
+			if len(value) >= options.MinLength && filter.Contains(key+"\x00v"+value) {
+				col.verbatim++
+			} else if normalized := normalizeLeakValue(value); len(normalized) >= options.MinLength &&
+				filter.Contains(key+"\x00n"+normalized) {
+				col.normal++
+			}
+		} else if col.identity {
+			if detector := detectPII(unescapeCopyValue(value)); len(detector) > 0 {
+				col.detected[detector]++
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. Build the report
+	for key, col := range columns {
+		parts := strings.SplitN(key, "\x00", 3)
+		leak := ColumnLeak{Schema: parts[0], Table: parts[1], Column: parts[2], Values: col.values}
+		if col.leaked(col.verbatim) {
+			leak.Reason, leak.Matches = LeakVerbatim, col.verbatim
+			report.Leaks = append(report.Leaks, leak)
+		}
+		if col.leaked(col.normal) {
+			leak.Reason, leak.Matches = LeakNormalized, col.normal
+			report.Leaks = append(report.Leaks, leak)
+		}
+		if col.identity && isPIIColumnName(leak.Column) {
+			leak.Reason, leak.Matches = LeakPIIColumnName, 0
+			report.Leaks = append(report.Leaks, leak)
+		}
+		for detector, matches := range col.detected {
+			leak.Reason, leak.Matches = LeakPIIValue+":"+detector, matches
+			report.Leaks = append(report.Leaks, leak)
+		}
+	}
+
+	sort.Slice(report.Leaks, func(i, j int) bool {
+		a, b := report.Leaks[i], report.Leaks[j]
+		if a.Schema+"."+a.Table+"."+a.Column != b.Schema+"."+b.Table+"."+b.Column {
+			return a.Schema+"."+a.Table+"."+a.Column < b.Schema+"."+b.Table+"."+b.Column
+		}
+		return a.Reason < b.Reason
+	})
+	return report, nil
+}
+
+// scanDumpURL will call the supplied function for every value in the COPY statements of the dump file.
+func scanDumpURL(ctx context.Context, urlStr string, fn func(state *LineState, column string, value string)) error {
+	return scanDumpRows(ctx, urlStr, func(state *LineState, values []string) {
+		for i, column := range state.ColumnNames {
+			if i < len(values) {
+				fn(state, column, values[i])
+			}
+		}
+	})
+}
+
+// scanDumpRows will call the supplied function with the (COPY escaped) values of every row in the COPY statements of
+// the dump file.
+func scanDumpRows(ctx context.Context, urlStr string, fn func(state *LineState, values []string)) error {
+	file, err := OpenURL(urlStr)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(newContextReader(ctx, file), streamBufferSize)
+	state := new(LineState)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		trimmed := strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		switch {
+		case strings.HasPrefix(trimmed, StateChangeTokenBeginCopy+" "):
+			state.parseCopyLine(trimmed)
+		case trimmed == StateChangeTokenEndCopy:
+			state.Clear()
+		case state.IsRow && len(line) > 0:
+			fn(state, strings.Split(trimmed, "\t"))
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// leakColumnFor will return the state of the column, creating it if this is the first value of the column.
+func leakColumnFor(columns map[string]*leakColumn, mapper *DBMapper, state *LineState, column string) *leakColumn {
+	key := state.SchemaName + "\x00" + state.TableName + "\x00" + column
+	col, ok := columns[key]
+	if !ok {
+		col = &leakColumn{detected: map[string]int64{}}
+		if col.cmap = mapper.ColumnMapper(state.SchemaName, state.TableName, column); col.cmap != nil {
+			col.identity = true
+			for _, processor := range col.cmap.Processors {
+				if !leakIgnoredProcessors[processor.Name] {
+					col.indexed = true
+				}
+				if space, ok := leakOutputSpaces[processor.Name]; ok {
+					col.space, col.originals = space, map[string]int64{}
+				}
+				if processor.Name != "Identity" {
+					col.identity = false
+				}
+			}
+		}
+		columns[key] = col
+	}
+	return col
+}
+
+// columnKey will return the prefix used for values of the column in the Bloom filter.
+func columnKey(state *LineState, column string) string {
+	return state.SchemaName + "." + state.TableName + "." + column
+}
+
+// normalizeLeakValue will return the lowercase letters and digits of the (COPY escaped) value.
+func normalizeLeakValue(value string) string {
+	var b strings.Builder
+	for _, r := range unescapeCopyValue(value) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
+
+// isPIIColumnName will return true if the column name looks like it holds PII.
+func isPIIColumnName(column string) bool {
+	column = strings.ToLower(strings.Trim(column, `"`))
+	for _, name := range piiColumnNames {
+		if strings.Contains(column, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// detectPII will return the name of the first PII detector that matches the value, or an empty string.
+func detectPII(value string) string {
+	names := make([]string, 0, len(piiDetectors))
+	for name := range piiDetectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !piiDetectors[name].MatchString(value) {
+			continue
+		}
+		if name == "card" && !luhnValid(value) {
+			continue
+		}
+		return name
+	}
+	if ip := net.ParseIP(value); ip != nil && strings.Contains(value, ".") {
+		return "ipv4"
+	}
+	return ""
+}
+
+// luhnValid will return true if the digits in the value pass the Luhn checksum used by payment card numbers.
+func luhnValid(value string) bool {
+	sum, double := 0, false
+	for i := len(value) - 1; i >= 0; i-- {
+		c := value[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		digit := int(c - '0')
+		if double {
+			if digit *= 2; digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// bloomFilter is a fixed size Bloom filter using double hashing.
+type bloomFilter struct {
+	bits   []uint64
+	m      uint64
+	hashes uint64
+}
+
+// newBloomFilter returns a Bloom filter with m bits and the optimal number of hash functions for n values.
+func newBloomFilter(m, n uint64) *bloomFilter {
+	if m < 64 {
+		m = 64
+	}
+	if n == 0 {
+		n = 1
+	}
+	hashes := uint64(math.Ceil(float64(m) / float64(n) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	} else if hashes > 16 {
+		hashes = 16
+	}
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), m: m, hashes: hashes}
+}
+
+// locations returns the two hashes used to derive the bit locations of the key.
+func (filter *bloomFilter) locations(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	h1 := h.Sum64()
+
+	// splitmix64 finalizer for an independent second hash
+	h2 := h1 + 0x9e3779b97f4a7c15
+	h2 = (h2 ^ (h2 >> 30)) * 0xbf58476d1ce4e5b9
+	h2 = (h2 ^ (h2 >> 27)) * 0x94d049bb133111eb
+	h2 ^= h2 >> 31
+	return h1, h2 | 1
+}
+
+// Add will add the key to the filter.
+func (filter *bloomFilter) Add(key string) {
+	h1, h2 := filter.locations(key)
+	for i := uint64(0); i < filter.hashes; i++ {
+		bit := (h1 + i*h2) % filter.m
+		filter.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Contains will return true if the key may have been added to the filter.
+func (filter *bloomFilter) Contains(key string) bool {
+	h1, h2 := filter.locations(key)
+	for i := uint64(0); i < filter.hashes; i++ {
+		bit := (h1 + i*h2) % filter.m
+		if filter.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// FalsePositiveRate will return the probability that Contains returns true for a key that was not added.
+func (filter *bloomFilter) FalsePositiveRate() float64 {
+	var set int
+	for _, word := range filter.bits {
+		set += bits.OnesCount64(word)
+	}
+	return math.Pow(float64(set)/float64(filter.m), float64(filter.hashes))
+}
+
+// String will return a single line description of the leak.
+func (leak ColumnLeak) String() string {
+	switch {
+	case leak.Reason == LeakPIIColumnName:
+		return fmt.Sprintf("%s.%s.%s: column is not anonymized (Identity) but its name looks like PII",
+			leak.Schema, leak.Table, leak.Column)
+	case strings.HasPrefix(leak.Reason, LeakPIIValue):
+		return fmt.Sprintf("%s.%s.%s: column is not anonymized (Identity) but %d of %d values look like PII (%s)",
+			leak.Schema, leak.Table, leak.Column, leak.Matches, leak.Values,
+			strings.TrimPrefix(leak.Reason, LeakPIIValue+":"))
+	}
+	return fmt.Sprintf("%s.%s.%s: %d of %d values appear %s in the processed file",
+		leak.Schema, leak.Table, leak.Column, leak.Matches, leak.Values, leak.Reason)
+}
@@ -0,0 +1,163 @@
+package gonymizer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanForLeaks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonymizer-leaks")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	columnMap, err := LoadConfigSkeleton(TestMapFile)
+	require.Nil(t, err)
+	processed := filepath.Join(dir, "processed.sql")
+	require.Nil(t, ProcessDumpFile(columnMap, TestDbFile, processed, "", "", false))
+
+	leaks := func(report *LeakReport) map[string]bool {
+		found := map[string]bool{}
+		for _, leak := range report.Leaks {
+			found[fmt.Sprintf("%s.%s.%s:%s", leak.Schema, leak.Table, leak.Column, leak.Reason)] = true
+		}
+		return found
+	}
+
+	// Anonymized columns do not leak, but email and name columns were left as Identity in the test map
+	report, err := ScanForLeaks(columnMap, TestDbFile, processed, LeakScanOptions{MaxMemoryMB: 1})
+	require.Nil(t, err)
+	require.True(t, report.HasLeaks())
+	require.Greater(t, report.IndexedValues, int64(0))
+	require.Less(t, report.FalsePositiveRate, 1e-9)
+	require.Equal(t, map[string]bool{
+		"public.distributors.email:pii-column-name":    true,
+		"public.distributors.email:pii-value:email":    true,
+		"public.purchasers.email:pii-column-name":      true,
+		"public.purchasers.email:pii-value:email":      true,
+		"public.purchasers.first_name:pii-column-name": true,
+		"public.purchasers.last_name:pii-column-name":  true,
+	}, leaks(report))
+
+	// Scanning the raw dump as the processed file finds every anonymized column
+	report, err = ScanForLeaks(columnMap, TestDbFile, TestDbFile, LeakScanOptions{MaxMemoryMB: 1})
+	require.Nil(t, err)
+	found := leaks(report)
+	require.True(t, found["public.authors.name:verbatim"])
+	require.True(t, found["public.books.title:verbatim"])
+	require.False(t, found["public.distributors.has_physical_store:verbatim"])
+
+	// Changing the case and punctuation of a value is still a leak
+	normalized := filepath.Join(dir, "normalized.sql")
+	require.Nil(t, ioutil.WriteFile(normalized, []byte(
+		"COPY public.authors (id, created_at, updated_at, name, birthdate) FROM stdin;\n"+
+			"x\t2018-01-01\t2018-01-01\tLEVI D. JUNKERT\t\\N\n\\.\n"), 0644))
+	report, err = ScanForLeaks(columnMap, TestDbFile, normalized, LeakScanOptions{MaxMemoryMB: 1})
+	require.Nil(t, err)
+	require.True(t, leaks(report)["public.authors.name:normalized"], report.Leaks)
+}
+
+func TestScanForLeaksRandomDate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonymizer-leaks")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	columnMap, err := LoadConfigSkeleton(TestMapFile)
+	require.Nil(t, err)
+
+	writeAuthors := func(name string, birthdates []string) string {
+		var b strings.Builder
+		b.WriteString("COPY public.authors (id, created_at, updated_at, name, birthdate) FROM stdin;\n")
+		for _, birthdate := range birthdates {
+			b.WriteString("x\t2018-01-01\t2018-01-01\tx\t" + birthdate + "\n")
+		}
+		b.WriteString("\\.\n")
+		path := filepath.Join(dir, name)
+		require.Nil(t, ioutil.WriteFile(path, []byte(b.String()), 0644))
+		return path
+	}
+	processDates := func(birthdates []string) []string {
+		random := newProcessorRandom(rand.New(rand.NewSource(1)))
+		processed := make([]string, len(birthdates))
+		for i, birthdate := range birthdates {
+			processed[i], err = randomDate(nil, birthdate, random)
+			require.Nil(t, err)
+		}
+		return processed
+	}
+
+	// Dates of birth in the same year collide with the original values by chance
+	var sameYear []string
+	for i := 0; i < 1000; i++ {
+		sameYear = append(sameYear, fmt.Sprintf("1980-%02d-%02d", i%12+1, i%28+1))
+	}
+	raw := writeAuthors("raw-same-year.sql", sameYear)
+	processed := writeAuthors("processed-same-year.sql", processDates(sameYear))
+	report, err := ScanForLeaks(columnMap, raw, processed, LeakScanOptions{MaxMemoryMB: 1})
+	require.Nil(t, err)
+	require.False(t, report.HasLeaks(), report.Leaks)
+
+	// Dates of birth spread over many years are still reported when they are left unchanged
+	var years []string
+	for i := 0; i < 100; i++ {
+		years = append(years, fmt.Sprintf("%d-06-15", 1900+i))
+	}
+	raw = writeAuthors("raw-years.sql", years)
+	report, err = ScanForLeaks(columnMap, raw, raw, LeakScanOptions{MaxMemoryMB: 1})
+	require.Nil(t, err)
+	require.Len(t, report.Leaks, 1)
+	require.Equal(t, "birthdate", report.Leaks[0].Column)
+	require.Equal(t, LeakVerbatim, report.Leaks[0].Reason)
+
+	processed = writeAuthors("processed-years.sql", processDates(years))
+	report, err = ScanForLeaks(columnMap, raw, processed, LeakScanOptions{MaxMemoryMB: 1})
+	require.Nil(t, err)
+	require.False(t, report.HasLeaks(), report.Leaks)
+}
+
+func TestDetectPII(t *testing.T) {
+	for value, expected := range map[string]string{
+		"john.smith@example.com":     "email",
+		"contact: jane@example.org":  "email",
+		"123-45-6789":                "ssn",
+		"(555) 123-4567":             "phone",
+		"+1 555.123.4567":            "phone",
+		"4111 1111 1111 1111":        "card",
+		"4111 1111 1111 1112":        "",
+		"192.168.1.20":               "ipv4",
+		"The Name of the Wind":       "",
+		"2019-01-01 00:00:00+00":     "",
+		"a0eebc99-9c0b-4ef8-bb6d-6b": "",
+	} {
+		require.Equal(t, expected, detectPII(value), value)
+	}
+
+	require.True(t, isPIIColumnName("billing_address"))
+	require.True(t, isPIIColumnName(`"DateOfBirth"`))
+	require.False(t, isPIIColumnName("created_at"))
+}
+
+func TestBloomFilter(t *testing.T) {
+	filter := newBloomFilter(1024*1024, 1000)
+	for i := 0; i < 1000; i++ {
+		filter.Add(fmt.Sprint("value-", i))
+	}
+	for i := 0; i < 1000; i++ {
+		require.True(t, filter.Contains(fmt.Sprint("value-", i)))
+	}
+
+	falsePositives := 0
+	for i := 1000; i < 101000; i++ {
+		if filter.Contains(fmt.Sprint("value-", i)) {
+			falsePositives++
+		}
+	}
+	require.Less(t, falsePositives, 10)
+	require.Less(t, filter.FalsePositiveRate(), 1e-6)
+}
@@ -1,20 +1,59 @@
 package gonymizer
 
 import (
+	"context"
 	"database/sql"
 	"encoding/csv"
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// LoadFile will load an SQL file into the specified PGConfig.
+// LoadOptions configures LoadFileWithOptions.
+type LoadOptions struct {
+	// Manifest configures how the manifest of the file is verified. Files with a manifest are always verified.
+	Manifest ManifestOptions
+	// RowCountFile is the row count file (see: VerifyRowCount) the loaded database is compared to before it replaces
+	// the existing database.
+	RowCountFile string
+	// RowCounts configures how the row counts are compared. If RowCounts.Strict is set, the existing database is only
+	// replaced when the row counts match.
+	RowCounts RowCountOptions
+}
+
+// LoadFile will load an SQL file into the specified PGConfig. The file may be a local path or a URL for any registered
+// Storage backend. If the file has a manifest (see: ManifestURL) the file must match it. See LoadFileWithOptions.
 func LoadFile(conf PGConfig, filePath string) (err error) {
+	return LoadFileWithOptionsContext(context.Background(), conf, filePath, LoadOptions{})
+}
+
+// LoadFileContext is the same as LoadFile, but psql is killed when the context is cancelled. The temporary
+// _gonymizer_loading database is dropped if the file could not be loaded.
+func LoadFileContext(ctx context.Context, conf PGConfig, filePath string) (err error) {
+	return LoadFileWithOptionsContext(ctx, conf, filePath, LoadOptions{})
+}
+
+// LoadFileWithOptions will load an SQL file into the specified PGConfig using the supplied options. The file is
+// checksummed while it is loaded, and the database is only replaced if the file matches its manifest and, when
+// options.RowCounts.Strict is set, the row counts of options.RowCountFile.
+func LoadFileWithOptions(conf PGConfig, filePath string, options LoadOptions) error {
+	return LoadFileWithOptionsContext(context.Background(), conf, filePath, options)
+}
+
+// LoadFileWithOptionsContext is the same as LoadFileWithOptions, but psql is killed when the context is cancelled. The
+// temporary _gonymizer_loading database is dropped if the file could not be loaded or was refused.
+func LoadFileWithOptionsContext(ctx context.Context, conf PGConfig, filePath string, options LoadOptions) (err error) {
+	logger := loggerFromContext(ctx)
+	ctx, stopStep := StartStep(ctx, "load")
+	defer stopStep()
+
 	var (
 		dbExists   bool
 		mainConn   *sql.DB
@@ -27,6 +66,12 @@ func LoadFile(conf PGConfig, filePath string) (err error) {
 	tempDbConf = conf
 	tempDbConf.DefaultDBName = conf.DefaultDBName + "_gonymizer_loading"
 
+	// Refuse files that were not anonymized before anything is created
+	verifier, err := newManifestVerifier(filePath, options.Manifest)
+	if err != nil {
+		return err
+	}
+
 	mainConn, err = OpenDB(conf)
 	if err != nil {
 		return err
@@ -34,8 +79,8 @@ func LoadFile(conf PGConfig, filePath string) (err error) {
 	defer mainConn.Close()
 
 	// It is always good to check to see if a previous version of the gonymizer table still exists
-	log.Infof("Checking to see if database '%s' exists", tempDbConf.DefaultDBName)
-	dbExists, err = CheckIfDbExists(mainConn, tempDbConf.DefaultDBName)
+	logger.Infof("Checking to see if database '%s' exists", tempDbConf.DefaultDBName)
+	dbExists, err = CheckIfDbExistsContext(ctx, mainConn, tempDbConf.DefaultDBName)
 	if err != nil {
 		return err
 	} else if dbExists {
@@ -44,18 +89,46 @@ func LoadFile(conf PGConfig, filePath string) (err error) {
 	}
 
 	// Create temp database
-	log.Info("Creating database: ", tempDbConf.DefaultDBName)
-	if err = CreateDatabase(tempDbConf); err != nil {
-		log.Error("Unable to create database: ", tempDbConf.DefaultDBName)
+	logger.Info("Creating database: ", tempDbConf.DefaultDBName)
+	err = traceFunc(ctx, "create database", func(ctx context.Context) error {
+		return CreateDatabaseContext(ctx, tempDbConf)
+	}, attribute.String("db.name", tempDbConf.DefaultDBName))
+	if err != nil {
+		logger.Error("Unable to create database: ", tempDbConf.DefaultDBName)
 		return err
 	}
 
-	log.Infof("Reloading database file '%s' -> '%s' ", filePath, tempDbConf.DefaultDBName)
-	if err = SQLCommandFile(tempDbConf, filePath, true); err != nil {
-		log.Fatalf("There was an error importing '%s' to: %s", filePath, tempDbConf.DefaultDBName)
+	// Never leave the temporary database behind, otherwise the next load refuses to run
+	swapped := false
+	defer func() {
+		if err != nil && !swapped {
+			dropLoadingDatabase(tempDbConf)
+		}
+	}()
+
+	logger.Infof("Reloading database file '%s' -> '%s' ", RedactSecrets(filePath), tempDbConf.DefaultDBName)
+	err = traceFunc(ctx, "load sql file", func(ctx context.Context) error {
+		return loadSQLFile(ctx, tempDbConf, filePath, verifier)
+	}, attribute.String("db.name", tempDbConf.DefaultDBName))
+	if err != nil {
+		logger.Errorf("There was an error importing '%s' to: %s", RedactSecrets(filePath), tempDbConf.DefaultDBName)
 		return err
 	}
 
+	// The file is only verified once it has been read so it cannot change between the verification and the load
+	if err = verifier.Verify(); err != nil {
+		return err
+	}
+
+	// Row counts are compared before the swap so a database with mismatched row counts never replaces the existing one
+	if len(options.RowCountFile) > 0 {
+		logger.Info("Comparing row counts to: ", RedactSecrets(options.RowCountFile))
+		err = VerifyRowCountWithOptionsContext(ctx, tempDbConf, options.RowCountFile, options.RowCounts)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Kill all database connections so we can swap the databases
 	// Reload the database into the new temp db
 	psqlDbConf = conf
@@ -64,66 +137,289 @@ func LoadFile(conf PGConfig, filePath string) (err error) {
 	if err != nil {
 		return err
 	}
+	defer psqlConn.Close()
 
-	// Kill db connections so we can rename the database
-	log.Info("Killing all connections on database: ", conf.DefaultDBName)
-	if err = KillDatabaseConnections(psqlConn, conf.DefaultDBName); err != nil {
-		log.Error("Unable to kill connections on database: ", psqlDbConf.DefaultDBName)
-		return err
+	// Kill db connections so we can rename the databases
+	for _, dbName := range []string{conf.DefaultDBName, tempDbConf.DefaultDBName} {
+		logger.Info("Killing all connections on database: ", dbName)
+		err = traceFunc(ctx, "kill database connections", func(ctx context.Context) error {
+			return KillDatabaseConnectionsContext(ctx, psqlConn, dbName)
+		}, attribute.String("db.name", dbName))
+		if err != nil {
+			logger.Error("Unable to kill connections on database: ", dbName)
+			return err
+		}
 	}
 
 	// Rename main database -> old database
 	oldDbName := conf.DefaultDBName + "_old_" + strconv.FormatInt(time.Now().Unix(), 10)
 
-	log.Infof("Renaming database '%s' -> '%s'", conf.DefaultDBName, oldDbName)
-	if err = RenameDatabase(psqlConn, conf.DefaultDBName, oldDbName); err != nil {
+	logger.Infof("Renaming database '%s' -> '%s'", conf.DefaultDBName, oldDbName)
+	err = traceFunc(ctx, "rename database", func(ctx context.Context) error {
+		return RenameDatabaseContext(ctx, psqlConn, conf.DefaultDBName, oldDbName)
+	}, attribute.String("db.name", conf.DefaultDBName), attribute.String("db.new_name", oldDbName))
+	if err != nil {
 		return err
 	}
 
-	// Rename temp database -> main database
-	log.Infof("Renaming database '%s' -> '%s'", tempDbConf.DefaultDBName, conf.DefaultDBName)
-	return RenameDatabase(psqlConn, tempDbConf.DefaultDBName, conf.DefaultDBName)
+	// Rename temp database -> main database. This is not cancelled since the main database has already been renamed.
+	logger.Infof("Renaming database '%s' -> '%s'", tempDbConf.DefaultDBName, conf.DefaultDBName)
+	swapped = true
+	return traceFunc(ctx, "rename database", func(context.Context) error {
+		return RenameDatabase(psqlConn, tempDbConf.DefaultDBName, conf.DefaultDBName)
+	}, attribute.String("db.name", tempDbConf.DefaultDBName), attribute.String("db.new_name", conf.DefaultDBName))
+}
+
+// dropLoadingDatabase will drop the temporary database of a load that did not complete. It is never cancelled so the
+// database is dropped even when the load was.
+func dropLoadingDatabase(tempDbConf PGConfig) {
+	log.Info("Dropping incomplete database: ", tempDbConf.DefaultDBName)
+
+	psqlDbConf := tempDbConf
+	psqlDbConf.DefaultDBName = "postgres"
+	if psqlConn, err := OpenDB(psqlDbConf); err == nil {
+		// psql may still be connected when it was killed
+		_ = KillDatabaseConnections(psqlConn, tempDbConf.DefaultDBName)
+		psqlConn.Close()
+	}
+	if err := DropDatabase(tempDbConf); err != nil {
+		log.Errorf("Unable to drop database %s. Drop it before loading again", tempDbConf.DefaultDBName)
+	}
+}
+
+// loadSQLFile will load the SQL file into the database using psql. Files in remote storage, encrypted files, and files
+// that are verified against their manifest are streamed to psql without being written to the local disk.
+func loadSQLFile(ctx context.Context, conf PGConfig, filePath string, verifier *manifestVerifier) error {
+	if IsLocalURL(filePath) && verifier == nil {
+		encrypted, err := IsEncryptedURL(filePath)
+		if err != nil {
+			return err
+		}
+		if !encrypted {
+			return SQLCommandFileContext(ctx, conf, localPath(filePath), true)
+		}
+	}
+
+	reader, err := OpenURL(filePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// Errors reading from storage are returned by the command even though psql itself ignores errors
+	return SQLCommandReaderContext(ctx, conf, verifier.Reader(newContextReader(ctx, reader)), true)
+}
+
+// RowCountOptions configures how VerifyRowCountWithOptions compares the row counts of the loaded database with the row
+// count file.
+type RowCountOptions struct {
+	// Strict will return an error if any table does not match its row count.
+	Strict bool
+	// Tolerances are the allowed differences between the row counts of (live) tables.
+	Tolerances []RowCountTolerance
+	// EmptyTables are the tables (schema.table or table) whose data was excluded from the dump. They are expected to
+	// be empty after loading.
+	EmptyTables []string
+}
+
+// RowCountTolerance is the allowed difference between the expected and actual row count of a table.
+type RowCountTolerance struct {
+	// Table is schema.table, or * for all tables without their own tolerance.
+	Table string
+	// Absolute is the allowed difference in rows.
+	Absolute int64
+	// Percent is the allowed difference as a percentage of the expected row count.
+	Percent float64
+}
+
+// ParseRowCountTolerance will parse a tolerance in the form: schema.table=100 (rows) or schema.table=0.5% (of the
+// expected row count). The table may be * to set the tolerance of all other tables.
+func ParseRowCountTolerance(value string) (RowCountTolerance, error) {
+	var tolerance RowCountTolerance
+
+	i := strings.LastIndex(value, "=")
+	if i < 1 {
+		return tolerance, fmt.Errorf("row count tolerance '%s' must be in the form: schema.table=rows or "+
+			"schema.table=percent%%", value)
+	}
+	tolerance.Table = strings.TrimSpace(value[:i])
+	if tolerance.Table != "*" && len(strings.Split(tolerance.Table, ".")) != 2 {
+		return tolerance, fmt.Errorf("row count tolerance '%s' must use schema.table or *", value)
+	}
+
+	amount := strings.TrimSpace(value[i+1:])
+	var err error
+	if strings.HasSuffix(amount, "%") {
+		tolerance.Percent, err = strconv.ParseFloat(strings.TrimSuffix(amount, "%"), 64)
+	} else {
+		tolerance.Absolute, err = strconv.ParseInt(amount, 10, 64)
+	}
+	if err != nil || tolerance.Percent < 0 || tolerance.Absolute < 0 {
+		return tolerance, fmt.Errorf("row count tolerance '%s' must be a positive number of rows or percentage", value)
+	}
+	return tolerance, nil
 }
 
-// VerifyRowCount will verify that the rowcounts in the PGConfig matches the supplied CSV file (see command/dump)
+// VerifyRowCount will verify that the rowcounts in the PGConfig matches the supplied CSV file (see command/dump). The
+// CSV file may be a local path or a URL for any registered Storage backend. Mismatches are logged as warnings. See
+// VerifyRowCountWithOptions.
 func VerifyRowCount(conf PGConfig, filePath string) (err error) {
-	// Load local row counts into a map of maps so we can quickly look up values
-	dbRowCount := make(map[string]map[string]int)
-	rowObjs, err := GetTableRowCountsInDB(conf, "", []string{})
+	return VerifyRowCountWithOptionsContext(context.Background(), conf, filePath, RowCountOptions{})
+}
+
+// VerifyRowCountWithOptions will verify that the row counts in the PGConfig match the supplied CSV file using the
+// tolerances in the options. Tables in the CSV file that are missing in the database never match. An error is returned
+// for mismatches if options.Strict is set, otherwise they are logged as warnings.
+func VerifyRowCountWithOptions(conf PGConfig, filePath string, options RowCountOptions) error {
+	return VerifyRowCountWithOptionsContext(context.Background(), conf, filePath, options)
+}
+
+// VerifyRowCountWithOptionsContext is the same as VerifyRowCountWithOptions, but the row counts are no longer queried
+// once the context is cancelled.
+func VerifyRowCountWithOptionsContext(ctx context.Context, conf PGConfig, filePath string,
+	options RowCountOptions) error {
+	ctx, stopStep := StartStep(ctx, "verify-row-count")
+	defer stopStep()
+
+	rowObjs, err := GetTableRowCountsInDBContext(ctx, conf, "", []string{})
 	if err != nil {
 		return err
 	}
 
-	for _, row := range *rowObjs {
-		if len(dbRowCount[*row.SchemaName]) < 1 {
-			dbRowCount[*row.SchemaName] = make(map[string]int)
-			dbRowCount[*row.SchemaName][*row.TableName] = *row.Count
+	expected, err := readRowCountFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	mismatches := 0
+	comparisons := CompareRowCounts(expected, *rowObjs, options)
+	for _, comparison := range comparisons {
+		GetRunReport().AddRowCount(comparison)
+		if comparison.Match {
+			continue
+		}
+		mismatches++
+		if comparison.Missing {
+			loggerFromContext(ctx).Warnf("Table is missing from the database: %s.%s (expected %d rows)",
+				comparison.Schema, comparison.Table, comparison.Expected)
 		} else {
-			dbRowCount[*row.SchemaName][*row.TableName] = *row.Count
+			loggerFromContext(ctx).Warnf("Production row counts do not match: (prod) %s.%s = %d / %d (tolerance: %d)",
+				comparison.Schema,
+				comparison.Table,
+				comparison.Expected,
+				comparison.Actual,
+				comparison.Tolerance,
+			)
+		}
+	}
+
+	if mismatches > 0 && options.Strict {
+		return fmt.Errorf("%d of %d tables do not match their row counts", mismatches, len(comparisons))
+	}
+	return nil
+}
+
+// CompareRowCounts will compare the expected row counts (see VerifyRowCount) with the actual row counts of the
+// database. Tables whose data was excluded from the dump (options.EmptyTables) are expected to be empty, even if they
+// are not in the expected row counts.
+func CompareRowCounts(expected, actual []RowCounts, options RowCountOptions) []RowCountComparison {
+	var comparisons []RowCountComparison
+
+	actualCounts := make(map[string]int)
+	for _, row := range actual {
+		actualCounts[*row.SchemaName+"."+*row.TableName] = *row.Count
+	}
+
+	seen := make(map[string]bool)
+	for _, row := range expected {
+		key := *row.SchemaName + "." + *row.TableName
+		seen[key] = true
+
+		comparison := RowCountComparison{Schema: *row.SchemaName, Table: *row.TableName, Expected: int64(*row.Count)}
+		if options.isEmptyTable(comparison.Schema, comparison.Table) {
+			comparison.Expected = 0
+		}
+		count, ok := actualCounts[key]
+		comparison.Actual = int64(count)
+		comparison.Missing = !ok
+		comparisons = append(comparisons, options.compare(comparison))
+	}
+
+	for _, row := range actual {
+		if seen[*row.SchemaName+"."+*row.TableName] || !options.isEmptyTable(*row.SchemaName, *row.TableName) {
+			continue
+		}
+		comparisons = append(comparisons, options.compare(RowCountComparison{
+			Schema: *row.SchemaName,
+			Table:  *row.TableName,
+			Actual: int64(*row.Count),
+		}))
+	}
+	return comparisons
+}
+
+// compare will set the tolerance of the table and whether the actual row count is within the tolerance.
+func (options RowCountOptions) compare(comparison RowCountComparison) RowCountComparison {
+	var tolerance *RowCountTolerance
+	for i, t := range options.Tolerances {
+		if t.Table == comparison.Schema+"."+comparison.Table {
+			tolerance = &options.Tolerances[i]
+			break
+		} else if t.Table == "*" && tolerance == nil {
+			tolerance = &options.Tolerances[i]
+		}
+	}
+
+	// Tables that are expected to be empty must be empty
+	if tolerance != nil && comparison.Expected > 0 {
+		comparison.Tolerance = tolerance.Absolute
+		percent := int64(math.Floor(float64(comparison.Expected) * tolerance.Percent / 100))
+		if percent > comparison.Tolerance {
+			comparison.Tolerance = percent
 		}
 	}
 
-	// No read in CSV file and compare to our DB counts
-	reader, err := os.OpenFile(filePath, os.O_RDONLY, 0644)
+	difference := comparison.Expected - comparison.Actual
+	if difference < 0 {
+		difference = -difference
+	}
+	comparison.Match = !comparison.Missing && difference <= comparison.Tolerance
+	return comparison
+}
+
+// isEmptyTable will return true if the data of the table was excluded from the dump.
+func (options RowCountOptions) isEmptyTable(schema, table string) bool {
+	for _, name := range options.EmptyTables {
+		if name == table || name == schema+"."+table {
+			return true
+		}
+	}
+	return false
+}
+
+// readRowCountFile will read the row counts from the supplied CSV file (see command/dump).
+func readRowCountFile(filePath string) ([]RowCounts, error) {
+	var rowCounts []RowCounts
+
+	reader, err := OpenURL(filePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer reader.Close()
 	csvReader := csv.NewReader(reader)
-	lineNum := 1
 
-	// Now loop through CSV and verify our count matches the CSV
 	for {
 		csvRow, err := csvReader.Read()
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return err
+			return nil, err
 		}
 
 		// Verify we have schema, table, count
 		if len(csvRow) != 3 {
 			e := fmt.Sprint("CSV should contain exactly 3 columns, but has ", len(csvRow))
-			return errors.New(e)
+			return nil, errors.New(e)
 		}
 
 		// Carve out data from CSV
@@ -131,23 +427,34 @@ func VerifyRowCount(conf PGConfig, filePath string) (err error) {
 		table := csvRow[1]
 		count, err := strconv.Atoi(csvRow[2])
 		if err != nil {
-			return err
+			return nil, err
 		}
+		rowCounts = append(rowCounts, RowCounts{SchemaName: &schema, TableName: &table, Count: &count})
+	}
+	return rowCounts, nil
+}
 
-		if len(csvRow) != 3 {
-			return errors.New("CSV file had the wrong number of columns")
-		}
-		// Now check to see if they match
+// WriteRowCountFile will write the row counts as a CSV file (see VerifyRowCount) to the supplied local path or URL for
+// any registered Storage backend.
+func WriteRowCountFile(filePath string, rowCounts []ManifestRowCount) error {
+	writer, err := CreateURL(filePath)
+	if err != nil {
+		return err
+	}
 
-		if dbRowCount[schema][table] != count {
-			log.Warnf("Production row counts do not match: (prod) %s.%s = %d / %d",
-				schema,
-				table,
-				count,
-				dbRowCount[schema][table],
-			)
+	csvWriter := csv.NewWriter(writer)
+	for _, row := range rowCounts {
+		if err = csvWriter.Write([]string{row.Schema, row.Table, strconv.Itoa(row.Count)}); err != nil {
+			break
 		}
-		lineNum++
 	}
-	return err
+	csvWriter.Flush()
+	if err == nil {
+		err = csvWriter.Error()
+	}
+	if err != nil {
+		abortWriter(writer, err)
+		return err
+	}
+	return writer.Close()
 }
@@ -1,6 +1,9 @@
 package gonymizer
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -19,6 +22,19 @@ func TestLoadFile(t *testing.T) {
 	conf := GetTestDbConf(TestLoadFileDb)
 	require.Nil(t, CreateDatabase(conf))
 	require.Nil(t, LoadFile(conf, TestProcessDumpfile))
+
+	// Databases with mismatched row counts are dropped before they replace the existing database
+	options := LoadOptions{RowCountFile: TestRowCountIncorrectRowCountsFile, RowCounts: RowCountOptions{Strict: true}}
+	require.NotNil(t, LoadFileWithOptions(conf, TestProcessDumpfile, options))
+	dbConn, err := OpenDB(GetTestDbConf("postgres"))
+	require.Nil(t, err)
+	defer dbConn.Close()
+	exists, err := CheckIfDbExists(dbConn, TestLoadFileDb+"_gonymizer_loading")
+	require.Nil(t, err)
+	require.False(t, exists)
+	exists, err = CheckIfDbExists(dbConn, TestLoadFileDb)
+	require.Nil(t, err)
+	require.True(t, exists)
 	require.Nil(t, CloseTestDb(TestLoadFileDb))
 }
 
@@ -26,5 +42,76 @@ func TestVerifyRowCount(t *testing.T) {
 	conf := GetTestDbConf(TestDb)
 	require.Nil(t, VerifyRowCount(conf, TestRowCountFile))
 	require.Nil(t, VerifyRowCount(conf, TestRowCountIncorrectRowCountsFile)) // Should return Nil and print a warning
+	require.NotNil(t, VerifyRowCountWithOptions(conf, TestRowCountIncorrectRowCountsFile, RowCountOptions{Strict: true}))
 	require.NotNil(t, VerifyRowCount(conf, TestRowCountsIncorrectNumberColumnsFile))
 }
+
+func TestCompareRowCounts(t *testing.T) {
+	rowCounts := func(counts ...interface{}) []RowCounts {
+		var rows []RowCounts
+		for i := 0; i < len(counts); i += 3 {
+			schema, table, count := counts[i].(string), counts[i+1].(string), counts[i+2].(int)
+			rows = append(rows, RowCounts{SchemaName: &schema, TableName: &table, Count: &count})
+		}
+		return rows
+	}
+	expected := rowCounts("public", "users", 100, "public", "events", 1000, "public", "orders", 10)
+	actual := rowCounts("public", "users", 100, "public", "events", 995, "public", "audit_log", 3)
+
+	// Without options only exact matches pass and missing tables never match
+	comparisons := CompareRowCounts(expected, actual, RowCountOptions{})
+	require.Len(t, comparisons, 3)
+	require.True(t, comparisons[0].Match)
+	require.False(t, comparisons[1].Match)
+	require.False(t, comparisons[2].Match)
+	require.True(t, comparisons[2].Missing)
+
+	events, err := ParseRowCountTolerance("public.events=0.5%")
+	require.Nil(t, err)
+	all, err := ParseRowCountTolerance("*=2")
+	require.Nil(t, err)
+	comparisons = CompareRowCounts(expected, actual, RowCountOptions{
+		Tolerances:  []RowCountTolerance{all, events},
+		EmptyTables: []string{"audit_log"},
+	})
+	require.Len(t, comparisons, 4)
+	require.Equal(t, int64(5), comparisons[1].Tolerance)
+	require.True(t, comparisons[1].Match)
+	require.Equal(t, int64(2), comparisons[2].Tolerance)
+	require.False(t, comparisons[2].Match)
+	require.Equal(t, RowCountComparison{Schema: "public", Table: "audit_log", Actual: 3}, comparisons[3])
+
+	// Tables whose data was excluded must be empty, even with a tolerance
+	comparisons = CompareRowCounts(rowCounts("public", "audit_log", 3), actual, RowCountOptions{
+		Tolerances:  []RowCountTolerance{all},
+		EmptyTables: []string{"public.audit_log"},
+	})
+	require.Len(t, comparisons, 1)
+	require.Equal(t, int64(0), comparisons[0].Expected)
+	require.False(t, comparisons[0].Match)
+
+	for _, value := range []string{"public.events", "events=5", "public.events=-1", "public.events=abc%"} {
+		_, err = ParseRowCountTolerance(value)
+		require.NotNil(t, err, value)
+	}
+}
+
+func TestWriteRowCountFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonymizer-row-counts")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "row-counts.csv")
+	require.Nil(t, WriteRowCountFile(path, []ManifestRowCount{
+		{Schema: "public", Table: "users", Count: 10},
+		{Schema: "public", Table: "orders", Count: 0},
+	}))
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "public,users,10\npublic,orders,0\n", string(data))
+
+	rowCounts, err := readRowCountFile(path)
+	require.Nil(t, err)
+	require.Len(t, rowCounts, 2)
+	require.Equal(t, 10, *rowCounts[0].Count)
+}
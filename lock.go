@@ -0,0 +1,78 @@
+package gonymizer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ErrLocked is returned by AcquireLock when another Gonymizer process holds the lock.
+var ErrLocked = errors.New("lock is held by another process")
+
+// lockOwner is the process holding a lock. It is stored in the lock file.
+type lockOwner struct {
+	PID      int       `json:"pid"`
+	Host     string    `json:"host"`
+	LockedAt time.Time `json:"locked_at"`
+}
+
+// AcquireLock will create the lock file at the supplied path so only one process at a time can hold the lock. An
+// error wrapping ErrLocked is returned if another process holds the lock. Locks left behind by processes on this host
+// that are no longer running are taken over. The returned function releases the lock.
+func AcquireLock(path string) (func() error, error) {
+	host, _ := os.Hostname()
+	owner := lockOwner{PID: os.Getpid(), Host: host, LockedAt: time.Now().UTC()}
+	data, err := json.Marshal(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = file.Write(data)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				_ = os.Remove(path)
+				return nil, err
+			}
+			return func() error { return os.Remove(path) }, nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+
+		var current lockOwner
+		contents, readErr := ioutil.ReadFile(path)
+		if readErr == nil {
+			readErr = json.Unmarshal(contents, &current)
+		}
+		if readErr != nil || attempt > 0 || current.Host != host || processExists(current.PID) {
+			return nil, fmt.Errorf("%w: %s (pid %d on %s since %s)", ErrLocked, path, current.PID, current.Host,
+				current.LockedAt.Format(time.RFC3339))
+		}
+
+		// The process holding the lock is gone so the lock is stale
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// processExists returns true if a process with the pid is running on this host.
+func processExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, os.ErrPermission)
+}
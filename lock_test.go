@@ -0,0 +1,46 @@
+package gonymizer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquireLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonymizer-lock")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gonymizer.lock")
+
+	unlock, err := AcquireLock(path)
+	require.Nil(t, err)
+
+	_, err = AcquireLock(path)
+	require.True(t, errors.Is(err, ErrLocked))
+
+	require.Nil(t, unlock())
+	unlock, err = AcquireLock(path)
+	require.Nil(t, err)
+	require.Nil(t, unlock())
+
+	// Locks of processes that are no longer running are taken over
+	host, _ := os.Hostname()
+	stale, err := json.Marshal(lockOwner{PID: 999999999, Host: host})
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(path, stale, 0600))
+	unlock, err = AcquireLock(path)
+	require.Nil(t, err)
+	require.Nil(t, unlock())
+
+	// Locks held on other hosts are never taken over
+	remote, err := json.Marshal(lockOwner{PID: 999999999, Host: "another-host"})
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(path, remote, 0600))
+	_, err = AcquireLock(path)
+	require.True(t, errors.Is(err, ErrLocked))
+}
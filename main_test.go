@@ -35,6 +35,9 @@ const TestGenerateSchemaFile = "testing/output.TestGenerateSchemaFile.sql"
 const TestMapOutputFile = "testing/output.TestMapperFile.json"
 const TestFileInjectorFile = "testing/output.TestFileInjectorFile.sql"
 const TestProcessDumpfile = "testing/output.TestProcessDumpFile.sql"
+const TestSQLiteFile = "testing/output.TestSQLiteFile.db"
+const TestAuditLogFile = "testing/output.TestAuditLogFile.jsonl"
+const TestContextProcessedFile = "testing/output.TestContextProcessedFile.sql"
 
 // Test schemaPrefix
 const TestSchemaPrefix = ""
@@ -116,6 +119,14 @@ func seqUnitTests(t *testing.T) {
 	t.Run("BaseDSN", TestBaseDSN)
 	t.Run("URI", TestURI)
 	t.Run("BaseURI", TestBaseURI)
+	t.Run("LoadFromConnString", TestLoadFromConnString)
+	t.Run("ConnectionOptionsDSN", TestConnectionOptionsDSN)
+	t.Run("LoadFromService", TestLoadFromService)
+	t.Run("LoadFromPassFile", TestLoadFromPassFile)
+	t.Run("CommandURI", TestCommandURI)
+	t.Run("RedactSecrets", TestRedactSecrets)
+	t.Run("CommandEnv", TestCommandEnv)
+	t.Run("TailBuffer", TestTailBuffer)
 	t.Run("OpenDB", TestOpenDB)
 	t.Run("PsqlCmd", TestPsqlCommand)
 
@@ -173,6 +184,7 @@ func seqUnitTests(t *testing.T) {
 	t.Run("GenerateSchemaSql", TestGenerateSchemaSql)
 	t.Run("PreProcess", TestPreProcess)
 	t.Run("ProcessDumpFile", TestProcessDumpFile)
+	t.Run("ProcessDump", TestProcessDump)
 	t.Run("PostProcess", TestPostProcess)
 	t.Run("Clear", TestClear)
 
@@ -180,6 +192,103 @@ func seqUnitTests(t *testing.T) {
 	t.Run("LoadFile", TestLoadFile)
 	t.Run("TempDbCreate", TestLoaderTempDbCreation)
 	t.Run("VerifyRowCounts", TestVerifyRowCount)
+	t.Run("CompareRowCounts", TestCompareRowCounts)
+	t.Run("WriteRowCountFile", TestWriteRowCountFile)
+
+	// sqlite.go
+	t.Run("SQLiteColumnType", TestSQLiteColumnType)
+	t.Run("ParseSQLiteTable", TestParseSQLiteTable)
+	t.Run("UnescapeCopyValue", TestUnescapeCopyValue)
+	t.Run("LoadFileToSQLite", TestLoadFileToSQLite)
+	t.Run("LoadFileToSQLiteManifest", TestLoadFileToSQLiteManifest)
+
+	// secrets.go
+	t.Run("ParseSecretRef", TestParseSecretRef)
+	t.Run("ResolveSecret", TestResolveSecret)
+	t.Run("VaultSecretProvider", TestVaultSecretProvider)
+	t.Run("AWSSecretsManagerProvider", TestAWSSecretsManagerProvider)
+
+	// storage.go
+	t.Run("GetStorage", TestGetStorage)
+	t.Run("LocalStorage", TestLocalStorage)
+	t.Run("PipeUploader", TestPipeUploader)
+	t.Run("ParseBucketURL", TestParseBucketURL)
+
+	// s3.go
+	t.Run("ParseS3Url", TestParseS3Url)
+	t.Run("S3UploadInput", TestS3UploadInput)
+	t.Run("S3Storage", TestS3Storage)
+
+	// encryption.go
+	t.Run("DetectEncryption", TestDetectEncryption)
+	t.Run("AgeEncryption", TestAgeEncryption)
+	t.Run("PGPEncryption", TestPGPEncryption)
+	t.Run("CreateDumpFileEncrypted", TestCreateDumpFileEncrypted)
+
+	// manifest.go
+	t.Run("ManifestHasher", TestManifestHasher)
+	t.Run("ManifestSignature", TestManifestSignature)
+	t.Run("ManifestVerify", TestManifestVerify)
+
+	// leak.go
+	t.Run("ScanForLeaks", TestScanForLeaks)
+	t.Run("ScanForLeaksRandomDate", TestScanForLeaksRandomDate)
+	t.Run("DetectPII", TestDetectPII)
+	t.Run("BloomFilter", TestBloomFilter)
+
+	// quality.go
+	t.Run("GenerateQualityReport", TestGenerateQualityReport)
+	t.Run("HyperLogLog", TestHyperLogLog)
+
+	// runreport.go
+	t.Run("RunReport", TestRunReport)
+
+	// progress.go
+	t.Run("ProgressTracker", TestProgressTracker)
+	t.Run("ParseProgressMode", TestParseProgressMode)
+
+	// metrics.go
+	t.Run("ServeMetrics", TestServeMetrics)
+	t.Run("PushMetrics", TestPushMetrics)
+
+	// tracing.go
+	t.Run("StartTracing", TestStartTracing)
+	t.Run("StartTracingErrors", TestStartTracingErrors)
+
+	// audit.go
+	t.Run("AuditLog", TestAuditLog)
+	t.Run("AuditLogTampering", TestAuditLogTampering)
+
+	// lock.go
+	t.Run("AcquireLock", TestAcquireLock)
+
+	// scheduler.go
+	t.Run("Scheduler", TestScheduler)
+	t.Run("SchedulerRun", TestSchedulerRun)
+
+	// jobs.go
+	t.Run("JobServer", TestJobServer)
+	t.Run("JobServerQueue", TestJobServerQueue)
+
+	// notify.go
+	t.Run("NewNotification", TestNewNotification)
+	t.Run("Notifiers", TestNotifiers)
+	t.Run("NotifierSMTP", TestNotifierSMTP)
+
+	// context.go
+	t.Run("ContextReader", TestContextReader)
+	t.Run("ProcessDumpFileContext", TestProcessDumpFileContext)
+	t.Run("ExecPostgresCmdContext", TestExecPostgresCmdContext)
+
+	// processor.go
+	t.Run("Processor", TestProcessor)
+	t.Run("ProcessorRandom", TestProcessorRandom)
+
+	// processor_registry.go
+	t.Run("RegisterProcessor", TestRegisterProcessor)
+
+	// external_processor.go
+	t.Run("ExternalProcessor", TestExternalProcessor)
 
 	// db_client.go / DB Cleanup
 	t.Run("DropDatabase", TestDropDatabase)
@@ -201,13 +310,15 @@ func removeTestFiles(t *testing.T) {
 			TestCreateFile,
 			TestGenerateSchemaFile,
 			TestDumpFile,
-			TestPreProcessFile,
 			TestProcessDumpfile,
+			TestSQLiteFile,
+			TestAuditLogFile,
+			TestContextProcessedFile,
 		}
 	)
 	for _, f := range filesToDelete {
 		fi, err := os.Stat(f)
-		if os.IsNotExist(err) || !fi.IsDir() {
+		if err != nil || fi.IsDir() {
 			continue
 		} else {
 			t.Logf("Removing file: %s", f)
@@ -0,0 +1,468 @@
+package gonymizer
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ManifestSuffix is appended to the location of a dump or processed file to get the location of its manifest.
+	ManifestSuffix = ".manifest.json"
+	// manifestLinePrefixSize is the number of bytes of every line the manifest hasher keeps to find COPY statements.
+	manifestLinePrefixSize = 512
+)
+
+// Manifest describes a dump or processed file and how it was created. Manifests are written next to the file they
+// describe (see: ManifestURL) by the dump and process commands and verified by the load command.
+type Manifest struct {
+	Command     string    `json:"command"`
+	Version     string    `json:"version"`
+	BuildNumber int64     `json:"build_number"`
+	BuildDate   time.Time `json:"build_date"`
+	StartedAt   time.Time `json:"started_at"`
+	CompletedAt time.Time `json:"completed_at"`
+
+	// Source is the database the dump was created from
+	Source string `json:"source,omitempty"`
+
+	// Input is the dump file that was processed and InputManifest is the SHA-256 of the dump file's manifest
+	Input         *ManifestFile `json:"input,omitempty"`
+	InputManifest string        `json:"input_manifest_sha256,omitempty"`
+	Output        ManifestFile  `json:"output"`
+	MapFile       *ManifestFile `json:"map_file,omitempty"`
+
+	// SeedSHA256 is the SHA-256 of the seed from the map file. It is empty when the seed was generated.
+	SeedSHA256    string             `json:"seed_sha256,omitempty"`
+	GeneratedSeed bool               `json:"generated_seed,omitempty"`
+	Tables        []string           `json:"tables,omitempty"`
+	RowCounts     []ManifestRowCount `json:"row_counts,omitempty"`
+
+	// KeyID is the SHA-256 of the public key that signed the manifest
+	KeyID     string `json:"key_id,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// ManifestFile is the location, SHA-256 checksum, and size of a file in a Manifest. The checksum and size are of the
+// decrypted contents of the file so they do not change when a file is encrypted or copied.
+type ManifestFile struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// ManifestRowCount is the number of rows in a table when the dump was created.
+type ManifestRowCount struct {
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+	Count  int    `json:"count"`
+}
+
+// NewManifest will return a Manifest for the supplied command using the current Gonymizer version.
+func NewManifest(command string) *Manifest {
+	return &Manifest{
+		Command:     command,
+		Version:     Version(),
+		BuildNumber: BuildNumber(),
+		BuildDate:   BuildDate().UTC(),
+		StartedAt:   time.Now().UTC(),
+	}
+}
+
+// ManifestURL will return the location of the manifest for the supplied file.
+func ManifestURL(urlStr string) string {
+	return urlStr + ManifestSuffix
+}
+
+// SetRowCounts will add the supplied row counts to the manifest.
+func (manifest *Manifest) SetRowCounts(rowCounts *[]RowCounts) {
+	manifest.RowCounts = nil
+	for _, row := range *rowCounts {
+		manifest.RowCounts = append(manifest.RowCounts, ManifestRowCount{
+			Schema: *row.SchemaName,
+			Table:  *row.TableName,
+			Count:  *row.Count,
+		})
+	}
+}
+
+// SetSeed will record the SHA-256 of the seed in the manifest so the seed can be verified without disclosing it.
+func (manifest *Manifest) SetSeed(seed int64, generated bool) {
+	manifest.GeneratedSeed = generated
+	manifest.SeedSHA256 = ""
+	if !generated {
+		sum := sha256.Sum256([]byte(fmt.Sprint(seed)))
+		manifest.SeedSHA256 = hex.EncodeToString(sum[:])
+	}
+}
+
+// Sign will sign the manifest using the supplied Ed25519 private key.
+func (manifest *Manifest) Sign(key ed25519.PrivateKey) error {
+	manifest.KeyID = manifestKeyID(key.Public().(ed25519.PublicKey))
+	manifest.Signature = ""
+
+	payload, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	manifest.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload))
+	return nil
+}
+
+// VerifySignature will verify the signature of the manifest using the public key with a matching KeyID.
+func (manifest *Manifest) VerifySignature(keys []ed25519.PublicKey) error {
+	if len(manifest.Signature) == 0 {
+		return errors.New("manifest is not signed")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(manifest.Signature)
+	if err != nil {
+		return fmt.Errorf("unable to decode manifest signature: %s", err)
+	}
+
+	unsigned := *manifest
+	unsigned.Signature = ""
+	payload, err := json.Marshal(unsigned)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if manifestKeyID(key) == manifest.KeyID && ed25519.Verify(key, payload, signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("manifest signature is invalid or was not signed by a trusted key (key_id: %s)", manifest.KeyID)
+}
+
+// Verify will verify that the file matches the checksum and size in the manifest. The file must have been created by
+// the process command since dump files contain PHI/PII. If keys are supplied, the manifest must be signed by one of the
+// keys. Use LoadFileWithOptions to verify a file while it is loaded instead of reading it an extra time.
+func (manifest *Manifest) Verify(urlStr string, keys []ed25519.PublicKey) error {
+	if err := manifest.verifyOrigin(keys); err != nil {
+		return err
+	}
+
+	file, _, err := HashURL(urlStr)
+	if err != nil {
+		return err
+	}
+	return manifest.verifyFile(urlStr, file)
+}
+
+// verifyOrigin will verify the signature of the manifest and that it describes a processed file.
+func (manifest *Manifest) verifyOrigin(keys []ed25519.PublicKey) error {
+	if len(keys) > 0 {
+		if err := manifest.VerifySignature(keys); err != nil {
+			return err
+		}
+	} else if len(manifest.Signature) > 0 {
+		log.Warn("Manifest is signed, but no manifest verify keys are configured. Skipping signature verification")
+	}
+
+	if manifest.Command != "process" {
+		return fmt.Errorf("manifest shows the file was created by '%s' instead of 'process'. Refusing to load a "+
+			"file that was not anonymized", manifest.Command)
+	}
+	if manifest.Input == nil {
+		return errors.New("manifest does not include the dump file the processed file was created from")
+	}
+	return nil
+}
+
+// verifyFile will verify that the checksum and size of the file match the manifest.
+func (manifest *Manifest) verifyFile(urlStr string, file ManifestFile) error {
+	if file.SHA256 != manifest.Output.SHA256 || file.Size != manifest.Output.Size {
+		return fmt.Errorf("checksum of '%s' does not match the manifest (sha256: %s, size: %d, expected sha256: %s, "+
+			"size: %d)", RedactSecrets(urlStr), file.SHA256, file.Size, manifest.Output.SHA256, manifest.Output.Size)
+	}
+	return nil
+}
+
+// ManifestOptions configures how the manifest of a file is verified when it is loaded.
+type ManifestOptions struct {
+	// Require will refuse to load files that do not have a manifest.
+	Require bool
+	// Keys are the public keys trusted to sign manifests. If any are set, the manifest must be signed by one of them.
+	Keys []ed25519.PublicKey
+}
+
+// manifestVerifier checksums a file while it is loaded so it is only read once, and verifies it against its manifest
+// before the loaded data is used.
+type manifestVerifier struct {
+	urlStr   string
+	manifest *Manifest
+	hasher   *manifestHasher
+}
+
+// newManifestVerifier will read the manifest of the file and verify its signature. nil is returned for files without a
+// manifest unless options.Require is set.
+func newManifestVerifier(urlStr string, options ManifestOptions) (*manifestVerifier, error) {
+	manifest, _, err := ReadManifest(urlStr)
+	if os.IsNotExist(err) {
+		if options.Require {
+			return nil, errors.New("no manifest was found for: " + RedactSecrets(urlStr))
+		}
+		log.Warn("No manifest was found. Skipping manifest verification for: ", RedactSecrets(urlStr))
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	log.Info("Verifying file against manifest: ", RedactSecrets(ManifestURL(urlStr)))
+	if err = manifest.verifyOrigin(options.Keys); err != nil {
+		return nil, err
+	}
+	return &manifestVerifier{urlStr: urlStr, manifest: manifest, hasher: newManifestHasher()}, nil
+}
+
+// Reader will return a reader which checksums the file as it is read.
+func (verifier *manifestVerifier) Reader(reader io.Reader) io.Reader {
+	if verifier == nil {
+		return reader
+	}
+	return io.TeeReader(reader, verifier.hasher)
+}
+
+// Verify will verify that everything read from the file matches the manifest.
+func (verifier *manifestVerifier) Verify() error {
+	if verifier == nil {
+		return nil
+	}
+	if err := verifier.manifest.verifyFile(verifier.urlStr, verifier.hasher.File(verifier.urlStr)); err != nil {
+		return err
+	}
+	log.Infof("Manifest verified (gonymizer %s, build %d, processed at %s)",
+		verifier.manifest.Version, verifier.manifest.BuildNumber, verifier.manifest.CompletedAt)
+	return nil
+}
+
+// WriteManifest will write the manifest for the supplied file to ManifestURL(urlStr).
+func WriteManifest(urlStr string, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	writer, err := CreateURL(ManifestURL(urlStr))
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(append(data, '\n')); err != nil {
+		abortWriter(writer, err)
+		return err
+	}
+	return writer.Close()
+}
+
+// ReadManifest will read the manifest for the supplied file from ManifestURL(urlStr). The SHA-256 of the manifest
+// is also returned so other manifests can refer to it. If the manifest does not exist os.IsNotExist(err) is true.
+func ReadManifest(urlStr string) (*Manifest, string, error) {
+	var manifest Manifest
+
+	reader, err := OpenURL(ManifestURL(urlStr))
+	if err != nil {
+		return nil, "", err
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, "", err
+	}
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return nil, "", fmt.Errorf("unable to parse manifest '%s': %s", RedactSecrets(ManifestURL(urlStr)), err)
+	}
+
+	sum := sha256.Sum256(data)
+	return &manifest, hex.EncodeToString(sum[:]), nil
+}
+
+// HashURL will return the SHA-256 checksum and size of the file at the supplied URL, and the exact number of rows in
+// the COPY statements of every table if it is a PostgreSQL dump file.
+func HashURL(urlStr string) (ManifestFile, []ManifestRowCount, error) {
+	return HashURLContext(context.Background(), urlStr)
+}
+
+// HashURLContext is the same as HashURL, but stops when the context is cancelled.
+func HashURLContext(ctx context.Context, urlStr string) (ManifestFile, []ManifestRowCount, error) {
+	reader, err := OpenURL(urlStr)
+	if err != nil {
+		return ManifestFile{}, nil, err
+	}
+	defer reader.Close()
+
+	hasher := newManifestHasher()
+	if _, err = io.Copy(hasher, newContextReader(ctx, reader)); err != nil {
+		return ManifestFile{}, nil, err
+	}
+	return hasher.File(urlStr), hasher.RowCounts(), nil
+}
+
+// ParseManifestSigningKey will parse the PEM encoded (PKCS #8) Ed25519 private key supplied inline or as a path. Keys
+// can be created using: openssl genpkey -algorithm ed25519
+func ParseManifestSigningKey(value string) (ed25519.PrivateKey, error) {
+	block, err := readPEMBlock(value)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse manifest signing key: %s", err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("manifest signing key is not an Ed25519 private key")
+	}
+	return privateKey, nil
+}
+
+// ParseManifestVerifyKey will parse the PEM encoded (PKIX) Ed25519 public key supplied inline or as a path. Keys can be
+// created using: openssl pkey -in signing-key.pem -pubout
+func ParseManifestVerifyKey(value string) (ed25519.PublicKey, error) {
+	block, err := readPEMBlock(value)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse manifest verify key: %s", err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("manifest verify key is not an Ed25519 public key")
+	}
+	return publicKey, nil
+}
+
+// readPEMBlock will return the first PEM block of the key supplied inline or as a path.
+func readPEMBlock(value string) (*pem.Block, error) {
+	data, err := readKeyMaterial(value)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("unable to find a PEM encoded key")
+	}
+	return block, nil
+}
+
+// manifestKeyID will return the SHA-256 of the public key.
+func manifestKeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
+
+// manifestHasher is an io.Writer that calculates the SHA-256 and size of everything written to it and keeps track of
+// the tables and the number of rows in COPY statements.
+type manifestHasher struct {
+	hash    hash.Hash
+	size    int64
+	line    []byte
+	tables  []string
+	rows    map[string]int
+	copying string
+}
+
+// newManifestHasher returns a new manifestHasher.
+func newManifestHasher() *manifestHasher {
+	return &manifestHasher{hash: sha256.New(), rows: map[string]int{}}
+}
+
+// Write will add the bytes to the checksum.
+func (hasher *manifestHasher) Write(p []byte) (int, error) {
+	n, _ := hasher.hash.Write(p)
+	hasher.size += int64(n)
+
+	for len(p) > 0 {
+		end := bytes.IndexByte(p, '\n')
+		chunk := p
+		if end >= 0 {
+			chunk = p[:end]
+		}
+		if free := manifestLinePrefixSize - len(hasher.line); free > 0 {
+			if len(chunk) > free {
+				chunk = chunk[:free]
+			}
+			hasher.line = append(hasher.line, chunk...)
+		}
+		if end < 0 {
+			break
+		}
+		hasher.endLine()
+		p = p[end+1:]
+	}
+	return n, nil
+}
+
+// endLine will record the table if the current line is a COPY statement, or count the row if the current line is in
+// a COPY statement.
+func (hasher *manifestHasher) endLine() {
+	if len(hasher.copying) > 0 {
+		if string(bytes.TrimRight(hasher.line, "\r")) == StateChangeTokenEndCopy {
+			hasher.copying = ""
+		} else {
+			hasher.rows[hasher.copying]++
+		}
+	} else if bytes.HasPrefix(hasher.line, []byte("COPY ")) {
+		fields := strings.Fields(string(hasher.line))
+		if len(fields) > 1 {
+			if _, ok := hasher.rows[fields[1]]; !ok {
+				hasher.rows[fields[1]] = 0
+				hasher.tables = append(hasher.tables, fields[1])
+			}
+			hasher.copying = fields[1]
+		}
+	}
+	hasher.line = hasher.line[:0]
+}
+
+// File will return the ManifestFile for everything written to the hasher.
+func (hasher *manifestHasher) File(urlStr string) ManifestFile {
+	return ManifestFile{
+		URL:    RedactSecrets(urlStr),
+		SHA256: hex.EncodeToString(hasher.hash.Sum(nil)),
+		Size:   hasher.size,
+	}
+}
+
+// Tables will return the tables of all COPY statements written to the hasher.
+func (hasher *manifestHasher) Tables() []string {
+	return hasher.tables
+}
+
+// RowCounts will return the number of rows in the COPY statements of every table written to the hasher.
+func (hasher *manifestHasher) RowCounts() []ManifestRowCount {
+	var rowCounts []ManifestRowCount
+	for _, table := range hasher.tables {
+		parts := strings.SplitN(table, ".", 2)
+		if len(parts) == 1 {
+			parts = []string{"public", parts[0]}
+		}
+		rowCounts = append(rowCounts, ManifestRowCount{
+			Schema: strings.Trim(parts[0], `"`),
+			Table:  strings.Trim(parts[1], `"`),
+			Count:  hasher.rows[table],
+		})
+	}
+	return rowCounts
+}
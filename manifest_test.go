@@ -0,0 +1,138 @@
+package gonymizer
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestHasher(t *testing.T) {
+	contents := "SET client_encoding = 'UTF8';\nCOPY public.users (id, email) FROM stdin;\n1\ta@b.c\n\\.\n" +
+		"COPY public.orders (id) FROM stdin;\n\\.\nCOPY public.users (id, email) FROM stdin;\n\\.\n"
+
+	// Write one byte at a time to make sure lines that are split between writes are handled
+	hasher := newManifestHasher()
+	for i := 0; i < len(contents); i++ {
+		_, err := hasher.Write([]byte{contents[i]})
+		require.Nil(t, err)
+	}
+
+	sum := sha256.Sum256([]byte(contents))
+	file := hasher.File("testing/dump.sql")
+	require.Equal(t, hex.EncodeToString(sum[:]), file.SHA256)
+	require.Equal(t, int64(len(contents)), file.Size)
+	require.Equal(t, []string{"public.users", "public.orders"}, hasher.Tables())
+	require.Equal(t, []ManifestRowCount{
+		{Schema: "public", Table: "users", Count: 1},
+		{Schema: "public", Table: "orders", Count: 0},
+	}, hasher.RowCounts())
+
+	// Row counts match the row count file of the test database
+	file, rowCounts, err := HashURL(TestDbFile)
+	require.Nil(t, err)
+	expected, err := readRowCountFile(TestRowCountFile)
+	require.Nil(t, err)
+	require.Len(t, rowCounts, len(expected))
+	for i, row := range expected {
+		require.Equal(t, ManifestRowCount{Schema: *row.SchemaName, Table: *row.TableName, Count: *row.Count}, rowCounts[i])
+	}
+	info, err := os.Stat(TestDbFile)
+	require.Nil(t, err)
+	require.Equal(t, info.Size(), file.Size)
+}
+
+func TestManifestSignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+
+	// Keys are PEM encoded the same way as openssl genpkey -algorithm ed25519
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.Nil(t, err)
+	signingKey, err := ParseManifestSigningKey(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+	require.Nil(t, err)
+	der, err = x509.MarshalPKIXPublicKey(publicKey)
+	require.Nil(t, err)
+	verifyKey, err := ParseManifestVerifyKey(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	require.Nil(t, err)
+
+	manifest := NewManifest("process")
+	manifest.Output = ManifestFile{URL: "s3://bucket/processed.sql", SHA256: "abc", Size: 3}
+	manifest.Tables = []string{"public.users"}
+	require.NotNil(t, manifest.VerifySignature([]ed25519.PublicKey{verifyKey}))
+
+	require.Nil(t, manifest.Sign(signingKey))
+	require.Nil(t, manifest.VerifySignature([]ed25519.PublicKey{verifyKey}))
+	require.NotNil(t, manifest.VerifySignature([]ed25519.PublicKey{otherKey}))
+
+	// Any change to the manifest invalidates the signature
+	manifest.Tables = append(manifest.Tables, "public.orders")
+	require.NotNil(t, manifest.VerifySignature([]ed25519.PublicKey{verifyKey}))
+
+	_, err = ParseManifestSigningKey("not a key")
+	require.NotNil(t, err)
+}
+
+func TestManifestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonymizer-manifest")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	keys := []ed25519.PublicKey{publicKey}
+
+	columnMap, err := LoadConfigSkeleton(TestMapFile)
+	require.Nil(t, err)
+	processed := filepath.Join(dir, "processed.sql")
+	manifest, err := ProcessDumpFileWithManifest(columnMap, TestDbFile, processed, "", "", false)
+	require.Nil(t, err)
+
+	input, _, err := HashURL(TestDbFile)
+	require.Nil(t, err)
+	require.Equal(t, input.SHA256, manifest.Input.SHA256)
+	require.Len(t, manifest.Tables, 4)
+	require.Len(t, manifest.RowCounts, 4)
+	require.NotEmpty(t, manifest.SeedSHA256)
+	require.False(t, manifest.GeneratedSeed)
+
+	// Manifests survive a round trip through storage
+	require.Nil(t, manifest.Sign(privateKey))
+	require.Nil(t, WriteManifest(processed, manifest))
+	manifest, sum, err := ReadManifest(processed)
+	require.Nil(t, err)
+	require.Len(t, sum, 64)
+	require.Nil(t, manifest.Verify(processed, keys))
+
+	// Modified files are refused
+	f, err := os.OpenFile(processed, os.O_APPEND|os.O_WRONLY, 0644)
+	require.Nil(t, err)
+	_, err = f.WriteString("DROP TABLE users;\n")
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	require.NotNil(t, manifest.Verify(processed, keys))
+
+	// Dump files are refused since they were not anonymized
+	dumpManifest := NewManifest("dump")
+	dumpManifest.Output, _, err = HashURL(TestDbFile)
+	require.Nil(t, err)
+	require.Nil(t, dumpManifest.Sign(privateKey))
+	require.NotNil(t, dumpManifest.Verify(TestDbFile, keys))
+
+	// Unsigned manifests are refused when keys are configured
+	manifest.Signature = ""
+	require.NotNil(t, manifest.Verify(processed, keys))
+
+	_, _, err = ReadManifest(filepath.Join(dir, "missing.sql"))
+	require.True(t, os.IsNotExist(err))
+}
@@ -1,10 +1,13 @@
 package gonymizer
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 
@@ -79,25 +82,38 @@ func (dbMap DBMapper) ColumnMapper(schemaName, tableName, columnName string) *Co
 	return nil
 }
 
-// Validate is used to verify that a database map is complete and correct.
+// Validate is used to verify that a database map is complete and correct. Every processor used in the map must be
+// registered (see: RegisterProcessor).
 func (dbMap *DBMapper) Validate() error {
 	if len(dbMap.DBName) == 0 {
 		return errors.New("Expected non-empty DBName")
 	}
-	return nil
+	return validateProcessors(dbMap.ColumnMaps)
 }
 
 // GenerateConfigSkeleton will generate a column-map based on the supplied PGConfig and previously configured map file.
 func GenerateConfigSkeleton(conf PGConfig, schemaPrefix string, schemas, excludeTables []string) (*DBMapper, error) {
+	return GenerateConfigSkeletonContext(context.Background(), conf, schemaPrefix, schemas, excludeTables)
+}
+
+// GenerateConfigSkeletonContext is the same as GenerateConfigSkeleton, but the queries are cancelled when the context
+// is cancelled.
+func GenerateConfigSkeletonContext(ctx context.Context, conf PGConfig, schemaPrefix string, schemas,
+	excludeTables []string) (*DBMapper, error) {
+	logger := loggerFromContext(ctx)
+	ctx, stopStep := StartStep(ctx, "map")
+	defer stopStep()
+
 	var (
 		dbmap     *DBMapper
 		columnMap []ColumnMapper
 	)
 	db, err := OpenDB(conf)
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
 		return nil, err
 	}
+	defer db.Close()
 
 	dbmap = new(DBMapper)
 	dbmap.DBName = conf.DefaultDBName
@@ -109,10 +125,10 @@ func GenerateConfigSkeleton(conf PGConfig, schemaPrefix string, schemas, exclude
 		schemas = append(schemas, "public")
 	}
 
-	log.Info("Schemas to map: ", schemas)
+	logger.Info("Schemas to map: ", schemas)
 	for _, schema := range schemas {
-		log.Info("Mapping columns for schema: ", schema)
-		columnMap, err = mapColumns(db, columnMap, schemaPrefix, schema, excludeTables)
+		logger.Info("Mapping columns for schema: ", schema)
+		columnMap, err = mapColumns(ctx, db, columnMap, schemaPrefix, schema, excludeTables)
 		if err != nil {
 			return nil, err
 		}
@@ -147,6 +163,13 @@ func WriteConfigSkeleton(dbmap *DBMapper, filepath string) error {
 
 // LoadConfigSkeleton will load the column-map into memory for use in dumping, processing, and loading of SQL files.
 func LoadConfigSkeleton(givenPathToFile string) (*DBMapper, error) {
+	dbmap, _, err := LoadConfigSkeletonWithManifest(givenPathToFile)
+	return dbmap, err
+}
+
+// LoadConfigSkeletonWithManifest is the same as LoadConfigSkeleton, but also returns the checksum and size of the map
+// file. The checksum is calculated from the bytes the map was loaded from, so it describes the map that was used.
+func LoadConfigSkeletonWithManifest(givenPathToFile string) (*DBMapper, ManifestFile, error) {
 	pathToFile := givenPathToFile
 
 	f, err := os.Open(pathToFile)
@@ -154,11 +177,13 @@ func LoadConfigSkeleton(givenPathToFile string) (*DBMapper, error) {
 		log.Error("Failure to open file: ", err)
 		log.Error("givenPathToFile: ", givenPathToFile)
 		log.Error("pathToFile: ", pathToFile)
-		return nil, err
+		return nil, ManifestFile{}, err
 	}
 	defer f.Close()
 
-	jsonDecoder := json.NewDecoder(f)
+	hasher := newManifestHasher()
+	reader := io.TeeReader(f, hasher)
+	jsonDecoder := json.NewDecoder(reader)
 
 	dbmap := new(DBMapper)
 	err = jsonDecoder.Decode(dbmap)
@@ -167,17 +192,22 @@ func LoadConfigSkeleton(givenPathToFile string) (*DBMapper, error) {
 		log.Error("givenPathToFile: ", givenPathToFile)
 		log.Error("pathToFile: ", pathToFile)
 		log.Error("f: ", f)
-		return nil, err
+		return nil, ManifestFile{}, err
+	}
+
+	// The decoder stops after the map, so the rest of the file is read to complete the checksum
+	if _, err = io.Copy(ioutil.Discard, reader); err != nil {
+		return nil, ManifestFile{}, err
 	}
 
 	err = dbmap.Validate()
 	if err != nil {
 		log.Error(err)
 		log.Error("dbmap: ", dbmap)
-		return nil, err
+		return nil, ManifestFile{}, err
 	}
 
-	return dbmap, nil
+	return dbmap, hasher.File(givenPathToFile), nil
 }
 
 // findColumn searches the in-memory loaded column map using the specified parameters.
@@ -200,7 +230,8 @@ func findColumn(columns []ColumnMapper, columnName, tableName, schemaPrefix, sch
 	return ColumnMapper{}
 }
 
-// addColumn creates a ColumnMapper structure based on the input parameters.
+// addColumn creates a ColumnMapper structure based on the input parameters. The processors suggested for the column
+// (see: SuggestProcessors) are added to the comment of its Identity processor.
 func addColumn(columnName, tableName, schema, dataType string, ordinalPosition int,
 	isNullable bool) ColumnMapper {
 	col := ColumnMapper{}
@@ -217,12 +248,16 @@ func addColumn(columnName, tableName, schema, dataType string, ordinalPosition i
 	col.IsNullable = isNullable
 	col.TableSchema = schema
 
+	if suggestions := SuggestProcessors(col); len(suggestions) > 0 {
+		col.Processors[0].Comment = "Suggested processors: " + strings.Join(suggestions, ", ")
+	}
 	return col
 }
 
 // mapColumns
-func mapColumns(db *sql.DB, columns []ColumnMapper, schemaPrefix, schema string,
+func mapColumns(ctx context.Context, db *sql.DB, columns []ColumnMapper, schemaPrefix, schema string,
 	excludeTables []string) ([]ColumnMapper, error) {
+	logger := loggerFromContext(ctx)
 	var (
 		err           error
 		rows          *sql.Rows
@@ -250,13 +285,13 @@ func mapColumns(db *sql.DB, columns []ColumnMapper, schemaPrefix, schema string,
 
 	if len(schemaPrefix) == 0 && len(schema) == 0 {
 
-		log.Debug("Mapping all schemas")
-		rows, err = GetAllSchemaColumns(db)
+		logger.Debug("Mapping all schemas")
+		rows, err = GetAllSchemaColumnsContext(ctx, db)
 
 	} else if len(schemaPrefix) == 0 && len(schema) > 0 {
 
-		log.Debug("Mapping a single schema")
-		rows, err = GetSchemaColumnEquals(db, schema)
+		logger.Debug("Mapping a single schema")
+		rows, err = GetSchemaColumnEqualsContext(ctx, db, schema)
 
 	} else if schemaPrefix != "" && schema == "" {
 
@@ -265,19 +300,22 @@ func mapColumns(db *sql.DB, columns []ColumnMapper, schemaPrefix, schema string,
 
 	} else if strings.HasPrefix(schemaPrefix, schema) {
 
-		log.Debug("Mapping a schema with SchemaPrefix present")
+		logger.Debug("Mapping a schema with SchemaPrefix present")
 		prefixPresent = true
-		rows, err = GetSchemaColumnsLike(db, schemaPrefix)
+		rows, err = GetSchemaColumnsLikeContext(ctx, db, schemaPrefix)
 
 	} else {
 
-		log.Debug("Mapping a single schema")
-		rows, err = GetSchemaColumnEquals(db, schema)
+		logger.Debug("Mapping a single schema")
+		rows, err = GetSchemaColumnEqualsContext(ctx, db, schema)
 
 	}
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
-	log.Debug("Iterating through rows and creating skeleton map")
+	logger.Debug("Iterating through rows and creating skeleton map")
 	for {
 		var (
 			tableCatalog    string
@@ -338,5 +376,9 @@ func mapColumns(db *sql.DB, columns []ColumnMapper, schemaPrefix, schema string,
 		}
 	}
 
+	// Iterating stops early when the context is cancelled, so never return a partial map
+	if rowsErr := rows.Err(); rowsErr != nil {
+		return nil, rowsErr
+	}
 	return columns, err
 }
@@ -36,4 +36,12 @@ func TestLoadConfigSkeleton(t *testing.T) {
 	require.NotNil(t, err)
 	_, err = LoadConfigSkeleton("/dev/null")
 	require.NotNil(t, err)
+
+	// The checksum of the map describes the whole file the map was loaded from
+	_, mapFile, err := LoadConfigSkeletonWithManifest(TestMapFile)
+	require.Nil(t, err)
+	hashed, _, err := HashURL(TestMapFile)
+	require.Nil(t, err)
+	require.Equal(t, hashed.SHA256, mapFile.SHA256)
+	require.Equal(t, hashed.Size, mapFile.Size)
 }
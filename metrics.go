@@ -0,0 +1,122 @@
+package gonymizer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	log "github.com/sirupsen/logrus"
+)
+
+// metricsRegistry holds all Gonymizer metrics. It is pushed to the Pushgateway without the Go runtime metrics of the
+// default registry.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	metricRowsProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gonymizer_rows_processed_total",
+		Help: "Number of rows processed per table.",
+	}, []string{"schema", "table"})
+
+	metricBytesProcessed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gonymizer_bytes_processed_total",
+		Help: "Number of bytes of the dump file that were processed.",
+	})
+
+	metricInputBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gonymizer_input_bytes",
+		Help: "Size of the dump file being processed in bytes, or 0 if it is unknown.",
+	})
+
+	metricProcessorErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gonymizer_processor_errors_total",
+		Help: "Number of values a processor failed to process.",
+	}, []string{"processor"})
+
+	metricPhaseDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gonymizer_phase_duration_seconds",
+		Help: "Duration of the last run of each phase (dump, process, load, ...) in seconds.",
+	}, []string{"phase"})
+
+	metricRunSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gonymizer_run_success",
+		Help: "1 if the last command completed successfully, 0 otherwise.",
+	})
+
+	metricRunCompleted = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gonymizer_run_completed_timestamp_seconds",
+		Help: "Unix time the last command completed.",
+	})
+)
+
+// init registers all Gonymizer metrics.
+func init() {
+	metricsRegistry.MustRegister(
+		metricRowsProcessed,
+		metricBytesProcessed,
+		metricInputBytes,
+		metricProcessorErrors,
+		metricPhaseDuration,
+		metricRunSuccess,
+		metricRunCompleted,
+	)
+}
+
+// StartStep will start timing a step (phase) of the running command and start a span for it that is a child of the
+// span in the context. The returned context carries the span of the step. The returned function stops the timer, ends
+// the span, adds the step to the run report (if any), and records its duration in the
+// gonymizer_phase_duration_seconds metric.
+func StartStep(ctx context.Context, name string) (context.Context, func()) {
+	started := time.Now()
+	stopReport := GetRunReport().StartStep(name)
+	ctx, stopSpan := StartSpan(ctx, name)
+	return ctx, func() {
+		stopSpan(nil)
+		stopReport()
+		metricPhaseDuration.WithLabelValues(name).Set(time.Since(started).Seconds())
+	}
+}
+
+// SetRunResult will record the result of the command in the gonymizer_run_success and
+// gonymizer_run_completed_timestamp_seconds metrics.
+func SetRunResult(err error) {
+	if err != nil {
+		metricRunSuccess.Set(0)
+	} else {
+		metricRunSuccess.Set(1)
+	}
+	metricRunCompleted.SetToCurrentTime()
+}
+
+// ServeMetrics will expose the Gonymizer and Go runtime metrics on http://addr/metrics in the background. An error is
+// returned if the address can not be listened on. The Addr of the returned server is the address listened on.
+func ServeMetrics(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(
+		prometheus.Gatherers{metricsRegistry, prometheus.DefaultGatherer},
+		promhttp.HandlerOpts{},
+	))
+	server := &http.Server{Addr: listener.Addr().String(), Handler: mux}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error("Metrics server stopped: ", err)
+		}
+	}()
+	return server, nil
+}
+
+// PushMetrics will push the Gonymizer metrics to the Prometheus Pushgateway at the supplied URL using the job name.
+// Metrics pushed previously for the job are replaced.
+func PushMetrics(gatewayURL, job string) error {
+	return push.New(gatewayURL, job).Gatherer(metricsRegistry).Push()
+}
@@ -0,0 +1,53 @@
+package gonymizer
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeMetrics(t *testing.T) {
+	_, stopStep := StartStep(context.Background(), "metrics-test")
+	stopStep()
+	SetRunResult(nil)
+	require.Equal(t, 1.0, testutil.ToFloat64(metricRunSuccess))
+
+	server, err := ServeMetrics("127.0.0.1:0")
+	require.Nil(t, err)
+	defer server.Close()
+
+	resp, err := http.Get("http://" + server.Addr + "/metrics")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Contains(t, string(body), `gonymizer_phase_duration_seconds{phase="metrics-test"}`)
+	require.Contains(t, string(body), "gonymizer_run_success 1")
+	require.Contains(t, string(body), "go_goroutines")
+
+	_, err = ServeMetrics(server.Addr)
+	require.NotNil(t, err)
+}
+
+func TestPushMetrics(t *testing.T) {
+	var path string
+	var body []byte
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	SetRunResult(errors.New("failed"))
+	require.Nil(t, PushMetrics(gateway.URL, "nightly"))
+	require.Equal(t, "/metrics/job/nightly", path)
+	require.NotEmpty(t, body)
+	require.Equal(t, 0.0, testutil.ToFloat64(metricRunSuccess))
+}
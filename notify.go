@@ -0,0 +1,435 @@
+package gonymizer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// NotifierWebhook posts the notification as JSON (or the rendered template) to a URL
+// NotifierSlack posts the rendered template to a Slack incoming webhook
+// NotifierSMTP sends the rendered template as an email
+const (
+	NotifierWebhook = "webhook"
+	NotifierSlack   = "slack"
+	NotifierSMTP    = "smtp"
+)
+
+// NotifyOnFailure sends a notification when the command fails
+// NotifyOnSuccess sends a notification when the command completes without errors or anomalies
+// NotifyOnRowCountMismatch sends a notification when the row count of a table does not match after loading
+const (
+	NotifyOnFailure          = "failure"
+	NotifyOnSuccess          = "success"
+	NotifyOnRowCountMismatch = "row-count-mismatch"
+)
+
+// DefaultNotificationTemplate is the text/template used for messages when NotifierConfig.Template is empty. The data
+// of the template is the Notification.
+const DefaultNotificationTemplate = `Gonymizer {{.Command}} {{.Status}} on {{.Host}}
+{{- if .DurationSeconds}} after {{printf "%.1f" .DurationSeconds}}s{{end}}
+{{- if .Error}}
+Error: {{.Error}}
+{{- end}}
+{{- if .Tables}}
+Processed {{.Rows}} rows in {{.Tables}} tables, {{.ValuesChanged}} values changed
+{{- end}}
+{{- range .RowCountMismatches}}
+Row count mismatch: {{.Schema}}.{{.Table}} expected {{.Expected}} rows, found {{.Actual}}
+{{- end}}
+`
+
+// DefaultNotificationSubject is the text/template used for email subjects when NotifierConfig.Subject is empty.
+const DefaultNotificationSubject = `Gonymizer {{.Command}} {{.Status}} on {{.Host}}`
+
+// notificationTimeout is the time a notifier has to deliver a notification.
+const notificationTimeout = 30 * time.Second
+
+// Notification is the outcome of a command sent by a Notifier. The summary fields are taken from the run report (if
+// any), which is included in webhook notifications.
+type Notification struct {
+	Command            string               `json:"command"`
+	Status             string               `json:"status"`
+	Error              string               `json:"error,omitempty"`
+	Host               string               `json:"host"`
+	StartedAt          time.Time            `json:"started_at"`
+	CompletedAt        time.Time            `json:"completed_at"`
+	DurationSeconds    float64              `json:"duration_seconds"`
+	Tables             int                  `json:"tables"`
+	Rows               int64                `json:"rows"`
+	ValuesChanged      int64                `json:"values_changed"`
+	RowCountMismatches []RowCountComparison `json:"row_count_mismatches,omitempty"`
+	Report             *RunReport           `json:"report,omitempty"`
+}
+
+// NotifierConfig configures a Notifier. See NewNotifier.
+type NotifierConfig struct {
+	// Name identifies the notifier in log messages.
+	Name string
+	// Type is one of: NotifierWebhook, NotifierSlack, NotifierSMTP.
+	Type string
+	// Triggers are the outcomes a notification is sent for. Defaults to NotifyOnFailure.
+	Triggers []string
+	// URL is the URL of the webhook or Slack incoming webhook.
+	URL string
+	// Headers are added to webhook requests (I.E. Authorization).
+	Headers map[string]string
+	// Channel and Username override the defaults of the Slack incoming webhook.
+	Channel  string
+	Username string
+	// SMTPAddress is the host:port of the SMTP server. SMTPUsername and SMTPPassword are used for PLAIN authentication
+	// when set.
+	SMTPAddress  string
+	SMTPUsername string
+	SMTPPassword string
+	// From and To are the sender and recipients of emails.
+	From string
+	To   []string
+	// Subject is the text/template of the email subject. Defaults to DefaultNotificationSubject.
+	Subject string
+	// Template is the text/template of the message. Defaults to DefaultNotificationTemplate for Slack and email, and to
+	// the Notification as JSON for webhooks.
+	Template string
+}
+
+// Notifier sends notifications about the outcome of commands.
+type Notifier interface {
+	Notify(notification Notification) error
+}
+
+// WebhookNotifier posts the Notification as JSON, or the rendered template when Template is set, to URL.
+type WebhookNotifier struct {
+	URL      string
+	Headers  map[string]string
+	Template *template.Template
+}
+
+// SlackNotifier posts the rendered template to a Slack incoming webhook.
+type SlackNotifier struct {
+	URL      string
+	Channel  string
+	Username string
+	Template *template.Template
+}
+
+// SMTPNotifier sends the rendered template as a plain text email.
+type SMTPNotifier struct {
+	Address  string
+	Username string
+	Password string
+	From     string
+	To       []string
+	Subject  *template.Template
+	Template *template.Template
+}
+
+// triggeredNotifier only sends notifications for the configured triggers.
+type triggeredNotifier struct {
+	name     string
+	triggers []string
+	notifier Notifier
+}
+
+// notificationClient is the HTTP client used for webhooks.
+var notificationClient = &http.Client{Timeout: notificationTimeout}
+
+// NewNotification will return the Notification for a command that completed with the supplied error. The status and
+// summary are taken from the finished run report when it is not nil.
+func NewNotification(command string, report *RunReport, err error) Notification {
+	host, _ := os.Hostname()
+	notification := Notification{
+		Command:     command,
+		Status:      RunStatusSuccess,
+		Host:        host,
+		CompletedAt: time.Now().UTC(),
+		Report:      report,
+	}
+	if err != nil {
+		notification.Status = RunStatusFailure
+		notification.Error = RedactSecrets(err.Error())
+	}
+	if report == nil {
+		notification.StartedAt = notification.CompletedAt
+		return notification
+	}
+
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	if len(report.Status) > 0 {
+		notification.Status = report.Status
+	}
+	notification.StartedAt = report.StartedAt
+	if !report.CompletedAt.IsZero() {
+		notification.CompletedAt = report.CompletedAt
+	}
+	notification.DurationSeconds = notification.CompletedAt.Sub(notification.StartedAt).Seconds()
+	notification.Tables = len(report.Tables)
+	for _, table := range report.Tables {
+		notification.Rows += table.Rows
+		for _, changed := range table.ValuesChanged {
+			notification.ValuesChanged += changed
+		}
+	}
+	for _, rowCount := range report.RowCounts {
+		if !rowCount.Match {
+			notification.RowCountMismatches = append(notification.RowCountMismatches, rowCount)
+		}
+	}
+	return notification
+}
+
+// NewNotifier will return the Notifier for the supplied configuration. The Notifier only sends notifications for the
+// configured triggers.
+func NewNotifier(config NotifierConfig) (Notifier, error) {
+	triggers := config.Triggers
+	if len(triggers) == 0 {
+		triggers = []string{NotifyOnFailure}
+	}
+	for _, trigger := range triggers {
+		if trigger != NotifyOnFailure && trigger != NotifyOnSuccess && trigger != NotifyOnRowCountMismatch {
+			return nil, fmt.Errorf("unknown trigger '%s', must be one of: %s, %s, %s", trigger, NotifyOnFailure,
+				NotifyOnSuccess, NotifyOnRowCountMismatch)
+		}
+	}
+
+	var (
+		notifier Notifier
+		err      error
+	)
+	switch strings.ToLower(config.Type) {
+	case NotifierWebhook:
+		notifier, err = newWebhookNotifier(config)
+	case NotifierSlack:
+		notifier, err = newSlackNotifier(config)
+	case NotifierSMTP:
+		notifier, err = newSMTPNotifier(config)
+	default:
+		return nil, fmt.Errorf("unknown notifier type '%s', must be one of: %s, %s, %s", config.Type, NotifierWebhook,
+			NotifierSlack, NotifierSMTP)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &triggeredNotifier{name: config.Name, triggers: triggers, notifier: notifier}, nil
+}
+
+// SendNotifications will send the notification using every notifier. Errors of all notifiers are returned together so
+// one failing notifier does not prevent the others from being used.
+func SendNotifications(notifiers []Notifier, notification Notification) error {
+	var messages []string
+	for _, notifier := range notifiers {
+		if err := notifier.Notify(notification); err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+	if len(messages) > 0 {
+		return errors.New(strings.Join(messages, "; "))
+	}
+	return nil
+}
+
+// Notify will send the notification if it matches one of the triggers.
+func (notifier *triggeredNotifier) Notify(notification Notification) error {
+	triggered := false
+	for _, trigger := range notifier.triggers {
+		switch trigger {
+		case NotifyOnFailure:
+			triggered = triggered || notification.Status == RunStatusFailure
+		case NotifyOnSuccess:
+			triggered = triggered || notification.Status == RunStatusSuccess
+		case NotifyOnRowCountMismatch:
+			triggered = triggered || len(notification.RowCountMismatches) > 0
+		}
+	}
+	if !triggered {
+		return nil
+	}
+
+	if err := notifier.notifier.Notify(notification); err != nil {
+		return fmt.Errorf("notifier %s: %v", notifier.name, err)
+	}
+	return nil
+}
+
+// Notify will post the notification to the webhook.
+func (notifier *WebhookNotifier) Notify(notification Notification) error {
+	var (
+		body []byte
+		err  error
+	)
+	if notifier.Template != nil {
+		var message string
+		if message, err = renderNotification(notifier.Template, notification); err == nil {
+			body = []byte(message)
+		}
+	} else {
+		body, err = json.Marshal(notification)
+	}
+	if err != nil {
+		return err
+	}
+	return postNotification(notifier.URL, notifier.Headers, body)
+}
+
+// Notify will post the rendered template to the Slack incoming webhook.
+func (notifier *SlackNotifier) Notify(notification Notification) error {
+	message, err := renderNotification(notifier.Template, notification)
+	if err != nil {
+		return err
+	}
+	payload := map[string]string{"text": message}
+	if len(notifier.Channel) > 0 {
+		payload["channel"] = notifier.Channel
+	}
+	if len(notifier.Username) > 0 {
+		payload["username"] = notifier.Username
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return postNotification(notifier.URL, nil, body)
+}
+
+// Notify will send the rendered template as an email to the recipients.
+func (notifier *SMTPNotifier) Notify(notification Notification) error {
+	subject, err := renderNotification(notifier.Subject, notification)
+	if err != nil {
+		return err
+	}
+	message, err := renderNotification(notifier.Template, notification)
+	if err != nil {
+		return err
+	}
+
+	var email bytes.Buffer
+	fmt.Fprintf(&email, "From: %s\r\n", notifier.From)
+	fmt.Fprintf(&email, "To: %s\r\n", strings.Join(notifier.To, ", "))
+	fmt.Fprintf(&email, "Subject: %s\r\n", strings.TrimSpace(strings.ReplaceAll(subject, "\n", " ")))
+	fmt.Fprintf(&email, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	email.WriteString("MIME-Version: 1.0\r\n")
+	email.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	email.WriteString(strings.ReplaceAll(message, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if len(notifier.Username) > 0 {
+		host, _, err := net.SplitHostPort(notifier.Address)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", notifier.Username, notifier.Password, host)
+	}
+	return smtp.SendMail(notifier.Address, auth, notifier.From, notifier.To, email.Bytes())
+}
+
+// newWebhookNotifier will return the WebhookNotifier for the configuration.
+func newWebhookNotifier(config NotifierConfig) (*WebhookNotifier, error) {
+	if len(config.URL) == 0 {
+		return nil, errors.New("url is required for webhook notifications")
+	}
+	notifier := &WebhookNotifier{URL: config.URL, Headers: config.Headers}
+	if len(config.Template) > 0 {
+		tmpl, err := template.New("message").Parse(config.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template: %v", err)
+		}
+		notifier.Template = tmpl
+	}
+	return notifier, nil
+}
+
+// newSlackNotifier will return the SlackNotifier for the configuration.
+func newSlackNotifier(config NotifierConfig) (*SlackNotifier, error) {
+	if len(config.URL) == 0 {
+		return nil, errors.New("url is required for Slack notifications")
+	}
+	tmpl, err := parseNotificationTemplate("message", config.Template, DefaultNotificationTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return &SlackNotifier{URL: config.URL, Channel: config.Channel, Username: config.Username, Template: tmpl}, nil
+}
+
+// newSMTPNotifier will return the SMTPNotifier for the configuration.
+func newSMTPNotifier(config NotifierConfig) (*SMTPNotifier, error) {
+	if len(config.SMTPAddress) == 0 || len(config.From) == 0 || len(config.To) == 0 {
+		return nil, errors.New("smtp-address, from, and to are required for email notifications")
+	}
+	subject, err := parseNotificationTemplate("subject", config.Subject, DefaultNotificationSubject)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := parseNotificationTemplate("message", config.Template, DefaultNotificationTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return &SMTPNotifier{
+		Address:  config.SMTPAddress,
+		Username: config.SMTPUsername,
+		Password: config.SMTPPassword,
+		From:     config.From,
+		To:       config.To,
+		Subject:  subject,
+		Template: tmpl,
+	}, nil
+}
+
+// parseNotificationTemplate will parse the text/template, or the default template when text is empty.
+func parseNotificationTemplate(name, text, defaultText string) (*template.Template, error) {
+	if len(text) == 0 {
+		text = defaultText
+	}
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %v", name, err)
+	}
+	return tmpl, nil
+}
+
+// renderNotification will execute the template using the notification.
+func renderNotification(tmpl *template.Template, notification Notification) (string, error) {
+	var message bytes.Buffer
+	if err := tmpl.Execute(&message, notification); err != nil {
+		return "", err
+	}
+	return message.String(), nil
+}
+
+// postNotification will post the JSON body to the URL. The URL is left out of errors since webhook URLs usually contain
+// a secret.
+func postNotification(urlStr string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, urlStr, bytes.NewReader(body))
+	if err != nil {
+		return errors.New("invalid webhook URL")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := notificationClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
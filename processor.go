@@ -0,0 +1,540 @@
+package gonymizer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// ProcessorOptions configures a Processor. Unlike ProcessDumpFile, a Processor does not read any settings from the
+// configuration of the CLI.
+type ProcessorOptions struct {
+	// Mapper is the map of the columns to anonymize (required)
+	Mapper *DBMapper
+	// Seed is used to seed the random number generator. The Seed of the Mapper is used when it is 0
+	Seed int64
+	// GenerateSeed seeds the random number generator with a random value for every dump instead of using Seed
+	GenerateSeed bool
+	// Inclusive returns an error for columns of the dump that are not in the map (see: Inclusive Map Files)
+	Inclusive bool
+	// PreProcess is SQL written at the top of the processed dump (optional)
+	PreProcess io.Reader
+	// PostProcess is SQL written at the end of the processed dump (optional)
+	PostProcess io.Reader
+	// Logger is the logger used while processing. Defaults to the standard logrus logger
+	Logger log.FieldLogger
+	// Report counts the tables, rows, and changed values of the processed dumps. Defaults to the report set using
+	// SetRunReport
+	Report *RunReport
+	// DebugMap writes the original and anonymized values of the scramblers to /tmp/map.txt once a dump is processed.
+	// Only use this when debugging the map and process commands
+	DebugMap bool
+}
+
+// Processor anonymizes PostgreSQL dumps read from an io.Reader and writes them to an io.Writer. A Processor can
+// process any number of dumps, one at a time.
+type Processor struct {
+	options     ProcessorOptions
+	logger      log.FieldLogger
+	preProcess  []byte
+	postProcess []byte
+
+	// random is the random number generator (and the maps of consistent values) passed to the processors of the map.
+	// It is seeded before every dump so Processors do not affect each other
+	random *ProcessorRandom
+
+	// batchSize is the number of rows of the current table buffered in rows before they are processed. It is 0 when
+	// no column of the table uses a processor with a BatchFunc, so rows are processed one at a time
+	batchSize int
+	rows      []string
+
+	// preProcessSource and postProcessSource describe where the pre and post processing SQL came from
+	preProcessSource  string
+	postProcessSource string
+}
+
+// NewProcessor will return a Processor using the supplied options. The PreProcess and PostProcess readers are read
+// completely so the Processor can be reused.
+func NewProcessor(options ProcessorOptions) (*Processor, error) {
+	if options.Mapper == nil {
+		return nil, errors.New("a map is required to process dumps")
+	}
+	if !options.GenerateSeed && options.Seed == 0 && options.Mapper.Seed == 0 {
+		return nil, errors.New("Expected non-zero Seed")
+	}
+
+	processor := &Processor{
+		options:           options,
+		logger:            options.Logger,
+		random:            newProcessorRandom(rand.New(rand.NewSource(1))),
+		preProcessSource:  "PreProcess",
+		postProcessSource: "PostProcess",
+	}
+	if processor.logger == nil {
+		processor.logger = log.StandardLogger()
+	}
+
+	var err error
+	if options.PreProcess != nil {
+		if processor.preProcess, err = ioutil.ReadAll(options.PreProcess); err != nil {
+			return nil, err
+		}
+	}
+	if options.PostProcess != nil {
+		if processor.postProcess, err = ioutil.ReadAll(options.PostProcess); err != nil {
+			return nil, err
+		}
+	}
+	return processor, nil
+}
+
+// newFileProcessor will return a Processor for the ProcessDump and ProcessDumpFile functions, which read the pre and
+// post processing SQL from files (local paths or URLs), and the process.inclusive and log-level settings from the
+// configuration.
+func newFileProcessor(mapper *DBMapper, preProcessFile, postProcessFile string, generateSeed bool) (*Processor, error) {
+	options := ProcessorOptions{
+		Mapper:       mapper,
+		GenerateSeed: generateSeed,
+		Inclusive:    viper.GetBool("process.inclusive"),
+		DebugMap:     strings.ToLower(viper.GetString("log-level")) == "debug",
+	}
+	if len(preProcessFile) > 0 {
+		file, err := OpenURL(preProcessFile)
+		if err != nil {
+			log.Error("Unable to run preProcessor")
+			return nil, err
+		}
+		defer file.Close()
+		options.PreProcess = file
+	}
+	if len(postProcessFile) > 0 {
+		file, err := OpenURL(postProcessFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		options.PostProcess = file
+	}
+
+	processor, err := NewProcessor(options)
+	if err != nil {
+		return nil, err
+	}
+	processor.preProcessSource = "file: " + preProcessFile
+	processor.postProcessSource = "file: " + postProcessFile
+	return processor, nil
+}
+
+// Process will read a dump from src, anonymize it, and write the processed dump to dst.
+func (processor *Processor) Process(src io.Reader, dst io.Writer) error {
+	return processor.ProcessContext(context.Background(), src, dst)
+}
+
+// ProcessContext is the same as Process, but stops when the context is cancelled.
+func (processor *Processor) ProcessContext(ctx context.Context, src io.Reader, dst io.Writer) error {
+	return processor.process(newContextReader(ctx, src), dst, newProgressTracker(ctx, 0))
+}
+
+// process is Process, reporting the progress to the supplied progressTracker.
+func (processor *Processor) process(src io.Reader, dst io.Writer, progress *progressTracker) error {
+	var (
+		err        error
+		inputLine  string
+		outputLine string
+		lineCount  int64
+	)
+	logger := processor.logger
+	if processor.options.GenerateSeed {
+		for {
+			randVal, err := generateRandomInt64()
+			if err != nil {
+				logger.Error(err)
+			} else {
+				logger.Debugf("Using internal number generator for seed value: %d", randVal)
+				processor.random.Seed(randVal)
+				break
+			}
+		}
+	} else {
+		randVal := processor.options.Seed
+		if randVal == 0 {
+			randVal = processor.options.Mapper.Seed
+		}
+		logger.Debugf("Using map file for seed value: %d", randVal)
+		processor.random.Seed(randVal)
+	}
+
+	report := processor.options.Report
+	if report == nil {
+		report = GetRunReport()
+	}
+
+	fileReader := bufio.NewReaderSize(src, streamBufferSize)
+	dstFile := bufio.NewWriterSize(dst, streamBufferSize)
+
+	// Write any required configuration settings to the top of the processed dump file
+	if processor.preProcess != nil {
+		err = sqlInjector(processor.preProcessSource, bytes.NewReader(processor.preProcess), dstFile)
+		if err != nil {
+			logger.Error("Unable to run preProcessor")
+			return err
+		}
+	}
+
+	// Always make sure we are in replication mode so we can import tables without constraints
+	if _, err := dstFile.WriteString("SET session_replication_role = 'replica';\n"); err != nil {
+		return err
+	}
+
+	allDone := false
+	state := new(LineState)
+	processor.batchSize = 0
+	processor.rows = nil
+
+	for {
+		lineCount++
+		state.LineNum = lineCount
+		inputLine, err = fileReader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				// readline will fail if it doesn't encounter our delimiter (\n)
+				// EOF isn't a real error tho...
+
+				// do nothing
+				allDone = true
+			} else {
+				logger.Error(err)
+				logger.Debug("lineCount: ", lineCount)
+				logger.Debug("inputLine: ", inputLine)
+				return err
+			}
+		}
+
+		wasRow := state.IsRow
+		state, outputLine, err = processor.processLine(report, state, inputLine)
+
+		if err != nil {
+			logger.Error("processLine failure: ", err)
+			logger.Debug("lineCount", lineCount)
+			logger.Debug("inputLine", inputLine)
+			logger.Debug("outputLine", outputLine)
+			return err
+		}
+
+		bytesWritten, err := dstFile.WriteString(outputLine)
+		if err != nil {
+			logger.Error(err)
+			logger.Debug("lineCount", lineCount)
+			logger.Debug("inputLine", inputLine)
+			logger.Debug("bytesWritten", bytesWritten)
+			return err
+		}
+
+		progress.line(len(inputLine), wasRow, state)
+		if allDone {
+			break
+		}
+	}
+	// Rows are still buffered when the dump ends in the middle of a table
+	if len(processor.rows) > 0 {
+		outputLine, err = processor.flushRows(report, state)
+		if err != nil {
+			logger.Error("processLine failure: ", err)
+			return err
+		}
+		if _, err = dstFile.WriteString(outputLine); err != nil {
+			return err
+		}
+	}
+	progress.done()
+	if processor.options.DebugMap {
+		err = writeDebugMap(processor.random)
+		if err != nil {
+			return err
+		}
+	}
+	// Add in SQL at the end of the dump file
+	if processor.postProcess != nil {
+		err = sqlInjector(processor.postProcessSource, bytes.NewReader(processor.postProcess), dstFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Enable constraints (they were disabled earlier)
+	if _, err := dstFile.WriteString("SET session_replication_role = 'origin';\n"); err != nil {
+		return err
+	}
+	return dstFile.Flush()
+}
+
+// processLine will process the current line in the dump file by deciding which state the processor should be in
+// based on reading in the content of the current line in the dump file and analyzing it.
+func (processor *Processor) processLine(report *RunReport, state *LineState, inputLine string) (*LineState, string,
+	error) {
+
+	outputLine := inputLine
+	trimmedInput := strings.TrimLeftFunc(inputLine, unicode.IsSpace)
+	if len(trimmedInput) == 0 {
+		return state, outputLine, nil
+	}
+
+	if strings.HasPrefix(trimmedInput, "--") {
+		return state, outputLine, nil
+	}
+
+	if strings.HasPrefix(trimmedInput, StateChangeTokenBeginCopy) {
+		state.parseCopyLine(inputLine)
+		report.startTable(state.SchemaName, state.TableName)
+		processor.batchSize = processor.tableBatchSize(state)
+		return state, outputLine, nil
+	}
+
+	if strings.HasPrefix(trimmedInput, StateChangeTokenEndCopy) {
+		rows, err := processor.flushRows(report, state)
+		if err != nil {
+			return state, rows, err
+		}
+		report.endTable(state.SchemaName, state.TableName)
+		state.Clear()
+		processor.batchSize = 0
+		return state, rows + outputLine, nil
+	}
+
+	if state.IsRow {
+		if processor.batchSize == 0 {
+			return processor.processRow(report, state, inputLine)
+		}
+		processor.rows = append(processor.rows, inputLine)
+		if len(processor.rows) < processor.batchSize {
+			return state, "", nil
+		}
+		rows, err := processor.flushRows(report, state)
+		return state, rows, err
+	}
+
+	return state, outputLine, nil
+}
+
+// tableBatchSize will return the number of rows of the table to buffer before processing them, which is the largest
+// BatchSize of the processors with a BatchFunc used by its columns, or 0 if none of them has a BatchFunc.
+func (processor *Processor) tableBatchSize(state *LineState) int {
+	batchSize := 0
+	for _, columnName := range state.ColumnNames {
+		cmap := processor.options.Mapper.ColumnMapper(state.SchemaName, state.TableName, columnName)
+		if cmap == nil {
+			continue
+		}
+		for _, procDef := range cmap.Processors {
+			info, ok := LookupProcessor(procDef.Name)
+			if ok && info.BatchFunc != nil && info.BatchSize > batchSize {
+				batchSize = info.BatchSize
+			}
+		}
+	}
+	return batchSize
+}
+
+// flushRows will process the buffered rows of the current table and return them as they should be written to the
+// processed dump.
+func (processor *Processor) flushRows(report *RunReport, state *LineState) (string, error) {
+	if len(processor.rows) == 0 {
+		return "", nil
+	}
+	rows := processor.rows
+	processor.rows = nil
+
+	outputLines, err := processor.processRows(report, state, rows)
+	if err != nil {
+		return "****************** PROCESS ROW ERROR ******************", err
+	}
+	return strings.Join(outputLines, ""), nil
+}
+
+// processRow will process the line in the dump file IFF it is a SQL-line (eventual row in the database after import).
+func (processor *Processor) processRow(report *RunReport, state *LineState, inputLine string) (*LineState, string,
+	error) {
+
+	outputLines, err := processor.processRows(report, state, []string{inputLine})
+	if err != nil {
+		return state, "****************** PROCESS ROW ERROR ******************", err
+	}
+	return state, outputLines[0], nil
+}
+
+// processRows will process the rows of the current table. The values of each column are processed together, so
+// processors with a BatchFunc anonymize them in batches.
+func (processor *Processor) processRows(report *RunReport, state *LineState, inputLines []string) ([]string, error) {
+	rowVals := make([][]string, len(inputLines))
+	escapeChars := make([][]string, len(inputLines))
+	for r, inputLine := range inputLines {
+		rowVals[r] = strings.Split(inputLine, "\t")
+		escapeChars[r] = make([]string, len(rowVals[r]))
+		for i, val := range rowVals[r] {
+			// Check to see if the column has an escape char at the end of it.
+			// If so cut it and keep it for later
+			if strings.HasSuffix(val, "\n") {
+				escapeChars[r][i] = "\n"
+				rowVals[r][i] = strings.Replace(val, "\n", "", -1)
+			} else if strings.HasSuffix(val, "\t") {
+				escapeChars[r][i] = "\t"
+				rowVals[r][i] = strings.Replace(val, "\t", "", -1)
+			}
+		}
+		report.addRow(state.SchemaName, state.TableName)
+	}
+
+	for i, columnName := range state.ColumnNames {
+		cmap := processor.options.Mapper.ColumnMapper(state.SchemaName, state.TableName, columnName)
+		if cmap == nil && processor.options.Inclusive {
+			return nil, fmt.Errorf("column '%s.%s.%s' does not exist. Please add it to the map file",
+				state.SchemaName, state.TableName, columnName)
+		}
+		// If this column is not mapped, keep the values and continue on
+		if cmap == nil {
+			continue
+		}
+
+		// Column values that are nil are kept as they are
+		rows := make([]int, 0, len(rowVals))
+		inputs := make([]string, 0, len(rowVals))
+		for r := range rowVals {
+			if rowVals[r][i] != "\\N" {
+				rows = append(rows, r)
+				inputs = append(inputs, rowVals[r][i])
+			}
+		}
+		if len(inputs) == 0 {
+			continue
+		}
+
+		outputs, err := processor.processValues(report, state, cmap, inputs)
+		if err != nil {
+			processor.logger.Error(err)
+			processor.logger.Debug("i: ", i)
+			processor.logger.Debug("columnName: ", columnName)
+			return nil, err
+		}
+		for j, r := range rows {
+			rowVals[r][i] = outputs[j]
+		}
+	}
+
+	outputLines := make([]string, len(rowVals))
+	for r := range rowVals {
+		// Add escape characters back to the columns
+		for i := range rowVals[r] {
+			rowVals[r][i] += escapeChars[r][i]
+		}
+		outputLines[r] = strings.Join(rowVals[r], "\t")
+	}
+	return outputLines, nil
+}
+
+// processValue will anonymize or ignore the current value for a given column in the dump file. Values changed by a
+// processor are counted in the run report.
+func (processor *Processor) processValue(report *RunReport, state *LineState, cmap *ColumnMapper, input string) (
+	string, error) {
+
+	outputs, err := processor.processValues(report, state, cmap, []string{input})
+	if err != nil {
+		return "", err
+	}
+	return outputs[0], nil
+}
+
+// processValues will anonymize the values of a column using its processors. Processors with a BatchFunc are called
+// with up to BatchSize values at once, other processors are called for every value (with the random number generator
+// of the Processor when they have a RandomFunc). Values changed by a processor are counted in the run report.
+func (processor *Processor) processValues(report *RunReport, state *LineState, cmap *ColumnMapper, inputs []string) (
+	[]string, error) {
+	var err error
+
+	logger := processor.logger
+	outputs := inputs
+
+	for i, procDef := range cmap.Processors {
+
+		pfunc := lookupProcessorFunc(procDef.Name)
+
+		if pfunc == nil {
+			err = fmt.Errorf("unknown processor: %s", procDef.Name)
+			logger.Error("Unknown Processor Name: ", procDef.Name)
+			logger.Debug("i: ", i)
+			logger.Debug("procDef: ", procDef)
+			logger.Debug("cmap: ", cmap)
+			logger.Debug("inputs: ", inputs)
+			return nil, err
+
+		}
+
+		info, ok := LookupProcessor(procDef.Name)
+		if ok && info.BatchFunc != nil {
+			outputs, err = processBatches(info, cmap, inputs)
+		} else if ok && info.RandomFunc != nil {
+			outputs = make([]string, len(inputs))
+			for j, input := range inputs {
+				if outputs[j], err = info.RandomFunc(cmap, input, processor.random); err != nil {
+					break
+				}
+			}
+		} else {
+			outputs = make([]string, len(inputs))
+			for j, input := range inputs {
+				if outputs[j], err = pfunc(cmap, input); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			metricProcessorErrors.WithLabelValues(procDef.Name).Inc()
+			logger.Error(err)
+			logger.Debug("i: ", i)
+			logger.Debug("cmap: ", cmap)
+			logger.Debug("inputs: ", inputs)
+			return nil, err
+		}
+		for j := range outputs {
+			if outputs[j] != inputs[j] {
+				report.addChangedValue(state.SchemaName, state.TableName, procDef.Name)
+			}
+		}
+	}
+	return outputs, nil
+}
+
+// processBatches will anonymize the values using the BatchFunc of the processor, passing it up to BatchSize values at
+// once.
+func processBatches(info ProcessorInfo, cmap *ColumnMapper, inputs []string) ([]string, error) {
+	batchSize := info.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultProcessorBatchSize
+	}
+
+	outputs := make([]string, 0, len(inputs))
+	for start := 0; start < len(inputs); start += batchSize {
+		end := start + batchSize
+		if end > len(inputs) {
+			end = len(inputs)
+		}
+		batch, err := info.BatchFunc(cmap, inputs[start:end])
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) != end-start {
+			return nil, fmt.Errorf("processor %s returned %d values for %d inputs", info.Name, len(batch), end-start)
+		}
+		outputs = append(outputs, batch...)
+	}
+	return outputs, nil
+}
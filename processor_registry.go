@@ -0,0 +1,266 @@
+package gonymizer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Options of a ProcessorDefinition in the map file that processors may use (see: ProcessorOption)
+const (
+	ProcessorOptionMax      = "Max"
+	ProcessorOptionMin      = "Min"
+	ProcessorOptionVariance = "Variance"
+)
+
+// DefaultProcessorBatchSize is the number of values passed to the BatchFunc of a processor at once when its BatchSize
+// is not set.
+const DefaultProcessorBatchSize = 500
+
+// ErrProcessorExists is returned by RegisterProcessor when a processor with the same name is already registered.
+var ErrProcessorExists = errors.New("processor is already registered")
+
+var (
+	// processorRegistry are the registered processors by name. ProcessorCatalog holds the functions of the same
+	// processors for backwards compatibility.
+	processorRegistry      = map[string]ProcessorInfo{}
+	processorRegistryMutex sync.RWMutex
+)
+
+// ProcessorInfo describes a processor registered using RegisterProcessor.
+type ProcessorInfo struct {
+	// Name is the name of the processor used in map files (required)
+	Name string
+	// Description is a short, one line description of what the processor does
+	Description string
+	// Func is the function that anonymizes a value (required unless RandomFunc is set)
+	Func ProcessorFunc
+	// RandomFunc is the function that anonymizes a value using the random number generator of the Processor
+	// (optional). When set it is used instead of Func, so Processors do not share a random number generator and the
+	// same seed always anonymizes a dump the same way. Func defaults to RandomFunc using a shared generator
+	RandomFunc RandomProcessorFunc
+	// BatchFunc is the function that anonymizes many values of a column at once (optional). When set, rows of tables
+	// with columns using the processor are buffered so BatchFunc is called with up to BatchSize values instead of
+	// calling Func for every value
+	BatchFunc BatchProcessorFunc
+	// BatchSize is the maximum number of values passed to BatchFunc. Defaults to DefaultProcessorBatchSize
+	BatchSize int
+	// Options are the options of the ProcessorDefinition (Max, Min, Variance) the processor uses
+	Options []ProcessorOption
+	// DataTypes are the PostgreSQL data types (I.E. text, uuid) the processor supports. All data types are supported
+	// when empty
+	DataTypes []string
+	// Deterministic is true when the output only depends on the input, so the same input is always anonymized the
+	// same way
+	Deterministic bool
+	// Consistent is true when every occurrence of a value is anonymized the same way within a dump, which keeps
+	// relationships (I.E. foreign keys) intact
+	Consistent bool
+	// ColumnNames are the column names (I.E. email or first_name) the processor is suggested for in skeleton map
+	// files. A column matches when its name, or a part of its name separated by underscores, is one of the names
+	ColumnNames []string
+}
+
+// RandomProcessorFunc is a function that anonymizes a value using the supplied random number generator. The generator
+// is only used by one Processor at a time.
+type RandomProcessorFunc func(*ColumnMapper, string, *ProcessorRandom) (string, error)
+
+// BatchProcessorFunc is a function that anonymizes many values of a column at once. It must return one output for every
+// input, in the same order.
+type BatchProcessorFunc func(*ColumnMapper, []string) ([]string, error)
+
+// ProcessorOption describes an option of a ProcessorDefinition that a processor uses.
+type ProcessorOption struct {
+	// Name is one of ProcessorOptionMax, ProcessorOptionMin, or ProcessorOptionVariance
+	Name        string
+	Description string
+	Required    bool
+}
+
+// RegisterProcessor will register the processor so it can be used in map files. ErrProcessorExists is returned if a
+// processor with the same name is already registered. Processors should be registered before map files are loaded,
+// I.E. in the init function of the package providing them.
+func RegisterProcessor(info ProcessorInfo) error {
+	if len(info.Name) == 0 {
+		return errors.New("the name of the processor is required")
+	}
+	if info.Func == nil && info.RandomFunc != nil {
+		randomFunc := info.RandomFunc
+		info.Func = func(cmap *ColumnMapper, input string) (string, error) {
+			return callShared(randomFunc, cmap, input)
+		}
+	}
+	if info.Func == nil {
+		return fmt.Errorf("processor %s: a function is required", info.Name)
+	}
+	if info.BatchSize < 0 {
+		return fmt.Errorf("processor %s: the batch size must not be negative", info.Name)
+	}
+	if info.BatchFunc != nil && info.BatchSize == 0 {
+		info.BatchSize = DefaultProcessorBatchSize
+	}
+	for _, option := range info.Options {
+		switch option.Name {
+		case ProcessorOptionMax, ProcessorOptionMin, ProcessorOptionVariance:
+		default:
+			return fmt.Errorf("processor %s: unknown option '%s'", info.Name, option.Name)
+		}
+	}
+
+	processorRegistryMutex.Lock()
+	defer processorRegistryMutex.Unlock()
+	if _, ok := processorRegistry[info.Name]; ok {
+		return fmt.Errorf("%s: %w", info.Name, ErrProcessorExists)
+	}
+	if _, ok := ProcessorCatalog[info.Name]; ok {
+		return fmt.Errorf("%s: %w", info.Name, ErrProcessorExists)
+	}
+
+	info.Options = append([]ProcessorOption{}, info.Options...)
+	info.DataTypes = append([]string{}, info.DataTypes...)
+	info.ColumnNames = append([]string{}, info.ColumnNames...)
+	processorRegistry[info.Name] = info
+	ProcessorCatalog[info.Name] = info.Func
+	return nil
+}
+
+// LookupProcessor will return the registered processor with the supplied name.
+func LookupProcessor(name string) (ProcessorInfo, bool) {
+	processorRegistryMutex.RLock()
+	defer processorRegistryMutex.RUnlock()
+	info, ok := processorRegistry[name]
+	return info, ok
+}
+
+// RegisteredProcessors will return all registered processors sorted by name.
+func RegisteredProcessors() []ProcessorInfo {
+	processorRegistryMutex.RLock()
+	defer processorRegistryMutex.RUnlock()
+	processors := make([]ProcessorInfo, 0, len(processorRegistry))
+	for _, info := range processorRegistry {
+		processors = append(processors, info)
+	}
+	sort.Slice(processors, func(i, j int) bool { return processors[i].Name < processors[j].Name })
+	return processors
+}
+
+// SuggestProcessors will return the names of the registered processors suggested for the column, sorted by name. A
+// processor is suggested when the column name matches one of its ColumnNames and it supports the data type of the
+// column.
+func SuggestProcessors(column ColumnMapper) []string {
+	suggestions := make([]string, 0)
+	for _, info := range RegisteredProcessors() {
+		if info.supportsDataType(column.DataType) && info.matchesColumnName(column.ColumnName) {
+			suggestions = append(suggestions, info.Name)
+		}
+	}
+	return suggestions
+}
+
+// lookupProcessorFunc will return the function of the processor with the supplied name, or nil.
+func lookupProcessorFunc(name string) ProcessorFunc {
+	processorRegistryMutex.RLock()
+	defer processorRegistryMutex.RUnlock()
+	return ProcessorCatalog[name]
+}
+
+// supportsDataType will return true if the processor supports the PostgreSQL data type.
+func (info ProcessorInfo) supportsDataType(dataType string) bool {
+	if len(info.DataTypes) == 0 || len(dataType) == 0 {
+		return true
+	}
+	for _, supported := range info.DataTypes {
+		if strings.EqualFold(supported, dataType) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesColumnName will return true if the column name, or a part of it separated by underscores, is one of the
+// ColumnNames of the processor.
+func (info ProcessorInfo) matchesColumnName(column string) bool {
+	parts := strings.Split(strings.ToLower(column), "_")
+	for _, name := range info.ColumnNames {
+		length := strings.Count(name, "_") + 1
+		for i := 0; i+length <= len(parts); i++ {
+			if strings.Join(parts[i:i+length], "_") == strings.ToLower(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateProcessors will return an error if a column of the map uses a processor that is not registered, or does not
+// set an option the processor requires. Processors used on columns with data types they do not support, or with
+// options they do not use, are logged as warnings.
+func validateProcessors(columns []ColumnMapper) error {
+	problems := make([]string, 0)
+	for _, column := range columns {
+		name := column.TableSchema + "." + column.TableName + "." + column.ColumnName
+		for _, definition := range column.Processors {
+			if lookupProcessorFunc(definition.Name) == nil {
+				problems = append(problems, fmt.Sprintf("unknown processor %s on %s", definition.Name, name))
+				continue
+			}
+			info, ok := LookupProcessor(definition.Name)
+			if !ok {
+				// Added to ProcessorCatalog directly, so there is nothing to validate
+				continue
+			}
+			if !info.supportsDataType(column.DataType) {
+				log.Warnf("Processor %s does not support the data type of %s (%s). Supported data types: %s",
+					definition.Name, name, column.DataType, strings.Join(info.DataTypes, ", "))
+			}
+			for _, option := range info.unusedOptions(definition) {
+				log.Warnf("Processor %s does not use the %s option set on %s", definition.Name, option, name)
+			}
+			for _, option := range info.Options {
+				if option.Required && !definition.hasOption(option.Name) {
+					problems = append(problems, fmt.Sprintf("processor %s requires the %s option on %s",
+						definition.Name, option.Name, name))
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// unusedOptions will return the options set on the definition that the processor does not use.
+func (info ProcessorInfo) unusedOptions(definition ProcessorDefinition) []string {
+	unused := make([]string, 0)
+	for _, name := range []string{ProcessorOptionMax, ProcessorOptionMin, ProcessorOptionVariance} {
+		if !definition.hasOption(name) {
+			continue
+		}
+		used := false
+		for _, option := range info.Options {
+			used = used || option.Name == name
+		}
+		if !used {
+			unused = append(unused, name)
+		}
+	}
+	return unused
+}
+
+// hasOption will return true if the option is set (non-zero) on the definition.
+func (definition ProcessorDefinition) hasOption(name string) bool {
+	switch name {
+	case ProcessorOptionMax:
+		return definition.Max != 0
+	case ProcessorOptionMin:
+		return definition.Min != 0
+	case ProcessorOptionVariance:
+		return definition.Variance != 0
+	}
+	return false
+}
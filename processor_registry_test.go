@@ -0,0 +1,89 @@
+package gonymizer
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterProcessor(t *testing.T) {
+	memberID := ProcessorInfo{
+		Name:          "TestMemberID",
+		Description:   "Replaces a member ID",
+		Func:          func(_ *ColumnMapper, input string) (string, error) { return "M" + scrubString(input), nil },
+		Options:       []ProcessorOption{{Name: ProcessorOptionMax, Description: "Length of the ID", Required: true}},
+		DataTypes:     []string{"text"},
+		Deterministic: true,
+		Consistent:    true,
+		ColumnNames:   []string{"member_id"},
+	}
+	require.Nil(t, RegisterProcessor(memberID))
+	defer func() {
+		processorRegistryMutex.Lock()
+		delete(processorRegistry, memberID.Name)
+		delete(ProcessorCatalog, memberID.Name)
+		processorRegistryMutex.Unlock()
+	}()
+
+	// Names may only be registered once, including the built-in processors
+	err := RegisterProcessor(memberID)
+	require.True(t, errors.Is(err, ErrProcessorExists))
+	err = RegisterProcessor(ProcessorInfo{Name: "FakeEmailAddress", Func: ProcessorIdentity})
+	require.True(t, errors.Is(err, ErrProcessorExists))
+	require.NotNil(t, RegisterProcessor(ProcessorInfo{Name: "TestNoFunc"}))
+	require.NotNil(t, RegisterProcessor(ProcessorInfo{Name: "TestOption", Func: ProcessorIdentity,
+		Options: []ProcessorOption{{Name: "Length"}}}))
+
+	info, ok := LookupProcessor(memberID.Name)
+	require.True(t, ok)
+	require.Equal(t, "Replaces a member ID", info.Description)
+	require.True(t, info.Deterministic)
+	_, ok = LookupProcessor("TestNoFunc")
+	require.False(t, ok)
+
+	names := make([]string, 0)
+	for _, info := range RegisteredProcessors() {
+		names = append(names, info.Name)
+	}
+	require.Contains(t, names, memberID.Name)
+	require.Contains(t, names, "Identity")
+
+	// Processors are suggested by column name and data type
+	require.Equal(t, []string{memberID.Name}, SuggestProcessors(ColumnMapper{ColumnName: "primary_member_id",
+		DataType: "text"}))
+	require.Empty(t, SuggestProcessors(ColumnMapper{ColumnName: "member_id", DataType: "integer"}))
+	require.Empty(t, SuggestProcessors(ColumnMapper{ColumnName: "membership", DataType: "text"}))
+	require.Equal(t, []string{"FakeEmailAddress"}, SuggestProcessors(ColumnMapper{ColumnName: "email"}))
+	col := addColumn("member_id", "members", "public", "text", 1, false)
+	require.Equal(t, "Suggested processors: "+memberID.Name, col.Processors[0].Comment)
+
+	// Maps are validated against the registry
+	mapper := &DBMapper{DBName: "test", Seed: 1, ColumnMaps: []ColumnMapper{{
+		TableSchema: "public",
+		TableName:   "members",
+		ColumnName:  "member_id",
+		DataType:    "text",
+		Processors:  []ProcessorDefinition{{Name: memberID.Name, Max: 8}},
+	}}}
+	require.Nil(t, mapper.Validate())
+	mapper.ColumnMaps[0].Processors[0].Max = 0
+	err = mapper.Validate()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "requires the Max option on public.members.member_id")
+	mapper.ColumnMaps[0].Processors = []ProcessorDefinition{{Name: "TestUnknown"}}
+	err = mapper.Validate()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unknown processor TestUnknown on public.members.member_id")
+
+	// Registered processors are used when processing
+	mapper.ColumnMaps[0].Processors = []ProcessorDefinition{{Name: memberID.Name, Max: 8}}
+	processor, err := NewProcessor(ProcessorOptions{Mapper: mapper})
+	require.Nil(t, err)
+	var dst bytes.Buffer
+	src := "COPY public.members (member_id) FROM stdin;\nA1234\n\\.\n"
+	require.Nil(t, processor.Process(strings.NewReader(src), &dst))
+	require.Contains(t, dst.String(), "\nM*****\n")
+}
@@ -0,0 +1,162 @@
+package gonymizer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/icrowley/fake"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessor(t *testing.T) {
+	columnMap, err := LoadConfigSkeleton(TestMapFile)
+	require.Nil(t, err)
+
+	// A map and a seed are required
+	_, err = NewProcessor(ProcessorOptions{})
+	require.NotNil(t, err)
+	_, err = NewProcessor(ProcessorOptions{Mapper: &DBMapper{}})
+	require.NotNil(t, err)
+
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	report := NewRunReport("process")
+	processor, err := NewProcessor(ProcessorOptions{
+		Mapper:      columnMap,
+		Seed:        42,
+		PreProcess:  strings.NewReader("CREATE EXTENSION IF NOT EXISTS pgcrypto;"),
+		PostProcess: strings.NewReader("ANALYZE;\n"),
+		Logger:      logger,
+		Report:      report,
+	})
+	require.Nil(t, err)
+
+	src, err := ioutil.ReadFile(TestDbFile)
+	require.Nil(t, err)
+
+	// The same seed processes the same dump the same way, so a Processor can be reused
+	var first, second bytes.Buffer
+	require.Nil(t, processor.Process(bytes.NewReader(src), &first))
+	require.Nil(t, processor.Process(bytes.NewReader(src), &second))
+	require.Equal(t, first.String(), second.String())
+	require.NotEqual(t, string(src), first.String())
+
+	output := first.String()
+	require.True(t, strings.HasPrefix(output, "\n--\n-- Begin Gonymizer Injection from PreProcess\n--\n\n"+
+		"CREATE EXTENSION IF NOT EXISTS pgcrypto;\n"))
+	require.Contains(t, output, "-- Begin Gonymizer Injection from PostProcess\n--\n\nANALYZE;\n")
+	require.True(t, strings.HasSuffix(output, "SET session_replication_role = 'origin';\n"))
+
+	// Logs and counts go to the supplied logger and report
+	require.NotEmpty(t, hook.AllEntries())
+	report.Finish(nil)
+	require.NotEmpty(t, report.Tables)
+	var rows int64
+	for _, table := range report.Tables {
+		rows += table.Rows
+	}
+	require.True(t, rows > 0)
+
+	// Inclusive processors fail on columns missing from the map
+	processor, err = NewProcessor(ProcessorOptions{Mapper: &DBMapper{}, GenerateSeed: true, Inclusive: true,
+		Logger: logger})
+	require.Nil(t, err)
+	var dst bytes.Buffer
+	err = processor.Process(bytes.NewReader(src), &dst)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "does not exist. Please add it to the map file")
+}
+
+func TestProcessorRandom(t *testing.T) {
+	mapper := &DBMapper{DBName: "test", Seed: 7, ColumnMaps: []ColumnMapper{
+		{TableSchema: "public", TableName: "members", ColumnName: "ssn", DataType: "text",
+			Processors: []ProcessorDefinition{{Name: "RandomDigits"}}},
+		{TableSchema: "public", TableName: "members", ColumnName: "active", DataType: "boolean",
+			Processors: []ProcessorDefinition{{Name: "RandomBoolean"}}},
+		{TableSchema: "public", TableName: "members", ColumnName: "born", DataType: "date",
+			Processors: []ProcessorDefinition{{Name: "RandomDate"}}},
+		{TableSchema: "public", TableName: "members", ColumnName: "external_id", DataType: "uuid",
+			Processors: []ProcessorDefinition{{Name: "RandomUUID"}}},
+		{TableSchema: "public", TableName: "members", ColumnName: "code", DataType: "text",
+			ParentSchema: "public", ParentTable: "members", ParentColumn: "code",
+			Processors: []ProcessorDefinition{{Name: "AlphaNumericScrambler"}}},
+		{TableSchema: "public", TableName: "members", ColumnName: "first_name", DataType: "text",
+			Processors: []ProcessorDefinition{{Name: "FakeFirstName"}}},
+	}}
+	require.Nil(t, mapper.Validate())
+	var src strings.Builder
+	src.WriteString("COPY public.members (id, ssn, active, born, external_id, code, first_name) FROM stdin;\n")
+	for i := 0; i < 100; i++ {
+		src.WriteString(fmt.Sprintf("1\t123456789\tt\t1980-01-01\t%s\tAB-%03d\tLevi\n", uuid.New(), i%10))
+	}
+	src.WriteString("\\.\n")
+
+	// Processors running at the same time do not share a random number generator or the maps of consistent values,
+	// so the same seed always anonymizes the dump the same way
+	outputs := make([]string, 4)
+	errs := make([]error, len(outputs))
+	var wg sync.WaitGroup
+	for i := range outputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			options := ProcessorOptions{Mapper: mapper, Logger: logrus.New()}
+			if i%2 == 1 {
+				options.Seed = int64(i)
+			}
+			processor, err := NewProcessor(options)
+			if err == nil {
+				var dst bytes.Buffer
+				err = processor.Process(strings.NewReader(src.String()), &dst)
+				outputs[i] = dst.String()
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.Nil(t, err)
+	}
+	require.Equal(t, outputs[0], outputs[2])
+	require.NotEqual(t, outputs[0], outputs[1])
+	require.NotEqual(t, src.String(), outputs[0])
+
+	// Fake values only depend on the seed, even when the fake package is used in between
+	info, ok := LookupProcessor("FakeFirstName")
+	require.True(t, ok)
+	first := newProcessorRandom(rand.New(rand.NewSource(3)))
+	second := newProcessorRandom(rand.New(rand.NewSource(3)))
+	for i := 0; i < 10; i++ {
+		expected, err := randomFirstName(nil, "Levi", first)
+		require.Nil(t, err)
+		_ = fake.FirstName()
+		name, err := info.RandomFunc(nil, "Levi", second)
+		require.Nil(t, err)
+		require.Equal(t, expected, name)
+	}
+
+	// Processors registered with only a RandomFunc can also be called without a Processor
+	require.Nil(t, RegisterProcessor(ProcessorInfo{
+		Name: "TestRandomLetter",
+		RandomFunc: func(_ *ColumnMapper, _ string, random *ProcessorRandom) (string, error) {
+			return randomLowercase(random.Rand), nil
+		},
+	}))
+	defer func() {
+		processorRegistryMutex.Lock()
+		delete(processorRegistry, "TestRandomLetter")
+		delete(ProcessorCatalog, "TestRandomLetter")
+		processorRegistryMutex.Unlock()
+	}()
+	output, err := lookupProcessorFunc("TestRandomLetter")(&mapper.ColumnMaps[0], "a")
+	require.Nil(t, err)
+	require.Len(t, output, 1)
+}
@@ -1,21 +1,25 @@
 package gonymizer
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/icrowley/fake"
+	log "github.com/sirupsen/logrus"
 )
 
 // All processors are designed to work "unseeded"
-// Make sure something seeds the RNG before you call the top level process function.
+// Processors using random values have a RandomFunc which is passed the seeded random number generator of the
+// Processor. Their Func uses sharedRandom.
 
 // in order for the processor to "find" the functions it's got to
 // 1. conform to ProcessorFunc
@@ -43,22 +47,113 @@ const uppercaseSetLen = 26
 const numericSetLen = 10
 
 // ProcessorCatalog is the function map that points to each Processor to it's entry function. All Processors are listed
-// in this map.
-var ProcessorCatalog map[string]ProcessorFunc
+// in this map. Use RegisterProcessor to add processors.
+var ProcessorCatalog = map[string]ProcessorFunc{}
 
 // AlphaNumericMap is used to keep consistency with scrambled alpha numeric strings.
 // For example, if we need to scramble things such as Social Security Numbers, but it is nice to keep track of these
-// changes so if we run across the same SSN again we can scramble it to what we already have.
+// changes so if we run across the same SSN again we can scramble it to what we already have. It is only used by
+// processor functions called without a Processor (I.E. using ProcessorCatalog), every Processor has its own map.
 var AlphaNumericMap = map[string]map[string]string{}
 
 // UUIDMap is the Global UUID map for all UUIDs that we anonymize. Similar to AlphaNumericMap this map contains all
 // UUIDs and what they are changed to. Some tables use UUIDs as the primary key and this allows us to keep consistency
-// in the data set when anonymizing it.
+// in the data set when anonymizing it. Like AlphaNumericMap, every Processor has its own map.
 var UUIDMap = map[uuid.UUID]uuid.UUID{}
 
-// IBANMap is the Global IBANs map for all IBANs we anonymize.
+// IBANMap is the Global IBANs map for all IBANs we anonymize. Like AlphaNumericMap, every Processor has its own map.
 var IBANMap = map[string]string{}
 
+// sharedRandom is the random number generator of processor functions called without the generator of a Processor
+// (I.E. using ProcessorCatalog). It is safe for concurrent use.
+var sharedRandom = rand.New(&lockedSource{source: rand.NewSource(time.Now().UnixNano())})
+
+// fakeMutex serializes the use of the fake package, whose random number generator is global, so it can be seeded for
+// every value (see: fakeProcessor).
+var fakeMutex sync.Mutex
+
+// The Fake* processors using the random number generator of the Processor (see: fakeProcessor).
+var (
+	randomAddress      = fakeProcessor(fake.StreetAddress)
+	randomCity         = fakeProcessor(fake.City)
+	randomCompanyName  = fakeProcessor(fake.Company)
+	randomEmailAddress = fakeProcessor(fake.EmailAddress)
+	randomFirstName    = fakeProcessor(fake.FirstName)
+	randomFullName     = fakeProcessor(fake.FullName)
+	randomIPv4         = fakeProcessor(fake.IPv4)
+	randomLastName     = fakeProcessor(fake.LastName)
+	randomPhoneNumber  = fakeProcessor(fake.Phone)
+	randomState        = fakeProcessor(fake.State)
+	randomStateAbbrev  = fakeProcessor(fake.StateAbbrev)
+	randomUserName     = fakeProcessor(fake.UserName)
+	randomZip          = fakeProcessor(fake.Zip)
+)
+
+// sharedMutex serializes processor functions called without a Processor, which share sharedRandom and the global maps
+// (AlphaNumericMap, UUIDMap, and IBANMap).
+var sharedMutex sync.Mutex
+
+// lockedSource is a rand.Source that is safe for concurrent use.
+type lockedSource struct {
+	mutex  sync.Mutex
+	source rand.Source
+}
+
+// ProcessorRandom is passed to the RandomFunc of processors. It is the random number generator of a Processor, which
+// is seeded before every dump, along with the maps used to replace every occurrence of a value with the same random
+// value. It is only used by one Processor at a time.
+type ProcessorRandom struct {
+	*rand.Rand
+
+	alphaNumeric map[string]map[string]string
+	uuids        map[uuid.UUID]uuid.UUID
+	ibans        map[string]string
+}
+
+// newProcessorRandom will return a ProcessorRandom using the random number generator with empty maps.
+func newProcessorRandom(random *rand.Rand) *ProcessorRandom {
+	return &ProcessorRandom{
+		Rand:         random,
+		alphaNumeric: map[string]map[string]string{},
+		uuids:        map[uuid.UUID]uuid.UUID{},
+		ibans:        map[string]string{},
+	}
+}
+
+// Seed will seed the random number generator and clear the maps, so the values are anonymized the same way for every
+// dump processed using the same seed.
+func (random *ProcessorRandom) Seed(seed int64) {
+	random.Rand.Seed(seed)
+	random.alphaNumeric = map[string]map[string]string{}
+	random.uuids = map[uuid.UUID]uuid.UUID{}
+	random.ibans = map[string]string{}
+}
+
+// fakeProcessor will return a RandomProcessorFunc returning a value of the fake function. The generator of the fake
+// package is seeded from the random number generator of the Processor for every value, so the values are reproducible
+// from the seed of the Processor even when other Processors use the fake package at the same time.
+func fakeProcessor(fakeFunc func() string) RandomProcessorFunc {
+	return func(_ *ColumnMapper, _ string, random *ProcessorRandom) (string, error) {
+		seed := random.Int63()
+		fakeMutex.Lock()
+		defer fakeMutex.Unlock()
+		fake.Seed(seed)
+		return fakeFunc(), nil
+	}
+}
+
+// callShared will call the RandomFunc using sharedRandom and the global maps.
+func callShared(randomFunc RandomProcessorFunc, cmap *ColumnMapper, input string) (string, error) {
+	sharedMutex.Lock()
+	defer sharedMutex.Unlock()
+	return randomFunc(cmap, input, &ProcessorRandom{
+		Rand:         sharedRandom,
+		alphaNumeric: AlphaNumericMap,
+		uuids:        UUIDMap,
+		ibans:        IBANMap,
+	})
+}
+
 var countryCodes = `[{"Code": "AF", "Name": "Afghanistan"},{"Code": "AX", "Name": "\u00c5land Islands"},{"Code": "AL", "Name": "Albania"},{"Code": "DZ", "Name": "Algeria"},{"Code": "AS", "Name": "American Samoa"},{"Code": "AD", "Name": "Andorra"},{"Code": "AO", "Name": "Angola"},{"Code": "AI", "Name": "Anguilla"},{"Code": "AQ", "Name": "Antarctica"},{"Code": "AG", "Name": "Antigua and Barbuda"},{"Code": "AR", "Name": "Argentina"},{"Code": "AM", "Name": "Armenia"},{"Code": "AW", "Name": "Aruba"},{"Code": "AU", "Name": "Australia"},{"Code": "AT", "Name": "Austria"},{"Code": "AZ", "Name": "Azerbaijan"},{"Code": "BS", "Name": "Bahamas"},{"Code": "BH", "Name": "Bahrain"},{"Code": "BD", "Name": "Bangladesh"},{"Code": "BB", "Name": "Barbados"},{"Code": "BY", "Name": "Belarus"},{"Code": "BE", "Name": "Belgium"},{"Code": "BZ", "Name": "Belize"},{"Code": "BJ", "Name": "Benin"},{"Code": "BM", "Name": "Bermuda"},{"Code": "BT", "Name": "Bhutan"},{"Code": "BO", "Name": "Bolivia, Plurinational State of"},{"Code": "BQ", "Name": "Bonaire, Sint Eustatius and Saba"},{"Code": "BA", "Name": "Bosnia and Herzegovina"},{"Code": "BW", "Name": "Botswana"},{"Code": "BV", "Name": "Bouvet Island"},{"Code": "BR", "Name": "Brazil"},{"Code": "IO", "Name": "British Indian Ocean Territory"},{"Code": "BN", "Name": "Brunei Darussalam"},{"Code": "BG", "Name": "Bulgaria"},{"Code": "BF", "Name": "Burkina Faso"},{"Code": "BI", "Name": "Burundi"},{"Code": "KH", "Name": "Cambodia"},{"Code": "CM", "Name": "Cameroon"},{"Code": "CA", "Name": "Canada"},{"Code": "CV", "Name": "Cape Verde"},{"Code": "KY", "Name": "Cayman Islands"},{"Code": "CF", "Name": "Central African Republic"},{"Code": "TD", "Name": "Chad"},{"Code": "CL", "Name": "Chile"},{"Code": "CN", "Name": "China"},{"Code": "CX", "Name": "Christmas Island"},{"Code": "CC", "Name": "Cocos (Keeling) Islands"},{"Code": "CO", "Name": "Colombia"},{"Code": "KM", "Name": "Comoros"},{"Code": "CG", "Name": "Congo"},{"Code": "CD", "Name": "Congo, the Democratic Republic of the"},{"Code": "CK", "Name": "Cook Islands"},{"Code": "CR", "Name": "Costa Rica"},{"Code": "CI", "Name": "C\u00f4te d'Ivoire"},{"Code": "HR", "Name": "Croatia"},{"Code": "CU", "Name": "Cuba"},{"Code": "CW", "Name": "Cura\u00e7ao"},{"Code": "CY", "Name": "Cyprus"},{"Code": "CZ", "Name": "Czech Republic"},{"Code": "DK", "Name": "Denmark"},{"Code": "DJ", "Name": "Djibouti"},{"Code": "DM", "Name": "Dominica"},{"Code": "DO", "Name": "Dominican Republic"},{"Code": "EC", "Name": "Ecuador"},{"Code": "EG", "Name": "Egypt"},{"Code": "SV", "Name": "El Salvador"},{"Code": "GQ", "Name": "Equatorial Guinea"},{"Code": "ER", "Name": "Eritrea"},{"Code": "EE", "Name": "Estonia"},{"Code": "ET", "Name": "Ethiopia"},{"Code": "FK", "Name": "Falkland Islands (Malvinas)"},{"Code": "FO", "Name": "Faroe Islands"},{"Code": "FJ", "Name": "Fiji"},{"Code": "FI", "Name": "Finland"},{"Code": "FR", "Name": "France"},{"Code": "GF", "Name": "French Guiana"},{"Code": "PF", "Name": "French Polynesia"},{"Code": "TF", "Name": "French Southern Territories"},{"Code": "GA", "Name": "Gabon"},{"Code": "GM", "Name": "Gambia"},{"Code": "GE", "Name": "Georgia"},{"Code": "DE", "Name": "Germany"},{"Code": "GH", "Name": "Ghana"},{"Code": "GI", "Name": "Gibraltar"},{"Code": "GR", "Name": "Greece"},{"Code": "GL", "Name": "Greenland"},{"Code": "GD", "Name": "Grenada"},{"Code": "GP", "Name": "Guadeloupe"},{"Code": "GU", "Name": "Guam"},{"Code": "GT", "Name": "Guatemala"},{"Code": "GG", "Name": "Guernsey"},{"Code": "GN", "Name": "Guinea"},{"Code": "GW", "Name": "Guinea-Bissau"},{"Code": "GY", "Name": "Guyana"},{"Code": "HT", "Name": "Haiti"},{"Code": "HM", "Name": "Heard Island and McDonald Islands"},{"Code": "VA", "Name": "Holy See (Vatican City State)"},{"Code": "HN", "Name": "Honduras"},{"Code": "HK", "Name": "Hong Kong"},{"Code": "HU", "Name": "Hungary"},{"Code": "IS", "Name": "Iceland"},{"Code": "IN", "Name": "India"},{"Code": "ID", "Name": "Indonesia"},{"Code": "IR", "Name": "Iran, Islamic Republic of"},{"Code": "IQ", "Name": "Iraq"},{"Code": "IE", "Name": "Ireland"},{"Code": "IM", "Name": "Isle of Man"},{"Code": "IL", "Name": "Israel"},{"Code": "IT", "Name": "Italy"},{"Code": "JM", "Name": "Jamaica"},{"Code": "JP", "Name": "Japan"},{"Code": "JE", "Name": "Jersey"},{"Code": "JO", "Name": "Jordan"},{"Code": "KZ", "Name": "Kazakhstan"},{"Code": "KE", "Name": "Kenya"},{"Code": "KI", "Name": "Kiribati"},{"Code": "KP", "Name": "Korea, Democratic People's Republic of"},{"Code": "KR", "Name": "Korea, Republic of"},{"Code": "KW", "Name": "Kuwait"},{"Code": "KG", "Name": "Kyrgyzstan"},{"Code": "LA", "Name": "Lao People's Democratic Republic"},{"Code": "LV", "Name": "Latvia"},{"Code": "LB", "Name": "Lebanon"},{"Code": "LS", "Name": "Lesotho"},{"Code": "LR", "Name": "Liberia"},{"Code": "LY", "Name": "Libya"},{"Code": "LI", "Name": "Liechtenstein"},{"Code": "LT", "Name": "Lithuania"},{"Code": "LU", "Name": "Luxembourg"},{"Code": "MO", "Name": "Macao"},{"Code": "MK", "Name": "Macedonia, the Former Yugoslav Republic of"},{"Code": "MG", "Name": "Madagascar"},{"Code": "MW", "Name": "Malawi"},{"Code": "MY", "Name": "Malaysia"},{"Code": "MV", "Name": "Maldives"},{"Code": "ML", "Name": "Mali"},{"Code": "MT", "Name": "Malta"},{"Code": "MH", "Name": "Marshall Islands"},{"Code": "MQ", "Name": "Martinique"},{"Code": "MR", "Name": "Mauritania"},{"Code": "MU", "Name": "Mauritius"},{"Code": "YT", "Name": "Mayotte"},{"Code": "MX", "Name": "Mexico"},{"Code": "FM", "Name": "Micronesia, Federated States of"},{"Code": "MD", "Name": "Moldova, Republic of"},{"Code": "MC", "Name": "Monaco"},{"Code": "MN", "Name": "Mongolia"},{"Code": "ME", "Name": "Montenegro"},{"Code": "MS", "Name": "Montserrat"},{"Code": "MA", "Name": "Morocco"},{"Code": "MZ", "Name": "Mozambique"},{"Code": "MM", "Name": "Myanmar"},{"Code": "NA", "Name": "Namibia"},{"Code": "NR", "Name": "Nauru"},{"Code": "NP", "Name": "Nepal"},{"Code": "NL", "Name": "Netherlands"},{"Code": "NC", "Name": "New Caledonia"},{"Code": "NZ", "Name": "New Zealand"},{"Code": "NI", "Name": "Nicaragua"},{"Code": "NE", "Name": "Niger"},{"Code": "NG", "Name": "Nigeria"},{"Code": "NU", "Name": "Niue"},{"Code": "NF", "Name": "Norfolk Island"},{"Code": "MP", "Name": "Northern Mariana Islands"},{"Code": "NO", "Name": "Norway"},{"Code": "OM", "Name": "Oman"},{"Code": "PK", "Name": "Pakistan"},{"Code": "PW", "Name": "Palau"},{"Code": "PS", "Name": "Palestine, State of"},{"Code": "PA", "Name": "Panama"},{"Code": "PG", "Name": "Papua New Guinea"},{"Code": "PY", "Name": "Paraguay"},{"Code": "PE", "Name": "Peru"},{"Code": "PH", "Name": "Philippines"},{"Code": "PN", "Name": "Pitcairn"},{"Code": "PL", "Name": "Poland"},{"Code": "PT", "Name": "Portugal"},{"Code": "PR", "Name": "Puerto Rico"},{"Code": "QA", "Name": "Qatar"},{"Code": "RE", "Name": "R\u00e9union"},{"Code": "RO", "Name": "Romania"},{"Code": "RU", "Name": "Russian Federation"},{"Code": "RW", "Name": "Rwanda"},{"Code": "BL", "Name": "Saint Barth\u00e9lemy"},{"Code": "SH", "Name": "Saint Helena, Ascension and Tristan da Cunha"},{"Code": "KN", "Name": "Saint Kitts and Nevis"},{"Code": "LC", "Name": "Saint Lucia"},{"Code": "MF", "Name": "Saint Martin (French part)"},{"Code": "PM", "Name": "Saint Pierre and Miquelon"},{"Code": "VC", "Name": "Saint Vincent and the Grenadines"},{"Code": "WS", "Name": "Samoa"},{"Code": "SM", "Name": "San Marino"},{"Code": "ST", "Name": "Sao Tome and Principe"},{"Code": "SA", "Name": "Saudi Arabia"},{"Code": "SN", "Name": "Senegal"},{"Code": "RS", "Name": "Serbia"},{"Code": "SC", "Name": "Seychelles"},{"Code": "SL", "Name": "Sierra Leone"},{"Code": "SG", "Name": "Singapore"},{"Code": "SX", "Name": "Sint Maarten (Dutch part)"},{"Code": "SK", "Name": "Slovakia"},{"Code": "SI", "Name": "Slovenia"},{"Code": "SB", "Name": "Solomon Islands"},{"Code": "SO", "Name": "Somalia"},{"Code": "ZA", "Name": "South Africa"},{"Code": "GS", "Name": "South Georgia and the South Sandwich Islands"},{"Code": "SS", "Name": "South Sudan"},{"Code": "ES", "Name": "Spain"},{"Code": "LK", "Name": "Sri Lanka"},{"Code": "SD", "Name": "Sudan"},{"Code": "SR", "Name": "Suriname"},{"Code": "SJ", "Name": "Svalbard and Jan Mayen"},{"Code": "SZ", "Name": "Swaziland"},{"Code": "SE", "Name": "Sweden"},{"Code": "CH", "Name": "Switzerland"},{"Code": "SY", "Name": "Syrian Arab Republic"},{"Code": "TW", "Name": "Taiwan, Province of China"},{"Code": "TJ", "Name": "Tajikistan"},{"Code": "TZ", "Name": "Tanzania, United Republic of"},{"Code": "TH", "Name": "Thailand"},{"Code": "TL", "Name": "Timor-Leste"},{"Code": "TG", "Name": "Togo"},{"Code": "TK", "Name": "Tokelau"},{"Code": "TO", "Name": "Tonga"},{"Code": "TT", "Name": "Trinidad and Tobago"},{"Code": "TN", "Name": "Tunisia"},{"Code": "TR", "Name": "Turkey"},{"Code": "TM", "Name": "Turkmenistan"},{"Code": "TC", "Name": "Turks and Caicos Islands"},{"Code": "TV", "Name": "Tuvalu"},{"Code": "UG", "Name": "Uganda"},{"Code": "UA", "Name": "Ukraine"},{"Code": "AE", "Name": "United Arab Emirates"},{"Code": "GB", "Name": "United Kingdom"},{"Code": "US", "Name": "United States"},{"Code": "UM", "Name": "United States Minor Outlying Islands"},{"Code": "UY", "Name": "Uruguay"},{"Code": "UZ", "Name": "Uzbekistan"},{"Code": "VU", "Name": "Vanuatu"},{"Code": "VE", "Name": "Venezuela, Bolivarian Republic of"},{"Code": "VN", "Name": "Viet Nam"},{"Code": "VG", "Name": "Virgin Islands, British"},{"Code": "VI", "Name": "Virgin Islands, U.S."},{"Code": "WF", "Name": "Wallis and Futuna"},{"Code": "EH", "Name": "Western Sahara"},{"Code": "YE", "Name": "Yemen"},{"Code": "ZM", "Name": "Zambia"},{"Code": "ZW", "Name": "Zimbabwe"}]`
 
 type CountryCode struct {
@@ -67,56 +162,217 @@ type CountryCode struct {
 
 var CountryCodes []CountryCode
 
-// init initializes the ProcessorCatalog map for all processors. A processor must be listed here to be accessible.
+// init registers the built-in processors and parses the list of country codes.
 func init() {
-	ProcessorCatalog = map[string]ProcessorFunc{
-		"AlphaNumericScrambler": ProcessorAlphaNumericScrambler,
-		"EmptyJson":             ProcessorEmptyJson,
-		"FakeStreetAddress":     ProcessorAddress,
-		"FakeCity":              ProcessorCity,
-		"FakeCompanyName":       ProcessorCompanyName,
-		"FakeEmailAddress":      ProcessorEmailAddress,
-		"FakeFirstName":         ProcessorFirstName,
-		"FakeFullName":          ProcessorFullName,
-		"FakeIPv4":              ProcessorIPv4,
-		"FakeLastName":          ProcessorLastName,
-		"FakePhoneNumber":       ProcessorPhoneNumber,
-		"FakeState":             ProcessorState,
-		"FakeStateAbbrev":       ProcessorStateAbbrev,
-		"FakeUsername":          ProcessorUserName,
-		"FakeZip":               ProcessorZip,
-		"Identity":              ProcessorIdentity, // Default: Does not modify field
-		"RandomBoolean":         ProcessorRandomBoolean,
-		"RandomDate":            ProcessorRandomDate,
-		"RandomDigits":          ProcessorRandomDigits,
-		"RandomUUID":            ProcessorRandomUUID,
-		"ScrubString":           ProcessorScrubString,
-		"IBANScrambler":         ProcessorIBANScrambler,
-		"RandomCountryCode":     ProcessorRandomCountryCode,
+	for _, info := range builtinProcessors {
+		if err := RegisterProcessor(info); err != nil {
+			log.Error("Unable to register processor: ", err)
+		}
 	}
 	if err := json.Unmarshal([]byte(countryCodes), &CountryCodes); err != nil {
-		fmt.Println("Failed to parse list of country codes:", err.Error())
-		os.Exit(1)
+		log.Error("Failed to parse list of country codes: ", err)
 	}
 
 }
 
+// builtinProcessors are the processors registered by Gonymizer.
+var builtinProcessors = []ProcessorInfo{
+	{
+		Name:        "AlphaNumericScrambler",
+		Description: "Scrambles letters and digits, keeping other characters. Consistent for columns with a parent",
+		Func:        ProcessorAlphaNumericScrambler,
+		RandomFunc:  randomAlphaNumericScrambler,
+		Consistent:  true,
+	},
+	{
+		Name:          "EmptyJson",
+		Description:   "Replaces a JSON with an empty one ({})",
+		Func:          ProcessorEmptyJson,
+		DataTypes:     []string{"json", "jsonb"},
+		Deterministic: true,
+		Consistent:    true,
+	},
+	{
+		Name:        "FakeStreetAddress",
+		Description: "Replaces a real US address with a fake one",
+		Func:        ProcessorAddress,
+		RandomFunc:  randomAddress,
+		ColumnNames: []string{"address", "street", "street_address", "address_line"},
+	},
+	{
+		Name:        "FakeCity",
+		Description: "Replaces a city",
+		Func:        ProcessorCity,
+		RandomFunc:  randomCity,
+		ColumnNames: []string{"city"},
+	},
+	{
+		Name:        "FakeCompanyName",
+		Description: "Replaces a company name",
+		Func:        ProcessorCompanyName,
+		RandomFunc:  randomCompanyName,
+		ColumnNames: []string{"company", "company_name", "employer"},
+	},
+	{
+		Name:        "FakeEmailAddress",
+		Description: "Replaces an e-mail address with a fake one",
+		Func:        ProcessorEmailAddress,
+		RandomFunc:  randomEmailAddress,
+		ColumnNames: []string{"email", "email_address", "e_mail"},
+	},
+	{
+		Name:        "FakeFirstName",
+		Description: "Replaces a person's first name with a fake first name (non-gender specific)",
+		Func:        ProcessorFirstName,
+		RandomFunc:  randomFirstName,
+		ColumnNames: []string{"first_name", "firstname", "given_name"},
+	},
+	{
+		Name:        "FakeFullName",
+		Description: "Replaces a person's full name with a fake full name",
+		Func:        ProcessorFullName,
+		RandomFunc:  randomFullName,
+		ColumnNames: []string{"full_name", "fullname"},
+	},
+	{
+		Name:        "FakeIPv4",
+		Description: "Replaces an IP address with a fake one",
+		Func:        ProcessorIPv4,
+		RandomFunc:  randomIPv4,
+		ColumnNames: []string{"ip", "ip_address", "ipv4"},
+	},
+	{
+		Name:        "FakeLastName",
+		Description: "Replaces a person's last name with a fake last name",
+		Func:        ProcessorLastName,
+		RandomFunc:  randomLastName,
+		ColumnNames: []string{"last_name", "lastname", "surname", "family_name"},
+	},
+	{
+		Name:        "FakePhoneNumber",
+		Description: "Replaces a person's phone number with a fake phone number",
+		Func:        ProcessorPhoneNumber,
+		RandomFunc:  randomPhoneNumber,
+		ColumnNames: []string{"phone", "phone_number", "mobile", "fax"},
+	},
+	{
+		Name:        "FakeState",
+		Description: "Replaces a state (full state name, non-abbreviated)",
+		Func:        ProcessorState,
+		RandomFunc:  randomState,
+		ColumnNames: []string{"state"},
+	},
+	{
+		Name:        "FakeStateAbbrev",
+		Description: "Replaces a state abbreviation",
+		Func:        ProcessorStateAbbrev,
+		RandomFunc:  randomStateAbbrev,
+	},
+	{
+		Name:        "FakeUsername",
+		Description: "Replaces a username with a fake one",
+		Func:        ProcessorUserName,
+		RandomFunc:  randomUserName,
+		ColumnNames: []string{"username", "user_name", "login"},
+	},
+	{
+		Name:        "FakeZip",
+		Description: "Replaces a real zip code with another zip code",
+		Func:        ProcessorZip,
+		RandomFunc:  randomZip,
+		ColumnNames: []string{"zip", "zip_code", "zipcode", "postal_code"},
+	},
+	{
+		Name:          "Identity",
+		Description:   "Does not anonymize the column (same as leaving the column out of the map file)",
+		Func:          ProcessorIdentity,
+		Deterministic: true,
+		Consistent:    true,
+	},
+	{
+		Name:        "RandomBoolean",
+		Description: "Randomizes boolean fields",
+		Func:        ProcessorRandomBoolean,
+		RandomFunc:  randomBoolean,
+		DataTypes:   []string{"boolean"},
+	},
+	{
+		Name:        "RandomDate",
+		Description: "Randomizes the day and month, but keeps the year the same",
+		Func:        ProcessorRandomDate,
+		RandomFunc:  randomDate,
+		DataTypes:   []string{"date"},
+		ColumnNames: []string{"birthdate", "birth_date", "date_of_birth", "dob"},
+	},
+	{
+		Name:        "RandomDigits",
+		Description: "Randomizes a string of digits, but keeps the same length",
+		Func:        ProcessorRandomDigits,
+		RandomFunc:  randomDigits,
+		ColumnNames: []string{"ssn", "social_security_number"},
+	},
+	{
+		Name:        "RandomUUID",
+		Description: "Randomizes a UUID, replacing every occurrence of the UUID with the same random UUID",
+		Func:        ProcessorRandomUUID,
+		RandomFunc:  randomUUID,
+		DataTypes:   []string{"uuid", "character varying", "text"},
+		Consistent:  true,
+	},
+	{
+		Name:          "ScrubString",
+		Description:   "Replaces a string with *'s. Useful for password hashes",
+		Func:          ProcessorScrubString,
+		Deterministic: true,
+		Consistent:    true,
+		ColumnNames:   []string{"password", "password_hash", "encrypted_password"},
+	},
+	{
+		Name:        "IBANScrambler",
+		Description: "Scrambles an IBAN, keeping the country code. Every occurrence of an IBAN is scrambled the same way",
+		Func:        ProcessorIBANScrambler,
+		RandomFunc:  randomIBANScrambler,
+		Consistent:  true,
+		ColumnNames: []string{"iban"},
+	},
+	{
+		Name:        "RandomCountryCode",
+		Description: "Replaces a country code with a random ISO 3166 country code",
+		Func:        ProcessorRandomCountryCode,
+		RandomFunc:  randomCountryCode,
+		ColumnNames: []string{"country_code"},
+	},
+}
+
 // ProcessorFunc is a simple function prototype for the ProcessorMap function pointers.
 type ProcessorFunc func(*ColumnMapper, string) (string, error)
 
-func ProcessorIBANScrambler(_ *ColumnMapper, input string) (string, error) {
-	if annonymizedIBAN, ok := IBANMap[input]; ok {
+func ProcessorIBANScrambler(cmap *ColumnMapper, input string) (string, error) {
+	return callShared(randomIBANScrambler, cmap, input)
+}
+
+// randomIBANScrambler is ProcessorIBANScrambler using the supplied random number generator.
+func randomIBANScrambler(_ *ColumnMapper, input string, random *ProcessorRandom) (string, error) {
+	if annonymizedIBAN, ok := random.ibans[input]; ok {
 		return annonymizedIBAN, nil
 	}
-	newAnnonymizedIBAN := fmt.Sprintf("%s%s", input[:2], scrambleString(input[2:]))
+	newAnnonymizedIBAN := fmt.Sprintf("%s%s", input[:2], scrambleString(input[2:], random.Rand))
 
-	IBANMap[input] = newAnnonymizedIBAN
+	random.ibans[input] = newAnnonymizedIBAN
 
 	return newAnnonymizedIBAN, nil
 }
 
-func ProcessorRandomCountryCode(_ *ColumnMapper, _ string) (string, error) {
-	return CountryCodes[rand.Int63n(int64(len(CountryCodes)))].Code, nil
+func ProcessorRandomCountryCode(cmap *ColumnMapper, input string) (string, error) {
+	return callShared(randomCountryCode, cmap, input)
+}
+
+// randomCountryCode is ProcessorRandomCountryCode using the supplied random number generator.
+func randomCountryCode(_ *ColumnMapper, _ string, random *ProcessorRandom) (string, error) {
+	if len(CountryCodes) == 0 {
+		return "", errors.New("the list of country codes is empty")
+	}
+	return CountryCodes[random.Int63n(int64(len(CountryCodes)))].Code, nil
 
 }
 
@@ -125,12 +381,17 @@ func ProcessorRandomCountryCode(_ *ColumnMapper, _ string) (string, error) {
 
 // ProcessorAlphaNumericScrambler will receive the column metadata via ColumnMap and the column's actual data via the
 // input string. The processor will scramble all alphanumeric digits and characters, but it will leave all
-// non-alphanumerics the same without modification. These values are globally mapped and use the AlphaNumericMap to
-// remap values once they are seen more than once.
+// non-alphanumerics the same without modification. These values are mapped (using AlphaNumericMap, or the map of the
+// Processor) to remap values once they are seen more than once.
 //
 // Example:
 // "PUI-7x9vY" = ProcessorAlphaNumericScrambler("ABC-1a2bC")
 func ProcessorAlphaNumericScrambler(cmap *ColumnMapper, input string) (string, error) {
+	return callShared(randomAlphaNumericScrambler, cmap, input)
+}
+
+// randomAlphaNumericScrambler is ProcessorAlphaNumericScrambler using the supplied random number generator.
+func randomAlphaNumericScrambler(cmap *ColumnMapper, input string, random *ProcessorRandom) (string, error) {
 	var (
 		err       error
 		scramble  string
@@ -142,19 +403,19 @@ func ProcessorAlphaNumericScrambler(cmap *ColumnMapper, input string) (string, e
 
 	// Check to see if we are working on a mapped column
 	if cmap.ParentSchema != "" && cmap.ParentTable != "" && cmap.ParentColumn != "" {
-		// Check to see if value already exists in AlphaNumericMap
-		if len(AlphaNumericMap[parentKey]) < 1 {
-			AlphaNumericMap[parentKey] = map[string]string{}
+		// Check to see if value already exists in the map
+		if len(random.alphaNumeric[parentKey]) < 1 {
+			random.alphaNumeric[parentKey] = map[string]string{}
 		}
-		if len(AlphaNumericMap[parentKey][input]) < 1 {
-			scramble = scrambleString(input)
-			AlphaNumericMap[parentKey][input] = scramble
+		if len(random.alphaNumeric[parentKey][input]) < 1 {
+			scramble = scrambleString(input, random.Rand)
+			random.alphaNumeric[parentKey][input] = scramble
 		} else {
 			// Key already exists so use consistent value
-			scramble = AlphaNumericMap[parentKey][input]
+			scramble = random.alphaNumeric[parentKey][input]
 		}
 	} else {
-		scramble = scrambleString(input)
+		scramble = scrambleString(input, random.Rand)
 	}
 
 	return scramble, err
@@ -162,27 +423,27 @@ func ProcessorAlphaNumericScrambler(cmap *ColumnMapper, input string) (string, e
 
 // ProcessorAddress will return a fake address string that is compiled from the fake library
 func ProcessorAddress(cmap *ColumnMapper, input string) (string, error) {
-	return fake.StreetAddress(), nil
+	return callShared(randomAddress, cmap, input)
 }
 
 // ProcessorCity will return a real city name that is >= 0.4 Jaro-Winkler similar than the input.
 func ProcessorCity(cmap *ColumnMapper, input string) (string, error) {
-	return fake.City(), nil
+	return callShared(randomCity, cmap, input)
 }
 
 // ProcessorEmailAddress will return an e-mail address that is >= 0.4 Jaro-Winkler similar than the input.
 func ProcessorEmailAddress(cmap *ColumnMapper, input string) (string, error) {
-	return fake.EmailAddress(), nil
+	return callShared(randomEmailAddress, cmap, input)
 }
 
 // ProcessorFirstName will return a first name that is >= 0.4 Jaro-Winkler similar than the input.
 func ProcessorFirstName(cmap *ColumnMapper, input string) (string, error) {
-	return fake.FirstName(), nil
+	return callShared(randomFirstName, cmap, input)
 }
 
 // ProcessorFullName will return a full name that is >= 0.4 Jaro-Winkler similar than the input.
 func ProcessorFullName(cmap *ColumnMapper, input string) (string, error) {
-	return fake.FullName(), nil
+	return callShared(randomFullName, cmap, input)
 }
 
 // ProcessorIdentity will skip anonymization and leave output === input.
@@ -191,12 +452,12 @@ func ProcessorIdentity(cmap *ColumnMapper, input string) (string, error) {
 }
 
 func ProcessorIPv4(cmap *ColumnMapper, input string) (string, error) {
-	return fake.IPv4(), nil
+	return callShared(randomIPv4, cmap, input)
 }
 
 // ProcessorLastName will return a last name that is >= 0.4 Jaro-Winkler similar than the input.
 func ProcessorLastName(cmap *ColumnMapper, input string) (string, error) {
-	return fake.LastName(), nil
+	return callShared(randomLastName, cmap, input)
 }
 
 // ProcessorEmptyJson will return an empty JSON no matter what is the input.
@@ -206,45 +467,55 @@ func ProcessorEmptyJson(cmap *ColumnMapper, input string) (string, error) {
 
 // ProcessorPhoneNumber will return a phone number that is >= 0.4 Jaro-Winkler similar than the input.
 func ProcessorPhoneNumber(cmap *ColumnMapper, input string) (string, error) {
-	return fake.Phone(), nil
+	return callShared(randomPhoneNumber, cmap, input)
 }
 
 // ProcessorState will return a state that is >= 0.4 Jaro-Winkler similar than the input.
 func ProcessorState(cmap *ColumnMapper, input string) (string, error) {
-	return fake.State(), nil
+	return callShared(randomState, cmap, input)
 }
 
 // ProcessorStateAbbrev will return a state abbreviation.
 func ProcessorStateAbbrev(cmap *ColumnMapper, input string) (string, error) {
-	return fake.StateAbbrev(), nil
+	return callShared(randomStateAbbrev, cmap, input)
 }
 
 // ProcessorUserName will return a username that is >= 0.4 Jaro-Winkler similar than the input.
 func ProcessorUserName(cmap *ColumnMapper, input string) (string, error) {
-	return fake.UserName(), nil
+	return callShared(randomUserName, cmap, input)
 }
 
 // ProcessorZip will return a zip code that is >= 0.4 Jaro-Winkler similar than the input.
 func ProcessorZip(cmap *ColumnMapper, input string) (string, error) {
-	return fake.Zip(), nil
+	return callShared(randomZip, cmap, input)
 }
 
 // ProcessorCompanyName will return a company name that is >= 0.4 Jaro-Winkler similar than the input.
 func ProcessorCompanyName(cmap *ColumnMapper, input string) (string, error) {
-	return fake.Company(), nil
+	return callShared(randomCompanyName, cmap, input)
 }
 
 // ProcessorRandomBoolean will return a random boolean value.
 func ProcessorRandomBoolean(cmap *ColumnMapper, input string) (string, error) {
-	var randomBoolean string = "FALSE"
-	if rand.Intn(2) == 0 {
-		randomBoolean = "TRUE"
+	return callShared(randomBoolean, cmap, input)
+}
+
+// randomBoolean is ProcessorRandomBoolean using the supplied random number generator.
+func randomBoolean(_ *ColumnMapper, _ string, random *ProcessorRandom) (string, error) {
+	output := "FALSE"
+	if random.Intn(2) == 0 {
+		output = "TRUE"
 	}
-	return randomBoolean, nil
+	return output, nil
 }
 
 // ProcessorRandomDate will return a random day and month, but keep year the same (See: HIPAA rules)
 func ProcessorRandomDate(cmap *ColumnMapper, input string) (string, error) {
+	return callShared(randomDate, cmap, input)
+}
+
+// randomDate is ProcessorRandomDate using the supplied random number generator.
+func randomDate(_ *ColumnMapper, input string, random *ProcessorRandom) (string, error) {
 	// ISO 8601/SQL standard ->  2018-08-28
 	dateSplit := strings.Split(input, "-")
 
@@ -259,19 +530,33 @@ func ProcessorRandomDate(cmap *ColumnMapper, input string) (string, error) {
 	}
 
 	// NOTE: HIPAA only requires we scramble month and day, not year
-	scrambledDate := randomizeDate(year)
+	scrambledDate := randomizeDate(year, random.Rand)
 	return scrambledDate, nil
 }
 
 // ProcessorRandomDigits will return a random string of digit(s) keeping the same length of the input.
 func ProcessorRandomDigits(cmap *ColumnMapper, input string) (string, error) {
-	return fake.DigitsN(len(input)), nil
+	return callShared(randomDigits, cmap, input)
+}
+
+// randomDigits is ProcessorRandomDigits using the supplied random number generator.
+func randomDigits(_ *ColumnMapper, input string, random *ProcessorRandom) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(input); i++ {
+		b.WriteString(randomNumeric(random.Rand))
+	}
+	return b.String(), nil
 }
 
 // ProcessorRandomUUID will generate a random UUID and replace the input with the new UUID. The input however will be
 // mapped to the output so every occurrence of the input UUID will replace it with the same output UUID that was
 // originally created during the first occurrence of the input UUID.
 func ProcessorRandomUUID(cmap *ColumnMapper, input string) (string, error) {
+	return callShared(randomUUID, cmap, input)
+}
+
+// randomUUID is ProcessorRandomUUID using the supplied random number generator.
+func randomUUID(_ *ColumnMapper, input string, random *ProcessorRandom) (string, error) {
 	var scrambledUUID string
 
 	inputID, err := uuid.Parse(input)
@@ -279,7 +564,7 @@ func ProcessorRandomUUID(cmap *ColumnMapper, input string) (string, error) {
 	if err != nil {
 		scrambledUUID = ""
 	} else {
-		scrambledUUID, err = randomizeUUID(inputID)
+		scrambledUUID, err = randomizeUUID(inputID, random)
 	}
 
 	return scrambledUUID, err
@@ -305,32 +590,37 @@ func jaroWinkler(input string, jwDistance float64, faker fakeFuncPtr) (output st
 
 // randomizeUUID creates a random UUID and adds it to the map of input->output. If input already exists it returns
 // the output that was previously calculated for input.
-func randomizeUUID(input uuid.UUID) (string, error) {
+func randomizeUUID(input uuid.UUID, random *ProcessorRandom) (string, error) {
 	var (
 		finalUUID uuid.UUID
 		err       error
 	)
 
-	if _, ok := UUIDMap[input]; !ok {
-		finalUUID, err = uuid.NewRandom()
+	if _, ok := random.uuids[input]; !ok {
+		// rand.Rand.Read is not safe for concurrent use, even with a lockedSource
+		var id [16]byte
+		for i := range id {
+			id[i] = byte(random.Intn(256))
+		}
+		finalUUID, err = uuid.NewRandomFromReader(bytes.NewReader(id[:]))
 		if err != nil {
 			return "", err
 		}
-		UUIDMap[input] = finalUUID
+		random.uuids[input] = finalUUID
 	} else {
-		finalUUID = UUIDMap[input]
+		finalUUID = random.uuids[input]
 	}
 	return finalUUID.String(), nil
 }
 
 // randomizeDate randomizes a day and month for a given year. This function is leap year compatible.
-func randomizeDate(year int) string {
+func randomizeDate(year int, random *rand.Rand) string {
 	// To find the length of the randomly selected month we need to find the last day of the month.
 	// See: https://yourbasic.org/golang/last-day-month-date/
 
-	randMonth := rand.Intn(12) + 1
+	randMonth := random.Intn(12) + 1
 	monthMaxDay := date(year, randMonth, 0).Day()
-	randDay := rand.Intn(monthMaxDay) + 1
+	randDay := random.Intn(monthMaxDay) + 1
 	fullDateTime := date(year, randMonth, randDay).Format("2006-01-02")
 
 	return fullDateTime
@@ -344,17 +634,17 @@ func date(year, month, day int) time.Time {
 // scrambleString will replace capital letters with a random capital letter, a lower-case letter with a random
 // lower-case letter, and numbers with a random number. String size will be the same length and non-alphanumerics will
 // be ignored in the input and output.
-func scrambleString(input string) string {
+func scrambleString(input string, random *rand.Rand) string {
 	var b strings.Builder
 
 	for i := 0; i < len(input); i++ {
 		switch c := input[i]; {
 		case c >= 'a' && c <= 'z':
-			b.WriteString(randomLowercase())
+			b.WriteString(randomLowercase(random))
 		case c >= 'A' && c <= 'Z':
-			b.WriteString(randomUppercase())
+			b.WriteString(randomUppercase(random))
 		case c >= '0' && c <= '9':
-			b.WriteString(randomNumeric())
+			b.WriteString(randomNumeric(random))
 		default:
 			b.WriteByte(c)
 		}
@@ -369,16 +659,30 @@ func scrubString(input string) string {
 }
 
 // randomLowercase will pick a random location in the lowercase constant string and return the letter at that position.
-func randomLowercase() string {
-	return string(lowercaseSet[rand.Intn(lowercaseSetLen)])
+func randomLowercase(random *rand.Rand) string {
+	return string(lowercaseSet[random.Intn(lowercaseSetLen)])
 }
 
 // randomUppercase will pick a random location in the uppercase constant string and return the letter at that position.
-func randomUppercase() string {
-	return string(uppercaseSet[rand.Intn(uppercaseSetLen)])
+func randomUppercase(random *rand.Rand) string {
+	return string(uppercaseSet[random.Intn(uppercaseSetLen)])
 }
 
 // randomNumeric will return a random location in the numeric constant string and return the number at that position.
-func randomNumeric() string {
-	return string(numericSet[rand.Intn(numericSetLen)])
+func randomNumeric(random *rand.Rand) string {
+	return string(numericSet[random.Intn(numericSetLen)])
+}
+
+// Int63 will return a random int64 from the source.
+func (source *lockedSource) Int63() int64 {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	return source.source.Int63()
+}
+
+// Seed will seed the source.
+func (source *lockedSource) Seed(seed int64) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	source.source.Seed(seed)
 }
@@ -0,0 +1,270 @@
+package gonymizer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ProgressMode is how the progress of processing a dump file is reported. See SetProgress.
+type ProgressMode int
+
+// ProgressLog logs the progress periodically (default)
+// ProgressNone disables progress reporting
+// ProgressBar draws a progress bar on a terminal
+const (
+	ProgressLog ProgressMode = iota
+	ProgressNone
+	ProgressBar
+)
+
+const (
+	// progressLogInterval is how often the progress is logged in ProgressLog mode.
+	progressLogInterval = 10 * time.Second
+	// progressBarInterval is how often the progress bar is redrawn in ProgressBar mode.
+	progressBarInterval = 200 * time.Millisecond
+	// progressBarWidth is the width of the bar (not including the statistics) in characters.
+	progressBarWidth = 30
+)
+
+var (
+	// progressMode is the ProgressMode used when processing dump files.
+	progressMode = ProgressLog
+	// progressWriter is where the progress bar is drawn in ProgressBar mode.
+	progressWriter io.Writer
+	// progressHook is the logrus hook that clears the progress bar before log lines are written.
+	progressHook *progressLogHook
+	// progressMutex protects progressMode and progressWriter from concurrent updates.
+	progressMutex sync.RWMutex
+)
+
+// progressTracker tracks the progress of processing a dump file. It reports the percentage, ETA, and throughput of the
+// whole file and of the current table, and updates the Prometheus metrics.
+type progressTracker struct {
+	mode   ProgressMode
+	writer io.Writer
+
+	total      int64
+	bytes      int64
+	started    time.Time
+	lastReport time.Time
+
+	schema       string
+	table        string
+	tableRows    int64
+	tableStarted time.Time
+	tableCounter prometheus.Counter
+	tableSpan    trace.Span
+
+	// ctx carries the span the table spans are children of
+	ctx context.Context
+}
+
+// progressLogHook is a logrus hook that clears the progress bar before a log line is written so the log line does not
+// start in the middle of the progress bar.
+type progressLogHook struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+// SetProgress will set how the progress of processing dump files is reported. The writer is only used in ProgressBar
+// mode and should be a terminal.
+func SetProgress(mode ProgressMode, writer io.Writer) {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	progressMode = mode
+	progressWriter = writer
+
+	if progressHook == nil {
+		progressHook = &progressLogHook{}
+		log.AddHook(progressHook)
+	}
+	progressHook.mutex.Lock()
+	defer progressHook.mutex.Unlock()
+	progressHook.writer = nil
+	if mode == ProgressBar {
+		progressHook.writer = writer
+	}
+}
+
+// ParseProgressMode will return the ProgressMode for the supplied name (none, log, bar).
+func ParseProgressMode(name string) (ProgressMode, error) {
+	switch strings.ToLower(name) {
+	case "none":
+		return ProgressNone, nil
+	case "log":
+		return ProgressLog, nil
+	case "bar":
+		return ProgressBar, nil
+	}
+	return ProgressNone, fmt.Errorf("unknown progress mode '%s', must be one of: none, log, bar", name)
+}
+
+// newProgressTracker returns a progressTracker for a dump file of the supplied size. Total may be 0 if the size is
+// unknown, in which case no percentage or ETA is reported. The spans of the tables are children of the span in the
+// context.
+func newProgressTracker(ctx context.Context, total int64) *progressTracker {
+	progressMutex.RLock()
+	defer progressMutex.RUnlock()
+
+	metricInputBytes.Set(float64(total))
+	now := time.Now()
+	tracker := &progressTracker{
+		mode:       progressMode,
+		writer:     progressWriter,
+		total:      total,
+		ctx:        ctx,
+		started:    now,
+		lastReport: now,
+	}
+	if tracker.mode == ProgressBar && tracker.writer == nil {
+		tracker.mode = ProgressLog
+	}
+	return tracker
+}
+
+// line will add a line of the dump file to the progress. wasRow and state are the state of the processor before and
+// after the line was processed, which is used to detect the start and end of COPY statements.
+func (tracker *progressTracker) line(size int, wasRow bool, state *LineState) {
+	tracker.bytes += int64(size)
+	metricBytesProcessed.Add(float64(size))
+
+	switch {
+	case !wasRow && state.IsRow:
+		tracker.startTable(state.SchemaName, state.TableName)
+	case wasRow && !state.IsRow:
+		tracker.endTable()
+	case wasRow:
+		tracker.tableRows++
+		tracker.tableCounter.Inc()
+	}
+
+	if tracker.mode == ProgressNone {
+		return
+	}
+	interval := progressLogInterval
+	if tracker.mode == ProgressBar {
+		interval = progressBarInterval
+	}
+	if now := time.Now(); now.Sub(tracker.lastReport) >= interval {
+		tracker.lastReport = now
+		tracker.report(now)
+	}
+}
+
+// done will report the end of processing.
+func (tracker *progressTracker) done() {
+	if len(tracker.table) > 0 {
+		tracker.endTable()
+	}
+	elapsed := time.Since(tracker.started)
+	if tracker.mode != ProgressNone {
+		log.Infof("Processed %s in %s (%s/s)", formatBytes(tracker.bytes), elapsed.Round(time.Second),
+			formatBytes(int64(float64(tracker.bytes)/elapsed.Seconds())))
+	}
+}
+
+// startTable will start tracking the rows of a table.
+func (tracker *progressTracker) startTable(schema, table string) {
+	tracker.schema = schema
+	tracker.table = table
+	tracker.tableRows = 0
+	tracker.tableStarted = time.Now()
+	tracker.tableCounter = metricRowsProcessed.WithLabelValues(schema, table)
+	tracker.tableSpan = startSpan(tracker.ctx, "process table", attribute.String("db.sql.schema", schema),
+		attribute.String("db.sql.table", table))
+}
+
+// endTable will report the number of rows and throughput of the current table.
+func (tracker *progressTracker) endTable() {
+	if tracker.mode != ProgressNone && tracker.tableRows > 0 {
+		elapsed := time.Since(tracker.tableStarted)
+		log.Infof("Processed %s.%s: %d rows in %s (%.0f rows/s)", tracker.schema, tracker.table, tracker.tableRows,
+			elapsed.Round(time.Millisecond), float64(tracker.tableRows)/elapsed.Seconds())
+	}
+	if tracker.tableSpan != nil {
+		tracker.tableSpan.SetAttributes(attribute.Int64("rows", tracker.tableRows))
+		endSpan(tracker.tableSpan, nil)
+		tracker.tableSpan = nil
+	}
+	tracker.schema = ""
+	tracker.table = ""
+}
+
+// report will log the progress, or redraw the progress bar.
+func (tracker *progressTracker) report(now time.Time) {
+	elapsed := now.Sub(tracker.started).Seconds()
+	rate := float64(tracker.bytes) / elapsed
+
+	var status strings.Builder
+	if tracker.total > 0 {
+		ratio := float64(tracker.bytes) / float64(tracker.total)
+		if ratio > 1 {
+			// Encrypted and compressed dump files are smaller than their contents
+			ratio = 1
+		}
+		var eta time.Duration
+		if rate > 0 && tracker.bytes < tracker.total {
+			eta = time.Duration(float64(tracker.total-tracker.bytes)/rate) * time.Second
+		}
+
+		if tracker.mode == ProgressBar {
+			filled := int(ratio * progressBarWidth)
+			status.WriteString("[" + strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled) + "] ")
+		}
+		fmt.Fprintf(&status, "%5.1f%% %s/%s, %s/s, ETA %s", ratio*100, formatBytes(tracker.bytes),
+			formatBytes(tracker.total), formatBytes(int64(rate)), eta.Round(time.Second))
+	} else {
+		fmt.Fprintf(&status, "%s, %s/s", formatBytes(tracker.bytes), formatBytes(int64(rate)))
+	}
+
+	if len(tracker.table) > 0 {
+		tableRate := float64(tracker.tableRows) / now.Sub(tracker.tableStarted).Seconds()
+		fmt.Fprintf(&status, " | %s.%s: %d rows (%.0f rows/s)", tracker.schema, tracker.table, tracker.tableRows,
+			tableRate)
+	}
+
+	if tracker.mode == ProgressBar {
+		fmt.Fprint(tracker.writer, "\r\033[K", status.String())
+	} else {
+		log.Info("Processing: ", status.String())
+	}
+}
+
+// Levels will return the log levels the hook is fired for.
+func (hook *progressLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire will clear the progress bar before the log line is written.
+func (hook *progressLogHook) Fire(*log.Entry) error {
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+	if hook.writer == nil {
+		return nil
+	}
+	_, err := fmt.Fprint(hook.writer, "\r\033[K")
+	return err
+}
+
+// formatBytes will format the number of bytes using binary units, I.E. 1.5 GiB.
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,69 @@
+package gonymizer
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressTracker(t *testing.T) {
+	var out bytes.Buffer
+	SetProgress(ProgressBar, &out)
+	defer SetProgress(ProgressLog, nil)
+
+	rows := testutil.ToFloat64(metricRowsProcessed.WithLabelValues("public", "progress"))
+	processed := testutil.ToFloat64(metricBytesProcessed)
+
+	tracker := newProgressTracker(context.Background(), 1000)
+	state := &LineState{}
+	tracker.line(100, false, state)
+
+	state.parseCopyLine("COPY public.progress (id, name) FROM stdin;\n")
+	tracker.line(50, false, state)
+	for i := 0; i < 10; i++ {
+		tracker.line(10, true, state)
+	}
+
+	// Force the progress bar to be drawn
+	tracker.lastReport = time.Time{}
+	tracker.line(10, true, state)
+	require.Contains(t, out.String(), "[=====")
+	require.Contains(t, out.String(), " 26.0% ")
+	require.Contains(t, out.String(), "public.progress: 11 rows")
+
+	state.Clear()
+	tracker.line(3, true, state)
+	tracker.done()
+	require.Equal(t, rows+11, testutil.ToFloat64(metricRowsProcessed.WithLabelValues("public", "progress")))
+	require.Equal(t, processed+263, testutil.ToFloat64(metricBytesProcessed))
+	require.Equal(t, 1000.0, testutil.ToFloat64(metricInputBytes))
+
+	// Nothing is drawn when progress is disabled
+	SetProgress(ProgressNone, &out)
+	out.Reset()
+	tracker = newProgressTracker(context.Background(), 0)
+	tracker.lastReport = time.Time{}
+	tracker.line(10, false, state)
+	tracker.done()
+	require.Empty(t, out.String())
+}
+
+func TestParseProgressMode(t *testing.T) {
+	for name, expected := range map[string]ProgressMode{"none": ProgressNone, "LOG": ProgressLog, "bar": ProgressBar} {
+		mode, err := ParseProgressMode(name)
+		require.Nil(t, err)
+		require.Equal(t, expected, mode)
+	}
+	_, err := ParseProgressMode("fancy")
+	require.NotNil(t, err)
+
+	require.Equal(t, "512 B", formatBytes(512))
+	require.Equal(t, "1.5 KiB", formatBytes(1536))
+	require.Equal(t, "2.0 GiB", formatBytes(2*1024*1024*1024))
+	require.False(t, strings.Contains(formatBytes(1<<62), "%"))
+}
@@ -0,0 +1,575 @@
+package gonymizer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"io"
+	"math"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultQualityK is the default k used to count the rows that are not k-anonymous.
+	defaultQualityK = 5
+	// defaultQualitySampleSize is the default number of numeric values sampled per column to calculate quantiles.
+	defaultQualitySampleSize = 10000
+	// qualityMaxDiversity is the highest l-diversity that is tracked for an equivalence class. It limits the memory used
+	// per equivalence class.
+	qualityMaxDiversity = 32
+	// hllPrecision is the number of bits used to select a HyperLogLog register (2^12 registers, ~1.6% error).
+	hllPrecision = 12
+)
+
+// qualityLengthBuckets are the upper bounds (inclusive) of the value length histogram buckets.
+var qualityLengthBuckets = []int{0, 4, 8, 16, 32, 64, 128}
+
+// QualityOptions are the options used by GenerateQualityReport.
+type QualityOptions struct {
+	// QuasiIdentifiers are the columns (schema.table.column) that can be combined to re-identify a person, I.E. zip
+	// code, birth date, and gender. Each table's quasi-identifiers form the equivalence classes of the table.
+	QuasiIdentifiers []string
+	// SensitiveColumns are the columns (schema.table.column) used to calculate l-diversity.
+	SensitiveColumns []string
+	// K is the k used to count the rows that are not k-anonymous.
+	K int
+	// SampleSize is the number of numeric values sampled per column to calculate quantiles.
+	SampleSize int
+}
+
+// QualityReport is the anonymization quality report created by GenerateQualityReport.
+type QualityReport struct {
+	GeneratedAt   time.Time          `json:"generated_at"`
+	RawFile       string             `json:"raw_file"`
+	ProcessedFile string             `json:"processed_file"`
+	Anonymity     []TableAnonymity   `json:"anonymity"`
+	Columns       []ColumnComparison `json:"columns"`
+}
+
+// TableAnonymity is the k-anonymity and l-diversity of a table in the processed file.
+type TableAnonymity struct {
+	Schema             string       `json:"schema"`
+	Table              string       `json:"table"`
+	QuasiIdentifiers   []string     `json:"quasi_identifiers"`
+	Rows               int64        `json:"rows"`
+	EquivalenceClasses int64        `json:"equivalence_classes"`
+	K                  int64        `json:"k"`
+	TargetK            int64        `json:"target_k"`
+	RowsBelowTargetK   int64        `json:"rows_below_target_k"`
+	UniqueRows         int64        `json:"unique_rows"`
+	Diversity          []LDiversity `json:"l_diversity,omitempty"`
+}
+
+// LDiversity is the lowest number of distinct values of a sensitive column in any equivalence class. Values above
+// 32 are reported as 32.
+type LDiversity struct {
+	Column string `json:"column"`
+	L      int64  `json:"l"`
+}
+
+// ColumnComparison compares the distribution of a column in the raw and processed files.
+type ColumnComparison struct {
+	Schema    string        `json:"schema"`
+	Table     string        `json:"table"`
+	Column    string        `json:"column"`
+	Raw       ColumnProfile `json:"raw"`
+	Processed ColumnProfile `json:"processed"`
+}
+
+// ColumnProfile is the distribution of the values of a column.
+type ColumnProfile struct {
+	Rows            int64             `json:"rows"`
+	Nulls           int64             `json:"nulls"`
+	NullRate        float64           `json:"null_rate"`
+	Distinct        int64             `json:"distinct"`
+	LengthHistogram []HistogramBucket `json:"length_histogram"`
+	Numeric         *NumericSummary   `json:"numeric,omitempty"`
+}
+
+// HistogramBucket is a single bucket of the value length histogram.
+type HistogramBucket struct {
+	Label string `json:"label"`
+	Count int64  `json:"count"`
+}
+
+// NumericSummary holds the quantiles of a column where every value is a number. Quantiles are calculated using a
+// random sample of the values.
+type NumericSummary struct {
+	Min    float64 `json:"min"`
+	P25    float64 `json:"p25"`
+	Median float64 `json:"median"`
+	P75    float64 `json:"p75"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+}
+
+// columnProfiler builds the ColumnProfile of a column using bounded memory.
+type columnProfiler struct {
+	rows     int64
+	nulls    int64
+	lengths  []int64
+	distinct hyperLogLog
+	numeric  int64
+	sum      float64
+	min      float64
+	max      float64
+	sample   []float64
+}
+
+// equivalenceClass is the set of rows in a table that share the same quasi-identifier values.
+type equivalenceClass struct {
+	size      int64
+	sensitive [][]uint64
+}
+
+// tableAnonymizer calculates the k-anonymity and l-diversity of a table.
+type tableAnonymizer struct {
+	quasiIdentifiers []string
+	sensitive        []string
+	rows             int64
+	classes          map[uint64]*equivalenceClass
+}
+
+// GenerateQualityReport will compare the distribution of every column in the raw and processed dump files and
+// calculate the k-anonymity and l-diversity of the processed file using the quasi-identifiers in the options. Both
+// files may be local paths or URLs for any registered Storage backend.
+func GenerateQualityReport(rawURL, processedURL string, options QualityOptions) (*QualityReport, error) {
+	return GenerateQualityReportContext(context.Background(), rawURL, processedURL, options)
+}
+
+// GenerateQualityReportContext is the same as GenerateQualityReport, but stops when the context is cancelled.
+func GenerateQualityReportContext(ctx context.Context, rawURL, processedURL string,
+	options QualityOptions) (*QualityReport, error) {
+	ctx, stopStep := StartStep(ctx, "report")
+	defer stopStep()
+
+	if options.K <= 0 {
+		options.K = defaultQualityK
+	}
+	if options.SampleSize <= 0 {
+		options.SampleSize = defaultQualitySampleSize
+	}
+
+	report := &QualityReport{
+		GeneratedAt:   time.Now().UTC(),
+		RawFile:       RedactSecrets(rawURL),
+		ProcessedFile: RedactSecrets(processedURL),
+	}
+
+	// Quasi-identifiers and sensitive columns grouped by table
+	tables := map[string]*tableAnonymizer{}
+	for _, column := range options.QuasiIdentifiers {
+		table, name, err := splitQualityColumn(column)
+		if err != nil {
+			return nil, err
+		}
+		if tables[table] == nil {
+			tables[table] = &tableAnonymizer{classes: map[uint64]*equivalenceClass{}}
+		}
+		tables[table].quasiIdentifiers = append(tables[table].quasiIdentifiers, name)
+	}
+	for _, column := range options.SensitiveColumns {
+		table, name, err := splitQualityColumn(column)
+		if err != nil {
+			return nil, err
+		}
+		if tables[table] == nil {
+			return nil, fmt.Errorf("sensitive column '%s' does not have any quasi-identifiers", column)
+		}
+		tables[table].sensitive = append(tables[table].sensitive, name)
+	}
+
+	var order []string
+	raw := map[string]*columnProfiler{}
+	processed := map[string]*columnProfiler{}
+	random := rand.New(rand.NewSource(1))
+
+	log.Info("Profiling raw file: ", RedactSecrets(rawURL))
+	err := scanDumpRows(ctx, rawURL, func(state *LineState, values []string) {
+		for i, column := range state.ColumnNames {
+			key := state.SchemaName + "." + state.TableName + "." + column
+			if raw[key] == nil {
+				raw[key] = newColumnProfiler()
+				order = append(order, key)
+			}
+			if i < len(values) {
+				raw[key].Add(values[i], options.SampleSize, random)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Profiling processed file: ", RedactSecrets(processedURL))
+	err = scanDumpRows(ctx, processedURL, func(state *LineState, values []string) {
+		table := state.SchemaName + "." + state.TableName
+		for i, column := range state.ColumnNames {
+			key := table + "." + column
+			if processed[key] == nil {
+				processed[key] = newColumnProfiler()
+				if raw[key] == nil {
+					order = append(order, key)
+				}
+			}
+			if i < len(values) {
+				processed[key].Add(values[i], options.SampleSize, random)
+			}
+		}
+		if anonymizer := tables[table]; anonymizer != nil {
+			anonymizer.Add(state.ColumnNames, values)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// A quasi-identifier or sensitive column missing from the processed file would put every row in the same
+	// equivalence class (or value) and report a false k-anonymity (or l-diversity).
+	for _, column := range options.QuasiIdentifiers {
+		if processed[column] == nil {
+			return nil, fmt.Errorf("quasi-identifier '%s' does not appear in the processed file", column)
+		}
+	}
+	for _, column := range options.SensitiveColumns {
+		if processed[column] == nil {
+			return nil, fmt.Errorf("sensitive column '%s' does not appear in the processed file", column)
+		}
+	}
+
+	for _, key := range order {
+		parts := strings.SplitN(key, ".", 3)
+		comparison := ColumnComparison{Schema: parts[0], Table: parts[1], Column: parts[2]}
+		if raw[key] != nil {
+			comparison.Raw = raw[key].Profile()
+		}
+		if processed[key] != nil {
+			comparison.Processed = processed[key].Profile()
+		}
+		report.Columns = append(report.Columns, comparison)
+	}
+
+	for table, anonymizer := range tables {
+		parts := strings.SplitN(table, ".", 2)
+		report.Anonymity = append(report.Anonymity, anonymizer.Anonymity(parts[0], parts[1], int64(options.K)))
+	}
+	sort.Slice(report.Anonymity, func(i, j int) bool {
+		return report.Anonymity[i].Schema+"."+report.Anonymity[i].Table <
+			report.Anonymity[j].Schema+"."+report.Anonymity[j].Table
+	})
+	return report, nil
+}
+
+// WriteJSON will write the report to the writer as JSON.
+func (report *QualityReport) WriteJSON(writer io.Writer) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "    ")
+	return encoder.Encode(report)
+}
+
+// WriteHTML will write the report to the writer as a single HTML page.
+func (report *QualityReport) WriteHTML(writer io.Writer) error {
+	return qualityReportTemplate.Execute(writer, report)
+}
+
+// splitQualityColumn will split schema.table.column into schema.table and column.
+func splitQualityColumn(column string) (string, string, error) {
+	parts := strings.Split(column, ".")
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("column '%s' must be in the form: schema.table.column", column)
+	}
+	return parts[0] + "." + parts[1], parts[2], nil
+}
+
+// newColumnProfiler returns an empty columnProfiler.
+func newColumnProfiler() *columnProfiler {
+	return &columnProfiler{lengths: make([]int64, len(qualityLengthBuckets)+1)}
+}
+
+// Add will add the (COPY escaped) value to the profile.
+func (profiler *columnProfiler) Add(value string, sampleSize int, random *rand.Rand) {
+	profiler.rows++
+	if value == "\\N" {
+		profiler.nulls++
+		return
+	}
+
+	value = unescapeCopyValue(value)
+	profiler.distinct.Add(hashString(value))
+
+	length := utf8.RuneCountInString(value)
+	bucket := sort.SearchInts(qualityLengthBuckets, length)
+	profiler.lengths[bucket]++
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return
+	}
+	if profiler.numeric == 0 || number < profiler.min {
+		profiler.min = number
+	}
+	if profiler.numeric == 0 || number > profiler.max {
+		profiler.max = number
+	}
+	profiler.numeric++
+	profiler.sum += number
+
+	// Reservoir sampling keeps a uniform random sample of the numbers
+	if len(profiler.sample) < sampleSize {
+		profiler.sample = append(profiler.sample, number)
+	} else if i := random.Int63n(profiler.numeric); i < int64(sampleSize) {
+		profiler.sample[i] = number
+	}
+}
+
+// Profile will return the ColumnProfile of all values added to the profiler.
+func (profiler *columnProfiler) Profile() ColumnProfile {
+	profile := ColumnProfile{
+		Rows:     profiler.rows,
+		Nulls:    profiler.nulls,
+		Distinct: profiler.distinct.Count(),
+	}
+	if profiler.rows > 0 {
+		profile.NullRate = float64(profiler.nulls) / float64(profiler.rows)
+	}
+
+	low := 0
+	for i, count := range profiler.lengths {
+		label := fmt.Sprintf("%d+", low)
+		if i < len(qualityLengthBuckets) {
+			label = fmt.Sprintf("%d-%d", low, qualityLengthBuckets[i])
+			if low == qualityLengthBuckets[i] {
+				label = fmt.Sprint(low)
+			}
+			low = qualityLengthBuckets[i] + 1
+		}
+		profile.LengthHistogram = append(profile.LengthHistogram, HistogramBucket{Label: label, Count: count})
+	}
+
+	// Only columns where every value is a number have a numeric summary
+	if profiler.numeric > 0 && profiler.numeric == profiler.rows-profiler.nulls {
+		sample := append([]float64(nil), profiler.sample...)
+		sort.Float64s(sample)
+		profile.Numeric = &NumericSummary{
+			Min:    profiler.min,
+			P25:    quantile(sample, 0.25),
+			Median: quantile(sample, 0.5),
+			P75:    quantile(sample, 0.75),
+			Max:    profiler.max,
+			Mean:   profiler.sum / float64(profiler.numeric),
+		}
+	}
+	return profile
+}
+
+// quantile will return the q quantile of the sorted values using linear interpolation.
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	pos := q * float64(len(sorted)-1)
+	lower := int(math.Floor(pos))
+	upper := int(math.Ceil(pos))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(pos-float64(lower))
+}
+
+// Add will add the row to the equivalence class matching its quasi-identifier values.
+func (anonymizer *tableAnonymizer) Add(columns, values []string) {
+	valueOf := func(name string) string {
+		for i, column := range columns {
+			if column == name && i < len(values) {
+				return values[i]
+			}
+		}
+		return "\\N"
+	}
+
+	var key strings.Builder
+	for _, name := range anonymizer.quasiIdentifiers {
+		key.WriteString(valueOf(name))
+		key.WriteByte(0)
+	}
+	classKey := hashString(key.String())
+
+	class := anonymizer.classes[classKey]
+	if class == nil {
+		class = &equivalenceClass{sensitive: make([][]uint64, len(anonymizer.sensitive))}
+		anonymizer.classes[classKey] = class
+	}
+	class.size++
+	anonymizer.rows++
+
+	for i, name := range anonymizer.sensitive {
+		if len(class.sensitive[i]) >= qualityMaxDiversity {
+			continue
+		}
+		hash := hashString(valueOf(name))
+		found := false
+		for _, seen := range class.sensitive[i] {
+			if seen == hash {
+				found = true
+				break
+			}
+		}
+		if !found {
+			class.sensitive[i] = append(class.sensitive[i], hash)
+		}
+	}
+}
+
+// Anonymity will return the k-anonymity and l-diversity of all rows added to the table.
+func (anonymizer *tableAnonymizer) Anonymity(schema, table string, targetK int64) TableAnonymity {
+	anonymity := TableAnonymity{
+		Schema:             schema,
+		Table:              table,
+		QuasiIdentifiers:   anonymizer.quasiIdentifiers,
+		Rows:               anonymizer.rows,
+		EquivalenceClasses: int64(len(anonymizer.classes)),
+		TargetK:            targetK,
+	}
+
+	diversity := make([]int64, len(anonymizer.sensitive))
+	for i := range diversity {
+		diversity[i] = qualityMaxDiversity
+	}
+	for _, class := range anonymizer.classes {
+		if anonymity.K == 0 || class.size < anonymity.K {
+			anonymity.K = class.size
+		}
+		if class.size < targetK {
+			anonymity.RowsBelowTargetK += class.size
+		}
+		if class.size == 1 {
+			anonymity.UniqueRows++
+		}
+		for i, values := range class.sensitive {
+			if int64(len(values)) < diversity[i] {
+				diversity[i] = int64(len(values))
+			}
+		}
+	}
+
+	for i, name := range anonymizer.sensitive {
+		if anonymizer.rows == 0 {
+			diversity[i] = 0
+		}
+		anonymity.Diversity = append(anonymity.Diversity, LDiversity{Column: name, L: diversity[i]})
+	}
+	return anonymity
+}
+
+// hashString will return a 64 bit hash of the string.
+func hashString(value string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(value))
+	hash := h.Sum64()
+
+	// splitmix64 finalizer to spread the bits of short values
+	hash = (hash ^ (hash >> 30)) * 0xbf58476d1ce4e5b9
+	hash = (hash ^ (hash >> 27)) * 0x94d049bb133111eb
+	return hash ^ (hash >> 31)
+}
+
+// hyperLogLog estimates the number of distinct values using 4KB of memory.
+type hyperLogLog struct {
+	registers [1 << hllPrecision]uint8
+}
+
+// Add will add the hash of a value.
+func (hll *hyperLogLog) Add(hash uint64) {
+	index := hash >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > hll.registers[index] {
+		hll.registers[index] = rank
+	}
+}
+
+// Count will return the estimated number of distinct values.
+func (hll *hyperLogLog) Count() int64 {
+	m := float64(len(hll.registers))
+	sum, zeros := 0.0, 0
+	for _, rank := range hll.registers {
+		sum += math.Pow(2, -float64(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(estimate))
+}
+
+// qualityReportTemplate is the HTML template used by QualityReport.WriteHTML.
+var qualityReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": func(value float64) string { return fmt.Sprintf("%.1f%%", value*100) },
+	"number":  func(value float64) string { return strconv.FormatFloat(value, 'g', 6, 64) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Gonymizer Anonymization Quality Report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: right; vertical-align: top; }
+th { background: #eee; }
+td.name { text-align: left; }
+.warn { background: #fdd; }
+</style>
+</head>
+<body>
+<h1>Anonymization Quality Report</h1>
+<p>Raw file: {{.RawFile}}<br>Processed file: {{.ProcessedFile}}<br>Generated: {{.GeneratedAt}}</p>
+
+<h2>k-Anonymity and l-Diversity</h2>
+{{if .Anonymity}}
+<table>
+<tr><th>Table</th><th>Quasi-identifiers</th><th>Rows</th><th>Equivalence classes</th><th>k</th>
+<th>Rows below target k</th><th>Unique rows</th><th>l-Diversity</th></tr>
+{{range .Anonymity}}
+<tr{{if lt .K .TargetK}} class="warn"{{end}}>
+<td class="name">{{.Schema}}.{{.Table}}</td>
+<td class="name">{{range $i, $c := .QuasiIdentifiers}}{{if $i}}, {{end}}{{$c}}{{end}}</td>
+<td>{{.Rows}}</td><td>{{.EquivalenceClasses}}</td><td>{{.K}}</td>
+<td>{{.RowsBelowTargetK}} (k &lt; {{.TargetK}})</td><td>{{.UniqueRows}}</td>
+<td class="name">{{range .Diversity}}{{.Column}}: {{.L}}<br>{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>No quasi-identifiers were configured.</p>
+{{end}}
+
+<h2>Column Distributions (raw / processed)</h2>
+<table>
+<tr><th>Column</th><th>Rows</th><th>Null rate</th><th>Distinct</th><th>Length histogram</th><th>Numeric quantiles</th></tr>
+{{range .Columns}}
+<tr>
+<td class="name">{{.Schema}}.{{.Table}}.{{.Column}}</td>
+<td>{{.Raw.Rows}}<br>{{.Processed.Rows}}</td>
+<td>{{percent .Raw.NullRate}}<br>{{percent .Processed.NullRate}}</td>
+<td>{{.Raw.Distinct}}<br>{{.Processed.Distinct}}</td>
+<td class="name">{{range .Raw.LengthHistogram}}{{if .Count}}{{.Label}}: {{.Count}} {{end}}{{end}}<br>
+{{range .Processed.LengthHistogram}}{{if .Count}}{{.Label}}: {{.Count}} {{end}}{{end}}</td>
+<td class="name">{{with .Raw.Numeric}}{{number .Min}} / {{number .P25}} / {{number .Median}} / {{number .P75}} / {{number .Max}}{{end}}<br>
+{{with .Processed.Numeric}}{{number .Min}} / {{number .P25}} / {{number .Median}} / {{number .P75}} / {{number .Max}}{{end}}</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,99 @@
+package gonymizer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateQualityReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonymizer-quality")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	raw := filepath.Join(dir, "raw.sql")
+	require.Nil(t, ioutil.WriteFile(raw, []byte(
+		"COPY public.patients (id, zip, gender, diagnosis) FROM stdin;\n"+
+			"1\t10001\tF\tflu\n2\t10002\tF\tcold\n3\t10003\tM\tflu\n4\t10004\tM\t\\N\n\\.\n"), 0644))
+
+	// Generalized zip codes make every row indistinguishable from at least one other row
+	processed := filepath.Join(dir, "processed.sql")
+	require.Nil(t, ioutil.WriteFile(processed, []byte(
+		"COPY public.patients (id, zip, gender, diagnosis) FROM stdin;\n"+
+			"1\t100**\tF\tflu\n2\t100**\tF\tcold\n3\t100**\tM\tflu\n4\t100**\tM\tflu\n\\.\n"), 0644))
+
+	report, err := GenerateQualityReport(raw, processed, QualityOptions{
+		QuasiIdentifiers: []string{"public.patients.zip", "public.patients.gender"},
+		SensitiveColumns: []string{"public.patients.diagnosis"},
+		K:                3,
+	})
+	require.Nil(t, err)
+
+	require.Len(t, report.Anonymity, 1)
+	anonymity := report.Anonymity[0]
+	require.Equal(t, int64(4), anonymity.Rows)
+	require.Equal(t, int64(2), anonymity.EquivalenceClasses)
+	require.Equal(t, int64(2), anonymity.K)
+	require.Equal(t, int64(4), anonymity.RowsBelowTargetK)
+	require.Equal(t, int64(0), anonymity.UniqueRows)
+	require.Equal(t, []LDiversity{{Column: "diagnosis", L: 1}}, anonymity.Diversity)
+
+	require.Len(t, report.Columns, 4)
+	zip := report.Columns[1]
+	require.Equal(t, "zip", zip.Column)
+	require.Equal(t, int64(4), zip.Raw.Distinct)
+	require.Equal(t, int64(1), zip.Processed.Distinct)
+	require.NotNil(t, zip.Raw.Numeric)
+	require.Equal(t, 10001.0, zip.Raw.Numeric.Min)
+	require.Equal(t, 10002.5, zip.Raw.Numeric.Median)
+	require.Nil(t, zip.Processed.Numeric)
+	require.Equal(t, int64(4), zip.Processed.LengthHistogram[2].Count)
+
+	diagnosis := report.Columns[3]
+	require.Equal(t, 0.25, diagnosis.Raw.NullRate)
+	require.Equal(t, 0.0, diagnosis.Processed.NullRate)
+
+	// The JSON and HTML reports include every table and column
+	var out bytes.Buffer
+	require.Nil(t, report.WriteJSON(&out))
+	var decoded QualityReport
+	require.Nil(t, json.Unmarshal(out.Bytes(), &decoded))
+	require.Equal(t, report.Anonymity, decoded.Anonymity)
+	out.Reset()
+	require.Nil(t, report.WriteHTML(&out))
+	require.Contains(t, out.String(), "public.patients.diagnosis")
+
+	_, err = GenerateQualityReport(raw, processed, QualityOptions{QuasiIdentifiers: []string{"patients.zip"}})
+	require.NotNil(t, err)
+	_, err = GenerateQualityReport(raw, processed, QualityOptions{SensitiveColumns: []string{"public.patients.zip"}})
+	require.NotNil(t, err)
+
+	// Columns and tables missing from the processed file are errors instead of a single equivalence class
+	_, err = GenerateQualityReport(raw, processed, QualityOptions{QuasiIdentifiers: []string{"public.patients.zipcode"}})
+	require.Contains(t, err.Error(), "public.patients.zipcode")
+	_, err = GenerateQualityReport(raw, processed, QualityOptions{QuasiIdentifiers: []string{"public.people.zip"}})
+	require.Contains(t, err.Error(), "public.people.zip")
+	_, err = GenerateQualityReport(raw, processed, QualityOptions{
+		QuasiIdentifiers: []string{"public.patients.zip"},
+		SensitiveColumns: []string{"public.patients.diagnosis_code"},
+	})
+	require.Contains(t, err.Error(), "public.patients.diagnosis_code")
+}
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{0, 10, 1000, 100000} {
+		var hll hyperLogLog
+		for i := 0; i < n; i++ {
+			hll.Add(hashString(fmt.Sprint("value-", i)))
+			hll.Add(hashString(fmt.Sprint("value-", i)))
+		}
+		require.InDelta(t, n, hll.Count(), math.Max(1, float64(n)*0.05), n)
+	}
+}
@@ -0,0 +1,244 @@
+package gonymizer
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RunStatusSuccess is the status of a command that completed without errors or anomalies
+// RunStatusWarning is the status of a command that completed, but found anomalies (I.E. row counts do not match)
+// RunStatusFailure is the status of a command that did not complete
+const (
+	RunStatusSuccess = "success"
+	RunStatusWarning = "warning"
+	RunStatusFailure = "failure"
+)
+
+// activeRunReport is the RunReport results of the running command are added to. See SetRunReport.
+var activeRunReport *RunReport
+
+// activeRunReportMutex protects activeRunReport from concurrent updates.
+var activeRunReportMutex sync.RWMutex
+
+// RunReport is the machine readable result of a command. All methods are safe to call on a nil RunReport so results
+// can be added without checking if a report was requested.
+type RunReport struct {
+	Command         string               `json:"command"`
+	Version         string               `json:"version"`
+	BuildNumber     int64                `json:"build_number"`
+	BuildDate       time.Time            `json:"build_date"`
+	Status          string               `json:"status"`
+	StartedAt       time.Time            `json:"started_at"`
+	CompletedAt     time.Time            `json:"completed_at"`
+	DurationSeconds float64              `json:"duration_seconds"`
+	Steps           []RunStep            `json:"steps,omitempty"`
+	Tables          []TableRunReport     `json:"tables,omitempty"`
+	RowCounts       []RowCountComparison `json:"row_counts,omitempty"`
+	Errors          []string             `json:"errors,omitempty"`
+
+	mutex      sync.Mutex
+	tables     map[string]*TableRunReport
+	tableStart time.Time
+}
+
+// RunStep is the timing of a single step of a command.
+type RunStep struct {
+	Name            string  `json:"name"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// TableRunReport is the number of rows processed and values changed by each processor for a table.
+type TableRunReport struct {
+	Schema          string           `json:"schema"`
+	Table           string           `json:"table"`
+	Rows            int64            `json:"rows"`
+	ValuesChanged   map[string]int64 `json:"values_changed,omitempty"`
+	DurationSeconds float64          `json:"duration_seconds"`
+}
+
+// RowCountComparison is the result of comparing the row count of a table in the source database with the row count
+// after loading. See CompareRowCounts.
+type RowCountComparison struct {
+	Schema    string `json:"schema"`
+	Table     string `json:"table"`
+	Expected  int64  `json:"expected"`
+	Actual    int64  `json:"actual"`
+	Tolerance int64  `json:"tolerance"`
+	Missing   bool   `json:"missing,omitempty"`
+	Match     bool   `json:"match"`
+}
+
+// NewRunReport will return a RunReport for the command that started now.
+func NewRunReport(command string) *RunReport {
+	return &RunReport{
+		Command:     command,
+		Version:     Version(),
+		BuildNumber: BuildNumber(),
+		BuildDate:   BuildDate().UTC(),
+		StartedAt:   time.Now().UTC(),
+		tables:      map[string]*TableRunReport{},
+	}
+}
+
+// SetRunReport will set the RunReport the results of the running command are added to. Passing nil disables the
+// run report.
+func SetRunReport(report *RunReport) {
+	activeRunReportMutex.Lock()
+	defer activeRunReportMutex.Unlock()
+	activeRunReport = report
+}
+
+// GetRunReport will return the RunReport set using SetRunReport, or nil if no run report was requested.
+func GetRunReport() *RunReport {
+	activeRunReportMutex.RLock()
+	defer activeRunReportMutex.RUnlock()
+	return activeRunReport
+}
+
+// StartStep will start timing a step of the command. The returned function stops the timer and adds the step to the
+// report.
+func (report *RunReport) StartStep(name string) func() {
+	started := time.Now()
+	return func() {
+		if report == nil {
+			return
+		}
+		report.mutex.Lock()
+		defer report.mutex.Unlock()
+		report.Steps = append(report.Steps, RunStep{Name: name, DurationSeconds: time.Since(started).Seconds()})
+	}
+}
+
+// AddError will add an error to the report.
+func (report *RunReport) AddError(err error) {
+	if report == nil || err == nil {
+		return
+	}
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.Errors = append(report.Errors, RedactSecrets(err.Error()))
+}
+
+// AddRowCount will add the result of comparing the expected and actual row count of a table to the report.
+func (report *RunReport) AddRowCount(comparison RowCountComparison) {
+	if report == nil {
+		return
+	}
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.RowCounts = append(report.RowCounts, comparison)
+}
+
+// Finish will set the status and completion time of the report. The status is RunStatusFailure if err is not nil,
+// RunStatusWarning if any row counts did not match, and RunStatusSuccess otherwise.
+func (report *RunReport) Finish(err error) {
+	if report == nil {
+		return
+	}
+	report.AddError(err)
+
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.CompletedAt = time.Now().UTC()
+	report.DurationSeconds = report.CompletedAt.Sub(report.StartedAt).Seconds()
+
+	report.Status = RunStatusSuccess
+	for _, rowCount := range report.RowCounts {
+		if !rowCount.Match {
+			report.Status = RunStatusWarning
+		}
+	}
+	if err != nil {
+		report.Status = RunStatusFailure
+	}
+
+	report.Tables = report.Tables[:0]
+	for _, table := range report.tables {
+		report.Tables = append(report.Tables, *table)
+	}
+	sort.Slice(report.Tables, func(i, j int) bool {
+		if report.Tables[i].Schema != report.Tables[j].Schema {
+			return report.Tables[i].Schema < report.Tables[j].Schema
+		}
+		return report.Tables[i].Table < report.Tables[j].Table
+	})
+}
+
+// WriteRunReport will write the report as JSON to the supplied local path or URL for any registered Storage backend.
+func WriteRunReport(urlStr string, report *RunReport) (err error) {
+	writer, err := CreateURL(urlStr)
+	if err != nil {
+		return err
+	}
+
+	report.mutex.Lock()
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "    ")
+	err = encoder.Encode(report)
+	report.mutex.Unlock()
+	if err != nil {
+		abortWriter(writer, err)
+		return err
+	}
+	return writer.Close()
+}
+
+// startTable will start timing the COPY statement of a table.
+func (report *RunReport) startTable(schema, table string) {
+	if report == nil {
+		return
+	}
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.table(schema, table)
+	report.tableStart = time.Now()
+}
+
+// endTable will stop timing the COPY statement of a table.
+func (report *RunReport) endTable(schema, table string) {
+	if report == nil {
+		return
+	}
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	if report.tableStart.IsZero() {
+		return
+	}
+	report.table(schema, table).DurationSeconds += time.Since(report.tableStart).Seconds()
+	report.tableStart = time.Time{}
+}
+
+// addRow will count a processed row of a table.
+func (report *RunReport) addRow(schema, table string) {
+	if report == nil {
+		return
+	}
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.table(schema, table).Rows++
+}
+
+// addChangedValue will count a value of a table that was changed by the processor.
+func (report *RunReport) addChangedValue(schema, table, processor string) {
+	if report == nil {
+		return
+	}
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	tableReport := report.table(schema, table)
+	if tableReport.ValuesChanged == nil {
+		tableReport.ValuesChanged = map[string]int64{}
+	}
+	tableReport.ValuesChanged[processor]++
+}
+
+// table will return the TableRunReport for the table, creating it if needed. The caller must hold the mutex.
+func (report *RunReport) table(schema, table string) *TableRunReport {
+	key := schema + "." + table
+	if report.tables[key] == nil {
+		report.tables[key] = &TableRunReport{Schema: schema, Table: table}
+	}
+	return report.tables[key]
+}
@@ -1,18 +1,38 @@
 package gonymizer
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net/url"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// Defaults for streaming uploads and downloads (see: S3Config)
+const (
+	s3DefaultUploadPartSize    = 64 * 1024 * 1024
+	s3DefaultUploadConcurrency = 4
+	s3DownloadRangeSize        = 64 * 1024 * 1024
+	s3DownloadMaxRetries       = 5
+)
+
+// s3HostRegex matches the virtual hosted-style AWS S3 host names: <Bucket>.s3.<Region>.amazonaws.com,
+// <Bucket>.s3-<Region>.amazonaws.com, and <Bucket>.s3.amazonaws.com
+var s3HostRegex = regexp.MustCompile(`^(.+)\.s3(?:[.-]([a-z0-9-]+))?\.amazonaws\.com$`)
+
 // S3File is the main structure for gonymizer files in S3 metadata.
 type S3File struct {
 	Bucket   string
@@ -22,7 +42,33 @@ type S3File struct {
 	URL      *url.URL
 }
 
-// ParseS3Url will parse the supplied S3 uri and load it into a S3File structure
+// S3Config holds the settings used to connect to AWS S3 or any S3-compatible object store (MinIO, Ceph, LocalStack).
+// All settings are optional and fall back to the AWS SDK defaults (environment variables and shared configuration).
+type S3Config struct {
+	// Endpoint is the URL of an S3-compatible object store, I.E. http://localhost:9000
+	Endpoint string
+	// Region is used when the S3 URL does not include a region.
+	Region string
+	// Profile is the named profile in the shared AWS configuration files.
+	Profile string
+	// RoleARN is the ARN of an IAM role to assume using the credentials of the session.
+	RoleARN string
+	// PathStyle uses path-style addressing (http://endpoint/bucket/key) instead of virtual hosted-style addressing.
+	PathStyle bool
+	// ServerSideEncryption is the server-side encryption used for uploads: AES256 (default), aws:kms, or none.
+	ServerSideEncryption string
+	// KMSKeyID is the KMS key used for uploads. Setting a key implies aws:kms server-side encryption.
+	KMSKeyID string
+	// UploadPartSize is the size in bytes of each part of a multipart upload. Streamed uploads have an unknown size so
+	// S3's limit of 10,000 parts means the largest object is 10,000 * UploadPartSize (default: 64 MiB, or 640 GiB).
+	UploadPartSize int64
+	// UploadConcurrency is the number of parts that are uploaded in parallel (default: 4). Every part in flight is
+	// buffered in memory.
+	UploadConcurrency int
+}
+
+// ParseS3Url will parse the supplied S3 uri and load it into a S3File structure. Both s3://<Bucket>/<path> and the
+// AWS host form s3://<Bucket>.s3.<Region>.amazonaws.com/<path> are supported.
 func (s3f *S3File) ParseS3Url(s3url string) (err error) {
 	// Parse S3 URL into Bucket, Region, and path
 	if s3url != "" {
@@ -31,26 +77,93 @@ func (s3f *S3File) ParseS3Url(s3url string) (err error) {
 			log.Error("Unable to parse URL string: ", s3url)
 			return err
 		}
-
-		// We need to split up the URL for the host string to pull out Bucket and Region
-		// Structure: <Bucket>.s3.<Region>.amazonaws.com<path>
-		hostSplit := strings.Split(s3f.URL.Host, ".")
-		s3f.Scheme = strings.Split(s3url, ":")[0]
-		s3f.Bucket = hostSplit[0]
-		s3f.Region = hostSplit[2]
-		s3f.FilePath = s3f.URL.Path[1:] // Chop the first / from the path
-		if s3f.URL.Scheme != "s3" {
+		if s3f.URL.Scheme != "s3" || len(s3f.URL.Host) == 0 {
 			return errors.New("Unable to parse S3File URL: " + s3url)
 		}
+
+		s3f.Scheme = s3f.URL.Scheme
+		s3f.Bucket = s3f.URL.Host
+		s3f.Region = ""
+		if match := s3HostRegex.FindStringSubmatch(s3f.URL.Host); match != nil {
+			s3f.Bucket = match[1]
+			s3f.Region = match[2]
+		}
+		s3f.FilePath = strings.TrimPrefix(s3f.URL.Path, "/")
 		log.Debugf("ParseS3Url => Bucket: %s\tRegion: %s\tFilePath: %s", s3f.Bucket, s3f.Region, s3f.FilePath)
 	}
 	return nil
 }
 
-// AddFileToS3 will upload the supplied inFile to the supplied S3File.FilePath
+// NewS3Session returns an AWS session using the supplied S3Config. The region of the S3 URL (if any) takes precedence
+// over the region in the configuration.
+func NewS3Session(config S3Config, region string) (*session.Session, error) {
+	awsConfig := aws.NewConfig().WithS3ForcePathStyle(config.PathStyle)
+	if region = firstNonEmpty(region, config.Region); len(region) > 0 {
+		awsConfig = awsConfig.WithRegion(region)
+	}
+	if len(config.Endpoint) > 0 {
+		awsConfig = awsConfig.WithEndpoint(config.Endpoint)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		Profile:           config.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.RoleARN) > 0 {
+		log.Debug("Assuming IAM role: ", config.RoleARN)
+		sess = sess.Copy(&aws.Config{Credentials: stscreds.NewCredentials(sess, config.RoleARN)})
+	}
+	return sess, nil
+}
+
+// uploadInput returns the s3manager.UploadInput for the S3File using the server-side encryption settings of the
+// S3Config.
+func (config S3Config) uploadInput(s3file *S3File, body io.Reader) *s3manager.UploadInput {
+	input := &s3manager.UploadInput{
+		ACL:                aws.String("private"),
+		Body:               body,
+		Bucket:             aws.String(s3file.Bucket),
+		ContentDisposition: aws.String("attachment"),
+		ContentType:        aws.String("text/plain"),
+		Key:                aws.String(s3file.FilePath),
+	}
+
+	sse := config.ServerSideEncryption
+	if len(sse) == 0 {
+		sse = s3.ServerSideEncryptionAes256
+		if len(config.KMSKeyID) > 0 {
+			sse = s3.ServerSideEncryptionAwsKms
+		}
+	}
+	if !strings.EqualFold(sse, "none") {
+		input.ServerSideEncryption = aws.String(sse)
+	}
+	if len(config.KMSKeyID) > 0 {
+		input.SSEKMSKeyId = aws.String(config.KMSKeyID)
+	}
+	return input
+}
+
+// AddFileToS3 will upload the supplied inFile to the supplied S3File.FilePath. When sess is nil the session,
+// encryption, and upload settings of the S3Storage registered for s3:// URLs are used.
 func AddFileToS3(sess *session.Session, inFile string, s3file *S3File) (err error) {
+	return AddFileToS3Context(context.Background(), sess, inFile, s3file)
+}
+
+// AddFileToS3Context is the same as AddFileToS3, but the upload is aborted when the context is cancelled.
+func AddFileToS3Context(ctx context.Context, sess *session.Session, inFile string, s3file *S3File) (err error) {
+	span := startSpan(ctx, "s3 upload", attribute.String("s3.bucket", s3file.Bucket),
+		attribute.String("s3.key", s3file.FilePath))
+	defer func() { endSpan(span, err) }()
+
+	storage := registeredS3Storage()
 	if sess == nil {
-		sess, err = session.NewSession(&aws.Config{Region: aws.String(s3file.Region)})
+		sess, err = storage.session(s3file)
 		if err != nil {
 			return err
 		}
@@ -74,26 +187,29 @@ func AddFileToS3(sess *session.Session, inFile string, s3file *S3File) (err erro
 
 	// Use s3 manager to upload the file in pieces
 	//select Region to use.
-	svc := s3manager.NewUploader(sess)
-
-	response, err := svc.Upload(&s3manager.UploadInput{
-		ACL:                  aws.String("private"),
-		Body:                 file,
-		Bucket:               aws.String(s3file.Bucket),
-		ContentDisposition:   aws.String("attachment"),
-		ContentType:          aws.String("text/plain"),
-		Key:                  aws.String(s3file.FilePath),
-		ServerSideEncryption: aws.String("AES256"),
-	})
+	svc := s3manager.NewUploader(sess, storage.configureUploader)
+
+	response, err := svc.UploadWithContext(ctx, storage.Config.uploadInput(s3file, file))
 	log.Debug("AWS Response: ", response)
 	return err
 }
 
-// GetFileFromS3 will save the S3File to the loadFile destination.
+// GetFileFromS3 will save the S3File to the loadFile destination. When sess is nil the session of the S3Storage
+// registered for s3:// URLs is used.
 func GetFileFromS3(sess *session.Session, s3file *S3File, loadFile string) (err error) {
+	return GetFileFromS3Context(context.Background(), sess, s3file, loadFile)
+}
+
+// GetFileFromS3Context is the same as GetFileFromS3, but the download is aborted when the context is cancelled. The
+// partially downloaded loadFile is removed if the download fails.
+func GetFileFromS3Context(ctx context.Context, sess *session.Session, s3file *S3File, loadFile string) (err error) {
+	span := startSpan(ctx, "s3 download", attribute.String("s3.bucket", s3file.Bucket),
+		attribute.String("s3.key", s3file.FilePath))
+	defer func() { endSpan(span, err) }()
+
 	// Download the file to the loadFile destination
 	if sess == nil {
-		sess, err = session.NewSession(&aws.Config{Region: aws.String(s3file.Region)})
+		sess, err = registeredS3Storage().session(s3file)
 		if err != nil {
 			return err
 		}
@@ -105,7 +221,8 @@ func GetFileFromS3(sess *session.Session, s3file *S3File, loadFile string) (err
 	defer file.Close()
 
 	downloader := s3manager.NewDownloader(sess)
-	_, err = downloader.Download(
+	_, err = downloader.DownloadWithContext(
+		ctx,
 		file,
 		&s3.GetObjectInput{
 			Bucket: aws.String(s3file.Bucket),
@@ -113,7 +230,284 @@ func GetFileFromS3(sess *session.Session, s3file *S3File, loadFile string) (err
 		})
 	if err != nil {
 		log.Errorf("Unable to download item: %s", s3file.URL.String())
+		_ = file.Close()
+		removePartialFile(loadFile)
+		return err
+	}
+	return nil
+}
+
+// S3Storage is the Storage backend for S3 URLs in the form: s3://<Bucket>/<path> or
+// s3://<Bucket>.s3.<Region>.amazonaws.com/<path>
+type S3Storage struct {
+	Session *session.Session
+	Config  S3Config
+}
+
+// NewS3Storage returns an S3Storage using the supplied session. If sess is nil a new session is created for the
+// region of each URL.
+func NewS3Storage(sess *session.Session) *S3Storage {
+	return &S3Storage{Session: sess}
+}
+
+// NewS3StorageWithConfig returns an S3Storage that creates its sessions using the supplied S3Config.
+func NewS3StorageWithConfig(config S3Config) *S3Storage {
+	return &S3Storage{Config: config}
+}
+
+// Open will return a reader streaming the S3 object. The object is downloaded using consecutive ranged requests which
+// are retried (resuming at the last byte read) if the connection fails, so very large objects can be streamed reliably.
+func (storage *S3Storage) Open(urlStr string) (io.ReadCloser, error) {
+	s3file, sess, err := storage.parseObject(urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	svc := s3.New(sess)
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s3file.Bucket),
+		Key:    aws.String(s3file.FilePath),
+	})
+	if err != nil {
+		return nil, s3Error("open", urlStr, err)
+	}
+
+	return &s3RangeReader{
+		svc:    svc,
+		s3file: s3file,
+		etag:   head.ETag,
+		size:   aws.Int64Value(head.ContentLength),
+	}, nil
+}
+
+// Create will return a writer that uploads everything written to it to the S3 object using a multipart upload.
+func (storage *S3Storage) Create(urlStr string) (io.WriteCloser, error) {
+	s3file, sess, err := storage.parseObject(urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	uploader := s3manager.NewUploader(sess, storage.configureUploader)
+
+	return newPipeUploader(func(reader io.Reader) error {
+		response, err := uploader.Upload(storage.Config.uploadInput(s3file, reader))
+		log.Debug("AWS Response: ", response)
+		return err
+	}), nil
+}
+
+// Stat will return the StorageObject for the S3 object.
+func (storage *S3Storage) Stat(urlStr string) (StorageObject, error) {
+	s3file, sess, err := storage.parseObject(urlStr)
+	if err != nil {
+		return StorageObject{}, err
+	}
+
+	output, err := s3.New(sess).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s3file.Bucket),
+		Key:    aws.String(s3file.FilePath),
+	})
+	if err != nil {
+		return StorageObject{}, s3Error("stat", urlStr, err)
+	}
+	return StorageObject{
+		URL:     urlStr,
+		Size:    aws.Int64Value(output.ContentLength),
+		ModTime: aws.TimeValue(output.LastModified),
+	}, nil
+}
+
+// List will return all S3 objects whose key starts with the path of the URL.
+func (storage *S3Storage) List(urlStr string) ([]StorageObject, error) {
+	var objects []StorageObject
+
+	s3file, sess, err := storage.parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s3file.Bucket),
+		Prefix: aws.String(s3file.FilePath),
+	}
+	err = s3.New(sess).ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			objectURL := *s3file.URL
+			objectURL.Path = "/" + aws.StringValue(object.Key)
+			objects = append(objects, StorageObject{
+				URL:     objectURL.String(),
+				Size:    aws.Int64Value(object.Size),
+				ModTime: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	})
+	return objects, err
+}
+
+// Delete will remove the S3 object.
+func (storage *S3Storage) Delete(urlStr string) error {
+	s3file, sess, err := storage.parseObject(urlStr)
+	if err != nil {
+		return err
+	}
+
+	_, err = s3.New(sess).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s3file.Bucket),
+		Key:    aws.String(s3file.FilePath),
+	})
+	return err
+}
+
+// configureUploader will set the part size and concurrency of the uploader from the S3Config.
+func (storage *S3Storage) configureUploader(uploader *s3manager.Uploader) {
+	uploader.PartSize = s3DefaultUploadPartSize
+	if storage.Config.UploadPartSize > 0 {
+		uploader.PartSize = storage.Config.UploadPartSize
+	}
+	uploader.Concurrency = s3DefaultUploadConcurrency
+	if storage.Config.UploadConcurrency > 0 {
+		uploader.Concurrency = storage.Config.UploadConcurrency
+	}
+}
+
+// session will return the session of the S3Storage, or a new session using its S3Config for the region of the file.
+func (storage *S3Storage) session(s3file *S3File) (*session.Session, error) {
+	if storage.Session != nil {
+		return storage.Session, nil
+	}
+	return NewS3Session(storage.Config, s3file.Region)
+}
+
+// registeredS3Storage will return the S3Storage registered for s3:// URLs (see: RegisterStorage) so AddFileToS3 and
+// GetFileFromS3 use the configured endpoint, credentials, and encryption settings.
+func registeredS3Storage() *S3Storage {
+	if storage, err := GetStorage("s3://"); err == nil {
+		if s3Storage, ok := storage.(*S3Storage); ok {
+			return s3Storage
+		}
+	}
+	return NewS3Storage(nil)
+}
+
+// parse will parse the S3 URL and return the session to use for it.
+func (storage *S3Storage) parse(urlStr string) (*S3File, *session.Session, error) {
+	s3file := new(S3File)
+	if err := s3file.ParseS3Url(urlStr); err != nil {
+		return nil, nil, err
+	}
+
+	sess, err := storage.session(s3file)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s3file, sess, nil
+}
+
+// parseObject will parse the S3 URL of a single object and return the session to use for it.
+func (storage *S3Storage) parseObject(urlStr string) (*S3File, *session.Session, error) {
+	s3file, sess, err := storage.parse(urlStr)
+	if err == nil && len(s3file.FilePath) == 0 {
+		err = errors.New("S3 URL is missing the object key: " + urlStr)
+	}
+	return s3file, sess, err
+}
+
+// s3RangeReader streams an S3 object using consecutive ranged GET requests. Failed reads are retried from the current
+// offset. The ETag of the object is checked on every request so a changing object is never stitched together.
+type s3RangeReader struct {
+	svc      *s3.S3
+	s3file   *S3File
+	etag     *string
+	size     int64
+	offset   int64
+	body     io.ReadCloser
+	failures int
+}
+
+// Read will read from the current range, requesting the next range when the current one is complete.
+func (reader *s3RangeReader) Read(p []byte) (int, error) {
+	for {
+		if reader.body == nil {
+			if reader.offset >= reader.size {
+				return 0, io.EOF
+			}
+			if err := reader.nextRange(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := reader.body.Read(p)
+		reader.offset += int64(n)
+		if err == nil {
+			reader.failures = 0
+			return n, nil
+		}
+
+		reader.body.Close()
+		reader.body = nil
+		if err != io.EOF {
+			if reader.failures++; reader.failures > s3DownloadMaxRetries {
+				return n, err
+			}
+			log.Warnf("Retrying download of s3://%s/%s at byte %d: %s",
+				reader.s3file.Bucket, reader.s3file.FilePath, reader.offset, err)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// nextRange will request the next range of the object starting at the current offset.
+func (reader *s3RangeReader) nextRange() error {
+	end := reader.offset + s3DownloadRangeSize - 1
+	if end >= reader.size {
+		end = reader.size - 1
+	}
+
+	for {
+		output, err := reader.svc.GetObject(&s3.GetObjectInput{
+			Bucket:  aws.String(reader.s3file.Bucket),
+			Key:     aws.String(reader.s3file.FilePath),
+			IfMatch: reader.etag,
+			Range:   aws.String(fmt.Sprintf("bytes=%d-%d", reader.offset, end)),
+		})
+		if err == nil {
+			reader.body = output.Body
+			return nil
+		}
+
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() < 500 {
+			// Client errors (I.E. the object changed) will not be fixed by retrying
+			return err
+		}
+		if reader.failures++; reader.failures > s3DownloadMaxRetries {
+			return err
+		}
+		log.Warnf("Retrying download of s3://%s/%s at byte %d: %s",
+			reader.s3file.Bucket, reader.s3file.FilePath, reader.offset, err)
+		time.Sleep(time.Duration(reader.failures) * time.Second)
+	}
+}
+
+// Close will close the current range.
+func (reader *s3RangeReader) Close() error {
+	if reader.body != nil {
+		err := reader.body.Close()
+		reader.body = nil
 		return err
 	}
 	return nil
 }
+
+// s3Error will convert S3 not found errors into errors that satisfy os.IsNotExist.
+func s3Error(op, urlStr string, err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, s3.ErrCodeNoSuchBucket, "NotFound":
+			return notExistError(op, urlStr)
+		}
+	}
+	return err
+}
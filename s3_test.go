@@ -0,0 +1,206 @@
+package gonymizer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseS3Url(t *testing.T) {
+	for s3url, expected := range map[string][3]string{
+		"s3://my-bucket/path/to/dump.sql":                            {"my-bucket", "", "path/to/dump.sql"},
+		"s3://my-bucket.s3.us-west-2.amazonaws.com/path/to/dump.sql": {"my-bucket", "us-west-2", "path/to/dump.sql"},
+		"s3://my.dotted.bucket.s3-eu-west-1.amazonaws.com/dump.sql":  {"my.dotted.bucket", "eu-west-1", "dump.sql"},
+		"s3://my-bucket.s3.amazonaws.com/dump.sql":                   {"my-bucket", "", "dump.sql"},
+		"s3://my-bucket": {"my-bucket", "", ""},
+	} {
+		var s3file S3File
+		require.Nil(t, s3file.ParseS3Url(s3url), s3url)
+		require.Equal(t, expected[0], s3file.Bucket, s3url)
+		require.Equal(t, expected[1], s3file.Region, s3url)
+		require.Equal(t, expected[2], s3file.FilePath, s3url)
+		require.Equal(t, "s3", s3file.Scheme)
+	}
+
+	for _, s3url := range []string{"gs://my-bucket/dump.sql", "s3:///dump.sql", "my-bucket/dump.sql"} {
+		var s3file S3File
+		require.NotNil(t, s3file.ParseS3Url(s3url), s3url)
+	}
+}
+
+func TestS3UploadInput(t *testing.T) {
+	s3file := &S3File{Bucket: "my-bucket", FilePath: "dump.sql"}
+
+	input := S3Config{}.uploadInput(s3file, nil)
+	require.Equal(t, "AES256", *input.ServerSideEncryption)
+	require.Nil(t, input.SSEKMSKeyId)
+
+	input = S3Config{KMSKeyID: "alias/gonymizer"}.uploadInput(s3file, nil)
+	require.Equal(t, "aws:kms", *input.ServerSideEncryption)
+	require.Equal(t, "alias/gonymizer", *input.SSEKMSKeyId)
+
+	input = S3Config{ServerSideEncryption: "none"}.uploadInput(s3file, nil)
+	require.Nil(t, input.ServerSideEncryption)
+}
+
+func TestS3Storage(t *testing.T) {
+	var (
+		mutex    sync.Mutex
+		objects  = map[string]string{}
+		headers  = map[string]string{}
+		failNext bool
+	)
+
+	// Minimal path-style S3-compatible server (I.E. MinIO)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		switch {
+		case r.Method == http.MethodPut:
+			body, _ := ioutil.ReadAll(r.Body)
+			objects[key] = string(body)
+			headers[key] = r.Header.Get("X-Amz-Server-Side-Encryption")
+		case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><IsTruncated>false</IsTruncated>`)
+			for name, body := range objects {
+				if strings.HasPrefix(name, key+"/"+r.URL.Query().Get("prefix")) {
+					fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size></Contents>",
+						strings.TrimPrefix(name, key+"/"), len(body))
+				}
+			}
+			fmt.Fprint(w, `</ListBucketResult>`)
+		case r.Method == http.MethodGet || r.Method == http.MethodHead:
+			body, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				if r.Method == http.MethodGet {
+					fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>Not found</Message></Error>`)
+				}
+				return
+			}
+			if r.Method == http.MethodHead {
+				w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+				return
+			}
+
+			start, end := 0, len(body)-1
+			if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+				if end >= len(body) {
+					end = len(body) - 1
+				}
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(body)))
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(end-start+1))
+			w.WriteHeader(http.StatusPartialContent)
+			if failNext {
+				// Drop the connection half way through the range
+				failNext = false
+				fmt.Fprint(w, body[start:start+(end-start+1)/2])
+				return
+			}
+			fmt.Fprint(w, body[start:end+1])
+		case r.Method == http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	require.Nil(t, os.Setenv("AWS_ACCESS_KEY_ID", "minio"))
+	require.Nil(t, os.Setenv("AWS_SECRET_ACCESS_KEY", "minio123"))
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	storage := NewS3StorageWithConfig(S3Config{
+		Endpoint:             server.URL,
+		Region:               "us-east-1",
+		PathStyle:            true,
+		ServerSideEncryption: "none",
+	})
+
+	writer, err := storage.Create("s3://my-bucket/dumps/dump.sql")
+	require.Nil(t, err)
+	_, err = writer.Write([]byte("SELECT 1;\n"))
+	require.Nil(t, err)
+	require.Nil(t, writer.Close())
+	mutex.Lock()
+	require.Equal(t, "SELECT 1;\n", objects["my-bucket/dumps/dump.sql"])
+	require.Equal(t, "", headers["my-bucket/dumps/dump.sql"])
+	mutex.Unlock()
+
+	reader, err := storage.Open("s3://my-bucket/dumps/dump.sql")
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(reader)
+	require.Nil(t, err)
+	require.Nil(t, reader.Close())
+	require.Equal(t, "SELECT 1;\n", string(body))
+
+	// Interrupted downloads resume where they left off
+	mutex.Lock()
+	failNext = true
+	mutex.Unlock()
+	reader, err = storage.Open("s3://my-bucket/dumps/dump.sql")
+	require.Nil(t, err)
+	body, err = ioutil.ReadAll(reader)
+	require.Nil(t, err)
+	require.Nil(t, reader.Close())
+	require.Equal(t, "SELECT 1;\n", string(body))
+	mutex.Lock()
+	require.False(t, failNext)
+	mutex.Unlock()
+
+	object, err := storage.Stat("s3://my-bucket/dumps/dump.sql")
+	require.Nil(t, err)
+	require.Equal(t, int64(10), object.Size)
+
+	list, err := storage.List("s3://my-bucket/dumps/")
+	require.Nil(t, err)
+	require.Len(t, list, 1)
+	require.Equal(t, "s3://my-bucket/dumps/dump.sql", list[0].URL)
+
+	// AddFileToS3 and GetFileFromS3 use the settings of the registered S3Storage
+	oldStorage, err := GetStorage("s3://")
+	require.Nil(t, err)
+	defer RegisterStorage("s3", oldStorage)
+	RegisterStorage("s3", NewS3StorageWithConfig(S3Config{
+		Endpoint:  server.URL,
+		Region:    "us-east-1",
+		PathStyle: true,
+		KMSKeyID:  "alias/gonymizer",
+	}))
+	s3file := new(S3File)
+	require.Nil(t, s3file.ParseS3Url("s3://my-bucket/dumps/legacy.sql"))
+	require.Nil(t, AddFileToS3(nil, TestDbFile, s3file))
+	mutex.Lock()
+	require.Equal(t, "aws:kms", headers["my-bucket/dumps/legacy.sql"])
+	mutex.Unlock()
+	dir, err := ioutil.TempDir("", "gonymizer-s3")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, GetFileFromS3(nil, s3file, filepath.Join(dir, "legacy.sql")))
+	expected, err := ioutil.ReadFile(TestDbFile)
+	require.Nil(t, err)
+	downloaded, err := ioutil.ReadFile(filepath.Join(dir, "legacy.sql"))
+	require.Nil(t, err)
+	require.Equal(t, expected, downloaded)
+	require.Nil(t, storage.Delete("s3://my-bucket/dumps/legacy.sql"))
+
+	require.Nil(t, storage.Delete("s3://my-bucket/dumps/dump.sql"))
+	_, err = storage.Stat("s3://my-bucket/dumps/dump.sql")
+	require.True(t, os.IsNotExist(err))
+	_, err = storage.Open("s3://my-bucket/dumps/dump.sql")
+	require.True(t, os.IsNotExist(err))
+
+	_, err = storage.Open("s3://my-bucket")
+	require.NotNil(t, err)
+}
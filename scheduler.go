@@ -0,0 +1,235 @@
+package gonymizer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// RunStatusRunning is the status of a scheduled run that has not completed yet
+// RunStatusSkipped is the status of a scheduled run that did not start because another run was in progress
+const (
+	RunStatusRunning = "running"
+	RunStatusSkipped = "skipped"
+)
+
+// defaultSchedulerHistorySize is the number of runs kept in the history when SchedulerOptions.HistorySize is not set.
+const defaultSchedulerHistorySize = 20
+
+// ErrRunInProgress is returned by Scheduler.RunNow when a run is already in progress.
+var ErrRunInProgress = errors.New("a run is already in progress")
+
+// SchedulerOptions configures a Scheduler.
+type SchedulerOptions struct {
+	// HistorySize is the number of recent runs kept in the history. Defaults to 20.
+	HistorySize int
+	// HistoryFile is the local path the history is stored in so it is kept across restarts. The history is only kept
+	// in memory when it is empty.
+	HistoryFile string
+}
+
+// Scheduler runs a job on a cron schedule. Runs never overlap, and a history of recent runs is kept which is exposed
+// over HTTP by Handler.
+type Scheduler struct {
+	spec     string
+	schedule cron.Schedule
+	job      func() error
+	options  SchedulerOptions
+
+	mutex   sync.Mutex
+	running bool
+	next    time.Time
+	history []ScheduledRun
+	wait    sync.WaitGroup
+}
+
+// ScheduledRun is a single run of the scheduled job.
+type ScheduledRun struct {
+	ID              int64     `json:"id"`
+	Trigger         string    `json:"trigger"`
+	Status          string    `json:"status"`
+	StartedAt       time.Time `json:"started_at"`
+	CompletedAt     time.Time `json:"completed_at,omitempty"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// SchedulerStatus is the state of the Scheduler returned by the status endpoint.
+type SchedulerStatus struct {
+	Schedule string         `json:"schedule"`
+	Running  bool           `json:"running"`
+	NextRun  time.Time      `json:"next_run"`
+	Runs     []ScheduledRun `json:"runs"`
+}
+
+// NewScheduler will return a Scheduler that runs the job on the supplied cron schedule (I.E. "0 2 * * *" or @daily).
+// Jobs should return an error wrapping ErrLocked when they are skipped because another process holds their lock.
+func NewScheduler(spec string, job func() error, options SchedulerOptions) (*Scheduler, error) {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, err
+	}
+	if options.HistorySize <= 0 {
+		options.HistorySize = defaultSchedulerHistorySize
+	}
+
+	scheduler := &Scheduler{spec: spec, schedule: schedule, job: job, options: options}
+	if len(options.HistoryFile) > 0 {
+		data, err := ioutil.ReadFile(options.HistoryFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err = json.Unmarshal(data, &scheduler.history); err != nil {
+				return nil, err
+			}
+		}
+		// Runs that were in progress when the previous process stopped did not complete
+		for i := range scheduler.history {
+			if scheduler.history[i].Status == RunStatusRunning {
+				scheduler.history[i].Status = RunStatusFailure
+				scheduler.history[i].Error = "the run was interrupted"
+			}
+		}
+	}
+	return scheduler, nil
+}
+
+// Run will run the job on the schedule until stop is closed. Run returns after the run in progress (if any) completes.
+func (scheduler *Scheduler) Run(stop <-chan struct{}) {
+	defer scheduler.wait.Wait()
+
+	for {
+		next := scheduler.schedule.Next(time.Now())
+		scheduler.mutex.Lock()
+		scheduler.next = next
+		scheduler.mutex.Unlock()
+		log.Info("Next scheduled run at: ", next.Format(time.RFC3339))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		scheduler.wait.Add(1)
+		go func() {
+			defer scheduler.wait.Done()
+			if _, err := scheduler.RunNow("schedule"); errors.Is(err, ErrRunInProgress) {
+				log.Warn("Skipping scheduled run: ", err)
+			}
+		}()
+	}
+}
+
+// RunNow will run the job now and return the run once it completes. The trigger describes what started the run (I.E.
+// schedule). ErrRunInProgress is returned, and the run is recorded as skipped, if a run is already in progress.
+func (scheduler *Scheduler) RunNow(trigger string) (ScheduledRun, error) {
+	scheduler.mutex.Lock()
+	run := ScheduledRun{Trigger: trigger, Status: RunStatusRunning, StartedAt: time.Now().UTC()}
+	if len(scheduler.history) > 0 {
+		run.ID = scheduler.history[len(scheduler.history)-1].ID
+	}
+	run.ID++
+	if scheduler.running {
+		run.Status = RunStatusSkipped
+		run.CompletedAt = run.StartedAt
+		run.Error = ErrRunInProgress.Error()
+		scheduler.addRun(run)
+		scheduler.mutex.Unlock()
+		return run, ErrRunInProgress
+	}
+	scheduler.running = true
+	scheduler.addRun(run)
+	scheduler.mutex.Unlock()
+
+	log.Infof("Starting run %d (%s)", run.ID, trigger)
+	err := scheduler.job()
+
+	run.CompletedAt = time.Now().UTC()
+	run.DurationSeconds = run.CompletedAt.Sub(run.StartedAt).Seconds()
+	switch {
+	case err == nil:
+		run.Status = RunStatusSuccess
+	case errors.Is(err, ErrLocked):
+		run.Status = RunStatusSkipped
+	default:
+		run.Status = RunStatusFailure
+	}
+	if err != nil {
+		run.Error = RedactSecrets(err.Error())
+	}
+	log.Infof("Run %d completed with status: %s", run.ID, run.Status)
+
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	scheduler.running = false
+	scheduler.addRun(run)
+	return run, err
+}
+
+// Status will return the schedule, the time of the next run, and the history of recent runs (newest first).
+func (scheduler *Scheduler) Status() SchedulerStatus {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	status := SchedulerStatus{Schedule: scheduler.spec, Running: scheduler.running, NextRun: scheduler.next}
+	for i := len(scheduler.history) - 1; i >= 0; i-- {
+		status.Runs = append(status.Runs, scheduler.history[i])
+	}
+	return status
+}
+
+// Handler will return an http.Handler that serves the SchedulerStatus as JSON on /status, and responds to health
+// checks on /healthz.
+func (scheduler *Scheduler) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "    ")
+		_ = encoder.Encode(scheduler.Status())
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// addRun will add the run to the history, replacing the entry with the same ID, and store the history in the history
+// file (if any). The caller must hold the mutex.
+func (scheduler *Scheduler) addRun(run ScheduledRun) {
+	replaced := false
+	for i := len(scheduler.history) - 1; i >= 0 && !replaced; i-- {
+		if scheduler.history[i].ID == run.ID {
+			scheduler.history[i] = run
+			replaced = true
+		}
+	}
+	if !replaced {
+		scheduler.history = append(scheduler.history, run)
+	}
+	if len(scheduler.history) > scheduler.options.HistorySize {
+		scheduler.history = scheduler.history[len(scheduler.history)-scheduler.options.HistorySize:]
+	}
+
+	if len(scheduler.options.HistoryFile) == 0 {
+		return
+	}
+	data, err := json.MarshalIndent(scheduler.history, "", "    ")
+	if err == nil {
+		err = ioutil.WriteFile(scheduler.options.HistoryFile, data, 0600)
+	}
+	if err != nil {
+		log.Error("Unable to write the run history: ", err)
+	}
+}
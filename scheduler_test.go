@@ -0,0 +1,120 @@
+package gonymizer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonymizer-scheduler")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	historyFile := filepath.Join(dir, "history.json")
+
+	_, err = NewScheduler("not a schedule", func() error { return nil }, SchedulerOptions{})
+	require.NotNil(t, err)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	results := []error{nil, errors.New("load failed"), fmt.Errorf("run: %w", ErrLocked)}
+	job := func() error {
+		started <- struct{}{}
+		<-release
+		err := results[0]
+		results = results[1:]
+		return err
+	}
+	scheduler, err := NewScheduler("0 2 * * *", job, SchedulerOptions{HistorySize: 3, HistoryFile: historyFile})
+	require.Nil(t, err)
+
+	// Runs never overlap
+	done := make(chan ScheduledRun)
+	go func() {
+		run, _ := scheduler.RunNow("schedule")
+		done <- run
+	}()
+	<-started
+	require.True(t, scheduler.Status().Running)
+	skipped, err := scheduler.RunNow("api")
+	require.Equal(t, ErrRunInProgress, err)
+	require.Equal(t, RunStatusSkipped, skipped.Status)
+	release <- struct{}{}
+	run := <-done
+	require.Equal(t, RunStatusSuccess, run.Status)
+	require.Equal(t, int64(1), run.ID)
+
+	for _, status := range []string{RunStatusFailure, RunStatusSkipped} {
+		go func() {
+			run, _ := scheduler.RunNow("schedule")
+			done <- run
+		}()
+		<-started
+		release <- struct{}{}
+		run = <-done
+		require.Equal(t, status, run.Status)
+	}
+
+	// The history is limited and newest first
+	status := scheduler.Status()
+	require.Equal(t, "0 2 * * *", status.Schedule)
+	require.False(t, status.Running)
+	require.Len(t, status.Runs, 3)
+	require.Equal(t, int64(4), status.Runs[0].ID)
+	require.Equal(t, "load failed", status.Runs[1].Error)
+	require.Equal(t, int64(2), status.Runs[2].ID)
+
+	// The history is kept across restarts
+	restarted, err := NewScheduler("0 2 * * *", job, SchedulerOptions{HistoryFile: historyFile})
+	require.Nil(t, err)
+	require.Equal(t, status.Runs, restarted.Status().Runs)
+
+	recorder := httptest.NewRecorder()
+	scheduler.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/status", nil))
+	require.Equal(t, 200, recorder.Code)
+	var served SchedulerStatus
+	require.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &served))
+	require.Len(t, served.Runs, 3)
+
+	recorder = httptest.NewRecorder()
+	scheduler.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	require.Equal(t, 200, recorder.Code)
+}
+
+func TestSchedulerRun(t *testing.T) {
+	runs := make(chan struct{}, 10)
+	scheduler, err := NewScheduler("@every 50ms", func() error {
+		runs <- struct{}{}
+		return nil
+	}, SchedulerOptions{})
+	require.Nil(t, err)
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		scheduler.Run(stop)
+		close(stopped)
+	}()
+
+	select {
+	case <-runs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job did not run on schedule")
+	}
+	require.False(t, scheduler.Status().NextRun.IsZero())
+
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the scheduler did not stop")
+	}
+}
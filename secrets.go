@@ -0,0 +1,328 @@
+package gonymizer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	log "github.com/sirupsen/logrus"
+)
+
+// SecretProviders is the map of URL schemes to the SecretProvider that resolves references using that scheme. All
+// secret providers must be listed in this map (see: RegisterSecretProvider) to be accessible.
+var SecretProviders = map[string]SecretProvider{}
+
+// secretProvidersMutex protects SecretProviders from concurrent registration.
+var secretProvidersMutex sync.RWMutex
+
+// SecretRef is a parsed secret reference in the form: scheme://path?param=value#key
+type SecretRef struct {
+	Scheme string
+	Path   string
+	Key    string
+	Params url.Values
+}
+
+// SecretProvider is the interface all secret backends must implement to resolve secret references.
+type SecretProvider interface {
+	Resolve(ref SecretRef) (string, error)
+}
+
+// init initializes the SecretProviders map with the providers that do not need any configuration. Providers that
+// need configuration (Vault, AWS Secrets Manager) are registered using their default configuration and can be replaced
+// using RegisterSecretProvider.
+func init() {
+	RegisterSecretProvider("file", FileSecretProvider{})
+	RegisterSecretProvider("env", EnvSecretProvider{})
+	RegisterSecretProvider("vault", NewVaultSecretProvider("", "", ""))
+	RegisterSecretProvider("awssm", NewAWSSecretsManagerProvider(nil))
+}
+
+// RegisterSecretProvider will add the provider to SecretProviders for the supplied URL scheme. A provider that was
+// previously registered for the scheme is replaced.
+func RegisterSecretProvider(scheme string, provider SecretProvider) {
+	secretProvidersMutex.Lock()
+	defer secretProvidersMutex.Unlock()
+	SecretProviders[strings.ToLower(scheme)] = provider
+}
+
+// ParseSecretRef will parse the supplied value into a SecretRef. Ok is false when the value is not a reference to a
+// registered secret provider, in which case the value should be used as-is.
+func ParseSecretRef(value string) (ref SecretRef, ok bool, err error) {
+	schemeEnd := strings.Index(value, "://")
+	if schemeEnd < 1 {
+		return ref, false, nil
+	}
+
+	ref.Scheme = strings.ToLower(value[:schemeEnd])
+	secretProvidersMutex.RLock()
+	_, ok = SecretProviders[ref.Scheme]
+	secretProvidersMutex.RUnlock()
+	if !ok {
+		return ref, false, nil
+	}
+
+	rest := value[schemeEnd+3:]
+	if idx := strings.Index(rest, "#"); idx >= 0 {
+		ref.Key = rest[idx+1:]
+		rest = rest[:idx]
+	}
+	if idx := strings.Index(rest, "?"); idx >= 0 {
+		if ref.Params, err = url.ParseQuery(rest[idx+1:]); err != nil {
+			return ref, true, err
+		}
+		rest = rest[:idx]
+	}
+	if ref.Params == nil {
+		ref.Params = url.Values{}
+	}
+	ref.Path = rest
+
+	if len(ref.Path) == 0 {
+		return ref, true, errors.New("Secret reference is missing a path: " + ref.Scheme + "://")
+	}
+	return ref, true, nil
+}
+
+// ResolveSecret will resolve the supplied value if it references a registered secret provider (I.E.
+// file:///run/secrets/db-password, env://DB_PASSWORD, vault://secret/data/gonymizer#password, or
+// awssm://prod/gonymizer#password). All other values are returned unchanged.
+func ResolveSecret(value string) (string, error) {
+	ref, ok, err := ParseSecretRef(value)
+	if err != nil || !ok {
+		return value, err
+	}
+
+	secretProvidersMutex.RLock()
+	provider := SecretProviders[ref.Scheme]
+	secretProvidersMutex.RUnlock()
+
+	log.Debugf("Resolving secret using the %s provider", ref.Scheme)
+	secret, err := provider.Resolve(ref)
+	if err != nil {
+		log.Errorf("Unable to resolve %s secret: %s", ref.Scheme, ref.Path)
+		return "", err
+	}
+	return secret, nil
+}
+
+// FileSecretProvider resolves file:// references by reading the secret from a file such as a mounted Kubernetes
+// secret. A single trailing newline is removed from the file contents.
+type FileSecretProvider struct{}
+
+// Resolve will read the secret from the file referenced by ref.Path.
+func (FileSecretProvider) Resolve(ref SecretRef) (string, error) {
+	data, err := ioutil.ReadFile(ref.Path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+	return secretKey(secret, ref)
+}
+
+// EnvSecretProvider resolves env:// references using the environment variable named by ref.Path.
+type EnvSecretProvider struct{}
+
+// Resolve will return the value of the environment variable referenced by ref.Path.
+func (EnvSecretProvider) Resolve(ref SecretRef) (string, error) {
+	secret, ok := os.LookupEnv(ref.Path)
+	if !ok {
+		return "", errors.New("Environment variable is not set: " + ref.Path)
+	}
+	return secretKey(secret, ref)
+}
+
+// FakeSecretProvider resolves references using an in-memory map. This is meant for tests and local development only.
+// Secrets are looked up using "path#key" first and "path" second.
+type FakeSecretProvider struct {
+	Secrets map[string]string
+}
+
+// Resolve will return the secret stored in the FakeSecretProvider for the reference.
+func (fake FakeSecretProvider) Resolve(ref SecretRef) (string, error) {
+	if len(ref.Key) > 0 {
+		if secret, ok := fake.Secrets[ref.Path+"#"+ref.Key]; ok {
+			return secret, nil
+		}
+	}
+	if secret, ok := fake.Secrets[ref.Path]; ok {
+		return secretKey(secret, ref)
+	}
+	return "", errors.New("Secret not found: " + ref.Path)
+}
+
+// VaultSecretProvider resolves vault:// references using the HashiCorp Vault HTTP API. Both the KV version 1 and version
+// 2 secret engines are supported. For KV version 2 the path must include the data prefix, I.E.
+// vault://secret/data/gonymizer#password
+type VaultSecretProvider struct {
+	Address   string
+	Token     string
+	Namespace string
+	Client    *http.Client
+}
+
+// NewVaultSecretProvider returns a VaultSecretProvider for the supplied address, token, and namespace. Empty values
+// fall back to the VAULT_ADDR, VAULT_TOKEN, and VAULT_NAMESPACE environment variables when resolving secrets.
+func NewVaultSecretProvider(address, token, namespace string) *VaultSecretProvider {
+	return &VaultSecretProvider{
+		Address:   address,
+		Token:     token,
+		Namespace: namespace,
+		Client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Resolve will read the secret referenced by ref.Path from Vault and return the value of ref.Key.
+func (vault *VaultSecretProvider) Resolve(ref SecretRef) (string, error) {
+	address := firstNonEmpty(vault.Address, os.Getenv("VAULT_ADDR"))
+	token := firstNonEmpty(vault.Token, os.Getenv("VAULT_TOKEN"))
+	namespace := firstNonEmpty(vault.Namespace, os.Getenv("VAULT_NAMESPACE"))
+	if len(address) == 0 {
+		return "", errors.New("Vault address is not set (see VAULT_ADDR)")
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(address, "/")+"/v1/"+strings.TrimPrefix(ref.Path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	if len(token) > 0 {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if len(namespace) > 0 {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	resp, err := vault.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Vault returned status %d for secret: %s", resp.StatusCode, ref.Path)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	// KV version 2 nests the secret under data.data together with the metadata
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok = data["metadata"]; ok {
+			data = nested
+		}
+	}
+	return secretFromMap(data, ref)
+}
+
+// AWSSecretsManagerProvider resolves awssm:// references using AWS Secrets Manager. The secret name (or ARN) is the
+// path of the reference and the region may be supplied using the region parameter, I.E.
+// awssm://prod/gonymizer?region=us-west-2#password
+type AWSSecretsManagerProvider struct {
+	Session *session.Session
+}
+
+// NewAWSSecretsManagerProvider returns an AWSSecretsManagerProvider using the supplied session. If sess is nil a new
+// session is created (using the default AWS credential chain) every time a secret is resolved.
+func NewAWSSecretsManagerProvider(sess *session.Session) *AWSSecretsManagerProvider {
+	return &AWSSecretsManagerProvider{Session: sess}
+}
+
+// Resolve will fetch the secret referenced by ref.Path from AWS Secrets Manager. If ref.Key is set the secret string
+// is parsed as a JSON object and the value of ref.Key is returned.
+func (provider *AWSSecretsManagerProvider) Resolve(ref SecretRef) (string, error) {
+	sess := provider.Session
+	if sess == nil {
+		var err error
+		if sess, err = session.NewSessionWithOptions(session.Options{
+			SharedConfigState: session.SharedConfigEnable,
+		}); err != nil {
+			return "", err
+		}
+	}
+
+	var configs []*aws.Config
+	if region := ref.Params.Get("region"); len(region) > 0 {
+		configs = append(configs, aws.NewConfig().WithRegion(region))
+	}
+	svc := secretsmanager.New(sess, configs...)
+
+	input := &secretsmanager.GetSecretValueInput{SecretId: aws.String(ref.Path)}
+	if versionStage := ref.Params.Get("version-stage"); len(versionStage) > 0 {
+		input.VersionStage = aws.String(versionStage)
+	}
+
+	output, err := svc.GetSecretValue(input)
+	if err != nil {
+		return "", err
+	}
+
+	var secret string
+	if output.SecretString != nil {
+		secret = *output.SecretString
+	} else {
+		secret = string(output.SecretBinary)
+	}
+	return secretKey(secret, ref)
+}
+
+// secretKey will return the secret as-is when the reference does not have a key. Otherwise the secret is parsed as a
+// JSON object and the value of the key is returned.
+func secretKey(secret string, ref SecretRef) (string, error) {
+	if len(ref.Key) == 0 {
+		return secret, nil
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &data); err != nil {
+		return "", fmt.Errorf("Secret '%s' is not a JSON object, unable to read key: %s", ref.Path, ref.Key)
+	}
+	return secretFromMap(data, ref)
+}
+
+// secretFromMap will return the value of ref.Key from the secret data. If no key was supplied the secret must contain
+// exactly one value.
+func secretFromMap(data map[string]interface{}, ref SecretRef) (string, error) {
+	key := ref.Key
+	if len(key) == 0 {
+		if len(data) != 1 {
+			return "", fmt.Errorf("Secret '%s' contains %d values, please supply a #key", ref.Path, len(data))
+		}
+		for k := range data {
+			key = k
+		}
+	}
+
+	value, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("Secret '%s' does not contain key: %s", ref.Path, key)
+	}
+	if str, ok := value.(string); ok {
+		return str, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// firstNonEmpty returns the first non-empty string from the supplied values.
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if len(value) > 0 {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,162 @@
+package gonymizer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSecretRef(t *testing.T) {
+	ref, ok, err := ParseSecretRef("vault://secret/data/gonymizer?version=2#password")
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, "vault", ref.Scheme)
+	require.Equal(t, "secret/data/gonymizer", ref.Path)
+	require.Equal(t, "password", ref.Key)
+	require.Equal(t, "2", ref.Params.Get("version"))
+
+	// Values that are not references to a registered provider are not secrets
+	for _, value := range []string{"password", "s3://bucket/key.sql", "postgres://localhost/db", "://nope"} {
+		_, ok, err = ParseSecretRef(value)
+		require.Nil(t, err)
+		require.False(t, ok, value)
+	}
+
+	_, ok, err = ParseSecretRef("env://")
+	require.True(t, ok)
+	require.NotNil(t, err)
+}
+
+func TestResolveSecret(t *testing.T) {
+	// Non-references are returned as-is
+	secret, err := ResolveSecret("plain-text-password")
+	require.Nil(t, err)
+	require.Equal(t, "plain-text-password", secret)
+
+	// env://
+	require.Nil(t, os.Setenv("GON_TEST_SECRET", `{"password": "env-pass"}`))
+	defer os.Unsetenv("GON_TEST_SECRET")
+	secret, err = ResolveSecret("env://GON_TEST_SECRET")
+	require.Nil(t, err)
+	require.Equal(t, `{"password": "env-pass"}`, secret)
+	secret, err = ResolveSecret("env://GON_TEST_SECRET#password")
+	require.Nil(t, err)
+	require.Equal(t, "env-pass", secret)
+	_, err = ResolveSecret("env://GON_TEST_SECRET#missing")
+	require.NotNil(t, err)
+	_, err = ResolveSecret("env://GON_TEST_SECRET_NOT_SET")
+	require.NotNil(t, err)
+
+	// file://
+	dir, err := ioutil.TempDir("", "gonymizer-secrets")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "db-password")
+	require.Nil(t, ioutil.WriteFile(secretFile, []byte("file-pass\n"), 0600))
+	secret, err = ResolveSecret("file://" + secretFile)
+	require.Nil(t, err)
+	require.Equal(t, "file-pass", secret)
+	_, err = ResolveSecret("file://" + filepath.Join(dir, "missing"))
+	require.NotNil(t, err)
+
+	// fake://
+	RegisterSecretProvider("fake", FakeSecretProvider{Secrets: map[string]string{
+		"db":          `{"user": "admin", "port": 5432}`,
+		"db#password": "fake-pass",
+	}})
+	defer func() {
+		secretProvidersMutex.Lock()
+		delete(SecretProviders, "fake")
+		secretProvidersMutex.Unlock()
+	}()
+	secret, err = ResolveSecret("fake://db#password")
+	require.Nil(t, err)
+	require.Equal(t, "fake-pass", secret)
+	secret, err = ResolveSecret("fake://db#user")
+	require.Nil(t, err)
+	require.Equal(t, "admin", secret)
+	secret, err = ResolveSecret("fake://db#port")
+	require.Nil(t, err)
+	require.Equal(t, "5432", secret)
+	_, err = ResolveSecret("fake://missing")
+	require.NotNil(t, err)
+}
+
+func TestVaultSecretProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/gonymizer":
+			fmt.Fprint(w, `{"data": {"data": {"password": "kv2-pass"}, "metadata": {"version": 1}}}`)
+		case "/v1/kv/gonymizer":
+			fmt.Fprint(w, `{"data": {"password": "kv1-pass", "user": "admin"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	vault := NewVaultSecretProvider(server.URL, "test-token", "")
+	secret, err := vault.Resolve(SecretRef{Path: "secret/data/gonymizer", Key: "password"})
+	require.Nil(t, err)
+	require.Equal(t, "kv2-pass", secret)
+
+	// Secrets with a single value do not need a key
+	secret, err = vault.Resolve(SecretRef{Path: "secret/data/gonymizer"})
+	require.Nil(t, err)
+	require.Equal(t, "kv2-pass", secret)
+
+	secret, err = vault.Resolve(SecretRef{Path: "kv/gonymizer", Key: "user"})
+	require.Nil(t, err)
+	require.Equal(t, "admin", secret)
+
+	_, err = vault.Resolve(SecretRef{Path: "kv/gonymizer"})
+	require.NotNil(t, err)
+	_, err = vault.Resolve(SecretRef{Path: "kv/missing", Key: "password"})
+	require.NotNil(t, err)
+
+	vault.Token = "bad-token"
+	_, err = vault.Resolve(SecretRef{Path: "kv/gonymizer", Key: "user"})
+	require.NotNil(t, err)
+}
+
+func TestAWSSecretsManagerProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if string(body) != `{"SecretId":"prod/gonymizer"}` {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type": "ResourceNotFoundException", "message": "not found"}`)
+			return
+		}
+		fmt.Fprint(w, `{"Name": "prod/gonymizer", "SecretString": "{\"password\": \"aws-pass\"}"}`)
+	}))
+	defer server.Close()
+
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	require.Nil(t, err)
+
+	provider := NewAWSSecretsManagerProvider(sess)
+	secret, err := provider.Resolve(SecretRef{Path: "prod/gonymizer", Key: "password"})
+	require.Nil(t, err)
+	require.Equal(t, "aws-pass", secret)
+
+	_, err = provider.Resolve(SecretRef{Path: "prod/missing"})
+	require.NotNil(t, err)
+}
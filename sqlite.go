@@ -0,0 +1,649 @@
+package gonymizer
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+	_ "modernc.org/sqlite" // make sure we load the driver
+)
+
+// SQLiteDriverName is the database/sql driver name used for SQLite database files.
+const SQLiteDriverName = "sqlite"
+
+// SQLite column type affinities. See: https://www.sqlite.org/datatype3.html
+const (
+	SQLiteTypeInteger = "INTEGER"
+	SQLiteTypeReal    = "REAL"
+	SQLiteTypeNumeric = "NUMERIC"
+	SQLiteTypeText    = "TEXT"
+	SQLiteTypeBlob    = "BLOB"
+)
+
+// sqliteIndexRegex matches CREATE [UNIQUE] INDEX statements in a PostgreSQL dump file.
+// I.E. CREATE UNIQUE INDEX books_isbn_idx ON public.books USING btree (isbn);
+var sqliteIndexRegex = regexp.MustCompile(
+	`(?is)^CREATE\s+(UNIQUE\s+)?INDEX\s+(\S+)\s+ON\s+(?:ONLY\s+)?(\S+)\s+(?:USING\s+btree\s+)?\(([^()]*)\)\s*;$`)
+
+// sqliteConstraintRegex matches PRIMARY KEY and UNIQUE constraints added using ALTER TABLE in a PostgreSQL dump file.
+// I.E. ALTER TABLE ONLY public.authors ADD CONSTRAINT authors_pkey PRIMARY KEY (id);
+var sqliteConstraintRegex = regexp.MustCompile(
+	`(?is)^ALTER\s+TABLE\s+(?:ONLY\s+)?(\S+)\s+ADD\s+CONSTRAINT\s+(\S+)\s+(?:PRIMARY\s+KEY|UNIQUE)\s*\(([^()]*)\)\s*;$`)
+
+// SQLiteColumn is a single column of a PostgreSQL table definition translated to SQLite.
+type SQLiteColumn struct {
+	Name    string
+	PGType  string
+	Type    string
+	NotNull bool
+}
+
+// SQLiteTable is a PostgreSQL table definition translated to SQLite.
+type SQLiteTable struct {
+	Name    string
+	Columns []SQLiteColumn
+}
+
+// sqliteLoader keeps track of the tables that have been created while reading the dump file.
+type sqliteLoader struct {
+	db      *sql.DB
+	tables  map[string]*SQLiteTable
+	indexes []string
+}
+
+// LoadFileToSQLite will load a PostgreSQL dump file into the SQLite database file located at dbPath. Table
+// definitions in the dump file are translated into SQLite tables, COPY blocks are bulk inserted, and primary key,
+// unique, and simple btree indexes are recreated once the data has been loaded. Everything else (functions,
+// sequences, extensions, etc) is skipped. Similar to LoadFile the data is loaded into a temporary database file which is
+// then moved into place to minimize the time the database file is unavailable. The dump file may be a local path or a
+// URL for any registered Storage backend. If the file has a manifest (see: ManifestURL) the file must match it.
+func LoadFileToSQLite(dbPath, filePath string) (err error) {
+	return LoadFileToSQLiteWithOptionsContext(context.Background(), dbPath, filePath, LoadOptions{})
+}
+
+// LoadFileToSQLiteContext is the same as LoadFileToSQLite, but stops when the context is cancelled. The temporary
+// database file is removed if the dump file could not be loaded.
+func LoadFileToSQLiteContext(ctx context.Context, dbPath, filePath string) (err error) {
+	return LoadFileToSQLiteWithOptionsContext(ctx, dbPath, filePath, LoadOptions{})
+}
+
+// LoadFileToSQLiteWithOptions is the same as LoadFileToSQLite, but uses the supplied options. The file is checksummed
+// while it is loaded, and the database file is only moved into place if the file matches its manifest.
+func LoadFileToSQLiteWithOptions(dbPath, filePath string, options LoadOptions) error {
+	return LoadFileToSQLiteWithOptionsContext(context.Background(), dbPath, filePath, options)
+}
+
+// LoadFileToSQLiteWithOptionsContext is the same as LoadFileToSQLiteWithOptions, but stops when the context is
+// cancelled. The temporary database file is removed if the dump file could not be loaded or does not match its
+// manifest.
+func LoadFileToSQLiteWithOptionsContext(ctx context.Context, dbPath, filePath string, options LoadOptions) (err error) {
+	logger := loggerFromContext(ctx)
+	ctx, stopStep := StartStep(ctx, "load-sqlite")
+	defer stopStep()
+
+	tempDbPath := dbPath + ".gonymizer_loading"
+
+	logger.Infof("Checking to see if database file '%s' exists", tempDbPath)
+	if _, err = os.Stat(tempDbPath); err == nil {
+		return fmt.Errorf("Found a previous version of the %s database file. Is there another copy "+
+			"of Gonymizer running?", tempDbPath)
+	}
+
+	verifier, err := newManifestVerifier(filePath, options.Manifest)
+	if err != nil {
+		return err
+	}
+
+	srcFile, err := OpenURL(filePath)
+	if err != nil {
+		logger.Error(err)
+		logger.Debug("filePath: ", RedactSecrets(filePath))
+		return err
+	}
+	defer srcFile.Close()
+
+	logger.Info("Creating database file: ", tempDbPath)
+	db, err := OpenSQLiteDB(tempDbPath)
+	if err != nil {
+		return err
+	}
+
+	loader := &sqliteLoader{db: db, tables: map[string]*SQLiteTable{}}
+
+	logger.Infof("Reloading database file '%s' -> '%s' ", RedactSecrets(filePath), tempDbPath)
+	reader := verifier.Reader(newContextReader(ctx, srcFile))
+	if err = loader.load(bufio.NewReaderSize(reader, streamBufferSize)); err != nil {
+		logger.Errorf("There was an error importing '%s' to: %s", RedactSecrets(filePath), tempDbPath)
+		db.Close()
+		_ = os.Remove(tempDbPath)
+		return err
+	}
+
+	if err = db.Close(); err != nil {
+		_ = os.Remove(tempDbPath)
+		return err
+	}
+	if err = verifier.Verify(); err != nil {
+		_ = os.Remove(tempDbPath)
+		return err
+	}
+
+	logger.Infof("Renaming database file '%s' -> '%s'", tempDbPath, dbPath)
+	return os.Rename(tempDbPath, dbPath)
+}
+
+// OpenSQLiteDB will open (or create) the SQLite database file located at dbPath and return a pointer to the database
+// connection.
+func OpenSQLiteDB(dbPath string) (*sql.DB, error) {
+	db, err := sql.Open(SQLiteDriverName, dbPath)
+	if err != nil {
+		log.Error(err)
+		log.Debug("dbPath: ", dbPath)
+		return nil, err
+	}
+
+	// SQLite only allows a single writer so there is no use in having more connections than that
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// SQLiteTableName will return the SQLite table name for the given PostgreSQL schema and table. SQLite does not support
+// schemas so tables in the public schema keep their name while all other tables are prefixed with their schema name.
+func SQLiteTableName(schemaName, tableName string) string {
+	schemaName = strings.Replace(schemaName, "\"", "", -1)
+	tableName = strings.Replace(tableName, "\"", "", -1)
+
+	if schemaName == "" || schemaName == "public" {
+		return tableName
+	}
+	return schemaName + "_" + tableName
+}
+
+// sqliteColumnTypes maps PostgreSQL data types, without their type modifiers, to SQLite type affinities. Types that are
+// not listed (I.E. text, uuid, timestamps, ranges, and geometric types) are stored as TEXT.
+var sqliteColumnTypes = map[string]string{
+	"smallint":         SQLiteTypeInteger,
+	"integer":          SQLiteTypeInteger,
+	"bigint":           SQLiteTypeInteger,
+	"int":              SQLiteTypeInteger,
+	"int2":             SQLiteTypeInteger,
+	"int4":             SQLiteTypeInteger,
+	"int8":             SQLiteTypeInteger,
+	"smallserial":      SQLiteTypeInteger,
+	"serial":           SQLiteTypeInteger,
+	"bigserial":        SQLiteTypeInteger,
+	"serial2":          SQLiteTypeInteger,
+	"serial4":          SQLiteTypeInteger,
+	"serial8":          SQLiteTypeInteger,
+	"boolean":          SQLiteTypeInteger,
+	"bool":             SQLiteTypeInteger,
+	"numeric":          SQLiteTypeNumeric,
+	"decimal":          SQLiteTypeNumeric,
+	"money":            SQLiteTypeNumeric,
+	"real":             SQLiteTypeReal,
+	"float4":           SQLiteTypeReal,
+	"float8":           SQLiteTypeReal,
+	"float":            SQLiteTypeReal,
+	"double precision": SQLiteTypeReal,
+	"bytea":            SQLiteTypeBlob,
+}
+
+// SQLiteColumnType will translate the supplied PostgreSQL data type into the matching SQLite type affinity.
+func SQLiteColumnType(pgType string) string {
+	pgType = strings.ToLower(strings.TrimSpace(pgType))
+
+	if strings.HasSuffix(pgType, "]") {
+		// Arrays are stored in their text representation
+		return SQLiteTypeText
+	}
+	// Remove type modifiers, I.E. numeric(10,2)
+	if i := strings.Index(pgType, "("); i >= 0 {
+		pgType = strings.TrimSpace(pgType[:i])
+	}
+	if affinity, ok := sqliteColumnTypes[pgType]; ok {
+		return affinity
+	}
+	return SQLiteTypeText
+}
+
+// SQL will return the CREATE TABLE statement for the SQLiteTable.
+func (table *SQLiteTable) SQL() string {
+	columns := make([]string, 0, len(table.Columns))
+	for _, col := range table.Columns {
+		def := fmt.Sprintf("%s %s", quoteSQLiteIdent(col.Name), col.Type)
+		if col.NotNull {
+			def += " NOT NULL"
+		}
+		columns = append(columns, def)
+	}
+	return fmt.Sprintf("CREATE TABLE %s (\n    %s\n);", quoteSQLiteIdent(table.Name), strings.Join(columns, ",\n    "))
+}
+
+// column returns the column with the supplied name from the SQLiteTable or nil if it does not exist.
+func (table *SQLiteTable) column(name string) *SQLiteColumn {
+	name = strings.Replace(name, "\"", "", -1)
+	for i := range table.Columns {
+		if table.Columns[i].Name == name {
+			return &table.Columns[i]
+		}
+	}
+	return nil
+}
+
+// parseSQLiteTable will parse a PostgreSQL CREATE TABLE statement and translate it into a SQLiteTable.
+func parseSQLiteTable(statement string) (*SQLiteTable, error) {
+	openIdx := strings.Index(statement, "(")
+	closeIdx := strings.LastIndex(statement, ")")
+	if openIdx < 0 || closeIdx < openIdx {
+		return nil, errors.New("Unable to parse CREATE TABLE statement: " + statement)
+	}
+
+	// CREATE TABLE [IF NOT EXISTS] schema.table (
+	header := strings.Fields(statement[:openIdx])
+	if len(header) < 3 {
+		return nil, errors.New("Unable to parse CREATE TABLE statement: " + statement)
+	}
+	schemaName, tableName := splitSchemaTable(header[len(header)-1])
+
+	table := &SQLiteTable{Name: SQLiteTableName(schemaName, tableName)}
+	for _, def := range splitTopLevel(statement[openIdx+1 : closeIdx]) {
+		def = strings.TrimSpace(def)
+		if len(def) == 0 {
+			continue
+		}
+
+		// Table level constraints are added as indexes later on (if at all)
+		upperDef := strings.ToUpper(def)
+		if strings.HasPrefix(upperDef, "CONSTRAINT ") || strings.HasPrefix(upperDef, "PRIMARY KEY") ||
+			strings.HasPrefix(upperDef, "UNIQUE") || strings.HasPrefix(upperDef, "CHECK") ||
+			strings.HasPrefix(upperDef, "FOREIGN KEY") || strings.HasPrefix(upperDef, "EXCLUDE") {
+			continue
+		}
+
+		name, rest := splitColumnName(def)
+		pgType := rest
+		upperRest := strings.ToUpper(rest)
+		for _, keyword := range []string{" NOT NULL", " NULL", " DEFAULT ", " COLLATE ", " CONSTRAINT ", " CHECK ",
+			" GENERATED ", " REFERENCES ", " PRIMARY KEY", " UNIQUE"} {
+			if idx := strings.Index(upperRest, keyword); idx >= 0 && idx < len(pgType) {
+				pgType = rest[:idx]
+			}
+		}
+
+		table.Columns = append(table.Columns, SQLiteColumn{
+			Name:    name,
+			PGType:  strings.TrimSpace(pgType),
+			Type:    SQLiteColumnType(pgType),
+			NotNull: strings.Contains(upperRest, "NOT NULL"),
+		})
+	}
+
+	if len(table.Columns) < 1 {
+		return nil, errors.New("Found 0 columns in CREATE TABLE statement: " + statement)
+	}
+	return table, nil
+}
+
+// load reads the dump file and executes all translated statements against the SQLite database.
+func (loader *sqliteLoader) load(reader *bufio.Reader) error {
+	var statement string
+
+	// Bulk loading into a fresh database file does not need a rollback journal
+	for _, pragma := range []string{"PRAGMA journal_mode = OFF", "PRAGMA synchronous = OFF"} {
+		if _, err := loader.db.Exec(pragma); err != nil {
+			return err
+		}
+	}
+
+	state := new(LineState)
+	for {
+		state.LineNum++
+		inputLine, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		allDone := err == io.EOF
+
+		trimmedInput := strings.TrimLeftFunc(inputLine, unicode.IsSpace)
+		switch {
+		case len(statement) > 0:
+			// We are in the middle of a multi-line statement
+			statement += inputLine
+		case strings.HasPrefix(trimmedInput, "--") || len(trimmedInput) == 0:
+			// Skip comments and empty lines
+		case strings.HasPrefix(trimmedInput, StateChangeTokenBeginCopy+" "):
+			state.parseCopyLine(inputLine)
+			if err = loader.copyRows(state, reader); err != nil {
+				return err
+			}
+			state.Clear()
+		case strings.HasPrefix(strings.ToUpper(trimmedInput), "CREATE TABLE "),
+			strings.HasPrefix(strings.ToUpper(trimmedInput), "CREATE INDEX "),
+			strings.HasPrefix(strings.ToUpper(trimmedInput), "CREATE UNIQUE INDEX "),
+			strings.HasPrefix(strings.ToUpper(trimmedInput), "ALTER TABLE "):
+			statement = trimmedInput
+		}
+
+		if len(statement) > 0 && strings.HasSuffix(strings.TrimSpace(statement), ";") {
+			if err = loader.execStatement(strings.TrimSpace(statement)); err != nil {
+				log.Debug("lineNum: ", state.LineNum)
+				return err
+			}
+			statement = ""
+		}
+
+		if allDone {
+			break
+		}
+	}
+
+	// Indexes are created after loading the data since it is much faster than updating them on every insert
+	for _, index := range loader.indexes {
+		log.Debug("Creating index: ", index)
+		if _, err := loader.db.Exec(index); err != nil {
+			log.Error(err)
+			log.Debug("index: ", index)
+			return err
+		}
+	}
+	return nil
+}
+
+// execStatement translates a single CREATE TABLE, CREATE INDEX, or ALTER TABLE statement into SQLite.
+func (loader *sqliteLoader) execStatement(statement string) error {
+	upperStatement := strings.ToUpper(statement)
+
+	if strings.HasPrefix(upperStatement, "CREATE TABLE ") {
+		table, err := parseSQLiteTable(statement)
+		if err != nil {
+			return err
+		}
+		if _, ok := loader.tables[table.Name]; ok {
+			return errors.New("Found duplicate table definition for SQLite table: " + table.Name)
+		}
+
+		log.Debug("Creating table: ", table.Name)
+		if _, err = loader.db.Exec(table.SQL()); err != nil {
+			log.Error(err)
+			log.Debug("statement: ", table.SQL())
+			return err
+		}
+		loader.tables[table.Name] = table
+		return nil
+	}
+
+	var (
+		unique    string
+		indexName string
+		tableName string
+		columns   string
+	)
+	if match := sqliteIndexRegex.FindStringSubmatch(statement); match != nil {
+		unique, indexName, tableName, columns = match[1], match[2], match[3], match[4]
+	} else if match := sqliteConstraintRegex.FindStringSubmatch(statement); match != nil {
+		unique, tableName, indexName, columns = "UNIQUE ", match[1], match[2], match[3]
+	} else {
+		log.Debug("Skipping statement not supported by SQLite: ", statement)
+		return nil
+	}
+
+	table := loader.tables[SQLiteTableName(splitSchemaTable(tableName))]
+	if table == nil {
+		log.Debug("Skipping index for unknown table: ", tableName)
+		return nil
+	}
+
+	quotedColumns := []string{}
+	for _, col := range strings.Split(columns, ",") {
+		column := table.column(strings.TrimSpace(col))
+		if column == nil {
+			// Expression indexes and operator classes are not supported
+			log.Debug("Skipping index using unsupported column expression: ", statement)
+			return nil
+		}
+		quotedColumns = append(quotedColumns, quoteSQLiteIdent(column.Name))
+	}
+
+	_, indexName = splitSchemaTable(indexName)
+	loader.indexes = append(loader.indexes, fmt.Sprintf("CREATE %sINDEX IF NOT EXISTS %s ON %s (%s);",
+		strings.ToUpper(unique),
+		quoteSQLiteIdent(strings.Replace(indexName, "\"", "", -1)),
+		quoteSQLiteIdent(table.Name),
+		strings.Join(quotedColumns, ", "),
+	))
+	return nil
+}
+
+// copyRows will bulk insert all rows of the current COPY block into the matching SQLite table.
+func (loader *sqliteLoader) copyRows(state *LineState, reader *bufio.Reader) error {
+	tableName := SQLiteTableName(state.SchemaName, state.TableName)
+	table := loader.tables[tableName]
+	if table == nil {
+		return fmt.Errorf("Found data for table '%s.%s' without a table definition", state.SchemaName, state.TableName)
+	}
+
+	columns := make([]*SQLiteColumn, 0, len(state.ColumnNames))
+	quotedColumns := make([]string, 0, len(state.ColumnNames))
+	placeholders := make([]string, 0, len(state.ColumnNames))
+	for _, name := range state.ColumnNames {
+		column := table.column(name)
+		if column == nil {
+			return fmt.Errorf("Column '%s' does not exist in table '%s'", name, tableName)
+		}
+		columns = append(columns, column)
+		quotedColumns = append(quotedColumns, quoteSQLiteIdent(column.Name))
+		placeholders = append(placeholders, "?")
+	}
+
+	tx, err := loader.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		quoteSQLiteIdent(tableName),
+		strings.Join(quotedColumns, ", "),
+		strings.Join(placeholders, ", "),
+	))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	rowCount := 0
+	for {
+		state.LineNum++
+		inputLine, err := reader.ReadString('\n')
+		if err == io.EOF {
+			_ = tx.Rollback()
+			return fmt.Errorf("Unexpected end of file while loading data for table: %s", tableName)
+		} else if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		inputLine = strings.TrimSuffix(strings.TrimSuffix(inputLine, "\n"), "\r")
+		if inputLine == StateChangeTokenEndCopy {
+			break
+		}
+
+		rowVals := strings.Split(inputLine, "\t")
+		if len(rowVals) != len(columns) {
+			_ = tx.Rollback()
+			return fmt.Errorf("Expected %d columns, but found %d on line %d for table: %s",
+				len(columns), len(rowVals), state.LineNum, tableName)
+		}
+
+		values := make([]interface{}, len(rowVals))
+		for i, val := range rowVals {
+			if values[i], err = sqliteValue(columns[i], val); err != nil {
+				_ = tx.Rollback()
+				log.Debug("lineNum: ", state.LineNum)
+				log.Debug("column: ", columns[i].Name)
+				return err
+			}
+		}
+
+		if _, err = stmt.Exec(values...); err != nil {
+			_ = tx.Rollback()
+			log.Error(err)
+			log.Debug("lineNum: ", state.LineNum)
+			log.Debug("inputLine: ", inputLine)
+			return err
+		}
+		rowCount++
+	}
+
+	log.Debugf("Loaded %d rows into table: %s", rowCount, tableName)
+	return tx.Commit()
+}
+
+// sqliteValue converts a single value from a COPY block into the value that will be stored in the SQLite column.
+func sqliteValue(column *SQLiteColumn, val string) (interface{}, error) {
+	if val == "\\N" {
+		return nil, nil
+	}
+	val = unescapeCopyValue(val)
+
+	switch {
+	case strings.HasPrefix(strings.ToLower(column.PGType), "bool"):
+		switch strings.ToLower(val) {
+		case "t", "true", "y", "yes", "on", "1":
+			return 1, nil
+		case "f", "false", "n", "no", "off", "0":
+			return 0, nil
+		}
+		return nil, fmt.Errorf("Unable to parse boolean value: %q", val)
+	case column.Type == SQLiteTypeBlob && strings.HasPrefix(val, "\\x"):
+		return hex.DecodeString(val[2:])
+	default:
+		return val, nil
+	}
+}
+
+// unescapeCopyValue will remove the escaping PostgreSQL adds to values in the COPY text format.
+// See: https://www.postgresql.org/docs/current/sql-copy.html#id-1.9.3.55.9.2
+func unescapeCopyValue(val string) string {
+	if !strings.Contains(val, "\\") {
+		return val
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(val); i++ {
+		if val[i] != '\\' || i+1 >= len(val) {
+			b.WriteByte(val[i])
+			continue
+		}
+
+		i++
+		switch c := val[i]; {
+		case c == 'b':
+			b.WriteByte('\b')
+		case c == 'f':
+			b.WriteByte('\f')
+		case c == 'n':
+			b.WriteByte('\n')
+		case c == 'r':
+			b.WriteByte('\r')
+		case c == 't':
+			b.WriteByte('\t')
+		case c == 'v':
+			b.WriteByte('\v')
+		case c >= '0' && c <= '7':
+			// Up to three octal digits
+			octal := int(c - '0')
+			for j := 0; j < 2 && i+1 < len(val) && val[i+1] >= '0' && val[i+1] <= '7'; j++ {
+				i++
+				octal = octal*8 + int(val[i]-'0')
+			}
+			b.WriteByte(byte(octal))
+		case c == 'x' && i+1 < len(val) && isHexDigit(val[i+1]):
+			// Up to two hex digits
+			end := i + 2
+			if end < len(val) && isHexDigit(val[end]) {
+				end++
+			}
+			decoded, _ := strconv.ParseUint(val[i+1:end], 16, 8)
+			b.WriteByte(byte(decoded))
+			i = end - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// isHexDigit returns true if the supplied byte is a hexadecimal digit.
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// quoteSQLiteIdent will quote the identifier so it is safe to use in a SQLite statement.
+func quoteSQLiteIdent(name string) string {
+	return "\"" + strings.Replace(name, "\"", "\"\"", -1) + "\""
+}
+
+// splitSchemaTable splits a (possibly quoted) schema.table name into the schema and table names.
+func splitSchemaTable(name string) (string, string) {
+	split := strings.SplitN(name, ".", 2)
+	if len(split) < 2 {
+		return "", strings.Replace(split[0], "\"", "", -1)
+	}
+	return strings.Replace(split[0], "\"", "", -1), strings.Replace(split[1], "\"", "", -1)
+}
+
+// splitColumnName splits a column definition into the (unquoted) column name and the rest of the definition.
+func splitColumnName(def string) (string, string) {
+	if strings.HasPrefix(def, "\"") {
+		if end := strings.Index(def[1:], "\""); end >= 0 {
+			return def[1 : end+1], strings.TrimSpace(def[end+2:])
+		}
+	}
+
+	split := strings.SplitN(def, " ", 2)
+	if len(split) < 2 {
+		return split[0], ""
+	}
+	return split[0], strings.TrimSpace(split[1])
+}
+
+// splitTopLevel splits the input on commas that are not enclosed in parentheses or quotes.
+func splitTopLevel(input string) []string {
+	var (
+		parts   []string
+		depth   int
+		inQuote byte
+		start   int
+	)
+
+	for i := 0; i < len(input); i++ {
+		c := input[i]
+		switch {
+		case inQuote != 0:
+			if c == inQuote {
+				inQuote = 0
+			}
+		case c == '\'' || c == '"':
+			inQuote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, input[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, input[start:])
+}
@@ -0,0 +1,134 @@
+package gonymizer
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFileToSQLite(t *testing.T) {
+	_ = os.Remove(TestSQLiteFile)
+	require.Nil(t, LoadFileToSQLite(TestSQLiteFile, TestDbFile))
+	defer os.Remove(TestSQLiteFile)
+
+	db, err := OpenSQLiteDB(TestSQLiteFile)
+	require.Nil(t, err)
+	defer db.Close()
+
+	for table, expected := range map[string]int{"authors": 3, "books": 4, "distributors": 3, "purchasers": 4} {
+		var count int
+		require.Nil(t, db.QueryRow("SELECT COUNT(*) FROM "+quoteSQLiteIdent(table)).Scan(&count))
+		require.Equal(t, expected, count, table)
+	}
+
+	// Booleans are stored as integers and NULLs are kept
+	var hasStore int
+	require.Nil(t, db.QueryRow("SELECT has_physical_store FROM distributors WHERE id = 1").Scan(&hasStore))
+	require.Equal(t, 1, hasStore)
+
+	var nullCount int
+	require.Nil(t, db.QueryRow("SELECT COUNT(*) FROM authors WHERE birthdate IS NULL").Scan(&nullCount))
+	require.Equal(t, 1, nullCount)
+
+	// Loading again should replace the existing database file
+	require.Nil(t, LoadFileToSQLite(TestSQLiteFile, TestDbFile))
+}
+
+func TestLoadFileToSQLiteManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonymizer-sqlite")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	options := LoadOptions{Manifest: ManifestOptions{Require: true, Keys: []ed25519.PublicKey{publicKey}}}
+	dbPath := filepath.Join(dir, "test.db")
+
+	// Files without a manifest are refused when a manifest is required
+	processed := filepath.Join(dir, "processed.sql")
+	data, err := ioutil.ReadFile(TestDbFile)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(processed, data, 0600))
+	require.NotNil(t, LoadFileToSQLiteWithOptions(dbPath, processed, options))
+
+	// Files are checksummed while they are loaded
+	manifest := NewManifest("process")
+	manifest.Input = &ManifestFile{URL: TestDbFile}
+	manifest.Output, _, err = HashURL(processed)
+	require.Nil(t, err)
+	require.Nil(t, manifest.Sign(privateKey))
+	require.Nil(t, WriteManifest(processed, manifest))
+	require.Nil(t, LoadFileToSQLiteWithOptions(dbPath, processed, options))
+
+	// Modified files are loaded, but never replace the database file
+	require.Nil(t, os.Remove(dbPath))
+	require.Nil(t, ioutil.WriteFile(processed, append(data, "-- modified\n"...), 0600))
+	err = LoadFileToSQLiteWithOptions(dbPath, processed, options)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "does not match the manifest")
+	_, err = os.Stat(dbPath)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dbPath + ".gonymizer_loading")
+	require.True(t, os.IsNotExist(err))
+
+	// Manifests of dump files are refused before anything is loaded
+	manifest.Command = "dump"
+	require.Nil(t, manifest.Sign(privateKey))
+	require.Nil(t, WriteManifest(processed, manifest))
+	require.NotNil(t, LoadFileToSQLite(dbPath, processed))
+}
+
+func TestSQLiteColumnType(t *testing.T) {
+	fieldsToChecks := []Checker{
+		{Label: "integer", Expected: SQLiteTypeInteger, Candidate: SQLiteColumnType("integer")},
+		{Label: "bigint", Expected: SQLiteTypeInteger, Candidate: SQLiteColumnType("bigint")},
+		{Label: "boolean", Expected: SQLiteTypeInteger, Candidate: SQLiteColumnType("boolean")},
+		{Label: "numeric", Expected: SQLiteTypeNumeric, Candidate: SQLiteColumnType("numeric(10,2)")},
+		{Label: "double", Expected: SQLiteTypeReal, Candidate: SQLiteColumnType("double precision")},
+		{Label: "bytea", Expected: SQLiteTypeBlob, Candidate: SQLiteColumnType("bytea")},
+		{Label: "uuid", Expected: SQLiteTypeText, Candidate: SQLiteColumnType("uuid")},
+		{Label: "array", Expected: SQLiteTypeText, Candidate: SQLiteColumnType("integer[]")},
+		{Label: "timestamp", Expected: SQLiteTypeText, Candidate: SQLiteColumnType("timestamp with time zone")},
+		{Label: "serial", Expected: SQLiteTypeInteger, Candidate: SQLiteColumnType("serial4")},
+		{Label: "float", Expected: SQLiteTypeReal, Candidate: SQLiteColumnType("float(24)")},
+		{Label: "interval", Expected: SQLiteTypeText, Candidate: SQLiteColumnType("interval day")},
+		{Label: "point", Expected: SQLiteTypeText, Candidate: SQLiteColumnType("point")},
+		{Label: "int4range", Expected: SQLiteTypeText, Candidate: SQLiteColumnType("int4range")},
+		{Label: "int8range", Expected: SQLiteTypeText, Candidate: SQLiteColumnType("int8range")},
+	}
+	CheckAll(t, fieldsToChecks)
+}
+
+func TestParseSQLiteTable(t *testing.T) {
+	table, err := parseSQLiteTable(`CREATE TABLE sales."order" (
+    id integer NOT NULL,
+    total numeric(10,2) DEFAULT 0.00,
+    "desc" text,
+    CONSTRAINT order_total_check CHECK ((total >= (0)::numeric))
+);`)
+	require.Nil(t, err)
+	require.Equal(t, "sales_order", table.Name)
+	require.Len(t, table.Columns, 3)
+	require.Equal(t, SQLiteColumn{Name: "id", PGType: "integer", Type: SQLiteTypeInteger, NotNull: true},
+		table.Columns[0])
+	require.Equal(t, SQLiteColumn{Name: "total", PGType: "numeric(10,2)", Type: SQLiteTypeNumeric},
+		table.Columns[1])
+	require.Equal(t, SQLiteColumn{Name: "desc", PGType: "text", Type: SQLiteTypeText}, table.Columns[2])
+}
+
+func TestUnescapeCopyValue(t *testing.T) {
+	fieldsToChecks := []Checker{
+		{Label: "plain", Expected: "abc", Candidate: unescapeCopyValue("abc")},
+		{Label: "tab", Expected: "a\tb", Candidate: unescapeCopyValue("a\\tb")},
+		{Label: "newline", Expected: "a\nb", Candidate: unescapeCopyValue("a\\nb")},
+		{Label: "backslash", Expected: "a\\b", Candidate: unescapeCopyValue("a\\\\b")},
+		{Label: "octal", Expected: "A", Candidate: unescapeCopyValue("\\101")},
+		{Label: "hex", Expected: "A", Candidate: unescapeCopyValue("\\x41")},
+	}
+	CheckAll(t, fieldsToChecks)
+}
@@ -0,0 +1,344 @@
+package gonymizer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// StorageBackends is the map of URL schemes to the Storage backend that handles URLs using that scheme. All storage
+// backends must be listed in this map (see: RegisterStorage) to be accessible. Paths without a scheme use the
+// local file system.
+var StorageBackends = map[string]Storage{}
+
+// storageBackendsMutex protects StorageBackends from concurrent registration.
+var storageBackendsMutex sync.RWMutex
+
+// Storage is the interface all storage backends (local disk, S3, GCS, Azure Blob, SFTP) must implement. Every method
+// takes the full URL of the object, I.E. gs://bucket/path/to/file.sql
+type Storage interface {
+	// Open returns a reader for the object. The reader must be closed by the caller.
+	Open(urlStr string) (io.ReadCloser, error)
+	// Create returns a writer that replaces the object. The object is not complete until the writer is closed.
+	Create(urlStr string) (io.WriteCloser, error)
+	// Stat returns information about the object. If the object does not exist os.IsNotExist(err) is true.
+	Stat(urlStr string) (StorageObject, error)
+	// List returns all objects whose URL starts with the supplied URL.
+	List(urlStr string) ([]StorageObject, error)
+	// Delete removes the object.
+	Delete(urlStr string) error
+}
+
+// StorageObject holds the information about a single object returned by Storage.Stat and Storage.List.
+type StorageObject struct {
+	URL     string
+	Size    int64
+	ModTime time.Time
+}
+
+// init initializes the StorageBackends map with the default configuration for every supported backend. Backends that
+// need configuration can be replaced using RegisterStorage.
+func init() {
+	RegisterStorage("file", LocalStorage{})
+	RegisterStorage("s3", NewS3Storage(nil))
+	RegisterStorage("gs", NewGCSStorage(nil))
+	RegisterStorage("azblob", NewAzureStorage("", ""))
+	RegisterStorage("sftp", NewSFTPStorage("", ""))
+}
+
+// RegisterStorage will add the storage backend to StorageBackends for the supplied URL scheme. A backend that was
+// previously registered for the scheme is replaced.
+func RegisterStorage(scheme string, storage Storage) {
+	storageBackendsMutex.Lock()
+	defer storageBackendsMutex.Unlock()
+	StorageBackends[strings.ToLower(scheme)] = storage
+}
+
+// GetStorage will return the Storage backend for the supplied URL. URLs without a scheme are local file paths.
+func GetStorage(urlStr string) (Storage, error) {
+	scheme := urlScheme(urlStr)
+	if len(scheme) == 0 {
+		scheme = "file"
+	}
+
+	storageBackendsMutex.RLock()
+	defer storageBackendsMutex.RUnlock()
+	storage, ok := StorageBackends[scheme]
+	if !ok {
+		return nil, errors.New("Unsupported storage scheme: " + scheme)
+	}
+	return storage, nil
+}
+
+// IsLocalURL returns true if the supplied URL is a path on the local file system.
+func IsLocalURL(urlStr string) bool {
+	scheme := urlScheme(urlStr)
+	return len(scheme) == 0 || scheme == "file"
+}
+
+// OpenURL will open the object at the supplied URL for reading using the matching Storage backend. Objects encrypted
+// using age or OpenPGP are decrypted using the keys set with SetEncryption.
+func OpenURL(urlStr string) (io.ReadCloser, error) {
+	storage, err := GetStorage(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := storage.Open(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	return GetEncryption().DecryptReader(reader)
+}
+
+// CreateURL will create the object at the supplied URL for writing using the matching Storage backend. If encryption
+// is enabled (see: SetEncryption) the object is encrypted before it is written to the backend.
+func CreateURL(urlStr string) (io.WriteCloser, error) {
+	storage, err := GetStorage(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := storage.Create(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	return GetEncryption().EncryptWriter(writer)
+}
+
+// StatURL will return the StorageObject for the supplied URL using the matching Storage backend.
+func StatURL(urlStr string) (StorageObject, error) {
+	storage, err := GetStorage(urlStr)
+	if err != nil {
+		return StorageObject{}, err
+	}
+	return storage.Stat(urlStr)
+}
+
+// ListURL will return all objects starting with the supplied URL using the matching Storage backend.
+func ListURL(urlStr string) ([]StorageObject, error) {
+	storage, err := GetStorage(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	return storage.List(urlStr)
+}
+
+// DeleteURL will delete the object at the supplied URL using the matching Storage backend.
+func DeleteURL(urlStr string) error {
+	storage, err := GetStorage(urlStr)
+	if err != nil {
+		return err
+	}
+	return storage.Delete(urlStr)
+}
+
+// CopyURL will copy the object at srcURL to dstURL. Either URL may be local or use any registered Storage backend.
+// Encrypted objects are copied as-is, other objects are encrypted if encryption is enabled (see: SetEncryption).
+func CopyURL(dstURL, srcURL string) (err error) {
+	return CopyURLContext(context.Background(), dstURL, srcURL)
+}
+
+// CopyURLContext is the same as CopyURL, but stops when the context is cancelled. An incomplete copy is never kept.
+func CopyURLContext(ctx context.Context, dstURL, srcURL string) (err error) {
+	var dst io.WriteCloser
+
+	log.Debugf("Copying %s => %s", RedactSecrets(srcURL), RedactSecrets(dstURL))
+	span := startSpan(ctx, "copy", attribute.String("copy.source", RedactSecrets(srcURL)),
+		attribute.String("copy.destination", RedactSecrets(dstURL)))
+	defer func() { endSpan(span, err) }()
+
+	srcStorage, err := GetStorage(srcURL)
+	if err != nil {
+		return err
+	}
+	dstStorage, err := GetStorage(dstURL)
+	if err != nil {
+		return err
+	}
+
+	raw, err := srcStorage.Open(srcURL)
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+
+	src := bufio.NewReader(newContextReader(ctx, raw))
+	header, _ := src.Peek(encryptionHeaderSize)
+	if DetectEncryption(header) != EncryptionNone {
+		dst, err = dstStorage.Create(dstURL)
+	} else {
+		dst, err = CreateURL(dstURL)
+	}
+	if err != nil {
+		return err
+	}
+
+	size, err := io.Copy(dst, src)
+	if err != nil {
+		abortWriter(dst, err)
+		if IsLocalURL(dstURL) {
+			removePartialFile(localPath(dstURL))
+		}
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+
+	log.Infof("Copied %.2f GB to: %s", float64(size)/float64(1024*1024*1024), RedactSecrets(dstURL))
+	return nil
+}
+
+// LocalStorage is the Storage backend for the local file system. Both plain paths and file:// URLs are supported.
+type LocalStorage struct{}
+
+// Open will open the local file for reading.
+func (LocalStorage) Open(urlStr string) (io.ReadCloser, error) {
+	return os.Open(localPath(urlStr))
+}
+
+// Create will create (or truncate) the local file for writing. Missing parent directories are created. The file is only
+// accessible by the current user since dumps contain PII.
+func (LocalStorage) Create(urlStr string) (io.WriteCloser, error) {
+	path := localPath(urlStr)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// Existing files keep their mode when they are truncated
+	if err = file.Chmod(0600); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Stat will return the StorageObject for the local file.
+func (LocalStorage) Stat(urlStr string) (StorageObject, error) {
+	fileInfo, err := os.Stat(localPath(urlStr))
+	if err != nil {
+		return StorageObject{}, err
+	}
+	return StorageObject{URL: urlStr, Size: fileInfo.Size(), ModTime: fileInfo.ModTime()}, nil
+}
+
+// List will return all files whose path starts with the supplied path. Directories are searched recursively.
+func (LocalStorage) List(urlStr string) ([]StorageObject, error) {
+	var objects []StorageObject
+
+	prefix := filepath.Clean(localPath(urlStr))
+	root := prefix
+	if fileInfo, err := os.Stat(prefix); err != nil || !fileInfo.IsDir() {
+		root = filepath.Dir(prefix)
+	}
+
+	err := filepath.Walk(root, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileInfo.IsDir() || !strings.HasPrefix(path, prefix) {
+			return nil
+		}
+		objectURL := path
+		if urlScheme(urlStr) == "file" {
+			objectURL = "file://" + path
+		}
+		objects = append(objects, StorageObject{URL: objectURL, Size: fileInfo.Size(), ModTime: fileInfo.ModTime()})
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return objects, err
+}
+
+// Delete will remove the local file.
+func (LocalStorage) Delete(urlStr string) error {
+	return os.Remove(localPath(urlStr))
+}
+
+// localPath returns the file system path for a plain path or file:// URL.
+func localPath(urlStr string) string {
+	if urlScheme(urlStr) == "file" {
+		if u, err := url.Parse(urlStr); err == nil {
+			return u.Path
+		}
+	}
+	return urlStr
+}
+
+// urlScheme returns the lower case scheme of the URL or an empty string for plain paths.
+func urlScheme(urlStr string) string {
+	idx := strings.Index(urlStr, "://")
+	if idx < 1 {
+		return ""
+	}
+	return strings.ToLower(urlStr[:idx])
+}
+
+// notExistError returns an error for the URL that satisfies os.IsNotExist.
+func notExistError(op, urlStr string) error {
+	return &os.PathError{Op: op, Path: urlStr, Err: os.ErrNotExist}
+}
+
+// pipeUploader is an io.WriteCloser that streams everything written to it to an upload function running in a separate
+// goroutine. Close waits for the upload to complete and returns its error.
+type pipeUploader struct {
+	writer *io.PipeWriter
+	done   chan error
+}
+
+// newPipeUploader starts the upload function and returns the writer feeding it.
+func newPipeUploader(upload func(reader io.Reader) error) *pipeUploader {
+	reader, writer := io.Pipe()
+	uploader := &pipeUploader{writer: writer, done: make(chan error, 1)}
+	go func() {
+		err := upload(reader)
+		// Unblock the writer if the upload stopped before reading everything
+		_ = reader.CloseWithError(err)
+		uploader.done <- err
+	}()
+	return uploader
+}
+
+// Write will send p to the upload.
+func (uploader *pipeUploader) Write(p []byte) (int, error) {
+	return uploader.writer.Write(p)
+}
+
+// Close will signal the end of the data and wait for the upload to finish.
+func (uploader *pipeUploader) Close() error {
+	if err := uploader.writer.Close(); err != nil {
+		return err
+	}
+	return <-uploader.done
+}
+
+// CloseWithError will abort the upload so that an incomplete object is never stored.
+func (uploader *pipeUploader) CloseWithError(err error) error {
+	_ = uploader.writer.CloseWithError(err)
+	<-uploader.done
+	return nil
+}
+
+// abortWriter will close the writer after a failure. Writers that support aborting (I.E. uploads) are aborted so the
+// incomplete object is discarded.
+func abortWriter(writer io.WriteCloser, err error) {
+	if aborter, ok := writer.(interface{ CloseWithError(error) error }); ok {
+		_ = aborter.CloseWithError(err)
+		return
+	}
+	_ = writer.Close()
+}
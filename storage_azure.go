@@ -0,0 +1,177 @@
+package gonymizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// AzureStorage is the Storage backend for Azure Blob Storage URLs in the form: azblob://<container>/<path>
+type AzureStorage struct {
+	AccountName string
+	AccountKey  string
+}
+
+// NewAzureStorage returns an AzureStorage for the supplied storage account. Empty values fall back to the
+// AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_KEY environment variables. If no key is available the AZURE_STORAGE_SAS_TOKEN
+// environment variable is used instead.
+func NewAzureStorage(accountName, accountKey string) *AzureStorage {
+	return &AzureStorage{AccountName: accountName, AccountKey: accountKey}
+}
+
+// Open will return a reader streaming the blob.
+func (azure *AzureStorage) Open(urlStr string) (io.ReadCloser, error) {
+	blobURL, err := azure.blobURL(urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	response, err := blobURL.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return nil, azureError("open", urlStr, err)
+	}
+	return response.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3}), nil
+}
+
+// Create will return a writer that uploads everything written to it to the blob as a block blob.
+func (azure *AzureStorage) Create(urlStr string) (io.WriteCloser, error) {
+	blobURL, err := azure.blobURL(urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPipeUploader(func(reader io.Reader) error {
+		_, err := azblob.UploadStreamToBlockBlob(context.Background(), reader, blobURL,
+			azblob.UploadStreamToBlockBlobOptions{
+				BlobHTTPHeaders: azblob.BlobHTTPHeaders{ContentType: "text/plain"},
+			})
+		return err
+	}), nil
+}
+
+// Stat will return the StorageObject for the blob.
+func (azure *AzureStorage) Stat(urlStr string) (StorageObject, error) {
+	blobURL, err := azure.blobURL(urlStr)
+	if err != nil {
+		return StorageObject{}, err
+	}
+
+	properties, err := blobURL.GetProperties(context.Background(), azblob.BlobAccessConditions{})
+	if err != nil {
+		return StorageObject{}, azureError("stat", urlStr, err)
+	}
+	return StorageObject{URL: urlStr, Size: properties.ContentLength(), ModTime: properties.LastModified()}, nil
+}
+
+// List will return all blobs whose name starts with the path of the URL.
+func (azure *AzureStorage) List(urlStr string) ([]StorageObject, error) {
+	var objects []StorageObject
+
+	container, prefix, err := parseBucketURL(urlStr, "azblob")
+	if err != nil {
+		return nil, err
+	}
+	containerURL, err := azure.containerURL(container)
+	if err != nil {
+		return nil, err
+	}
+
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		response, err := containerURL.ListBlobsFlatSegment(context.Background(), marker,
+			azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			return nil, azureError("list", urlStr, err)
+		}
+		for _, blob := range response.Segment.BlobItems {
+			object := StorageObject{URL: "azblob://" + container + "/" + blob.Name, ModTime: blob.Properties.LastModified}
+			if blob.Properties.ContentLength != nil {
+				object.Size = *blob.Properties.ContentLength
+			}
+			objects = append(objects, object)
+		}
+		marker = response.NextMarker
+	}
+	return objects, nil
+}
+
+// Delete will remove the blob and its snapshots.
+func (azure *AzureStorage) Delete(urlStr string) error {
+	blobURL, err := azure.blobURL(urlStr)
+	if err != nil {
+		return err
+	}
+
+	_, err = blobURL.Delete(context.Background(), azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+	if err != nil {
+		return azureError("delete", urlStr, err)
+	}
+	return nil
+}
+
+// containerURL returns the azblob.ContainerURL for the container using the configured credentials.
+func (azure *AzureStorage) containerURL(container string) (azblob.ContainerURL, error) {
+	accountName := firstNonEmpty(azure.AccountName, os.Getenv("AZURE_STORAGE_ACCOUNT"))
+	accountKey := firstNonEmpty(azure.AccountKey, os.Getenv("AZURE_STORAGE_KEY"))
+	if len(accountName) == 0 {
+		return azblob.ContainerURL{}, errors.New("Azure storage account is not set (see AZURE_STORAGE_ACCOUNT)")
+	}
+
+	var (
+		credential azblob.Credential = azblob.NewAnonymousCredential()
+		query      string
+	)
+	if len(accountKey) > 0 {
+		sharedKey, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+		if err != nil {
+			return azblob.ContainerURL{}, err
+		}
+		credential = sharedKey
+	} else {
+		query = strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?")
+	}
+
+	u, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", accountName, container))
+	if err != nil {
+		return azblob.ContainerURL{}, err
+	}
+	u.RawQuery = query
+	return azblob.NewContainerURL(*u, azblob.NewPipeline(credential, azblob.PipelineOptions{})), nil
+}
+
+// blobURL returns the azblob.BlockBlobURL for the azblob:// URL.
+func (azure *AzureStorage) blobURL(urlStr string) (azblob.BlockBlobURL, error) {
+	container, name, err := parseBucketURL(urlStr, "azblob")
+	if err != nil {
+		return azblob.BlockBlobURL{}, err
+	}
+	if len(name) == 0 {
+		return azblob.BlockBlobURL{}, errors.New("Azure URL is missing the blob name: " + urlStr)
+	}
+
+	containerURL, err := azure.containerURL(container)
+	if err != nil {
+		return azblob.BlockBlobURL{}, err
+	}
+	return containerURL.NewBlockBlobURL(name), nil
+}
+
+// azureError will convert Azure not found errors into errors that satisfy os.IsNotExist.
+func azureError(op, urlStr string, err error) error {
+	if storageErr, ok := err.(azblob.StorageError); ok {
+		switch storageErr.ServiceCode() {
+		case azblob.ServiceCodeBlobNotFound, azblob.ServiceCodeContainerNotFound:
+			return notExistError(op, urlStr)
+		}
+		if storageErr.Response() != nil && storageErr.Response().StatusCode == 404 {
+			return notExistError(op, urlStr)
+		}
+	}
+	return err
+}
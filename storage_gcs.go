@@ -0,0 +1,177 @@
+package gonymizer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// GCSStorage is the Storage backend for Google Cloud Storage URLs in the form: gs://<bucket>/<path>
+type GCSStorage struct {
+	Client *storage.Client
+
+	clientOnce sync.Once
+	clientErr  error
+}
+
+// NewGCSStorage returns a GCSStorage using the supplied client. If client is nil a client using the application
+// default credentials is created the first time it is needed.
+func NewGCSStorage(client *storage.Client) *GCSStorage {
+	return &GCSStorage{Client: client}
+}
+
+// Open will return a reader streaming the GCS object.
+func (gcs *GCSStorage) Open(urlStr string) (io.ReadCloser, error) {
+	object, err := gcs.object(urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := object.NewReader(context.Background())
+	if err != nil {
+		return nil, gcsError("open", urlStr, err)
+	}
+	return reader, nil
+}
+
+// Create will return a writer that uploads everything written to it to the GCS object.
+func (gcs *GCSStorage) Create(urlStr string) (io.WriteCloser, error) {
+	object, err := gcs.object(urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := object.NewWriter(ctx)
+	writer.ContentType = "text/plain"
+	return &gcsWriter{Writer: writer, cancel: cancel}, nil
+}
+
+// Stat will return the StorageObject for the GCS object.
+func (gcs *GCSStorage) Stat(urlStr string) (StorageObject, error) {
+	object, err := gcs.object(urlStr)
+	if err != nil {
+		return StorageObject{}, err
+	}
+
+	attrs, err := object.Attrs(context.Background())
+	if err != nil {
+		return StorageObject{}, gcsError("stat", urlStr, err)
+	}
+	return StorageObject{URL: urlStr, Size: attrs.Size, ModTime: attrs.Updated}, nil
+}
+
+// List will return all GCS objects whose name starts with the path of the URL.
+func (gcs *GCSStorage) List(urlStr string) ([]StorageObject, error) {
+	var objects []StorageObject
+
+	bucket, prefix, err := parseBucketURL(urlStr, "gs")
+	if err != nil {
+		return nil, err
+	}
+	client, err := gcs.client()
+	if err != nil {
+		return nil, err
+	}
+
+	it := client.Bucket(bucket).Objects(context.Background(), &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		objects = append(objects, StorageObject{
+			URL:     "gs://" + bucket + "/" + attrs.Name,
+			Size:    attrs.Size,
+			ModTime: attrs.Updated,
+		})
+	}
+	return objects, nil
+}
+
+// Delete will remove the GCS object.
+func (gcs *GCSStorage) Delete(urlStr string) error {
+	object, err := gcs.object(urlStr)
+	if err != nil {
+		return err
+	}
+
+	if err = object.Delete(context.Background()); err != nil {
+		return gcsError("delete", urlStr, err)
+	}
+	return nil
+}
+
+// client returns the storage client, creating it the first time it is needed.
+func (gcs *GCSStorage) client() (*storage.Client, error) {
+	gcs.clientOnce.Do(func() {
+		if gcs.Client == nil {
+			gcs.Client, gcs.clientErr = storage.NewClient(context.Background())
+		}
+	})
+	return gcs.Client, gcs.clientErr
+}
+
+// object returns the object handle for the GCS URL.
+func (gcs *GCSStorage) object(urlStr string) (*storage.ObjectHandle, error) {
+	bucket, name, err := parseBucketURL(urlStr, "gs")
+	if err != nil {
+		return nil, err
+	}
+	if len(name) == 0 {
+		return nil, errors.New("GCS URL is missing the object name: " + urlStr)
+	}
+
+	client, err := gcs.client()
+	if err != nil {
+		return nil, err
+	}
+	return client.Bucket(bucket).Object(name), nil
+}
+
+// gcsWriter is a storage.Writer that can be aborted so an incomplete object is never stored.
+type gcsWriter struct {
+	*storage.Writer
+	cancel context.CancelFunc
+}
+
+// Close will finish the upload.
+func (writer *gcsWriter) Close() error {
+	defer writer.cancel()
+	return writer.Writer.Close()
+}
+
+// CloseWithError will abort the upload.
+func (writer *gcsWriter) CloseWithError(err error) error {
+	writer.cancel()
+	_ = writer.Writer.Close()
+	return nil
+}
+
+// gcsError will convert GCS not found errors into errors that satisfy os.IsNotExist.
+func gcsError(op, urlStr string, err error) error {
+	if err == storage.ErrObjectNotExist || err == storage.ErrBucketNotExist {
+		return notExistError(op, urlStr)
+	}
+	return err
+}
+
+// parseBucketURL will split a <scheme>://<bucket>/<path> URL into the bucket and path.
+func parseBucketURL(urlStr, scheme string) (bucket, path string, err error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != scheme || len(u.Host) == 0 {
+		return "", "", errors.New("Unable to parse " + scheme + " URL: " + urlStr)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
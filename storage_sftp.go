@@ -0,0 +1,263 @@
+package gonymizer
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultSFTPPort is the port used when the SFTP URL does not include one.
+const defaultSFTPPort = "22"
+
+// SFTPStorage is the Storage backend for SFTP URLs in the form: sftp://<user>@<host>:<port>/<path>
+// Authentication uses the password in the URL (if any), the SSH agent (SSH_AUTH_SOCK), and the private key file in that
+// order. The server's host key must be present in the known hosts file.
+type SFTPStorage struct {
+	KeyFile        string
+	KnownHostsFile string
+}
+
+// NewSFTPStorage returns an SFTPStorage using the supplied private key and known hosts files. Empty values fall back to
+// ~/.ssh/id_ed25519 or ~/.ssh/id_rsa and ~/.ssh/known_hosts.
+func NewSFTPStorage(keyFile, knownHostsFile string) *SFTPStorage {
+	return &SFTPStorage{KeyFile: keyFile, KnownHostsFile: knownHostsFile}
+}
+
+// Open will return a reader for the remote file. The SFTP connection is closed when the reader is closed.
+func (storage *SFTPStorage) Open(urlStr string) (io.ReadCloser, error) {
+	client, filePath, err := storage.connect(urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := client.Open(filePath)
+	if err != nil {
+		client.Close()
+		return nil, sftpError("open", urlStr, err)
+	}
+	return &sftpFile{File: file, client: client}, nil
+}
+
+// Create will return a writer for the remote file. Missing parent directories are created. The SFTP connection is
+// closed when the writer is closed.
+func (storage *SFTPStorage) Create(urlStr string) (io.WriteCloser, error) {
+	client, filePath, err := storage.connect(urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = client.MkdirAll(path.Dir(filePath)); err != nil {
+		client.Close()
+		return nil, err
+	}
+	file, err := client.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &sftpFile{File: file, client: client}, nil
+}
+
+// Stat will return the StorageObject for the remote file.
+func (storage *SFTPStorage) Stat(urlStr string) (StorageObject, error) {
+	client, filePath, err := storage.connect(urlStr)
+	if err != nil {
+		return StorageObject{}, err
+	}
+	defer client.Close()
+
+	fileInfo, err := client.Stat(filePath)
+	if err != nil {
+		return StorageObject{}, sftpError("stat", urlStr, err)
+	}
+	return StorageObject{URL: urlStr, Size: fileInfo.Size(), ModTime: fileInfo.ModTime()}, nil
+}
+
+// List will return all remote files whose path starts with the path of the URL. Directories are searched recursively.
+func (storage *SFTPStorage) List(urlStr string) ([]StorageObject, error) {
+	var objects []StorageObject
+
+	client, prefix, err := storage.connect(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	root := prefix
+	if fileInfo, err := client.Stat(prefix); err != nil || !fileInfo.IsDir() {
+		root = path.Dir(prefix)
+	}
+
+	u, _ := url.Parse(urlStr)
+	walker := client.Walk(root)
+	for walker.Step() {
+		if err = walker.Err(); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if walker.Stat().IsDir() || !strings.HasPrefix(walker.Path(), prefix) {
+			continue
+		}
+
+		objectURL := *u
+		objectURL.Path = walker.Path()
+		objects = append(objects, StorageObject{
+			URL:     objectURL.String(),
+			Size:    walker.Stat().Size(),
+			ModTime: walker.Stat().ModTime(),
+		})
+	}
+	return objects, nil
+}
+
+// Delete will remove the remote file.
+func (storage *SFTPStorage) Delete(urlStr string) error {
+	client, filePath, err := storage.connect(urlStr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err = client.Remove(filePath); err != nil {
+		return sftpError("delete", urlStr, err)
+	}
+	return nil
+}
+
+// connect will open an SFTP connection to the server in the URL and return the client and the remote file path.
+func (storage *SFTPStorage) connect(urlStr string) (*sftpClient, string, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Scheme != "sftp" || len(u.Hostname()) == 0 || len(u.Path) == 0 {
+		return nil, "", errors.New("Unable to parse SFTP URL: " + RedactSecrets(urlStr))
+	}
+
+	home, _ := os.UserHomeDir()
+	knownHostsFile := firstNonEmpty(storage.KnownHostsFile, filepath.Join(home, ".ssh", "known_hosts"))
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		log.Error("Unable to load SSH known hosts file: ", knownHostsFile)
+		return nil, "", err
+	}
+
+	username := u.User.Username()
+	if len(username) == 0 {
+		if username = os.Getenv("USER"); len(username) == 0 {
+			return nil, "", errors.New("SFTP URL is missing the username: " + RedactSecrets(urlStr))
+		}
+	}
+
+	config := &ssh.ClientConfig{
+		User:            username,
+		Auth:            storage.authMethods(u, home),
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}
+
+	port := u.Port()
+	if len(port) == 0 {
+		port = defaultSFTPPort
+	}
+	conn, err := ssh.Dial("tcp", net.JoinHostPort(u.Hostname(), port), config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	return &sftpClient{Client: client, conn: conn}, u.Path, nil
+}
+
+// authMethods returns the SSH authentication methods to try for the URL.
+func (storage *SFTPStorage) authMethods(u *url.URL, home string) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+
+	if password, ok := u.User.Password(); ok {
+		methods = append(methods, ssh.Password(password))
+	}
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); len(socket) > 0 {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		} else {
+			log.Debug("Unable to connect to SSH agent: ", err)
+		}
+	}
+
+	keyFiles := []string{storage.KeyFile}
+	if len(storage.KeyFile) == 0 {
+		keyFiles = []string{filepath.Join(home, ".ssh", "id_ed25519"), filepath.Join(home, ".ssh", "id_rsa")}
+	}
+	for _, keyFile := range keyFiles {
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			log.Warnf("Unable to parse SSH private key '%s': %s", keyFile, err)
+			continue
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+		break
+	}
+	return methods
+}
+
+// sftpClient is an sftp.Client that also closes the underlying SSH connection.
+type sftpClient struct {
+	*sftp.Client
+	conn *ssh.Client
+}
+
+// Close will close the SFTP session and the SSH connection.
+func (client *sftpClient) Close() error {
+	err := client.Client.Close()
+	if connErr := client.conn.Close(); err == nil {
+		err = connErr
+	}
+	return err
+}
+
+// sftpFile is an sftp.File that closes the SFTP connection when the file is closed.
+type sftpFile struct {
+	*sftp.File
+	client *sftpClient
+}
+
+// Close will close the remote file and the SFTP connection.
+func (file *sftpFile) Close() error {
+	err := file.File.Close()
+	if clientErr := file.client.Close(); err == nil {
+		err = clientErr
+	}
+	return err
+}
+
+// sftpError will convert SFTP not found errors into errors that satisfy os.IsNotExist.
+func sftpError(op, urlStr string, err error) error {
+	if os.IsNotExist(err) {
+		return notExistError(op, RedactSecrets(urlStr))
+	}
+	return err
+}
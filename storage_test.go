@@ -0,0 +1,111 @@
+package gonymizer
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetStorage(t *testing.T) {
+	for urlStr, expected := range map[string]Storage{
+		"testing/test_db.sql":                             StorageBackends["file"],
+		"file:///tmp/test.sql":                            StorageBackends["file"],
+		"s3://bucket.s3.us-west-2.amazonaws.com/test.sql": StorageBackends["s3"],
+		"GS://bucket/test.sql":                            StorageBackends["gs"],
+		"azblob://container/test.sql":                     StorageBackends["azblob"],
+		"sftp://user@host/test.sql":                       StorageBackends["sftp"],
+	} {
+		storage, err := GetStorage(urlStr)
+		require.Nil(t, err)
+		require.Equal(t, expected, storage, urlStr)
+	}
+
+	_, err := GetStorage("ftp://host/test.sql")
+	require.NotNil(t, err)
+
+	require.True(t, IsLocalURL("testing/test_db.sql"))
+	require.True(t, IsLocalURL("file:///tmp/test.sql"))
+	require.False(t, IsLocalURL("gs://bucket/test.sql"))
+}
+
+func TestLocalStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonymizer-storage")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Copy the test database into a directory that does not exist yet
+	dst := filepath.Join(dir, "nested", "output.sql")
+	require.Nil(t, CopyURL(dst, TestDbFile))
+
+	srcInfo, err := os.Stat(TestDbFile)
+	require.Nil(t, err)
+	object, err := StatURL("file://" + dst)
+	require.Nil(t, err)
+	require.Equal(t, srcInfo.Size(), object.Size)
+	dstInfo, err := os.Stat(dst)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), dstInfo.Mode().Perm())
+
+	// Copy back using a file:// URL
+	require.Nil(t, CopyURL("file://"+filepath.Join(dir, "nested", "output2.sql"), dst))
+
+	objects, err := ListURL(filepath.Join(dir, "nested", "output"))
+	require.Nil(t, err)
+	require.Len(t, objects, 2)
+	objects, err = ListURL(dir)
+	require.Nil(t, err)
+	require.Len(t, objects, 2)
+	objects, err = ListURL(filepath.Join(dir, "missing", "output"))
+	require.Nil(t, err)
+	require.Len(t, objects, 0)
+
+	require.Nil(t, DeleteURL(dst))
+	_, err = StatURL(dst)
+	require.True(t, os.IsNotExist(err))
+	require.NotNil(t, CopyURL(filepath.Join(dir, "output.sql"), dst))
+}
+
+func TestPipeUploader(t *testing.T) {
+	var uploaded []byte
+
+	uploader := newPipeUploader(func(reader io.Reader) (err error) {
+		uploaded, err = ioutil.ReadAll(reader)
+		return err
+	})
+	_, err := uploader.Write([]byte("COPY public.test (id) FROM stdin;\n"))
+	require.Nil(t, err)
+	require.Nil(t, uploader.Close())
+	require.Equal(t, "COPY public.test (id) FROM stdin;\n", string(uploaded))
+
+	// Aborting must surface the error to the upload so it is not stored
+	var uploadErr error
+	uploader = newPipeUploader(func(reader io.Reader) (err error) {
+		_, uploadErr = ioutil.ReadAll(reader)
+		return uploadErr
+	})
+	abortWriter(uploader, errors.New("read failed"))
+	require.EqualError(t, uploadErr, "read failed")
+
+	// Failed uploads are returned when closing
+	uploader = newPipeUploader(func(reader io.Reader) error {
+		return errors.New("upload failed")
+	})
+	require.EqualError(t, uploader.Close(), "upload failed")
+}
+
+func TestParseBucketURL(t *testing.T) {
+	bucket, path, err := parseBucketURL("gs://my-bucket/path/to/dump.sql", "gs")
+	require.Nil(t, err)
+	require.Equal(t, "my-bucket", bucket)
+	require.Equal(t, "path/to/dump.sql", path)
+
+	_, _, err = parseBucketURL("gs:///path/to/dump.sql", "gs")
+	require.NotNil(t, err)
+	_, _, err = parseBucketURL("azblob://container/path", "gs")
+	require.NotNil(t, err)
+}
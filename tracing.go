@@ -0,0 +1,172 @@
+package gonymizer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingExporterNone disables tracing
+// TracingExporterOTLP exports spans to an OpenTelemetry collector using OTLP over HTTP
+// TracingExporterFile writes spans as JSON to a local file
+const (
+	TracingExporterNone = ""
+	TracingExporterOTLP = "otlp"
+	TracingExporterFile = "file"
+)
+
+// tracerName is the name of the OpenTelemetry tracer used for all Gonymizer spans.
+const tracerName = "github.com/rkuska/gonymizer"
+
+// TracingConfig configures where the OpenTelemetry spans are exported to. See StartTracing.
+type TracingConfig struct {
+	// Exporter is one of: TracingExporterNone, TracingExporterOTLP, TracingExporterFile.
+	Exporter string
+	// Endpoint is the host:port of the OTLP collector. The OTEL_EXPORTER_OTLP_* environment variables are used when
+	// it is empty.
+	Endpoint string
+	// Insecure disables TLS when connecting to the OTLP collector.
+	Insecure bool
+	// File is the path spans are written to when using TracingExporterFile.
+	File string
+	// ServiceName is the service.name of the spans. Defaults to gonymizer.
+	ServiceName string
+}
+
+// traceLogHook is a logrus hook that adds the trace and span ID of the span in the context of the log entry (see:
+// logrus.WithContext) to the log line.
+type traceLogHook struct{}
+
+// StartTracing will export the spans of every phase (dump, process, upload, load, ...) using the configured exporter
+// and add the trace and span IDs to log lines that have a context. The returned function flushes all spans and must
+// be called before the application exits.
+func StartTracing(config TracingConfig) (func() error, error) {
+	var (
+		exporter sdktrace.SpanExporter
+		file     *os.File
+		err      error
+	)
+
+	switch strings.ToLower(config.Exporter) {
+	case TracingExporterNone:
+		return func() error { return nil }, nil
+	case TracingExporterOTLP:
+		var options []otlptracehttp.Option
+		if len(config.Endpoint) > 0 {
+			options = append(options, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	case TracingExporterFile:
+		if len(config.File) == 0 {
+			return nil, fmt.Errorf("a file is required for the %s tracing exporter", TracingExporterFile)
+		}
+		if file, err = os.Create(config.File); err != nil {
+			return nil, err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter '%s', must be one of: %s, %s", config.Exporter,
+			TracingExporterOTLP, TracingExporterFile)
+	}
+	if err != nil {
+		if file != nil {
+			_ = file.Close()
+		}
+		return nil, err
+	}
+
+	serviceName := config.ServiceName
+	if len(serviceName) == 0 {
+		serviceName = "gonymizer"
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName),
+			semconv.ServiceVersionKey.String(Version()),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	log.AddHook(traceLogHook{})
+
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}, nil
+}
+
+// StartSpan will start a span that is a child of the span in the context, if any. Spans started using the returned
+// context are children of the new span. The returned function ends the span and records the error (if any).
+func StartSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, func(err error)) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+	return ctx, func(err error) {
+		endSpan(span, err)
+	}
+}
+
+// traceFunc will run fn in a span that is a child of the span in the context and return the error of fn.
+func traceFunc(ctx context.Context, name string, fn func(ctx context.Context) error,
+	attributes ...attribute.KeyValue) error {
+	ctx, end := StartSpan(ctx, name, attributes...)
+	err := fn(ctx)
+	end(err)
+	return err
+}
+
+// startSpan will start a span that is a child of the span in the context, if any.
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) trace.Span {
+	_, span := otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+	return span
+}
+
+// endSpan will record the error (if any) and end the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, RedactSecrets(err.Error()))
+	}
+	span.End()
+}
+
+// Levels will return the log levels the hook is fired for.
+func (traceLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire will add the trace and span ID of the span in the context of the entry to the log entry.
+func (traceLogHook) Fire(entry *log.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+
+	spanContext := trace.SpanContextFromContext(entry.Context)
+	if spanContext.IsValid() {
+		entry.Data["trace_id"] = spanContext.TraceID().String()
+		entry.Data["span_id"] = spanContext.SpanID().String()
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package gonymizer
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestStartTracing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonymizer-tracing")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "spans.json")
+
+	stop, err := StartTracing(TracingConfig{Exporter: TracingExporterFile, File: file})
+	require.Nil(t, err)
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	ctx, endRoot := StartSpan(context.Background(), "gonymizer test")
+	stepCtx, stopStep := StartStep(ctx, "tracing-test")
+	err = traceFunc(stepCtx, "failing step", func(context.Context) error { return errors.New("step failed") })
+	require.NotNil(t, err)
+
+	// Log lines get the IDs of the span in their context
+	entry := log.NewEntry(log.StandardLogger()).WithContext(stepCtx)
+	require.Nil(t, traceLogHook{}.Fire(entry))
+	require.Len(t, entry.Data["trace_id"], 32)
+	require.Equal(t, trace.SpanContextFromContext(stepCtx).SpanID().String(), entry.Data["span_id"])
+	traceID := entry.Data["trace_id"].(string)
+
+	entry = log.NewEntry(log.StandardLogger())
+	require.Nil(t, traceLogHook{}.Fire(entry))
+	require.NotContains(t, entry.Data, "trace_id")
+
+	// Spans started at the same time using different contexts are children of the span in their own context
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			jobCtx, endJob := StartSpan(context.Background(), "gonymizer job")
+			defer endJob(nil)
+			for j := 0; j < 10; j++ {
+				span := startSpan(jobCtx, "child")
+				parent := span.(sdktrace.ReadOnlySpan).Parent()
+				span.End()
+				if parent.SpanID() != trace.SpanContextFromContext(jobCtx).SpanID() {
+					t.Error("span is not a child of the span in its context")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	stopStep()
+	endRoot(nil)
+	require.Nil(t, stop())
+
+	spans, err := ioutil.ReadFile(file)
+	require.Nil(t, err)
+	require.Contains(t, string(spans), `"Name":"gonymizer test"`)
+	require.Contains(t, string(spans), `"Name":"tracing-test"`)
+	require.Contains(t, string(spans), `"Name":"failing step"`)
+	require.Contains(t, string(spans), "step failed")
+	require.Contains(t, string(spans), traceID)
+}
+
+func TestStartTracingErrors(t *testing.T) {
+	stop, err := StartTracing(TracingConfig{})
+	require.Nil(t, err)
+	require.Nil(t, stop())
+
+	_, err = StartTracing(TracingConfig{Exporter: "zipkin"})
+	require.NotNil(t, err)
+
+	_, err = StartTracing(TracingConfig{Exporter: TracingExporterFile})
+	require.NotNil(t, err)
+}